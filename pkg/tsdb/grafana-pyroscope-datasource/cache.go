@@ -0,0 +1,60 @@
+package pyroscope
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlCache is a small concurrency-safe in-memory cache where every entry expires after a fixed TTL.
+type ttlCache[T any] struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]ttlCacheEntry[T]
+	now     func() time.Time
+}
+
+type ttlCacheEntry[T any] struct {
+	value     T
+	expiresAt time.Time
+}
+
+func newTTLCache[T any](ttl time.Duration) *ttlCache[T] {
+	return &ttlCache[T]{
+		ttl:     ttl,
+		entries: make(map[string]ttlCacheEntry[T]),
+		now:     time.Now,
+	}
+}
+
+// Get returns the cached value for the key if it exists and has not expired yet.
+func (c *ttlCache[T]) Get(key string) (T, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	if !c.now().Before(entry.expiresAt) {
+		delete(c.entries, key)
+		var zero T
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// Set stores the value for the key, replacing any previous entry and resetting its TTL.
+func (c *ttlCache[T]) Set(key string, value T) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	// Drop expired entries so the cache does not grow unbounded with stale keys.
+	for k, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = ttlCacheEntry[T]{value: value, expiresAt: now.Add(c.ttl)}
+}
@@ -0,0 +1,98 @@
+package pyroscope
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"golang.org/x/sync/errgroup"
+)
+
+// comparisonModeSideBySide returns the baseline and the comparison profiles as separate frames, so they can be
+// shown next to each other.
+const comparisonModeSideBySide = "sideBySide"
+
+const (
+	baselineFrameName   = "baseline"
+	comparisonFrameName = "comparison"
+)
+
+// profileSelection selects one of the profiles of a comparison. The label selector and the time range of the query
+// are used for the parts that are not set.
+type profileSelection struct {
+	LabelSelector string `json:"labelSelector"`
+	// From and To are in milliseconds since epoch.
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+// resolveSelection fills in the parts of the selection that are not set from the query.
+func resolveSelection(selection *profileSelection, labelSelector string, timeRange backend.TimeRange) profileSelection {
+	resolved := profileSelection{
+		LabelSelector: labelSelector,
+		From:          timeRange.From.UnixMilli(),
+		To:            timeRange.To.UnixMilli(),
+	}
+	if selection == nil {
+		return resolved
+	}
+	if selection.LabelSelector != "" {
+		resolved.LabelSelector = selection.LabelSelector
+	}
+	if selection.From != 0 {
+		resolved.From = selection.From
+	}
+	if selection.To != 0 {
+		resolved.To = selection.To
+	}
+	return resolved
+}
+
+// comparisonCacheKey is the part of the query cache key identifying the compared profiles, empty without comparison
+// and for the queries that are not a diff.
+func comparisonCacheKey(queryType string, qm queryModel, timeRange backend.TimeRange) string {
+	if qm.ComparisonMode == "" && queryType != queryTypeDiff {
+		return ""
+	}
+	baseline := resolveSelection(qm.Baseline, qm.LabelSelector, timeRange)
+	comparison := resolveSelection(qm.Comparison, qm.LabelSelector, timeRange)
+	return fmt.Sprintf("%s|%s|%d|%d|%s|%d|%d", qm.ComparisonMode,
+		baseline.LabelSelector, baseline.From, baseline.To,
+		comparison.LabelSelector, comparison.From, comparison.To)
+}
+
+// sideBySideFrames fetches the baseline and the comparison profiles concurrently and returns a flamegraph frame for
+// each of them, named after the profile it shows.
+func (d *PyroscopeDatasource) sideBySideFrames(ctx context.Context, qm queryModel, timeRange backend.TimeRange) ([]*data.Frame, error) {
+	selections := []profileSelection{
+		resolveSelection(qm.Baseline, qm.LabelSelector, timeRange),
+		resolveSelection(qm.Comparison, qm.LabelSelector, timeRange),
+	}
+	names := []string{baselineFrameName, comparisonFrameName}
+	frames := make([]*data.Frame, len(selections))
+
+	g, gCtx := errgroup.WithContext(ctx)
+	for i, selection := range selections {
+		i, selection := i, selection
+		g.Go(func() error {
+			logger.Debug("Calling GetProfile", "profile", names[i], "from", time.UnixMilli(selection.From), "to", time.UnixMilli(selection.To), "function", logEntrypoint())
+			prof, err := d.client.GetProfile(gCtx, qm.ProfileTypeId, selection.LabelSelector, selection.From, selection.To, qm.MaxNodes, qm.Symbolization)
+			if err != nil {
+				return fmt.Errorf("error getting the %s profile: %w", names[i], err)
+			}
+			frame, err := d.profileToFrame(prof, qm)
+			if err != nil {
+				return err
+			}
+			frame.Name = names[i]
+			frames[i] = frame
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return frames, nil
+}
@@ -0,0 +1,101 @@
+package pyroscope
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_sideBySideComparison(t *testing.T) {
+	pCtx := backend.PluginContext{
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			JSONData: []byte(`{}`),
+		},
+	}
+
+	t.Run("returns the baseline and the comparison profiles as labeled frames", func(t *testing.T) {
+		client := &FakeClient{}
+		ds := &PyroscopeDatasource{client: client}
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeProfile
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","labelSelector":"{app=\"baz\"}",` +
+			`"comparisonMode":"sideBySide","baseline":{"from":5000,"to":8000},"comparison":{"labelSelector":"{app=\"qux\"}"}}`)
+
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.Len(t, resp.Frames, 2)
+		require.Equal(t, baselineFrameName, resp.Frames[0].Name)
+		require.Equal(t, comparisonFrameName, resp.Frames[1].Name)
+		for _, frame := range resp.Frames {
+			require.Equal(t, []int64{0, 1, 2}, fieldValues[int64](frame.Fields[0]))
+		}
+
+		require.ElementsMatch(t, [][]any{
+			{`{app="baz"}`, int64(5000), int64(8000)},
+			{`{app="qux"}`, int64(10000), int64(20000)},
+		}, client.ProfileArgs)
+	})
+
+	t.Run("the selections go through the selector pipeline of the query", func(t *testing.T) {
+		client := &FakeClient{}
+		ds := &PyroscopeDatasource{
+			client:              client,
+			normalizeSelectors:  true,
+			orgDefaultSelectors: map[int64]string{1: `{service_name="checkout"}`},
+		}
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeProfile
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","labelSelector":"{ pod='a',app=\"baz\" }",` +
+			`"comparisonMode":"sideBySide","baseline":{"labelSelector":"{}"},"comparison":{"labelSelector":"{ pod='b',app=\"baz\" }"}}`)
+
+		resp := ds.query(context.Background(), backend.PluginContext{OrgID: 1, DataSourceInstanceSettings: pCtx.DataSourceInstanceSettings}, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.ElementsMatch(t, [][]any{
+			{`{service_name="checkout"}`, int64(10000), int64(20000)},
+			{`{app="baz", pod="b"}`, int64(10000), int64(20000)},
+		}, client.ProfileArgs)
+
+		client.ProfileArgs = nil
+		dataQuery.QueryType = queryTypeDiff
+		resp = ds.query(context.Background(), backend.PluginContext{OrgID: 1, DataSourceInstanceSettings: pCtx.DataSourceInstanceSettings}, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.Equal(t, []any{`{service_name="checkout"}`, int64(10000), int64(20000), `{app="baz", pod="b"}`, int64(10000), int64(20000)}, client.DiffArgs)
+	})
+
+	t.Run("profiles without data still have a frame", func(t *testing.T) {
+		ds := &PyroscopeDatasource{client: &FakeClient{EmptyProfile: true}}
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeProfile
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","comparisonMode":"sideBySide"}`)
+
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.Len(t, resp.Frames, 2)
+		require.Equal(t, 0, resp.Frames[0].Rows())
+		require.Equal(t, comparisonFrameName, resp.Frames[1].Name)
+	})
+
+	t.Run("unsupported comparison mode", func(t *testing.T) {
+		ds := &PyroscopeDatasource{client: &FakeClient{}}
+		dataQuery := makeDataQuery()
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","comparisonMode":"overlay"}`)
+
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.EqualError(t, resp.Error, `unsupported comparison mode "overlay"`)
+	})
+}
+
+func Test_comparisonCacheKey(t *testing.T) {
+	timeRange := backend.TimeRange{From: time.UnixMilli(1000), To: time.UnixMilli(2000)}
+	require.Equal(t, "", comparisonCacheKey(queryTypeProfile, queryModel{}, timeRange))
+
+	qm := queryModel{ComparisonMode: comparisonModeSideBySide, Comparison: &profileSelection{From: 1500}}
+	qm.LabelSelector = `{app="foo"}`
+	require.Equal(t, `sideBySide|{app="foo"}|1000|2000|{app="foo"}|1500|2000`, comparisonCacheKey(queryTypeProfile, qm, timeRange))
+
+	qm.ComparisonMode = ""
+	require.Equal(t, `|{app="foo"}|1000|2000|{app="foo"}|1500|2000`, comparisonCacheKey(queryTypeDiff, qm, timeRange))
+}
@@ -0,0 +1,166 @@
+package pyroscope
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// queryTypeDiff returns the difference between the Baseline and the Comparison profiles of the query as a single
+// flamegraph.
+const queryTypeDiff = "diff"
+
+// The offsets of the values of a bar in the levels of a diff flamebearer, every bar is represented by 7 numbers. The
+// start offsets are relative to the previous bar of the level in the left and the right profile respectively.
+const (
+	diffLeftStartOffset  = 0
+	diffLeftValueOffset  = 1
+	diffLeftSelfOffset   = 2
+	diffRightStartOffset = 3
+	diffRightValueOffset = 4
+	diffRightSelfOffset  = 5
+	diffNameOffset       = 6
+	diffItemOffset       = 7
+)
+
+// DiffProfileTree is a node of the difference between two profiles, with the values of the node in both of them.
+type DiffProfileTree struct {
+	// Start is the position of the node in the combined profile.
+	Start      int64
+	LeftValue  int64
+	LeftSelf   int64
+	RightValue int64
+	RightSelf  int64
+	Level      int
+	Name       string
+	Nodes      []*DiffProfileTree
+}
+
+func (t *DiffProfileTree) end() int64 {
+	return t.Start + t.LeftValue + t.RightValue
+}
+
+// diffLevelsToTree converts the levels of a diff flamebearer into a tree. The nodes are positioned in the combined
+// profile, where every node is as wide as its values in both profiles, as the nodes only present in one of the
+// profiles have no width in the other.
+func diffLevelsToTree(levels []*Level, names []string) *DiffProfileTree {
+	if len(levels) == 0 || len(levels[0].Values) < diffItemOffset {
+		return nil
+	}
+
+	tree := diffNode(levels[0].Values, 0, 0, names)
+	parents := []*DiffProfileTree{tree}
+	for level := 1; level < len(levels); level++ {
+		var nextParents []*DiffProfileTree
+		values := levels[level].Values
+		parent := 0
+		// cumulative offsets as items in flamebearer format have just relative to prev item
+		leftOffset, rightOffset := int64(0), int64(0)
+
+		for i := 0; i+diffItemOffset <= len(values); i += diffItemOffset {
+			node := diffNode(values[i:], leftOffset+rightOffset, level, names)
+			leftOffset += values[i+diffLeftStartOffset] + values[i+diffLeftValueOffset]
+			rightOffset += values[i+diffRightStartOffset] + values[i+diffRightValueOffset]
+
+			// Move to the parent the node is in the bounds of, the nodes of a level are in the order of their parents.
+			for parent < len(parents) && (node.Start < parents[parent].Start || node.end() > parents[parent].end()) {
+				parent++
+			}
+			if parent == len(parents) {
+				logger.Error("No parent found for the diff flamegraph item", "level", level, "itemIndex", i, "function", logEntrypoint())
+				break
+			}
+			parents[parent].Nodes = append(parents[parent].Nodes, node)
+			nextParents = append(nextParents, node)
+		}
+		parents = nextParents
+	}
+	return tree
+}
+
+// diffNode creates the node of the bar at the start of the values, offset is the end of the previous bar of the level
+// in the combined profile.
+func diffNode(values []int64, offset int64, level int, names []string) *DiffProfileTree {
+	return &DiffProfileTree{
+		Start:      offset + values[diffLeftStartOffset] + values[diffRightStartOffset],
+		LeftValue:  values[diffLeftValueOffset],
+		LeftSelf:   values[diffLeftSelfOffset],
+		RightValue: values[diffRightValueOffset],
+		RightSelf:  values[diffRightSelfOffset],
+		Level:      level,
+		Name:       names[values[diffNameOffset]],
+	}
+}
+
+// diffTreeToDataFrame walks the tree depth first into a nested set frame like treeToNestedSetDataFrame. The value and
+// self fields have the combined values of both profiles and the valueRight and selfRight fields the ones of the right
+// profile, as expected by the flamegraph panel to render a diff. The valueDelta and selfDelta fields are the change
+// from the left to the right profile, negative for the nodes that were removed or shrunk.
+func diffTreeToDataFrame(tree *DiffProfileTree, unit string) *data.Frame {
+	frame := data.NewFrame("response")
+	frame.Meta = &data.FrameMeta{PreferredVisualization: "flamegraph"}
+
+	levelField := data.NewField("level", nil, []int64{})
+	valueField := data.NewField("value", nil, []int64{})
+	selfField := data.NewField("self", nil, []int64{})
+	valueRightField := data.NewField("valueRight", nil, []int64{})
+	selfRightField := data.NewField("selfRight", nil, []int64{})
+	valueDeltaField := data.NewField("valueDelta", nil, []int64{})
+	selfDeltaField := data.NewField("selfDelta", nil, []int64{})
+	labelField := NewEnumField("label", nil)
+
+	for _, field := range []*data.Field{valueField, selfField, valueRightField, selfRightField, valueDeltaField, selfDeltaField} {
+		field.Config = &data.FieldConfig{Unit: unit}
+	}
+
+	// Tree can be nil if both profiles were empty, we can still send empty frame in that case
+	if tree != nil {
+		stack := []*DiffProfileTree{tree}
+		for len(stack) > 0 {
+			node := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			levelField.Append(int64(node.Level))
+			valueField.Append(node.LeftValue + node.RightValue)
+			selfField.Append(node.LeftSelf + node.RightSelf)
+			valueRightField.Append(node.RightValue)
+			selfRightField.Append(node.RightSelf)
+			valueDeltaField.Append(node.RightValue - node.LeftValue)
+			selfDeltaField.Append(node.RightSelf - node.LeftSelf)
+			labelField.Append(node.Name)
+			for i := len(node.Nodes) - 1; i >= 0; i-- {
+				stack = append(stack, node.Nodes[i])
+			}
+		}
+	}
+
+	frame.Fields = data.Fields{levelField, valueField, selfField, labelField.GetField(), valueRightField, selfRightField, valueDeltaField, selfDeltaField}
+	return frame
+}
+
+// diffFrame fetches the difference between the baseline, the left profile, and the comparison, the right profile, and
+// returns it as a flamegraph frame. When neither of them has data an empty frame is returned.
+func (d *PyroscopeDatasource) diffFrame(ctx context.Context, qm queryModel, timeRange backend.TimeRange) (*data.Frame, error) {
+	baseline := resolveSelection(qm.Baseline, qm.LabelSelector, timeRange)
+	comparison := resolveSelection(qm.Comparison, qm.LabelSelector, timeRange)
+
+	logger.Debug("Calling GetProfileDiff", "queryModel", qm, "function", logEntrypoint())
+	diff, err := d.client.GetProfileDiff(ctx, qm.ProfileTypeId,
+		baseline.LabelSelector, baseline.From, baseline.To,
+		comparison.LabelSelector, comparison.From, comparison.To,
+		qm.MaxNodes)
+	if err != nil {
+		return nil, fmt.Errorf("error getting the profile diff: %w", err)
+	}
+
+	if diff == nil {
+		frame := diffTreeToDataFrame(nil, "")
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityInfo,
+			Text:     noProfileDataNotice,
+		})
+		return frame, nil
+	}
+	return diffTreeToDataFrame(diffLevelsToTree(diff.Flamebearer.Levels, diff.Flamebearer.Names), diff.Units), nil
+}
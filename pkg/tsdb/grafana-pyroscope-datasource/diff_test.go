@@ -0,0 +1,96 @@
+package pyroscope
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_diffLevelsToTree(t *testing.T) {
+	t.Run("positions the nodes in the combined profile", func(t *testing.T) {
+		levels := []*Level{
+			{Values: []int64{0, 10, 0, 0, 15, 0, 0}},
+			{Values: []int64{0, 10, 10, 0, 5, 5, 1, 0, 0, 0, 0, 10, 10, 2}},
+			{Values: []int64{10, 0, 0, 5, 4, 4, 3}},
+		}
+		tree := diffLevelsToTree(levels, []string{"total", "foo", "bar", "baz"})
+
+		baz := &DiffProfileTree{Start: 15, RightValue: 4, RightSelf: 4, Level: 2, Name: "baz"}
+		require.Equal(t, &DiffProfileTree{
+			LeftValue: 10, RightValue: 15, Name: "total",
+			Nodes: []*DiffProfileTree{
+				{Start: 0, LeftValue: 10, LeftSelf: 10, RightValue: 5, RightSelf: 5, Level: 1, Name: "foo"},
+				{Start: 15, RightValue: 10, RightSelf: 10, Level: 1, Name: "bar", Nodes: []*DiffProfileTree{baz}},
+			},
+		}, tree)
+	})
+
+	t.Run("no levels", func(t *testing.T) {
+		require.Nil(t, diffLevelsToTree(nil, nil))
+	})
+}
+
+func Test_diffTreeToDataFrame(t *testing.T) {
+	tree := &DiffProfileTree{
+		LeftValue: 10, RightValue: 15, Name: "total",
+		Nodes: []*DiffProfileTree{
+			{Start: 0, LeftValue: 10, LeftSelf: 10, RightValue: 5, RightSelf: 5, Level: 1, Name: "foo"},
+			{Start: 15, RightValue: 10, RightSelf: 10, Level: 1, Name: "bar"},
+		},
+	}
+	frame := diffTreeToDataFrame(tree, "short")
+
+	require.Equal(t, "flamegraph", string(frame.Meta.PreferredVisualization))
+	require.Equal(t, []int64{0, 1, 1}, fieldValues[int64](frame.Fields[0]))
+	require.Equal(t, []int64{25, 15, 10}, fieldValues[int64](frame.Fields[1]))
+	require.Equal(t, []int64{0, 15, 10}, fieldValues[int64](frame.Fields[2]))
+	require.Equal(t, []data.EnumItemIndex{0, 1, 2}, fieldValues[data.EnumItemIndex](frame.Fields[3]))
+	require.Equal(t, []string{"total", "foo", "bar"}, frame.Fields[3].Config.TypeConfig.Enum.Text)
+	require.Equal(t, []int64{15, 5, 10}, fieldValues[int64](frame.Fields[4]))
+	require.Equal(t, []int64{0, 5, 10}, fieldValues[int64](frame.Fields[5]))
+	require.Equal(t, []int64{5, -5, 10}, fieldValues[int64](frame.Fields[6]))
+	require.Equal(t, []int64{0, -5, 10}, fieldValues[int64](frame.Fields[7]))
+	require.Equal(t, "short", frame.Fields[6].Config.Unit)
+}
+
+func Test_diffQuery(t *testing.T) {
+	pCtx := backend.PluginContext{
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			JSONData: []byte(`{}`),
+		},
+	}
+
+	t.Run("returns the diff of the baseline and the comparison", func(t *testing.T) {
+		client := &FakeClient{}
+		ds := &PyroscopeDatasource{client: client}
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeDiff
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","labelSelector":"{app=\"baz\"}",` +
+			`"baseline":{"from":5000,"to":8000},"comparison":{"labelSelector":"{app=\"qux\"}"}}`)
+
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.Len(t, resp.Frames, 1)
+		require.Equal(t, []int64{0, 1, 1, 2}, fieldValues[int64](resp.Frames[0].Fields[0]))
+		require.Equal(t, []int64{5, -5, 10, 4}, fieldValues[int64](resp.Frames[0].Fields[6]))
+		require.Equal(t, []any{`{app="baz"}`, int64(5000), int64(8000), `{app="qux"}`, int64(10000), int64(20000)}, client.DiffArgs)
+		require.Zero(t, client.SeriesCalls)
+		require.Empty(t, client.ProfileArgs)
+	})
+
+	t.Run("profiles without data still have a frame", func(t *testing.T) {
+		ds := &PyroscopeDatasource{client: &FakeClient{EmptyProfile: true}}
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeDiff
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes"}`)
+
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.Len(t, resp.Frames, 1)
+		require.Equal(t, 0, resp.Frames[0].Rows())
+		require.Equal(t, noProfileDataNotice, resp.Frames[0].Meta.Notices[0].Text)
+	})
+}
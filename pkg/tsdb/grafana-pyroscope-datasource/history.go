@@ -0,0 +1,110 @@
+package pyroscope
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queryHistorySize is the number of recent queries kept per datasource.
+const queryHistorySize = 50
+
+const redactedValue = "[REDACTED]"
+
+// sensitiveLabelNames are parts of label names whose values are redacted from the query history.
+var sensitiveLabelNames = []string{"token", "secret", "password", "passwd", "auth", "key", "credential"}
+
+// QueryHistoryEntry is a query recorded in the query history.
+type QueryHistoryEntry struct {
+	Time          time.Time `json:"time"`
+	RefID         string    `json:"refId"`
+	QueryType     string    `json:"queryType"`
+	ProfileTypeID string    `json:"profileTypeId"`
+	LabelSelector string    `json:"labelSelector"`
+	GroupBy       []string  `json:"groupBy"`
+	// Start and End are in milliseconds since epoch.
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// queryHistory is a ring buffer of the recent queries of a datasource.
+type queryHistory struct {
+	mu      sync.Mutex
+	entries []QueryHistoryEntry
+	// next is the index the next entry is written to once the buffer is full.
+	next int
+	size int
+}
+
+func newQueryHistory(size int) *queryHistory {
+	return &queryHistory{
+		entries: make([]QueryHistoryEntry, 0, size),
+		size:    size,
+	}
+}
+
+// Add records the entry, overwriting the oldest one when the history is full. Values of sensitive labels in the
+// label selector are redacted.
+func (h *queryHistory) Add(entry QueryHistoryEntry) {
+	if h == nil {
+		return
+	}
+	entry.LabelSelector = redactSelector(entry.LabelSelector)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) < h.size {
+		h.entries = append(h.entries, entry)
+		return
+	}
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % h.size
+}
+
+// Entries returns the recorded queries from the oldest to the most recent one.
+func (h *queryHistory) Entries() []QueryHistoryEntry {
+	res := []QueryHistoryEntry{}
+	if h == nil {
+		return res
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res = append(res, h.entries[h.next:]...)
+	return append(res, h.entries[:h.next]...)
+}
+
+// redactSelector replaces the values of sensitive labels in the selector. Selectors that cannot be parsed are
+// redacted completely as we cannot tell which part of them is sensitive.
+func redactSelector(selector string) string {
+	matchers, err := parseSelector(selector)
+	if err != nil {
+		return redactedValue
+	}
+
+	redacted := false
+	parts := make([]string, len(matchers))
+	for i, m := range matchers {
+		value := m.Value
+		if isSensitiveLabel(m.Name) {
+			value = redactedValue
+			redacted = true
+		}
+		parts[i] = m.Name + m.Type + strconv.Quote(value)
+	}
+	if !redacted {
+		return selector
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+func isSensitiveLabel(name string) bool {
+	name = strings.ToLower(name)
+	for _, sensitive := range sensitiveLabelNames {
+		if strings.Contains(name, sensitive) {
+			return true
+		}
+	}
+	return false
+}
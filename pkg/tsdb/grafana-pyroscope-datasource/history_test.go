@@ -0,0 +1,88 @@
+package pyroscope
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_queryHistory(t *testing.T) {
+	t.Run("keeps the most recent entries in order", func(t *testing.T) {
+		h := newQueryHistory(3)
+		for _, refID := range []string{"A", "B", "C", "D", "E"} {
+			h.Add(QueryHistoryEntry{RefID: refID})
+		}
+
+		var refIDs []string
+		for _, entry := range h.Entries() {
+			refIDs = append(refIDs, entry.RefID)
+		}
+		require.Equal(t, []string{"C", "D", "E"}, refIDs)
+	})
+
+	t.Run("redacts sensitive label values", func(t *testing.T) {
+		h := newQueryHistory(3)
+		h.Add(QueryHistoryEntry{LabelSelector: `{service_name="app", api_token="abc"}`})
+		h.Add(QueryHistoryEntry{LabelSelector: `{service_name="app"}`})
+		h.Add(QueryHistoryEntry{LabelSelector: `{password="abc`})
+
+		entries := h.Entries()
+		require.Equal(t, `{service_name="app", api_token="[REDACTED]"}`, entries[0].LabelSelector)
+		require.Equal(t, `{service_name="app"}`, entries[1].LabelSelector)
+		require.Equal(t, `[REDACTED]`, entries[2].LabelSelector)
+	})
+
+	t.Run("nil history is empty", func(t *testing.T) {
+		var h *queryHistory
+		h.Add(QueryHistoryEntry{RefID: "A"})
+		require.Equal(t, []QueryHistoryEntry{}, h.Entries())
+	})
+}
+
+func Test_queryHistoryResource(t *testing.T) {
+	ds := &PyroscopeDatasource{
+		client:       &FakeClient{},
+		queryHistory: newQueryHistory(2),
+	}
+	pCtx := backend.PluginContext{
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			JSONData: []byte(`{}`),
+		},
+	}
+
+	for _, refID := range []string{"A", "B", "C"} {
+		dataQuery := makeDataQuery()
+		dataQuery.RefID = refID
+		dataQuery.QueryType = queryTypeMetrics
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","labelSelector":"{app=\"baz\"}"}`)
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+	}
+
+	sender := &FakeSender{}
+	err := ds.CallResource(
+		context.Background(),
+		&backend.CallResourceRequest{
+			PluginContext: backend.PluginContext{},
+			Path:          "queryHistory",
+			Method:        "GET",
+			URL:           "queryHistory",
+		},
+		sender,
+	)
+	require.NoError(t, err)
+	require.Equal(t, 200, sender.Resp.Status)
+
+	var entries []QueryHistoryEntry
+	require.NoError(t, json.Unmarshal(sender.Resp.Body, &entries))
+	require.Len(t, entries, 2)
+	require.Equal(t, "B", entries[0].RefID)
+	require.Equal(t, "C", entries[1].RefID)
+	require.Equal(t, "memory:alloc_objects:count:space:bytes", entries[1].ProfileTypeID)
+	require.Equal(t, `{app="baz"}`, entries[1].LabelSelector)
+	require.Equal(t, int64(10000), entries[1].Start)
+	require.Equal(t, int64(20000), entries[1].End)
+}
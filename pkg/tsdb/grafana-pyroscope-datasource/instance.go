@@ -2,13 +2,23 @@ package pyroscope
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/bufbuild/connect-go"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
@@ -25,12 +35,28 @@ var (
 	_ backend.StreamHandler       = (*PyroscopeDatasource)(nil)
 )
 
+const (
+	// defaultMaxLabelValues is the number of values the labelValues resource returns when no maximum is configured.
+	defaultMaxLabelValues = 5000
+	// labelValuesTruncatedHeader is set on labelValues responses that have been cut at the maximum.
+	labelValuesTruncatedHeader = "X-Label-Values-Truncated"
+	// defaultResourceCacheMaxAge is how long the cacheable resources may be cached when not configured.
+	defaultResourceCacheMaxAge = time.Minute
+	// defaultProfileTypesCacheTTL is how long the profile types are cached when not configured.
+	defaultProfileTypesCacheTTL = time.Minute
+	// defaultMaxResourceBodyBytes is the maximum size of the resource request bodies when no maximum is configured.
+	defaultMaxResourceBodyBytes = 1 << 20
+)
+
 type ProfilingClient interface {
 	ProfileTypes(context.Context) ([]*ProfileType, error)
-	LabelNames(ctx context.Context) ([]string, error)
-	LabelValues(ctx context.Context, label string) ([]string, error)
+	LabelNames(ctx context.Context, matchers []string) ([]string, error)
+	LabelValues(ctx context.Context, label, prefix string, start int64, end int64) ([]string, error)
 	GetSeries(ctx context.Context, profileTypeID string, labelSelector string, start int64, end int64, groupBy []string, step float64) (*SeriesResponse, error)
-	GetProfile(ctx context.Context, profileTypeID string, labelSelector string, start int64, end int64, maxNodes *int64) (*ProfileResponse, error)
+	GetProfile(ctx context.Context, profileTypeID string, labelSelector string, start int64, end int64, maxNodes *int64, symbolization string) (*ProfileResponse, error)
+	GetProfileDiff(ctx context.Context, profileTypeID, leftSelector string, leftStart, leftEnd int64, rightSelector string, rightStart, rightEnd int64, maxNodes *int64) (*ProfileDiffResponse, error)
+	GetProfileStats(ctx context.Context, profileTypeID, labelSelector string, start, end int64) (*ProfileStats, error)
+	Version(ctx context.Context) (string, error)
 }
 
 // PyroscopeDatasource is a datasource for querying application performance profiles.
@@ -39,34 +65,246 @@ type PyroscopeDatasource struct {
 	client     ProfilingClient
 	settings   backend.DataSourceInstanceSettings
 	ac         accesscontrol.AccessControl
+
+	// queryCache holds query results when the result cache is enabled in the datasource settings, nil otherwise.
+	queryCache *ttlCache[backend.DataResponse]
+	// profileTypesCache holds the profile types of the datasource by datasource UID, nil when it is disabled.
+	profileTypesCache *ttlCache[[]*ProfileType]
+	// maxNodes is the maximum number of flamegraph nodes of the queries that don't set one, 0 means no limit.
+	maxNodes int64
+	// maxLabelValues caps the number of values returned by the labelValues resource, defaultMaxLabelValues when 0.
+	maxLabelValues int
+	// maxFlamegraphBytes caps the serialized size of the flamegraph frames, 0 means no limit.
+	maxFlamegraphBytes int64
+	// defaultTimeRange is the window queried when a query has no time range, defaultTimeRangeWindow when 0.
+	defaultTimeRange time.Duration
+	// queryHistory holds the recent queries of the datasource for the queryHistory resource.
+	queryHistory *queryHistory
+	// resourceCacheMaxAge is the max-age of the Cache-Control header of the cacheable resources, none is set when 0.
+	resourceCacheMaxAge time.Duration
+	// normalizeSelectors makes the queries use the normalized form of their label selectors.
+	normalizeSelectors bool
+	// maxResourceBodyBytes caps the size of the resource request bodies, defaultMaxResourceBodyBytes when 0.
+	maxResourceBodyBytes int64
+	// childSortOrder is the order of the children of the flamegraph nodes for the queries without one.
+	childSortOrder string
+	// orgDefaultSelectors are the label selectors used for the queries without one, by org ID.
+	orgDefaultSelectors map[int64]string
+	// requiredMatcherLabel is the label the label selectors of the queries must match on, none when empty.
+	requiredMatcherLabel string
+	// profileTypeAliases are the display names of the profile types by profile type ID.
+	profileTypeAliases map[string]string
+	// maxConcurrentFetches caps the calls to Pyroscope in flight for the queries of a request, no limit when 0.
+	maxConcurrentFetches int
+	// streamQueries are the queries of the streams by channel path, see registerStream.
+	streamQueries *ttlCache[json.RawMessage]
+	// diagnostics is the effective configuration reported by CheckHealth.
+	diagnostics healthDiagnostics
+}
+
+// healthDiagnostics is the effective configuration of the datasource, reported in the details of the health check
+// so provisioned settings can be verified.
+type healthDiagnostics struct {
+	Timeout            string `json:"timeout"`
+	DialTimeout        string `json:"dialTimeout"`
+	MaxNodesDefault    int64  `json:"maxNodesDefault"`
+	MaxLabelValues     int    `json:"maxLabelValues"`
+	MaxFlamegraphBytes int64  `json:"maxFlamegraphBytes"`
+	QueryCacheEnabled  bool   `json:"queryCacheEnabled"`
+	QueryCacheTTL      string `json:"queryCacheTTL"`
+	MaxRetries         int    `json:"maxRetries"`
 }
 
 // NewPyroscopeDatasource creates a new datasource instance.
 func NewPyroscopeDatasource(ctx context.Context, httpClientProvider httpclient.Provider, settings backend.DataSourceInstanceSettings, ac accesscontrol.AccessControl) (instancemgmt.Instance, error) {
 	ctxLogger := logger.FromContext(ctx)
+	var dsJson dsJsonModel
+	if len(settings.JSONData) > 0 {
+		if err := json.Unmarshal(settings.JSONData, &dsJson); err != nil {
+			ctxLogger.Error("Failed to unmarshal datasource json model", "error", err, "function", logEntrypoint())
+			return nil, err
+		}
+	}
+
 	opt, err := settings.HTTPClientOptions(ctx)
 	if err != nil {
 		ctxLogger.Error("Failed to get HTTP client options", "error", err, "function", logEntrypoint())
 		return nil, err
 	}
+	if dsJson.EnableHTTP2 != nil {
+		opt.ConfigureTransport = configureHTTP2(opt.ConfigureTransport, *dsJson.EnableHTTP2)
+	}
+	if dsJson.DisableCompression {
+		opt.ConfigureTransport = disableCompression(opt.ConfigureTransport)
+	}
 	httpClient, err := httpClientProvider.New(opt)
 	if err != nil {
 		ctxLogger.Error("Failed to create HTTP client", "error", err, "function", logEntrypoint())
 		return nil, err
 	}
 
+	var queryCache *ttlCache[backend.DataResponse]
+	if dsJson.QueryCacheTTL != "" {
+		ttl, err := gtime.ParseDuration(dsJson.QueryCacheTTL)
+		if err != nil {
+			ctxLogger.Error("Failed to parse the QueryCacheTTL", "QueryCacheTTL", dsJson.QueryCacheTTL, "error", err, "function", logEntrypoint())
+			return nil, err
+		}
+		if ttl > 0 {
+			queryCache = newTTLCache[backend.DataResponse](ttl)
+		}
+	}
+
+	profileTypesCacheTTL := defaultProfileTypesCacheTTL
+	if dsJson.ProfileTypesCacheTTL != "" {
+		profileTypesCacheTTL, err = gtime.ParseDuration(dsJson.ProfileTypesCacheTTL)
+		if err != nil {
+			ctxLogger.Error("Failed to parse the ProfileTypesCacheTTL", "ProfileTypesCacheTTL", dsJson.ProfileTypesCacheTTL, "error", err, "function", logEntrypoint())
+			return nil, err
+		}
+	}
+	var profileTypesCache *ttlCache[[]*ProfileType]
+	if profileTypesCacheTTL > 0 {
+		profileTypesCache = newTTLCache[[]*ProfileType](profileTypesCacheTTL)
+	}
+
+	maxConcurrentFetches := dsJson.MaxConcurrentFetches
+	if maxConcurrentFetches <= 0 {
+		maxConcurrentFetches = defaultMaxConcurrentFetches
+	}
+
+	// The fetch limit comes before the retries, so a call holds its slot while it's retried.
+	clientOpts := []connect.ClientOption{withFetchLimit()}
+	if dsJson.DisableCompression {
+		clientOpts = append(clientOpts, withoutCompression())
+	}
+	if dsJson.MaxRetries > 0 {
+		var backoff time.Duration
+		if dsJson.RetryBackoff != "" {
+			backoff, err = gtime.ParseDuration(dsJson.RetryBackoff)
+			if err != nil {
+				ctxLogger.Error("Failed to parse the RetryBackoff", "RetryBackoff", dsJson.RetryBackoff, "error", err, "function", logEntrypoint())
+				return nil, err
+			}
+		}
+		clientOpts = append(clientOpts, withRetry(dsJson.MaxRetries, backoff))
+	}
+
+	if !isValidChildSortOrder(dsJson.ChildSortOrder) {
+		err := fmt.Errorf("unsupported child sort order %q", dsJson.ChildSortOrder)
+		ctxLogger.Error("Failed to parse the ChildSortOrder", "ChildSortOrder", dsJson.ChildSortOrder, "error", err, "function", logEntrypoint())
+		return nil, err
+	}
+
+	orgDefaultSelectors := make(map[int64]string, len(dsJson.OrgDefaultSelectors))
+	for org, selector := range dsJson.OrgDefaultSelectors {
+		orgID, err := strconv.ParseInt(org, 10, 64)
+		if err != nil {
+			ctxLogger.Error("Failed to parse the org ID of a default selector", "org", org, "error", err, "function", logEntrypoint())
+			return nil, err
+		}
+		orgDefaultSelectors[orgID] = selector
+	}
+
+	var defaultTimeRange time.Duration
+	if dsJson.DefaultTimeRange != "" {
+		defaultTimeRange, err = gtime.ParseDuration(dsJson.DefaultTimeRange)
+		if err != nil {
+			ctxLogger.Error("Failed to parse the DefaultTimeRange", "DefaultTimeRange", dsJson.DefaultTimeRange, "error", err, "function", logEntrypoint())
+			return nil, err
+		}
+	}
+
+	diagnostics := healthDiagnostics{
+		MaxNodesDefault:    dsJson.MaxNodesDefault,
+		MaxLabelValues:     labelValuesLimit(dsJson.MaxLabelValues),
+		MaxFlamegraphBytes: dsJson.MaxFlamegraphBytes,
+		QueryCacheEnabled:  queryCache != nil,
+		MaxRetries:         dsJson.MaxRetries,
+	}
+	if opt.Timeouts != nil {
+		diagnostics.Timeout = opt.Timeouts.Timeout.String()
+		diagnostics.DialTimeout = opt.Timeouts.DialTimeout.String()
+	}
+	if queryCache != nil {
+		diagnostics.QueryCacheTTL = queryCache.ttl.String()
+	}
+
+	resourceCacheMaxAge := defaultResourceCacheMaxAge
+	if dsJson.ResourceCacheMaxAge != "" {
+		resourceCacheMaxAge, err = gtime.ParseDuration(dsJson.ResourceCacheMaxAge)
+		if err != nil {
+			ctxLogger.Error("Failed to parse the ResourceCacheMaxAge", "ResourceCacheMaxAge", dsJson.ResourceCacheMaxAge, "error", err, "function", logEntrypoint())
+			return nil, err
+		}
+	}
+
 	return &PyroscopeDatasource{
 		httpClient: httpClient,
-		client:     NewPyroscopeClient(httpClient, settings.URL),
+		client:     NewPyroscopeClient(httpClient, settings.URL, clientOpts...),
 		settings:   settings,
 		ac:         ac,
+		queryCache: queryCache,
+
+		profileTypesCache: profileTypesCache,
+
+		maxNodes:           dsJson.MaxNodesDefault,
+		maxLabelValues:     dsJson.MaxLabelValues,
+		maxFlamegraphBytes: dsJson.MaxFlamegraphBytes,
+		defaultTimeRange:   defaultTimeRange,
+		queryHistory:       newQueryHistory(queryHistorySize),
+
+		resourceCacheMaxAge: resourceCacheMaxAge,
+		normalizeSelectors:  dsJson.NormalizeSelectors,
+		childSortOrder:      dsJson.ChildSortOrder,
+		orgDefaultSelectors: orgDefaultSelectors,
+		diagnostics:         diagnostics,
+
+		maxResourceBodyBytes: dsJson.MaxResourceBodyBytes,
+		requiredMatcherLabel: dsJson.RequiredMatcherLabel,
+		profileTypeAliases:   dsJson.ProfileTypeAliases,
+		maxConcurrentFetches: maxConcurrentFetches,
+		streamQueries:        newTTLCache[json.RawMessage](streamQueryTTL),
 	}, nil
 }
 
+// configureHTTP2 returns a transport configuration that forces HTTP/2 on or off, chained after the given one.
+func configureHTTP2(next sdkhttpclient.ConfigureTransportFunc, enabled bool) sdkhttpclient.ConfigureTransportFunc {
+	return func(opts sdkhttpclient.Options, transport *http.Transport) {
+		if next != nil {
+			next(opts, transport)
+		}
+		transport.ForceAttemptHTTP2 = enabled
+		if !enabled {
+			// A non-nil, empty TLSNextProto map disables HTTP/2 on the transport.
+			transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		}
+	}
+}
+
+// disableCompression returns a transport configuration that stops the transport from requesting compressed
+// responses, chained after the given one.
+func disableCompression(next sdkhttpclient.ConfigureTransportFunc) sdkhttpclient.ConfigureTransportFunc {
+	return func(opts sdkhttpclient.Options, transport *http.Transport) {
+		if next != nil {
+			next(opts, transport)
+		}
+		transport.DisableCompression = true
+	}
+}
+
 func (d *PyroscopeDatasource) CallResource(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
 	ctxLogger := logger.FromContext(ctx)
 	ctx, span := tracing.DefaultTracer().Start(ctx, "datasource.pyroscope.CallResource", trace.WithAttributes(attribute.String("path", req.Path), attribute.String("method", req.Method)))
 	defer span.End()
+	// Oversized bodies, like huge selectors, are rejected before they are logged or processed.
+	if limit := resourceBodyLimit(d.maxResourceBodyBytes); int64(len(req.Body)) > limit {
+		ctxLogger.Warn("Rejecting oversized resource request", "Path", req.Path, "size", len(req.Body), "limit", limit, "function", logEntrypoint())
+		return sender.Send(&backend.CallResourceResponse{
+			Status: http.StatusRequestEntityTooLarge,
+			Body:   []byte(fmt.Sprintf(`{"error":"request body exceeds the maximum size of %d bytes"}`, limit)),
+		})
+	}
 	ctxLogger.Debug("CallResource", "Path", req.Path, "Method", req.Method, "Body", req.Body, "function", logEntrypoint())
 	if req.Path == "profileTypes" {
 		return d.profileTypes(ctx, req, sender)
@@ -77,6 +315,21 @@ func (d *PyroscopeDatasource) CallResource(ctx context.Context, req *backend.Cal
 	if req.Path == "labelValues" {
 		return d.labelValues(ctx, req, sender)
 	}
+	if req.Path == "sampleTypes" {
+		return d.sampleTypes(ctx, req, sender)
+	}
+	if req.Path == "profileStats" {
+		return d.profileStats(ctx, req, sender)
+	}
+	if req.Path == "validateSelector" {
+		return d.validateSelector(ctx, req, sender)
+	}
+	if req.Path == "queryHistory" {
+		return d.recentQueries(ctx, req, sender)
+	}
+	if req.Path == "ready" {
+		return d.ready(ctx, req, sender)
+	}
 	return sender.Send(&backend.CallResourceResponse{
 		Status: 404,
 	})
@@ -84,17 +337,149 @@ func (d *PyroscopeDatasource) CallResource(ctx context.Context, req *backend.Cal
 
 func (d *PyroscopeDatasource) profileTypes(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
 	ctxLogger := logger.FromContext(ctx)
+	types, err := d.cachedProfileTypes(ctx)
+	if err != nil {
+		ctxLogger.Error("Received error from client", "error", err, "function", logEntrypoint())
+		return sendClientError(sender, fmt.Errorf("error calling ProfileTypes: %w", err))
+	}
+	bodyData, err := json.Marshal(d.aliasedProfileTypes(types))
+	if err != nil {
+		ctxLogger.Error("Failed to marshal response", "error", err, "function", logEntrypoint())
+		return err
+	}
+	err = sender.Send(&backend.CallResourceResponse{Body: bodyData, Headers: d.cacheableHeaders(req.Headers), Status: 200})
+	if err != nil {
+		ctxLogger.Error("Failed to send response", "error", err, "function", logEntrypoint())
+		return err
+	}
+	return nil
+}
+
+// cachedProfileTypes returns the profile types from the profile types cache, they are fetched and cached when they
+// are not cached yet or have expired. CheckHealth calls the client directly so it always checks the backend.
+func (d *PyroscopeDatasource) cachedProfileTypes(ctx context.Context) ([]*ProfileType, error) {
+	if d.profileTypesCache == nil {
+		return d.client.ProfileTypes(ctx)
+	}
+	if types, ok := d.profileTypesCache.Get(d.settings.UID); ok {
+		return types, nil
+	}
 	types, err := d.client.ProfileTypes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.profileTypesCache.Set(d.settings.UID, types)
+	return types, nil
+}
+
+// aliasedProfileTypes returns the profile types with the labels of the ones with an alias replaced by the alias. The
+// types are copied, as they may be shared with the profile types cache.
+func (d *PyroscopeDatasource) aliasedProfileTypes(types []*ProfileType) []*ProfileType {
+	if len(d.profileTypeAliases) == 0 {
+		return types
+	}
+	aliased := make([]*ProfileType, len(types))
+	for i, t := range types {
+		copied := *t
+		copied.Label = d.profileTypeLabel(t.ID, t.Label)
+		aliased[i] = &copied
+	}
+	return aliased
+}
+
+// profileTypeLabel returns the alias of the profile type, or the label when it has none.
+func (d *PyroscopeDatasource) profileTypeLabel(profileTypeID, label string) string {
+	if alias := d.profileTypeAliases[profileTypeID]; alias != "" {
+		return alias
+	}
+	return label
+}
+
+// labelNames returns the label names of the series matching the label selectors of the matchers parameters of the
+// request URL query, of all series when there are none.
+func (d *PyroscopeDatasource) labelNames(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	ctxLogger := logger.FromContext(ctx)
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		ctxLogger.Error("Failed to parse URL", "error", err, "function", logEntrypoint())
+		return err
+	}
+	var matchers []string
+	for _, matcher := range u.Query()["matchers"] {
+		if !isEmptySelector(matcher) {
+			matchers = append(matchers, matcher)
+		}
+	}
+
+	res, err := d.client.LabelNames(ctx, matchers)
 	if err != nil {
 		ctxLogger.Error("Received error from client", "error", err, "function", logEntrypoint())
+		return sendClientError(sender, fmt.Errorf("error calling LabelNames: %w", err))
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		ctxLogger.Error("Failed to marshal response", "error", err, "function", logEntrypoint())
 		return err
 	}
-	bodyData, err := json.Marshal(types)
+	err = sender.Send(&backend.CallResourceResponse{Body: data, Headers: d.cacheableHeaders(req.Headers), Status: 200})
+	if err != nil {
+		ctxLogger.Error("Failed to send response", "error", err, "function", logEntrypoint())
+		return err
+	}
+	return nil
+}
+
+// cacheableHeaders returns the response headers of a resource that rarely changes, with a Cache-Control header
+// allowing it to be cached for the configured max age.
+func (d *PyroscopeDatasource) cacheableHeaders(reqHeaders map[string][]string) map[string][]string {
+	headers := make(map[string][]string, len(reqHeaders)+1)
+	for k, v := range reqHeaders {
+		headers[k] = v
+	}
+	if d.resourceCacheMaxAge > 0 {
+		headers["Cache-Control"] = []string{fmt.Sprintf("private, max-age=%d", int64(d.resourceCacheMaxAge.Seconds()))}
+	}
+	return headers
+}
+
+// SampleType is one of the sample types (sample indices) available for a profile.
+type SampleType struct {
+	Index         int    `json:"index"`
+	ProfileTypeID string `json:"profileTypeId"`
+	SampleType    string `json:"sampleType"`
+	SampleUnit    string `json:"sampleUnit"`
+}
+
+// sampleTypes lists all the sample types available for the profile of the profileTypeId in the request URL query,
+// so the user can pick which one to look at.
+func (d *PyroscopeDatasource) sampleTypes(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	ctxLogger := logger.FromContext(ctx)
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		ctxLogger.Error("Failed to parse URL", "error", err, "function", logEntrypoint())
+		return err
+	}
+	profileTypeID := u.Query().Get("profileTypeId")
+	if profileTypeID == "" {
+		return sender.Send(&backend.CallResourceResponse{
+			Status: http.StatusBadRequest,
+			Body:   []byte(`{"error":"profileTypeId is required"}`),
+		})
+	}
+
+	types, err := d.cachedProfileTypes(ctx)
+	if err != nil {
+		ctxLogger.Error("Received error from client", "error", err, "function", logEntrypoint())
+		return sendClientError(sender, fmt.Errorf("error calling ProfileTypes: %w", err))
+	}
+
+	res := sampleTypesOf(profileTypeID, types)
+	data, err := json.Marshal(res)
 	if err != nil {
 		ctxLogger.Error("Failed to marshal response", "error", err, "function", logEntrypoint())
 		return err
 	}
-	err = sender.Send(&backend.CallResourceResponse{Body: bodyData, Headers: req.Headers, Status: 200})
+	err = sender.Send(&backend.CallResourceResponse{Body: data, Headers: req.Headers, Status: 200})
 	if err != nil {
 		ctxLogger.Error("Failed to send response", "error", err, "function", logEntrypoint())
 		return err
@@ -102,13 +487,100 @@ func (d *PyroscopeDatasource) profileTypes(ctx context.Context, req *backend.Cal
 	return nil
 }
 
-func (d *PyroscopeDatasource) labelNames(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+// sampleTypesOf returns the sample types of all the profile types that belong to the same profile as profileTypeID.
+// Profile type IDs have the name:sampleType:sampleUnit:periodType:periodUnit format, so profile types of the same
+// profile share the name and the period.
+func sampleTypesOf(profileTypeID string, types []*ProfileType) []*SampleType {
+	res := []*SampleType{}
+	parts := strings.Split(profileTypeID, ":")
+	if len(parts) != 5 {
+		return res
+	}
+	for _, t := range types {
+		typeParts := strings.Split(t.ID, ":")
+		if len(typeParts) != 5 {
+			continue
+		}
+		if typeParts[0] != parts[0] || typeParts[3] != parts[3] || typeParts[4] != parts[4] {
+			continue
+		}
+		res = append(res, &SampleType{
+			Index:         len(res),
+			ProfileTypeID: t.ID,
+			SampleType:    typeParts[1],
+			SampleUnit:    typeParts[2],
+		})
+	}
+	return res
+}
+
+// profileStats returns the ProfileStats of the profileTypeId and labelSelector in the start and end of the request URL
+// query, so the query editor can warn about heavy queries before running them.
+func (d *PyroscopeDatasource) profileStats(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
 	ctxLogger := logger.FromContext(ctx)
-	res, err := d.client.LabelNames(ctx)
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		ctxLogger.Error("Failed to parse URL", "error", err, "function", logEntrypoint())
+		return err
+	}
+	query := u.Query()
+	profileTypeID := query.Get("profileTypeId")
+	if profileTypeID == "" {
+		return sendBadRequest(sender, errors.New("profileTypeId is required"))
+	}
+	start, err := timestampParam(query, "start")
+	if err != nil {
+		return sendBadRequest(sender, err)
+	}
+	end, err := timestampParam(query, "end")
+	if err != nil {
+		return sendBadRequest(sender, err)
+	}
+	if _, err := parseSelector(query.Get("labelSelector")); err != nil {
+		return sendBadRequest(sender, err)
+	}
+
+	stats, err := d.client.GetProfileStats(ctx, profileTypeID, query.Get("labelSelector"), start, end)
 	if err != nil {
 		ctxLogger.Error("Received error from client", "error", err, "function", logEntrypoint())
-		return fmt.Errorf("error calling LabelNames: %v", err)
+		return sendClientError(sender, fmt.Errorf("error calling GetProfileStats: %w", err))
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		ctxLogger.Error("Failed to marshal response", "error", err, "function", logEntrypoint())
+		return err
+	}
+	err = sender.Send(&backend.CallResourceResponse{Body: data, Headers: req.Headers, Status: 200})
+	if err != nil {
+		ctxLogger.Error("Failed to send response", "error", err, "function", logEntrypoint())
+		return err
+	}
+	return nil
+}
+
+type ValidateSelectorResponse struct {
+	Valid bool                `json:"valid"`
+	Error *SelectorParseError `json:"error,omitempty"`
+}
+
+// validateSelector checks the label selector in the request URL query and reports where it is malformed.
+func (d *PyroscopeDatasource) validateSelector(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	ctxLogger := logger.FromContext(ctx)
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		ctxLogger.Error("Failed to parse URL", "error", err, "function", logEntrypoint())
+		return err
+	}
+
+	res := ValidateSelectorResponse{Valid: true}
+	if _, err := parseSelector(u.Query().Get("selector")); err != nil {
+		var parseErr *SelectorParseError
+		if !errors.As(err, &parseErr) {
+			return err
+		}
+		res = ValidateSelectorResponse{Valid: false, Error: parseErr}
 	}
+
 	data, err := json.Marshal(res)
 	if err != nil {
 		ctxLogger.Error("Failed to marshal response", "error", err, "function", logEntrypoint())
@@ -122,6 +594,100 @@ func (d *PyroscopeDatasource) labelNames(ctx context.Context, req *backend.CallR
 	return nil
 }
 
+func (d *PyroscopeDatasource) recentQueries(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	ctxLogger := logger.FromContext(ctx)
+	data, err := json.Marshal(d.queryHistory.Entries())
+	if err != nil {
+		ctxLogger.Error("Failed to marshal response", "error", err, "function", logEntrypoint())
+		return err
+	}
+	err = sender.Send(&backend.CallResourceResponse{Body: data, Headers: req.Headers, Status: 200})
+	if err != nil {
+		ctxLogger.Error("Failed to send response", "error", err, "function", logEntrypoint())
+		return err
+	}
+	return nil
+}
+
+// ready proxies the readiness check of the Pyroscope backend, responding with 200 when it is ready and 503
+// otherwise.
+func (d *PyroscopeDatasource) ready(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	ctxLogger := logger.FromContext(ctx)
+	status := http.StatusServiceUnavailable
+
+	readyReq, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(d.settings.URL, "/")+"/ready", nil)
+	if err != nil {
+		ctxLogger.Error("Failed to create readiness request", "error", err, "function", logEntrypoint())
+		return err
+	}
+	res, err := d.httpClient.Do(readyReq)
+	if err != nil {
+		ctxLogger.Warn("Pyroscope readiness check failed", "error", err, "function", logEntrypoint())
+	} else {
+		defer func() {
+			if err := res.Body.Close(); err != nil {
+				ctxLogger.Warn("Failed to close response body", "error", err, "function", logEntrypoint())
+			}
+		}()
+		if res.StatusCode == http.StatusOK {
+			status = http.StatusOK
+		}
+	}
+
+	body := []byte(`{"ready":false}`)
+	if status == http.StatusOK {
+		body = []byte(`{"ready":true}`)
+	}
+	err = sender.Send(&backend.CallResourceResponse{Body: body, Headers: req.Headers, Status: status})
+	if err != nil {
+		ctxLogger.Error("Failed to send response", "error", err, "function", logEntrypoint())
+		return err
+	}
+	return nil
+}
+
+// timestampParam parses the millisecond timestamp of the URL query parameter, 0 when it is not set.
+func timestampParam(query url.Values, name string) (int64, error) {
+	value := query.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	timestamp, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a timestamp in milliseconds", name)
+	}
+	return timestamp, nil
+}
+
+// sendClientError sends the error of a Pyroscope call as a JSON body, with the HTTP status Pyroscope answered with or
+// 500 when the error has none.
+func sendClientError(sender backend.CallResourceResponseSender, err error) error {
+	status := http.StatusInternalServerError
+	var clientErr *ClientError
+	if errors.As(err, &clientErr) && clientErr.Status != 0 {
+		status = clientErr.Status
+	}
+	body, jsonErr := json.Marshal(map[string]string{"error": err.Error(), "status": "error"})
+	if jsonErr != nil {
+		return jsonErr
+	}
+	return sender.Send(&backend.CallResourceResponse{
+		Status: status,
+		Body:   body,
+	})
+}
+
+func sendBadRequest(sender backend.CallResourceResponseSender, err error) error {
+	body, jsonErr := json.Marshal(map[string]string{"error": err.Error()})
+	if jsonErr != nil {
+		return jsonErr
+	}
+	return sender.Send(&backend.CallResourceResponse{
+		Status: http.StatusBadRequest,
+		Body:   body,
+	})
+}
+
 type LabelValuesPayload struct {
 	Query string
 	Label string
@@ -129,6 +695,23 @@ type LabelValuesPayload struct {
 	End   int64
 }
 
+// resourceBodyLimit is the configured maximum size of the resource request bodies, or the default one when not
+// configured.
+func resourceBodyLimit(maxResourceBodyBytes int64) int64 {
+	if maxResourceBodyBytes <= 0 {
+		return defaultMaxResourceBodyBytes
+	}
+	return maxResourceBodyBytes
+}
+
+// labelValuesLimit is the configured maximum number of label values, or the default one when not configured.
+func labelValuesLimit(maxLabelValues int) int {
+	if maxLabelValues <= 0 {
+		return defaultMaxLabelValues
+	}
+	return maxLabelValues
+}
+
 func (d *PyroscopeDatasource) labelValues(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
 	ctxLogger := logger.FromContext(ctx)
 	u, err := url.Parse(req.URL)
@@ -137,11 +720,36 @@ func (d *PyroscopeDatasource) labelValues(ctx context.Context, req *backend.Call
 		return err
 	}
 	query := u.Query()
+	label := query.Get("label")
+	if label == "" {
+		return sendBadRequest(sender, errors.New("label is required"))
+	}
+
+	// start and end are optional, the values of the whole retention are returned without them
+	start, err := timestampParam(query, "start")
+	if err != nil {
+		return sendBadRequest(sender, err)
+	}
+	end, err := timestampParam(query, "end")
+	if err != nil {
+		return sendBadRequest(sender, err)
+	}
 
-	res, err := d.client.LabelValues(ctx, query["label"][0])
+	// query is the optional prefix of the values the query editor autocompletes
+	res, err := d.client.LabelValues(ctx, label, query.Get("query"), start, end)
 	if err != nil {
 		ctxLogger.Error("Received error from client", "error", err, "function", logEntrypoint())
-		return fmt.Errorf("error calling LabelValues: %v", err)
+		return sendClientError(sender, fmt.Errorf("error calling LabelValues: %w", err))
+	}
+
+	headers := make(map[string][]string, len(req.Headers)+1)
+	for k, v := range req.Headers {
+		headers[k] = v
+	}
+	if limit := labelValuesLimit(d.maxLabelValues); len(res) > limit {
+		ctxLogger.Debug("Truncating label values", "label", label, "count", len(res), "limit", limit, "function", logEntrypoint())
+		res = res[:limit]
+		headers[labelValuesTruncatedHeader] = []string{"true"}
 	}
 
 	data, err := json.Marshal(res)
@@ -150,7 +758,7 @@ func (d *PyroscopeDatasource) labelValues(ctx context.Context, req *backend.Call
 		return err
 	}
 
-	err = sender.Send(&backend.CallResourceResponse{Body: data, Headers: req.Headers, Status: 200})
+	err = sender.Send(&backend.CallResourceResponse{Body: data, Headers: headers, Status: 200})
 	if err != nil {
 		ctxLogger.Error("Failed to send response", "error", err, "function", logEntrypoint())
 		return err
@@ -170,15 +778,28 @@ func (d *PyroscopeDatasource) QueryData(ctx context.Context, req *backend.QueryD
 	// create response struct
 	response := backend.NewQueryDataResponse()
 
-	// loop over queries and execute them individually.
+	// The queries run concurrently and share a limit on their calls to Pyroscope, so a dashboard with many queries,
+	// like diffs fetching two profiles each, doesn't send all of them at once.
+	ctx = withFetchLimiter(ctx, d.maxConcurrentFetches)
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
 	for i, q := range req.Queries {
-		ctxLogger.Debug("Processing query", "counter", i, "function", logEntrypoint())
-		res := d.query(ctx, req.PluginContext, q)
+		wg.Add(1)
+		go func(i int, q backend.DataQuery) {
+			defer wg.Done()
+			ctxLogger.Debug("Processing query", "counter", i, "function", logEntrypoint())
+			res := d.query(ctx, req.PluginContext, q)
 
-		// save the response in a hashmap
-		// based on with RefID as identifier
-		response.Responses[q.RefID] = res
+			// save the response in a hashmap
+			// based on with RefID as identifier
+			mu.Lock()
+			response.Responses[q.RefID] = res
+			mu.Unlock()
+		}(i, q)
 	}
+	wg.Wait()
 
 	ctxLogger.Debug("All queries processed", "function", logEntrypoint())
 	return response, nil
@@ -187,76 +808,423 @@ func (d *PyroscopeDatasource) QueryData(ctx context.Context, req *backend.QueryD
 // CheckHealth handles health checks sent from Grafana to the plugin.
 // The main use case for these health checks is the test button on the
 // datasource configuration page which allows users to verify that
-// a datasource is working as expected.
+// a datasource is working as expected. The effective configuration of the datasource is reported in the details.
 func (d *PyroscopeDatasource) CheckHealth(ctx context.Context, _ *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
 	logger.FromContext(ctx).Debug("CheckHealth called", "function", logEntrypoint())
 
-	status := backend.HealthStatusOk
-	message := "Data source is working"
+	details, err := json.Marshal(d.diagnostics)
+	if err != nil {
+		return nil, err
+	}
 
 	if _, err := d.client.ProfileTypes(ctx); err != nil {
-		status = backend.HealthStatusError
-		message = err.Error()
+		return &backend.CheckHealthResult{
+			Status:      backend.HealthStatusError,
+			Message:     d.healthErrorMessage(err),
+			JSONDetails: details,
+		}, nil
+	}
+
+	// The profile types of a server that doesn't check the credentials of the querier can still be listed, so the
+	// status API is called as well to verify them.
+	version, err := d.client.Version(ctx)
+	if err != nil {
+		if isAuthError(err) || isConnectionError(err) {
+			return &backend.CheckHealthResult{
+				Status:      backend.HealthStatusError,
+				Message:     d.healthErrorMessage(err),
+				JSONDetails: details,
+			}, nil
+		}
+		logger.FromContext(ctx).Debug("Failed to detect the Pyroscope version", "error", err, "function", logEntrypoint())
+		version = ""
+	}
+
+	message := "Data source is working"
+	if version != "" {
+		message += ". Pyroscope version " + version
+	}
+	if warning := versionWarning(version); warning != "" {
+		message += ". " + warning
 	}
 
 	return &backend.CheckHealthResult{
-		Status:  status,
-		Message: message,
+		Status:      backend.HealthStatusOk,
+		Message:     message,
+		JSONDetails: details,
 	}, nil
 }
 
+// healthErrorMessage explains the error of a health check call, telling the authentication failures and the
+// unreachable servers apart from the other errors.
+func (d *PyroscopeDatasource) healthErrorMessage(err error) string {
+	switch {
+	case isAuthError(err):
+		return "Authentication failed: " + err.Error()
+	case isConnectionError(err):
+		return fmt.Sprintf("Cannot reach Pyroscope at %s: %s", d.settings.URL, err.Error())
+	default:
+		return err.Error()
+	}
+}
+
+// isAuthError returns whether Pyroscope rejected the credentials of the call.
+func isAuthError(err error) bool {
+	var clientErr *ClientError
+	if !errors.As(err, &clientErr) {
+		return false
+	}
+	return clientErr.Status == http.StatusUnauthorized || clientErr.Status == http.StatusForbidden
+}
+
+// versionWarning explains the potential incompatibilities when the Pyroscope server is older than
+// minSupportedVersion. It is empty when the version is supported or cannot be detected.
+func versionWarning(version string) string {
+	parsed, ok := parseVersion(version)
+	if !ok || !parsed.less(minSupportedVersion) {
+		return ""
+	}
+	return fmt.Sprintf("Warning: Pyroscope %s is older than the minimum supported version %s, some queries and features may not work as expected", version, minSupportedVersion)
+}
+
+const (
+	// seriesStreamPath is the base path of the streams of the series of a query.
+	seriesStreamPath = "stream"
+	// defaultStreamInterval is how often the series of a stream are queried when the subscription doesn't set it.
+	defaultStreamInterval = 15 * time.Second
+)
+
+// streamQueryTTL is how long the queries of the streams are kept after the query returning their channel ran.
+const streamQueryTTL = time.Hour
+
+// streamPath returns the channel path of the stream of the query payload: the base path followed by a hash of the
+// payload. Grafana Live runs one stream per channel path, so only the subscriptions of the same query share a
+// stream, and the channel IDs stay under the length limit of Grafana Live whatever the size of the query.
+func streamPath(base string, payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return base + "/" + hex.EncodeToString(sum[:16])
+}
+
+// registerStream keeps the query of the stream for the subscriptions to the channel path it returns.
+func (d *PyroscopeDatasource) registerStream(base string, q any) (string, error) {
+	payload, err := json.Marshal(q)
+	if err != nil {
+		return "", err
+	}
+	path := streamPath(base, payload)
+	if d.streamQueries != nil {
+		d.streamQueries.Set(path, payload)
+	}
+	return path, nil
+}
+
+// streamPayload returns the query of the stream of the channel path: the one registered by the query that returned
+// the channel, or the data of the subscription when the path was built from it. ok is false when the path is not
+// under the base path.
+func (d *PyroscopeDatasource) streamPayload(path, base string, data json.RawMessage) (payload json.RawMessage, ok bool, err error) {
+	if !strings.HasPrefix(path, base+"/") {
+		return nil, false, nil
+	}
+	if d.streamQueries != nil {
+		if payload, found := d.streamQueries.Get(path); found {
+			return payload, true, nil
+		}
+	}
+	if len(data) > 0 && streamPath(base, data) == path {
+		return data, true, nil
+	}
+	return nil, true, fmt.Errorf("%w: %s", errUnknownStream, path)
+}
+
+// errUnknownStream is returned for the channel paths of queries that expired or ran on another instance, the
+// query has to run again to get a new channel.
+var errUnknownStream = errors.New("unknown stream")
+
+// streamQuery is the query of the series streams, run on every interval, see streamPayload.
+type streamQuery struct {
+	ProfileTypeID string   `json:"profileTypeId"`
+	LabelSelector string   `json:"labelSelector"`
+	GroupBy       []string `json:"groupBy"`
+	// IntervalMs is how often the series are queried, defaultStreamInterval when 0.
+	IntervalMs int64 `json:"intervalMs"`
+}
+
+func parseStreamQuery(payload json.RawMessage) (streamQuery, error) {
+	var q streamQuery
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &q); err != nil {
+			return q, fmt.Errorf("error unmarshaling stream query: %w", err)
+		}
+	}
+	if q.ProfileTypeID == "" {
+		return q, errors.New("stream query has no profile type")
+	}
+	if q.IntervalMs < 0 {
+		return q, fmt.Errorf("invalid stream interval %dms", q.IntervalMs)
+	}
+	return q, nil
+}
+
+// parseStreamPath returns the query of the series stream of the channel path.
+func (d *PyroscopeDatasource) parseStreamPath(path string, data json.RawMessage) (streamQuery, error) {
+	payload, ok, err := d.streamPayload(path, seriesStreamPath, data)
+	if !ok {
+		return streamQuery{}, fmt.Errorf("unsupported stream path %q", path)
+	}
+	if err != nil {
+		return streamQuery{}, err
+	}
+	return parseStreamQuery(payload)
+}
+
+func (q streamQuery) interval() time.Duration {
+	if q.IntervalMs == 0 {
+		return defaultStreamInterval
+	}
+	return time.Duration(q.IntervalMs) * time.Millisecond
+}
+
 // SubscribeStream is called when a client wants to connect to a stream. This callback
 // allows sending the first message.
 func (d *PyroscopeDatasource) SubscribeStream(_ context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
 	logger.Debug("Subscribing stream called", "function", logEntrypoint())
 
-	status := backend.SubscribeStreamStatusPermissionDenied
-	if req.Path == "stream" {
+	var err error
+	switch {
+	case strings.HasPrefix(req.Path, seriesStreamPath+"/"):
+		_, err = d.parseStreamPath(req.Path, req.Data)
+	case strings.HasPrefix(req.Path, labelValuesStreamPath+"/"):
+		_, err = d.parseLabelValuesStreamPath(req.Path, req.Data)
+	default:
 		// Allow subscribing only on expected path.
-		status = backend.SubscribeStreamStatusOK
+		return &backend.SubscribeStreamResponse{
+			Status: backend.SubscribeStreamStatusPermissionDenied,
+		}, nil
+	}
+	if errors.Is(err, errUnknownStream) {
+		return &backend.SubscribeStreamResponse{
+			Status: backend.SubscribeStreamStatusNotFound,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 	return &backend.SubscribeStreamResponse{
-		Status: status,
+		Status: backend.SubscribeStreamStatusOK,
 	}, nil
 }
 
 // RunStream is called once for any open channel.  Results are shared with everyone
-// subscribed to the same channel.
+// subscribed to the same channel. The series of the query of the channel path are sent on every interval of the
+// query, over the default time range ending now.
 func (d *PyroscopeDatasource) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
 	ctxLogger := logger.FromContext(ctx)
 	ctxLogger.Debug("Running stream", "path", req.Path, "function", logEntrypoint())
 
-	// Create the same data frame as for query data.
-	frame := data.NewFrame("response")
+	if strings.HasPrefix(req.Path, labelValuesStreamPath+"/") {
+		return d.runLabelValuesStream(ctx, req, sender)
+	}
 
-	// Add fields (matching the same schema used in QueryData).
-	frame.Fields = append(frame.Fields,
-		data.NewField("time", nil, make([]time.Time, 1)),
-		data.NewField("values", nil, make([]int64, 1)),
-	)
+	q, err := d.parseStreamPath(req.Path, req.Data)
+	if err != nil {
+		ctxLogger.Error("Invalid stream query", "path", req.Path, "error", err, "function", logEntrypoint())
+		return err
+	}
 
-	counter := 0
+	ticker := time.NewTicker(q.interval())
+	defer ticker.Stop()
 
+	framesSent := 0
+	var lastErr error
 	// Stream data frames periodically till stream closed by Grafana.
-	for {
+	for ctx.Err() == nil {
+		timeRange := d.resolveTimeRange(backend.TimeRange{}, time.Now())
+		frames, err := d.streamFrames(ctx, q, timeRange)
+		if err != nil && ctx.Err() == nil {
+			lastErr = err
+			ctxLogger.Error("Error querying the stream series", "path", req.Path, "error", err, "function", logEntrypoint())
+			// Let the consumer know the stream is failing, the query is retried on the next interval.
+			frame := data.NewFrame("response")
+			frame.AppendNotices(data.Notice{Severity: data.NoticeSeverityError, Text: err.Error()})
+			frames = []*data.Frame{frame}
+		}
+
+		for _, frame := range frames {
+			if err := sender.SendFrame(frame, data.IncludeAll); err != nil {
+				ctxLogger.Error("Error sending frame", "path", req.Path, "error", err, "function", logEntrypoint())
+				return err
+			}
+			framesSent++
+		}
+
 		select {
 		case <-ctx.Done():
-			ctxLogger.Info("Context done, finish streaming", "path", req.Path, "function", logEntrypoint())
-			return nil
-		case <-time.After(time.Second):
-			// Send new data periodically.
-			frame.Fields[0].Set(0, time.Now())
-			frame.Fields[1].Set(0, int64(10*(counter%2+1)))
+		case <-ticker.C:
+		}
+	}
 
-			counter++
+	ctxLogger.Info("Context done, finish streaming", "path", req.Path, "profileTypeId", q.ProfileTypeID, "framesSent", framesSent, "lastError", lastErr, "function", logEntrypoint())
+	return nil
+}
 
-			err := sender.SendFrame(frame, data.IncludeAll)
-			if err != nil {
-				ctxLogger.Error("Error sending frame", "error", err, "function", logEntrypoint())
+// streamFrames queries the series of the stream query in the time range.
+func (d *PyroscopeDatasource) streamFrames(ctx context.Context, q streamQuery, timeRange backend.TimeRange) ([]*data.Frame, error) {
+	resp, err := d.client.GetSeries(
+		ctx,
+		q.ProfileTypeID,
+		q.LabelSelector,
+		timeRange.From.UnixMilli(),
+		timeRange.To.UnixMilli(),
+		q.GroupBy,
+		q.interval().Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	resp.Label = d.profileTypeLabel(q.ProfileTypeID, resp.Label)
+	return seriesToDataFrames(resp), nil
+}
+
+const (
+	// labelValuesStreamPath is the base path of the streams of the values of a label, for the autocompletion of
+	// labels with too many values to wait for all of them.
+	labelValuesStreamPath = "labelValues"
+	// defaultLabelValuesBatchSize is the number of values per frame of the label values streams when the
+	// subscription doesn't set it.
+	defaultLabelValuesBatchSize = 500
+	// labelValuesStreamPages is the number of windows the time range of a label values stream is fetched in.
+	labelValuesStreamPages = 4
+)
+
+// labelValuesStreamQuery is the query of the label values streams, see streamPayload.
+type labelValuesStreamQuery struct {
+	Label string `json:"label"`
+	// Prefix is the optional prefix of the values, as typed in the query editor.
+	Prefix string `json:"prefix"`
+	// Start and End are the optional time range of the values in milliseconds, the values of the whole retention
+	// are streamed without them.
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// BatchSize is the number of values per frame, defaultLabelValuesBatchSize when 0.
+	BatchSize int `json:"batchSize"`
+}
+
+func parseLabelValuesStreamQuery(payload json.RawMessage) (labelValuesStreamQuery, error) {
+	var q labelValuesStreamQuery
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &q); err != nil {
+			return q, fmt.Errorf("error unmarshaling label values stream query: %w", err)
+		}
+	}
+	if q.Label == "" {
+		return q, errors.New("label values stream query has no label")
+	}
+	if q.BatchSize < 0 {
+		return q, fmt.Errorf("invalid label values batch size %d", q.BatchSize)
+	}
+	if q.BatchSize == 0 {
+		q.BatchSize = defaultLabelValuesBatchSize
+	}
+	return q, nil
+}
+
+// parseLabelValuesStreamPath returns the query of the label values stream of the channel path.
+func (d *PyroscopeDatasource) parseLabelValuesStreamPath(path string, data json.RawMessage) (labelValuesStreamQuery, error) {
+	payload, ok, err := d.streamPayload(path, labelValuesStreamPath, data)
+	if !ok {
+		return labelValuesStreamQuery{}, fmt.Errorf("unsupported stream path %q", path)
+	}
+	if err != nil {
+		return labelValuesStreamQuery{}, err
+	}
+	return parseLabelValuesStreamQuery(payload)
+}
+
+// pages splits the time range of the query in labelValuesStreamPages windows, the most recent first, as the values
+// seen recently are the most likely to be queried. A query without a time range is a single page over the whole
+// retention.
+func (q labelValuesStreamQuery) pages() [][2]int64 {
+	if q.Start <= 0 || q.End <= q.Start {
+		return [][2]int64{{q.Start, q.End}}
+	}
+	size := (q.End - q.Start + labelValuesStreamPages - 1) / labelValuesStreamPages
+	pages := make([][2]int64, 0, labelValuesStreamPages)
+	for end := q.End; end > q.Start; end -= size {
+		start := end - size
+		if start < q.Start {
+			start = q.Start
+		}
+		pages = append(pages, [2]int64{start, end})
+	}
+	return pages
+}
+
+// runLabelValuesStream fetches the values of the label page by page and sends the values of every page not sent yet
+// as soon as it arrives, in frames of the batch size of the query, so the query editor can offer the first values
+// while the others are still being fetched. The stream ends once all pages are sent. The values are capped like the
+// ones of the labelValues resource, with a notice in the last frame when they are.
+func (d *PyroscopeDatasource) runLabelValuesStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	ctxLogger := logger.FromContext(ctx)
+	q, err := d.parseLabelValuesStreamPath(req.Path, req.Data)
+	if err != nil {
+		ctxLogger.Error("Invalid label values stream query", "path", req.Path, "error", err, "function", logEntrypoint())
+		return err
+	}
+
+	limit := labelValuesLimit(d.maxLabelValues)
+	seen := map[string]bool{}
+	truncated := false
+	for _, page := range q.pages() {
+		if ctx.Err() != nil {
+			return nil
+		}
+		values, err := d.client.LabelValues(ctx, q.Label, q.Prefix, page[0], page[1])
+		if err != nil {
+			ctxLogger.Error("Received error from client", "path", req.Path, "error", err, "function", logEntrypoint())
+			frame := data.NewFrame(labelValuesStreamPath, data.NewField("value", nil, []string{}))
+			frame.AppendNotices(data.Notice{Severity: data.NoticeSeverityError, Text: err.Error()})
+			return sender.SendFrame(frame, data.IncludeAll)
+		}
+
+		var fresh []string
+		for _, value := range values {
+			if seen[value] {
 				continue
 			}
+			if len(seen) == limit {
+				truncated = true
+				break
+			}
+			seen[value] = true
+			fresh = append(fresh, value)
 		}
+		for start := 0; start < len(fresh); start += q.BatchSize {
+			end := start + q.BatchSize
+			if end > len(fresh) {
+				end = len(fresh)
+			}
+			if err := sender.SendFrame(data.NewFrame(labelValuesStreamPath, data.NewField("value", nil, fresh[start:end])), data.IncludeAll); err != nil {
+				ctxLogger.Error("Error sending frame", "path", req.Path, "error", err, "function", logEntrypoint())
+				return err
+			}
+		}
+		if truncated {
+			break
+		}
+	}
+
+	// The last frame tells the values are capped, or that there are none at all.
+	if !truncated && len(seen) > 0 {
+		return nil
+	}
+	frame := data.NewFrame(labelValuesStreamPath, data.NewField("value", nil, []string{}))
+	if truncated {
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("The label has more values than the maximum of %d, refine the prefix to see the others", limit),
+		})
 	}
+	return sender.SendFrame(frame, data.IncludeAll)
 }
 
 // PublishStream is called when a client sends a message to the stream.
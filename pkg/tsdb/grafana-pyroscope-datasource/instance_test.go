@@ -2,10 +2,27 @@ package pyroscope
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana/pkg/infra/httpclient"
+	querierv1 "github.com/grafana/pyroscope/api/gen/proto/go/querier/v1"
+	"github.com/grafana/pyroscope/api/gen/proto/go/querier/v1/querierv1connect"
+	typesv1 "github.com/grafana/pyroscope/api/gen/proto/go/types/v1"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 )
 
 // This is where the tests for the datasource backend live.
@@ -52,6 +69,771 @@ func Test_CallResource(t *testing.T) {
 		require.Equal(t, 200, sender.Resp.Status)
 		require.Equal(t, `[{"id":"type:1","label":"cpu"},{"id":"type:2","label":"memory"}]`, string(sender.Resp.Body))
 	})
+
+	t.Run("sample types resource", func(t *testing.T) {
+		ds := &PyroscopeDatasource{
+			client: &FakeClient{
+				Types: []*ProfileType{
+					{ID: "process_cpu:cpu:nanoseconds:cpu:nanoseconds", Label: "process_cpu - cpu"},
+					{ID: "memory:alloc_objects:count:space:bytes", Label: "memory - alloc_objects"},
+					{ID: "memory:alloc_space:bytes:space:bytes", Label: "memory - alloc_space"},
+					{ID: "memory:inuse_space:bytes:space:bytes", Label: "memory - inuse_space"},
+				},
+			},
+		}
+		sender := &FakeSender{}
+		err := ds.CallResource(
+			context.Background(),
+			&backend.CallResourceRequest{
+				PluginContext: backend.PluginContext{},
+				Path:          "sampleTypes",
+				Method:        "GET",
+				URL:           "sampleTypes?profileTypeId=memory:alloc_space:bytes:space:bytes",
+			},
+			sender,
+		)
+		require.NoError(t, err)
+		require.Equal(t, 200, sender.Resp.Status)
+		require.Equal(t, `[{"index":0,"profileTypeId":"memory:alloc_objects:count:space:bytes","sampleType":"alloc_objects","sampleUnit":"count"},`+
+			`{"index":1,"profileTypeId":"memory:alloc_space:bytes:space:bytes","sampleType":"alloc_space","sampleUnit":"bytes"},`+
+			`{"index":2,"profileTypeId":"memory:inuse_space:bytes:space:bytes","sampleType":"inuse_space","sampleUnit":"bytes"}]`, string(sender.Resp.Body))
+	})
+
+	t.Run("sample types resource without profile type", func(t *testing.T) {
+		sender := &FakeSender{}
+		err := ds.CallResource(
+			context.Background(),
+			&backend.CallResourceRequest{
+				Path:   "sampleTypes",
+				Method: "GET",
+				URL:    "sampleTypes",
+			},
+			sender,
+		)
+		require.NoError(t, err)
+		require.Equal(t, 400, sender.Resp.Status)
+	})
+}
+
+func Test_labelNamesResource(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		url      string
+		matchers []string
+	}{
+		{name: "matchers of the request", url: "labelNames?matchers=" + url.QueryEscape(`{service="foo"}`), matchers: []string{`{service="foo"}`}},
+		{name: "all series without matchers", url: "labelNames"},
+		{name: "empty matchers are ignored", url: "labelNames?matchers=" + url.QueryEscape("{}") + "&matchers="},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &FakeClient{Names: []string{"service_name"}}
+			sender := &FakeSender{}
+			err := (&PyroscopeDatasource{client: client}).CallResource(context.Background(), &backend.CallResourceRequest{
+				Path:   "labelNames",
+				Method: "GET",
+				URL:    tt.url,
+			}, sender)
+			require.NoError(t, err)
+			require.Equal(t, 200, sender.Resp.Status)
+			require.Equal(t, `["service_name"]`, string(sender.Resp.Body))
+			require.Equal(t, []any{tt.matchers}, client.Args)
+		})
+	}
+}
+
+func Test_labelValuesResource(t *testing.T) {
+	values := make([]string, 10)
+	for i := range values {
+		values[i] = fmt.Sprintf("value-%d", i)
+	}
+	callLabelValues := func(t *testing.T, ds *PyroscopeDatasource) *backend.CallResourceResponse {
+		t.Helper()
+		sender := &FakeSender{}
+		err := ds.CallResource(context.Background(), &backend.CallResourceRequest{
+			Path:   "labelValues",
+			Method: "GET",
+			URL:    "labelValues?label=service_name",
+		}, sender)
+		require.NoError(t, err)
+		require.Equal(t, 200, sender.Resp.Status)
+		return sender.Resp
+	}
+
+	t.Run("values above the maximum are truncated", func(t *testing.T) {
+		resp := callLabelValues(t, &PyroscopeDatasource{client: &FakeClient{Values: values}, maxLabelValues: 3})
+		require.Equal(t, `["value-0","value-1","value-2"]`, string(resp.Body))
+		require.Equal(t, []string{"true"}, resp.Headers[labelValuesTruncatedHeader])
+	})
+
+	t.Run("values within the maximum are returned as they are", func(t *testing.T) {
+		resp := callLabelValues(t, &PyroscopeDatasource{client: &FakeClient{Values: values}, maxLabelValues: 10})
+		require.Len(t, strings.Split(string(resp.Body), ","), 10)
+		require.NotContains(t, resp.Headers, labelValuesTruncatedHeader)
+	})
+
+	t.Run("time range is passed to the client", func(t *testing.T) {
+		client := &FakeClient{Values: values}
+		sender := &FakeSender{}
+		err := (&PyroscopeDatasource{client: client}).CallResource(context.Background(), &backend.CallResourceRequest{
+			Path:   "labelValues",
+			Method: "GET",
+			URL:    "labelValues?label=service_name&start=1000&end=2000",
+		}, sender)
+		require.NoError(t, err)
+		require.Equal(t, 200, sender.Resp.Status)
+		require.Equal(t, []any{"service_name", "", int64(1000), int64(2000)}, client.Args)
+	})
+
+	t.Run("full range without a time range", func(t *testing.T) {
+		client := &FakeClient{Values: values}
+		callLabelValues(t, &PyroscopeDatasource{client: client})
+		require.Equal(t, []any{"service_name", "", int64(0), int64(0)}, client.Args)
+	})
+
+	t.Run("prefix is passed to the client", func(t *testing.T) {
+		client := &FakeClient{Values: values}
+		sender := &FakeSender{}
+		err := (&PyroscopeDatasource{client: client}).CallResource(context.Background(), &backend.CallResourceRequest{
+			Path:   "labelValues",
+			Method: "GET",
+			URL:    "labelValues?label=pod&query=api-",
+		}, sender)
+		require.NoError(t, err)
+		require.Equal(t, 200, sender.Resp.Status)
+		require.Equal(t, []any{"pod", "api-", int64(0), int64(0)}, client.Args)
+	})
+
+	t.Run("invalid time range", func(t *testing.T) {
+		sender := &FakeSender{}
+		err := (&PyroscopeDatasource{client: &FakeClient{}}).CallResource(context.Background(), &backend.CallResourceRequest{
+			Path:   "labelValues",
+			Method: "GET",
+			URL:    "labelValues?label=service_name&start=yesterday",
+		}, sender)
+		require.NoError(t, err)
+		require.Equal(t, 400, sender.Resp.Status)
+		require.Equal(t, `{"error":"start must be a timestamp in milliseconds"}`, string(sender.Resp.Body))
+	})
+
+	t.Run("missing label", func(t *testing.T) {
+		for _, url := range []string{"labelValues", "labelValues?label=", "labelValues?query=api-"} {
+			sender := &FakeSender{}
+			err := (&PyroscopeDatasource{client: &FakeClient{}}).CallResource(context.Background(), &backend.CallResourceRequest{
+				Path:   "labelValues",
+				Method: "GET",
+				URL:    url,
+			}, sender)
+			require.NoError(t, err)
+			require.Equal(t, 400, sender.Resp.Status, url)
+			require.Equal(t, `{"error":"label is required"}`, string(sender.Resp.Body), url)
+		}
+	})
+
+	t.Run("default maximum", func(t *testing.T) {
+		require.Equal(t, defaultMaxLabelValues, labelValuesLimit(0))
+		require.Equal(t, 3, labelValuesLimit(3))
+	})
+}
+
+func Test_profileStatsResource(t *testing.T) {
+	call := func(t *testing.T, client *FakeClient, query string) *backend.CallResourceResponse {
+		t.Helper()
+		sender := &FakeSender{}
+		err := (&PyroscopeDatasource{client: client}).CallResource(context.Background(), &backend.CallResourceRequest{
+			Path:   "profileStats",
+			Method: "GET",
+			URL:    "profileStats?" + query,
+		}, sender)
+		require.NoError(t, err)
+		return sender.Resp
+	}
+
+	t.Run("stats of the selection", func(t *testing.T) {
+		client := &FakeClient{}
+		resp := call(t, client, "profileTypeId=process_cpu:cpu:nanoseconds:cpu:nanoseconds&labelSelector="+url.QueryEscape(`{app="foo"}`)+"&start=1000&end=2000")
+		require.Equal(t, 200, resp.Status)
+		require.JSONEq(t, `{"nonEmptyPoints":120,"seriesCount":3,"minTimestamp":10000,"maxTimestamp":20000}`, string(resp.Body))
+		require.Equal(t, []any{"process_cpu:cpu:nanoseconds:cpu:nanoseconds", `{app="foo"}`, int64(1000), int64(2000)}, client.Args)
+	})
+
+	t.Run("profile type is required", func(t *testing.T) {
+		resp := call(t, &FakeClient{}, "labelSelector={}")
+		require.Equal(t, 400, resp.Status)
+		require.Equal(t, `{"error":"profileTypeId is required"}`, string(resp.Body))
+	})
+
+	t.Run("invalid label selector", func(t *testing.T) {
+		client := &FakeClient{}
+		resp := call(t, client, "profileTypeId=process_cpu:cpu:nanoseconds:cpu:nanoseconds&labelSelector="+url.QueryEscape(`{app=}`))
+		require.Equal(t, 400, resp.Status)
+		require.Contains(t, string(resp.Body), "invalid label selector")
+		require.Nil(t, client.Args)
+	})
+}
+
+func Test_resourceCacheControl(t *testing.T) {
+	callResource := func(t *testing.T, ds *PyroscopeDatasource, path string) *backend.CallResourceResponse {
+		t.Helper()
+		sender := &FakeSender{}
+		err := ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: strings.Split(path, "?")[0], Method: "GET", URL: path}, sender)
+		require.NoError(t, err)
+		require.Equal(t, 200, sender.Resp.Status)
+		return sender.Resp
+	}
+
+	t.Run("cacheable resources have a Cache-Control header", func(t *testing.T) {
+		ds := &PyroscopeDatasource{client: &FakeClient{Names: []string{"service_name"}}, resourceCacheMaxAge: 2 * time.Minute}
+		for _, path := range []string{"profileTypes", "labelNames"} {
+			resp := callResource(t, ds, path)
+			require.Equal(t, []string{"private, max-age=120"}, resp.Headers["Cache-Control"], path)
+		}
+	})
+
+	t.Run("other resources are not cached", func(t *testing.T) {
+		ds := &PyroscopeDatasource{client: &FakeClient{Values: []string{"app"}}, resourceCacheMaxAge: 2 * time.Minute}
+		resp := callResource(t, ds, "labelValues?label=service_name")
+		require.NotContains(t, resp.Headers, "Cache-Control")
+	})
+
+	t.Run("caching can be disabled", func(t *testing.T) {
+		ds := &PyroscopeDatasource{client: &FakeClient{}}
+		resp := callResource(t, ds, "profileTypes")
+		require.NotContains(t, resp.Headers, "Cache-Control")
+	})
+
+	t.Run("max age defaults when not configured", func(t *testing.T) {
+		instance, err := NewPyroscopeDatasource(context.Background(), httpclient.NewProvider(), backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)}, nil)
+		require.NoError(t, err)
+		require.Equal(t, defaultResourceCacheMaxAge, instance.(*PyroscopeDatasource).resourceCacheMaxAge)
+
+		instance, err = NewPyroscopeDatasource(context.Background(), httpclient.NewProvider(), backend.DataSourceInstanceSettings{JSONData: []byte(`{"resourceCacheMaxAge":"0s"}`)}, nil)
+		require.NoError(t, err)
+		require.Equal(t, time.Duration(0), instance.(*PyroscopeDatasource).resourceCacheMaxAge)
+	})
+}
+
+func Test_profileTypesCache(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != querierv1connect.QuerierServiceProfileTypesProcedure {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		calls.Add(1)
+		body, err := proto.Marshal(&querierv1.ProfileTypesResponse{
+			ProfileTypes: []*typesv1.ProfileType{{ID: "process_cpu:cpu:nanoseconds:cpu:nanoseconds", Name: "process_cpu", SampleType: "cpu"}},
+		})
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/proto")
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	newDatasource := func(t *testing.T, jsonData string) *PyroscopeDatasource {
+		instance, err := NewPyroscopeDatasource(context.Background(), httpclient.NewProvider(), backend.DataSourceInstanceSettings{
+			UID:      "pyroscope",
+			URL:      server.URL,
+			JSONData: []byte(jsonData),
+		}, nil)
+		require.NoError(t, err)
+		return instance.(*PyroscopeDatasource)
+	}
+	callProfileTypes := func(t *testing.T, ds *PyroscopeDatasource) {
+		sender := &FakeSender{}
+		err := ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "profileTypes", Method: "GET", URL: "profileTypes"}, sender)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, sender.Resp.Status)
+		require.Equal(t, `[{"id":"process_cpu:cpu:nanoseconds:cpu:nanoseconds","label":"process_cpu - cpu"}]`, string(sender.Resp.Body))
+	}
+
+	t.Run("second call within the TTL is cached", func(t *testing.T) {
+		calls.Store(0)
+		ds := newDatasource(t, `{}`)
+		callProfileTypes(t, ds)
+		callProfileTypes(t, ds)
+		require.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("profile types are fetched again once expired", func(t *testing.T) {
+		calls.Store(0)
+		ds := newDatasource(t, `{"profileTypesCacheTTL":"30s"}`)
+		now := time.Now()
+		ds.profileTypesCache.now = func() time.Time { return now }
+		callProfileTypes(t, ds)
+		now = now.Add(31 * time.Second)
+		callProfileTypes(t, ds)
+		require.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("health check bypasses the cache", func(t *testing.T) {
+		calls.Store(0)
+		ds := newDatasource(t, `{}`)
+		callProfileTypes(t, ds)
+		res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusOk, res.Status)
+		require.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("caching can be disabled", func(t *testing.T) {
+		calls.Store(0)
+		ds := newDatasource(t, `{"profileTypesCacheTTL":"0s"}`)
+		require.Nil(t, ds.profileTypesCache)
+		callProfileTypes(t, ds)
+		callProfileTypes(t, ds)
+		require.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("concurrent calls", func(t *testing.T) {
+		ds := newDatasource(t, `{}`)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				types, err := ds.cachedProfileTypes(context.Background())
+				require.NoError(t, err)
+				require.Len(t, types, 1)
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func Test_configureHTTP2(t *testing.T) {
+	t.Run("enabled", func(t *testing.T) {
+		transport := &http.Transport{}
+		configureHTTP2(nil, true)(sdkhttpclient.Options{}, transport)
+		require.True(t, transport.ForceAttemptHTTP2)
+		require.Nil(t, transport.TLSNextProto)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		transport := &http.Transport{ForceAttemptHTTP2: true}
+		configureHTTP2(nil, false)(sdkhttpclient.Options{}, transport)
+		require.False(t, transport.ForceAttemptHTTP2)
+		require.NotNil(t, transport.TLSNextProto)
+		require.Empty(t, transport.TLSNextProto)
+	})
+
+	t.Run("chains the existing configuration", func(t *testing.T) {
+		called := false
+		next := func(opts sdkhttpclient.Options, transport *http.Transport) {
+			called = true
+		}
+		transport := &http.Transport{}
+		configureHTTP2(next, true)(sdkhttpclient.Options{}, transport)
+		require.True(t, called)
+		require.True(t, transport.ForceAttemptHTTP2)
+	})
+}
+
+func Test_readyResource(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		backendStatus  int
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "ready backend", backendStatus: http.StatusOK, expectedStatus: http.StatusOK, expectedBody: `{"ready":true}`},
+		{name: "not ready backend", backendStatus: http.StatusServiceUnavailable, expectedStatus: http.StatusServiceUnavailable, expectedBody: `{"ready":false}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var path string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				w.WriteHeader(tt.backendStatus)
+			}))
+			t.Cleanup(server.Close)
+
+			ds := &PyroscopeDatasource{
+				httpClient: server.Client(),
+				settings:   backend.DataSourceInstanceSettings{URL: server.URL + "/"},
+			}
+			sender := &FakeSender{}
+			err := ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "ready", Method: "GET", URL: "ready"}, sender)
+			require.NoError(t, err)
+			require.Equal(t, "/ready", path)
+			require.Equal(t, tt.expectedStatus, sender.Resp.Status)
+			require.Equal(t, tt.expectedBody, string(sender.Resp.Body))
+		})
+	}
+}
+
+func Test_CheckHealthDiagnostics(t *testing.T) {
+	instance, err := NewPyroscopeDatasource(context.Background(), httpclient.NewProvider(), backend.DataSourceInstanceSettings{
+		URL:      "http://localhost:4040",
+		JSONData: []byte(`{"timeout":45,"dialTimeout":5,"maxNodesDefault":2048,"maxFlamegraphBytes":1000000,"queryCacheTTL":"1m","maxRetries":3}`),
+	}, nil)
+	require.NoError(t, err)
+	ds := instance.(*PyroscopeDatasource)
+	ds.client = &FakeClient{}
+
+	res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+	require.NoError(t, err)
+	require.Equal(t, backend.HealthStatusOk, res.Status)
+
+	var details healthDiagnostics
+	require.NoError(t, json.Unmarshal(res.JSONDetails, &details))
+	require.Equal(t, healthDiagnostics{
+		Timeout:            "45s",
+		DialTimeout:        "5s",
+		MaxNodesDefault:    2048,
+		MaxLabelValues:     defaultMaxLabelValues,
+		MaxFlamegraphBytes: 1000000,
+		QueryCacheEnabled:  true,
+		QueryCacheTTL:      "1m0s",
+		MaxRetries:         3,
+	}, details)
+}
+
+func Test_CheckHealthVersionWarning(t *testing.T) {
+	for _, tt := range []struct {
+		name            string
+		version         string
+		expectedMessage string
+	}{
+		{name: "supported version", version: "v1.2.0", expectedMessage: "Data source is working. Pyroscope version v1.2.0"},
+		{name: "undetected version", version: "", expectedMessage: "Data source is working"},
+		{name: "development build", version: "main-ab12cd3", expectedMessage: "Data source is working. Pyroscope version main-ab12cd3"},
+		{
+			name:            "old version",
+			version:         "0.37.2",
+			expectedMessage: "Data source is working. Pyroscope version 0.37.2. Warning: Pyroscope 0.37.2 is older than the minimum supported version 1.0.0, some queries and features may not work as expected",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &PyroscopeDatasource{client: &FakeClient{BuildVersion: tt.version}}
+			res, err := ds.CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+			require.NoError(t, err)
+			require.Equal(t, backend.HealthStatusOk, res.Status)
+			require.Equal(t, tt.expectedMessage, res.Message)
+		})
+	}
+}
+
+func Test_CheckHealthErrors(t *testing.T) {
+	newDatasource := func(t *testing.T, url string) *PyroscopeDatasource {
+		t.Helper()
+		instance, err := NewPyroscopeDatasource(context.Background(), httpclient.NewProvider(), backend.DataSourceInstanceSettings{URL: url}, nil)
+		require.NoError(t, err)
+		return instance.(*PyroscopeDatasource)
+	}
+
+	t.Run("reachable but unauthorized", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		t.Cleanup(server.Close)
+
+		res, err := newDatasource(t, server.URL).CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusError, res.Status)
+		require.True(t, strings.HasPrefix(res.Message, "Authentication failed: "), res.Message)
+	})
+
+	t.Run("profile types listed but the status API forbidden", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != querierv1connect.QuerierServiceProfileTypesProcedure {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Content-Type", "application/proto")
+		}))
+		t.Cleanup(server.Close)
+
+		res, err := newDatasource(t, server.URL).CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusError, res.Status)
+		require.True(t, strings.HasPrefix(res.Message, "Authentication failed: "), res.Message)
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		url := server.URL
+		server.Close()
+
+		res, err := newDatasource(t, url).CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusError, res.Status)
+		require.True(t, strings.HasPrefix(res.Message, "Cannot reach Pyroscope at "+url+": "), res.Message)
+	})
+
+	t.Run("other errors are reported as they are", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		t.Cleanup(server.Close)
+
+		res, err := newDatasource(t, server.URL).CheckHealth(context.Background(), &backend.CheckHealthRequest{})
+		require.NoError(t, err)
+		require.Equal(t, backend.HealthStatusError, res.Status)
+		require.NotContains(t, res.Message, "Authentication failed")
+		require.NotContains(t, res.Message, "Cannot reach Pyroscope")
+	})
+}
+
+func Test_SubscribeStream(t *testing.T) {
+	ds := &PyroscopeDatasource{client: &FakeClient{}}
+
+	for _, tt := range []struct {
+		name           string
+		path           string
+		data           string
+		expectedStatus backend.SubscribeStreamStatus
+		expectedError  string
+	}{
+		{name: "valid query", path: seriesPath(`{"profileTypeId":"cpu","intervalMs":5000}`), data: `{"profileTypeId":"cpu","intervalMs":5000}`, expectedStatus: backend.SubscribeStreamStatusOK},
+		{name: "unexpected path", path: "other", data: `{"profileTypeId":"cpu"}`, expectedStatus: backend.SubscribeStreamStatusPermissionDenied},
+		{name: "path without query", path: "stream", data: `{"profileTypeId":"cpu"}`, expectedStatus: backend.SubscribeStreamStatusPermissionDenied},
+		{name: "unknown query", path: seriesPath(`{"profileTypeId":"cpu"}`), expectedStatus: backend.SubscribeStreamStatusNotFound},
+		{name: "data of another query", path: seriesPath(`{"profileTypeId":"cpu"}`), data: `{"profileTypeId":"memory"}`, expectedStatus: backend.SubscribeStreamStatusNotFound},
+		{name: "missing profile type", path: seriesPath(`{}`), data: `{}`, expectedError: "stream query has no profile type"},
+		{name: "negative interval", path: seriesPath(`{"profileTypeId":"cpu","intervalMs":-1}`), data: `{"profileTypeId":"cpu","intervalMs":-1}`, expectedError: "invalid stream interval -1ms"},
+		{name: "valid label values query", path: labelValuesPath(`{"label":"service_name","prefix":"api"}`), data: `{"label":"service_name","prefix":"api"}`, expectedStatus: backend.SubscribeStreamStatusOK},
+		{name: "label values path without query", path: "labelValues", data: `{"label":"service_name"}`, expectedStatus: backend.SubscribeStreamStatusPermissionDenied},
+		{name: "unknown label values query", path: labelValuesPath(`{"label":"service_name"}`), data: `{"label":"env"}`, expectedStatus: backend.SubscribeStreamStatusNotFound},
+		{name: "missing label", path: labelValuesPath(`{"prefix":"api"}`), data: `{"prefix":"api"}`, expectedError: "label values stream query has no label"},
+		{name: "negative batch size", path: labelValuesPath(`{"label":"service_name","batchSize":-1}`), data: `{"label":"service_name","batchSize":-1}`, expectedError: "invalid label values batch size -1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: tt.path, Data: []byte(tt.data)})
+			if tt.expectedError != "" {
+				require.EqualError(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedStatus, res.Status)
+		})
+	}
+}
+
+// seriesPath returns the channel path of the series stream of the query.
+func seriesPath(query string) string {
+	return streamPath(seriesStreamPath, []byte(query))
+}
+
+// labelValuesPath returns the channel path of the label values stream of the query.
+func labelValuesPath(query string) string {
+	return streamPath(labelValuesStreamPath, []byte(query))
+}
+
+// fakePacketSender collects the streamed frames, and cancels the stream once it got the expected number of them.
+type fakePacketSender struct {
+	frames   []*data.Frame
+	expected int
+	cancel   context.CancelFunc
+}
+
+func (s *fakePacketSender) Send(packet *backend.StreamPacket) error {
+	frame := &data.Frame{}
+	if err := json.Unmarshal(packet.Data, frame); err != nil {
+		return err
+	}
+	s.frames = append(s.frames, frame)
+	if len(s.frames) == s.expected {
+		s.cancel()
+	}
+	return nil
+}
+
+func Test_RunStream(t *testing.T) {
+	runStream := func(t *testing.T, client *FakeClient, expected int) []*data.Frame {
+		t.Helper()
+		ds := &PyroscopeDatasource{client: client}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		t.Cleanup(cancel)
+		packetSender := &fakePacketSender{expected: expected, cancel: cancel}
+
+		query := `{"profileTypeId":"memory:alloc_objects:count:space:bytes","labelSelector":"{app=\"baz\"}","intervalMs":10}`
+		err := ds.RunStream(ctx, &backend.RunStreamRequest{
+			Path: seriesPath(query),
+			Data: []byte(query),
+		}, backend.NewStreamSender(packetSender))
+		require.NoError(t, err)
+		require.Len(t, packetSender.frames, expected)
+		return packetSender.frames
+	}
+
+	t.Run("sends the series of the query on every interval", func(t *testing.T) {
+		client := &FakeClient{}
+		frames := runStream(t, client, 3)
+		require.Equal(t, 3, client.SeriesCalls)
+		require.Equal(t, "memory:alloc_objects:count:space:bytes", client.Args[0])
+		require.Equal(t, `{app="baz"}`, client.Args[1])
+		require.Equal(t, int64(time.Hour/time.Millisecond), client.Args[3].(int64)-client.Args[2].(int64))
+		require.Equal(t, 0.01, client.Args[5])
+		for _, frame := range frames {
+			require.Equal(t, "time", frame.Fields[0].Name)
+			require.Equal(t, 2, frame.Rows())
+		}
+	})
+
+	t.Run("surfaces series errors to the consumer", func(t *testing.T) {
+		client := &FakeClient{SeriesErr: errors.New("backend unavailable")}
+		frames := runStream(t, client, 2)
+		for _, frame := range frames {
+			require.Equal(t, []data.Notice{{Severity: data.NoticeSeverityError, Text: "backend unavailable"}}, frame.Meta.Notices)
+		}
+	})
+
+	t.Run("fails on an invalid query", func(t *testing.T) {
+		ds := &PyroscopeDatasource{client: &FakeClient{}}
+		err := ds.RunStream(context.Background(), &backend.RunStreamRequest{Path: seriesPath(`{}`), Data: []byte(`{}`)}, backend.NewStreamSender(&fakePacketSender{}))
+		require.EqualError(t, err, "stream query has no profile type")
+	})
+}
+
+func Test_RunLabelValuesStream(t *testing.T) {
+	runStream := func(t *testing.T, ds *PyroscopeDatasource, query string) []*data.Frame {
+		t.Helper()
+		packetSender := &fakePacketSender{cancel: func() {}}
+		err := ds.RunStream(context.Background(), &backend.RunStreamRequest{
+			Path: labelValuesPath(query),
+			Data: []byte(query),
+		}, backend.NewStreamSender(packetSender))
+		require.NoError(t, err)
+		return packetSender.frames
+	}
+	values := func(frame *data.Frame) []string {
+		var values []string
+		for i := 0; i < frame.Rows(); i++ {
+			values = append(values, frame.Fields[0].At(i).(string))
+		}
+		return values
+	}
+
+	t.Run("streams the values of every page as it arrives, the most recent first", func(t *testing.T) {
+		var pages [][2]int64
+		client := &FakeClient{PagedValues: func(start, end int64) []string {
+			pages = append(pages, [2]int64{start, end})
+			return []string{fmt.Sprintf("api-%d", start)}
+		}}
+		frames := runStream(t, &PyroscopeDatasource{client: client}, `{"label":"service_name","prefix":"api","start":1000,"end":4000}`)
+		require.Equal(t, [][2]int64{{3250, 4000}, {2500, 3250}, {1750, 2500}, {1000, 1750}}, pages)
+		require.Equal(t, "api", client.Args[1])
+		require.Len(t, frames, 4)
+		require.Equal(t, []string{"api-3250"}, values(frames[0]))
+		require.Equal(t, []string{"api-1000"}, values(frames[3]))
+
+		pages = nil
+		frames = runStream(t, &PyroscopeDatasource{client: client}, `{"label":"service_name"}`)
+		require.Equal(t, [][2]int64{{0, 0}}, pages, "the whole retention is a single page")
+		require.Len(t, frames, 1)
+	})
+
+	t.Run("values are sent in batches without duplicates", func(t *testing.T) {
+		client := &FakeClient{PagedValues: func(start, end int64) []string {
+			if end == 4000 {
+				return []string{"api-1", "api-2", "api-3"}
+			}
+			return []string{"api-2", "api-4"}
+		}}
+		frames := runStream(t, &PyroscopeDatasource{client: client}, `{"label":"service_name","start":2000,"end":4000,"batchSize":2}`)
+		require.Len(t, frames, 3)
+		require.Equal(t, []string{"api-1", "api-2"}, values(frames[0]))
+		require.Equal(t, []string{"api-3"}, values(frames[1]))
+		require.Equal(t, []string{"api-4"}, values(frames[2]))
+		for _, frame := range frames {
+			require.Nil(t, frame.Meta)
+		}
+	})
+
+	t.Run("values are capped", func(t *testing.T) {
+		client := &FakeClient{Values: []string{"a", "b", "c", "d", "e"}}
+		frames := runStream(t, &PyroscopeDatasource{client: client, maxLabelValues: 3}, `{"label":"service_name","batchSize":2}`)
+		require.Len(t, frames, 3)
+		require.Equal(t, []string{"a", "b"}, values(frames[0]))
+		require.Equal(t, []string{"c"}, values(frames[1]))
+		require.Equal(t, 0, frames[2].Rows())
+		require.Equal(t, []data.Notice{{
+			Severity: data.NoticeSeverityWarning,
+			Text:     "The label has more values than the maximum of 3, refine the prefix to see the others",
+		}}, frames[2].Meta.Notices)
+	})
+
+	t.Run("no values", func(t *testing.T) {
+		frames := runStream(t, &PyroscopeDatasource{client: &FakeClient{}}, `{"label":"service_name"}`)
+		require.Len(t, frames, 1)
+		require.Equal(t, 0, frames[0].Rows())
+	})
+
+	t.Run("fails on an invalid query", func(t *testing.T) {
+		ds := &PyroscopeDatasource{client: &FakeClient{}}
+		err := ds.RunStream(context.Background(), &backend.RunStreamRequest{Path: labelValuesPath(`{}`), Data: []byte(`{}`)}, backend.NewStreamSender(&fakePacketSender{}))
+		require.EqualError(t, err, "label values stream query has no label")
+	})
+}
+
+func Test_resourceBodyLimit(t *testing.T) {
+	callValidateSelector := func(t *testing.T, ds *PyroscopeDatasource, body []byte) *backend.CallResourceResponse {
+		t.Helper()
+		sender := &FakeSender{}
+		err := ds.CallResource(context.Background(), &backend.CallResourceRequest{
+			Path:   "validateSelector",
+			Method: "POST",
+			URL:    "validateSelector",
+			Body:   body,
+		}, sender)
+		require.NoError(t, err)
+		return sender.Resp
+	}
+
+	t.Run("oversized body is rejected", func(t *testing.T) {
+		resp := callValidateSelector(t, &PyroscopeDatasource{client: &FakeClient{}, maxResourceBodyBytes: 64}, []byte(strings.Repeat("a", 65)))
+		require.Equal(t, http.StatusRequestEntityTooLarge, resp.Status)
+		require.Equal(t, `{"error":"request body exceeds the maximum size of 64 bytes"}`, string(resp.Body))
+	})
+
+	t.Run("body within the limit is processed", func(t *testing.T) {
+		resp := callValidateSelector(t, &PyroscopeDatasource{client: &FakeClient{}, maxResourceBodyBytes: 64}, []byte(strings.Repeat("a", 64)))
+		require.Equal(t, http.StatusOK, resp.Status)
+	})
+
+	t.Run("default maximum", func(t *testing.T) {
+		require.Equal(t, int64(defaultMaxResourceBodyBytes), resourceBodyLimit(0))
+		require.Equal(t, int64(64), resourceBodyLimit(64))
+	})
+}
+
+func Test_resourceClientErrors(t *testing.T) {
+	status := http.StatusUnauthorized
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	ds := &PyroscopeDatasource{client: NewPyroscopeClient(server.Client(), server.URL)}
+
+	call := func(t *testing.T, path string, query string) *backend.CallResourceResponse {
+		sender := &FakeSender{}
+		err := ds.CallResource(context.Background(), &backend.CallResourceRequest{
+			Path:   path,
+			Method: "GET",
+			URL:    path + "?" + query,
+		}, sender)
+		require.NoError(t, err)
+		return sender.Resp
+	}
+
+	t.Run("upstream status is kept", func(t *testing.T) {
+		status = http.StatusUnauthorized
+		for path, query := range map[string]string{"profileTypes": "", "labelNames": "", "labelValues": "label=app", "sampleTypes": "profileTypeId=process_cpu:cpu:nanoseconds:cpu:nanoseconds", "profileStats": "profileTypeId=process_cpu:cpu:nanoseconds:cpu:nanoseconds"} {
+			resp := call(t, path, query)
+			require.Equal(t, http.StatusUnauthorized, resp.Status, path)
+
+			var body map[string]string
+			require.NoError(t, json.Unmarshal(resp.Body, &body))
+			require.Equal(t, "error", body["status"])
+			require.Contains(t, body["error"], "unauthenticated", path)
+		}
+	})
+
+	t.Run("errors without an upstream status are internal errors", func(t *testing.T) {
+		status = http.StatusInternalServerError
+		resp := call(t, "profileTypes", "")
+		require.Equal(t, http.StatusInternalServerError, resp.Status)
+		require.Contains(t, string(resp.Body), `"status":"error"`)
+	})
 }
 
 type FakeSender struct {
@@ -62,3 +844,42 @@ func (fs *FakeSender) Send(resp *backend.CallResourceResponse) error {
 	fs.Resp = resp
 	return nil
 }
+
+func Test_profileTypeAliases(t *testing.T) {
+	instance, err := NewPyroscopeDatasource(context.Background(), httpclient.NewProvider(), backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"profileTypeAliases":{"type:1":"CPU time","type:3":"Unused"}}`),
+	}, nil)
+	require.NoError(t, err)
+	ds := instance.(*PyroscopeDatasource)
+	require.Equal(t, map[string]string{"type:1": "CPU time", "type:3": "Unused"}, ds.profileTypeAliases)
+	client := &FakeClient{}
+	ds.client = client
+
+	t.Run("aliases are the labels of the profile types, the others pass through", func(t *testing.T) {
+		sender := &FakeSender{}
+		err := ds.CallResource(context.Background(), &backend.CallResourceRequest{Path: "profileTypes", Method: "GET", URL: "profileTypes"}, sender)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, sender.Resp.Status)
+		require.JSONEq(t, `[{"id":"type:1","label":"CPU time"},{"id":"type:2","label":"memory"}]`, string(sender.Resp.Body))
+
+		types, err := ds.cachedProfileTypes(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "cpu", types[0].Label, "the cached profile types keep their labels")
+	})
+
+	t.Run("series frames are named after the alias of the profile type", func(t *testing.T) {
+		pCtx := backend.PluginContext{DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{JSONData: []byte(`{}`)}}
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeMetrics
+
+		dataQuery.JSON = []byte(`{"profileTypeId":"type:1","labelSelector":"{app=\"foo\"}"}`)
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.NoError(t, resp.Error)
+		require.Equal(t, "CPU time", resp.Frames[0].Fields[1].Name)
+
+		dataQuery.JSON = []byte(`{"profileTypeId":"type:2","labelSelector":"{app=\"foo\"}"}`)
+		resp = ds.query(context.Background(), pCtx, *dataQuery)
+		require.NoError(t, resp.Error)
+		require.Equal(t, "test", resp.Frames[0].Fields[1].Name)
+	})
+}
@@ -0,0 +1,57 @@
+package pyroscope
+
+import (
+	"context"
+
+	"github.com/bufbuild/connect-go"
+)
+
+// defaultMaxConcurrentFetches is the number of calls to Pyroscope the queries of a request may have in flight when no
+// maximum is configured.
+const defaultMaxConcurrentFetches = 10
+
+// fetchLimiter bounds the calls to Pyroscope in flight, it holds a token for every call.
+type fetchLimiter chan struct{}
+
+type fetchLimiterKey struct{}
+
+// withFetchLimiter returns a context whose calls to Pyroscope share a limit of maxConcurrent calls in flight. The
+// context is returned as is when maxConcurrent is not positive.
+func withFetchLimiter(ctx context.Context, maxConcurrent int) context.Context {
+	if maxConcurrent <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, fetchLimiterKey{}, make(fetchLimiter, maxConcurrent))
+}
+
+// acquire waits for a free slot of the limiter, it returns the error of the context if it is done first.
+func (l fetchLimiter) acquire(ctx context.Context) error {
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l fetchLimiter) release() {
+	<-l
+}
+
+// withFetchLimit makes the calls wait for a free slot of the fetch limiter of their context. The calls of the
+// contexts without one are not limited.
+func withFetchLimit() connect.ClientOption {
+	return connect.WithInterceptors(connect.UnaryInterceptorFunc(func(next connect.UnaryFunc) connect.UnaryFunc {
+		return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+			limiter, ok := ctx.Value(fetchLimiterKey{}).(fetchLimiter)
+			if !ok {
+				return next(ctx, req)
+			}
+			if err := limiter.acquire(ctx); err != nil {
+				return nil, err
+			}
+			defer limiter.release()
+			return next(ctx, req)
+		}
+	}))
+}
@@ -0,0 +1,80 @@
+package pyroscope
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	querierv1 "github.com/grafana/pyroscope/api/gen/proto/go/querier/v1"
+	"github.com/grafana/pyroscope/api/gen/proto/go/querier/v1/querierv1connect"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func Test_QueryDataFetchLimit(t *testing.T) {
+	var inFlight, maxInFlight, calls atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, querierv1connect.QuerierServiceDiffProcedure, r.URL.Path)
+		calls.Add(1)
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			max := maxInFlight.Load()
+			if current <= max || maxInFlight.CompareAndSwap(max, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		body, err := proto.Marshal(&querierv1.DiffResponse{})
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/proto")
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	ds := &PyroscopeDatasource{
+		client:               NewPyroscopeClient(server.Client(), server.URL, withFetchLimit()),
+		maxConcurrentFetches: 2,
+	}
+	var queries []backend.DataQuery
+	for i := 0; i < 6; i++ {
+		queries = append(queries, backend.DataQuery{
+			RefID:     fmt.Sprintf("A%d", i),
+			QueryType: queryTypeDiff,
+			JSON:      []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes"}`),
+			TimeRange: backend.TimeRange{From: time.UnixMilli(10000), To: time.UnixMilli(20000)},
+		})
+	}
+
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{Queries: queries})
+	require.NoError(t, err)
+	require.Len(t, resp.Responses, len(queries))
+	for _, q := range queries {
+		require.NoError(t, resp.Responses[q.RefID].Error)
+	}
+	require.Equal(t, int64(len(queries)), calls.Load())
+	require.LessOrEqual(t, maxInFlight.Load(), int64(2))
+}
+
+func Test_withFetchLimit(t *testing.T) {
+	t.Run("calls without a limiter are not limited", func(t *testing.T) {
+		require.Equal(t, context.Background(), withFetchLimiter(context.Background(), 0))
+	})
+
+	t.Run("stops waiting when the context is done", func(t *testing.T) {
+		ctx := withFetchLimiter(context.Background(), 1)
+		limiter := ctx.Value(fetchLimiterKey{}).(fetchLimiter)
+		require.NoError(t, limiter.acquire(ctx))
+
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		require.ErrorIs(t, limiter.acquire(ctx), context.Canceled)
+		limiter.release()
+	})
+}
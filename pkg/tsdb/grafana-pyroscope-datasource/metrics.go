@@ -0,0 +1,78 @@
+package pyroscope
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	queryStatusOK    = "ok"
+	queryStatusError = "error"
+	// otherProfileType is the profile_type label of the queries of the profile types not in metricProfileTypes.
+	otherProfileType = "other"
+)
+
+// metricProfileTypes are the profile types the Pyroscope SDKs and agents send, the profile_type label of the
+// metrics only has these so the profile type IDs of the queries, which the users can set to anything, can't grow
+// the number of series.
+var metricProfileTypes = map[string]bool{
+	"process_cpu:cpu:nanoseconds:cpu:nanoseconds":        true,
+	"process_cpu:samples:count:cpu:milliseconds":         true,
+	"memory:alloc_objects:count:space:bytes":             true,
+	"memory:alloc_space:bytes:space:bytes":               true,
+	"memory:inuse_objects:count:space:bytes":             true,
+	"memory:inuse_space:bytes:space:bytes":               true,
+	"goroutine:goroutine:count:goroutine:count":          true,
+	"goroutines:goroutine:count:goroutine:count":         true,
+	"block:contentions:count:contentions:count":          true,
+	"block:delay:nanoseconds:contentions:count":          true,
+	"mutex:contentions:count:contentions:count":          true,
+	"mutex:delay:nanoseconds:contentions:count":          true,
+	"wall:wall:nanoseconds:wall:nanoseconds":             true,
+	"memory:alloc_in_new_tlab_objects:count:space:bytes": true,
+	"memory:alloc_in_new_tlab_bytes:bytes:space:bytes":   true,
+	"lock:contentions:count:contentions:count":           true,
+	"lock:delay:nanoseconds:contentions:count":           true,
+}
+
+// The metrics are Prometheus metrics registered with promauto rather than OpenTelemetry instruments, as the other
+// datasources of Grafana record their query metrics, so they are exposed on the /metrics endpoint of Grafana with them.
+var (
+	pluginQueriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana",
+		Name:      "pyroscope_plugin_queries_total",
+		Help:      "Number of Pyroscope queries by query type, profile type and status",
+	}, []string{"query_type", "profile_type", "status"})
+
+	pluginQueryDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "grafana",
+		Name:      "pyroscope_plugin_query_duration_seconds",
+		Help:      "Duration of Pyroscope queries in seconds",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"query_type", "profile_type", "status"})
+)
+
+// observeQuery records the count and the duration of a query in the metrics Grafana exposes for scraping.
+func observeQuery(ctx context.Context, queryType string, profileTypeID string, err error, duration time.Duration) {
+	status := queryStatusOK
+	if err != nil {
+		status = queryStatusError
+	}
+
+	profileType := otherProfileType
+	if metricProfileTypes[profileTypeID] {
+		profileType = profileTypeID
+	}
+
+	pluginQueriesTotal.WithLabelValues(queryType, profileType, status).Inc()
+	histogram := pluginQueryDurationSeconds.WithLabelValues(queryType, profileType, status)
+	if traceID := tracing.TraceIDFromContext(ctx, true); traceID != "" {
+		histogram.(prometheus.ExemplarObserver).ObserveWithExemplar(duration.Seconds(), prometheus.Labels{"traceID": traceID})
+	} else {
+		histogram.Observe(duration.Seconds())
+	}
+}
@@ -0,0 +1,78 @@
+package pyroscope
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_queryMetrics(t *testing.T) {
+	const profileTypeID = "memory:alloc_objects:count:space:bytes"
+	pCtx := backend.PluginContext{
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			JSONData: []byte(`{}`),
+		},
+	}
+	durationCount := func(t *testing.T, status string) uint64 {
+		t.Helper()
+		return profileTypeDurationCount(t, profileTypeID, status)
+	}
+
+	t.Run("successful queries", func(t *testing.T) {
+		counter := pluginQueriesTotal.WithLabelValues(queryTypeProfile, profileTypeID, queryStatusOK)
+		before, beforeDuration := testutil.ToFloat64(counter), durationCount(t, queryStatusOK)
+
+		ds := &PyroscopeDatasource{client: &FakeClient{}}
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeProfile
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+
+		require.Equal(t, before+1, testutil.ToFloat64(counter))
+		require.Equal(t, beforeDuration+1, durationCount(t, queryStatusOK))
+	})
+
+	t.Run("failed queries", func(t *testing.T) {
+		counter := pluginQueriesTotal.WithLabelValues(queryTypeProfile, profileTypeID, queryStatusError)
+		before, beforeDuration := testutil.ToFloat64(counter), durationCount(t, queryStatusError)
+
+		ds := &PyroscopeDatasource{client: &FakeClient{}}
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeProfile
+		dataQuery.JSON = []byte(`{"profileTypeId":"` + profileTypeID + `","valueType":"int8"}`)
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.Error(t, resp.Error)
+
+		require.Equal(t, before+1, testutil.ToFloat64(counter))
+		require.Equal(t, beforeDuration+1, durationCount(t, queryStatusError))
+	})
+
+	t.Run("unknown profile types are counted as other", func(t *testing.T) {
+		counter := pluginQueriesTotal.WithLabelValues(queryTypeProfile, otherProfileType, queryStatusOK)
+		before, beforeDuration := testutil.ToFloat64(counter), profileTypeDurationCount(t, otherProfileType, queryStatusOK)
+
+		ds := &PyroscopeDatasource{client: &FakeClient{}}
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeProfile
+		dataQuery.JSON = []byte(`{"profileTypeId":"custom:made_up:count:space:bytes"}`)
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+
+		require.Equal(t, before+1, testutil.ToFloat64(counter))
+		require.Equal(t, beforeDuration+1, profileTypeDurationCount(t, otherProfileType, queryStatusOK))
+		require.Zero(t, testutil.ToFloat64(pluginQueriesTotal.WithLabelValues(queryTypeProfile, "custom:made_up:count:space:bytes", queryStatusOK)))
+	})
+}
+
+func profileTypeDurationCount(t *testing.T, profileType, status string) uint64 {
+	t.Helper()
+	m := &dto.Metric{}
+	observer := pluginQueryDurationSeconds.WithLabelValues(queryTypeProfile, profileType, status)
+	require.NoError(t, observer.(prometheus.Metric).Write(m))
+	return m.GetHistogram().GetSampleCount()
+}
@@ -0,0 +1,234 @@
+package pyroscope
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strings"
+
+	googlev1 "github.com/grafana/pyroscope/api/gen/proto/go/google/v1"
+	querierv1 "github.com/grafana/pyroscope/api/gen/proto/go/querier/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// pprofContentType is the content type of the SelectMergeStacktraces responses carrying a pprof profile instead of
+// a flamegraph, as some Pyroscope compatible backends answer.
+const pprofContentType = "application/vnd.google.protobuf"
+
+// rawResponse is the undecoded body of a response, decoded by the caller according to its content type.
+type rawResponse struct {
+	body []byte
+}
+
+// rawCodec is the proto codec of the client of GetProfile. It marshals the requests as the default codec does but
+// keeps the bodies of the responses undecoded.
+type rawCodec struct{}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+func (rawCodec) Marshal(msg any) ([]byte, error) {
+	m, ok := msg.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto message", msg)
+	}
+	return proto.Marshal(m)
+}
+
+func (rawCodec) Unmarshal(data []byte, msg any) error {
+	switch m := msg.(type) {
+	case *rawResponse:
+		// connect reuses the buffer of the body once the call returns.
+		m.body = append([]byte(nil), data...)
+		return nil
+	case proto.Message:
+		return proto.Unmarshal(data, m)
+	default:
+		return fmt.Errorf("%T is not a proto message", msg)
+	}
+}
+
+// isPprofContentType returns whether the content type is the one of pprof profiles.
+func isPprofContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == pprofContentType
+}
+
+// decodeFlamegraph decodes the body of a SelectMergeStacktraces response, a pprof profile flattened into a flamegraph
+// of the values of the profile type when the content type is pprofContentType, a SelectMergeStacktracesResponse
+// otherwise.
+func decodeFlamegraph(contentType string, body []byte, profileTypeID string) (*querierv1.FlameGraph, error) {
+	if !isPprofContentType(contentType) {
+		var resp querierv1.SelectMergeStacktracesResponse
+		if err := proto.Unmarshal(body, &resp); err != nil {
+			return nil, fmt.Errorf("failed to decode the profile: %w", err)
+		}
+		return resp.Flamegraph, nil
+	}
+	profile, err := decodePprof(body)
+	if err != nil {
+		return nil, err
+	}
+	return pprofToFlamegraph(profile, profileTypeID), nil
+}
+
+// decodePprof decodes a pprof profile, which is gzip compressed when written by the Go tooling.
+func decodePprof(body []byte) (*googlev1.Profile, error) {
+	if len(body) > 1 && body[0] == 0x1f && body[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress the pprof profile: %w", err)
+		}
+		body, err = io.ReadAll(gz)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress the pprof profile: %w", err)
+		}
+	}
+	var profile googlev1.Profile
+	if err := proto.Unmarshal(body, &profile); err != nil {
+		return nil, fmt.Errorf("failed to decode the pprof profile: %w", err)
+	}
+	return &profile, nil
+}
+
+// pprofNode is a frame of the call tree of a pprof profile.
+type pprofNode struct {
+	name     string
+	total    int64
+	self     int64
+	children map[string]*pprofNode
+}
+
+func (n *pprofNode) child(name string) *pprofNode {
+	if n.children == nil {
+		n.children = map[string]*pprofNode{}
+	}
+	c, ok := n.children[name]
+	if !ok {
+		c = &pprofNode{name: name}
+		n.children[name] = c
+	}
+	return c
+}
+
+// sortedChildren returns the children of the node sorted by name, the order of the frames in Pyroscope flamegraphs.
+func (n *pprofNode) sortedChildren() []*pprofNode {
+	children := make([]*pprofNode, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].name < children[j].name })
+	return children
+}
+
+// pprofToFlamegraph merges the stacks of the samples of the profile into a flamegraph with the layout of the ones
+// SelectMergeStacktraces returns. The values are the ones of the sample type of the profile type, or of the first
+// sample type when the profile doesn't have it. It returns nil when the profile has no values.
+func pprofToFlamegraph(profile *googlev1.Profile, profileTypeID string) *querierv1.FlameGraph {
+	valueIndex := pprofValueIndex(profile, profileTypeID)
+	functions := make(map[uint64]string, len(profile.Function))
+	for _, f := range profile.Function {
+		functions[f.Id] = pprofString(profile, f.Name)
+	}
+	// The frames of the locations from the caller to the callee, inlined functions are on the same location.
+	locations := make(map[uint64][]string, len(profile.Location))
+	for _, l := range profile.Location {
+		if len(l.Line) == 0 {
+			locations[l.Id] = []string{fmt.Sprintf("0x%x", l.Address)}
+			continue
+		}
+		frames := make([]string, 0, len(l.Line))
+		for i := len(l.Line) - 1; i >= 0; i-- {
+			frames = append(frames, functions[l.Line[i].FunctionId])
+		}
+		locations[l.Id] = frames
+	}
+
+	root := &pprofNode{name: "total"}
+	for _, s := range profile.Sample {
+		if valueIndex >= len(s.Value) || s.Value[valueIndex] == 0 {
+			continue
+		}
+		value := s.Value[valueIndex]
+		node := root
+		node.total += value
+		// The locations of the samples are from the callee to the caller.
+		for i := len(s.LocationId) - 1; i >= 0; i-- {
+			for _, frame := range locations[s.LocationId[i]] {
+				node = node.child(frame)
+				node.total += value
+			}
+		}
+		node.self += value
+	}
+	if root.total == 0 {
+		return nil
+	}
+	return treeToFlamegraph(root)
+}
+
+// pprofValueIndex returns the index of the values of the sample type of the profile type in the samples.
+func pprofValueIndex(profile *googlev1.Profile, profileTypeID string) int {
+	parts := strings.Split(profileTypeID, ":")
+	if len(parts) < 2 {
+		return 0
+	}
+	for i, t := range profile.SampleType {
+		if pprofString(profile, t.Type) == parts[1] {
+			return i
+		}
+	}
+	return 0
+}
+
+func pprofString(profile *googlev1.Profile, index int64) string {
+	if index < 0 || index >= int64(len(profile.StringTable)) {
+		return ""
+	}
+	return profile.StringTable[index]
+}
+
+// treeToFlamegraph lays the tree out in flamegraph levels. Every node is 4 values: its offset from the end of the
+// previous node of the level, its total, its self and the index of its name.
+func treeToFlamegraph(root *pprofNode) *querierv1.FlameGraph {
+	type levelNode struct {
+		node *pprofNode
+		// start is the absolute offset of the node.
+		start int64
+	}
+
+	flamegraph := &querierv1.FlameGraph{Total: root.total}
+	nameIndex := map[string]int64{}
+	current := []levelNode{{node: root}}
+	for len(current) > 0 {
+		var next []levelNode
+		values := make([]int64, 0, 4*len(current))
+		end := int64(0)
+		for _, n := range current {
+			index, ok := nameIndex[n.node.name]
+			if !ok {
+				index = int64(len(flamegraph.Names))
+				nameIndex[n.node.name] = index
+				flamegraph.Names = append(flamegraph.Names, n.node.name)
+			}
+			values = append(values, n.start-end, n.node.total, n.node.self, index)
+			end = n.start + n.node.total
+			if n.node.self > flamegraph.MaxSelf {
+				flamegraph.MaxSelf = n.node.self
+			}
+
+			start := n.start
+			for _, c := range n.node.sortedChildren() {
+				next = append(next, levelNode{node: c, start: start})
+				start += c.total
+			}
+		}
+		flamegraph.Levels = append(flamegraph.Levels, &querierv1.Level{Values: values})
+		current = next
+	}
+	return flamegraph
+}
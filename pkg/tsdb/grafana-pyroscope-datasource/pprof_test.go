@@ -0,0 +1,115 @@
+package pyroscope
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	googlev1 "github.com/grafana/pyroscope/api/gen/proto/go/google/v1"
+	querierv1 "github.com/grafana/pyroscope/api/gen/proto/go/querier/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func Test_PyroscopeClient_pprofProfile(t *testing.T) {
+	const profileTypeID = "process_cpu:cpu:nanoseconds:cpu:nanoseconds"
+
+	pprofBody, err := os.ReadFile(filepath.Join("testdata", "profile_response.pb.gz"))
+	require.NoError(t, err)
+	jsonBody, err := os.ReadFile(filepath.Join("testdata", "profile_response.json"))
+	require.NoError(t, err)
+	var profile googlev1.Profile
+	require.NoError(t, protojson.Unmarshal(jsonBody, &profile))
+	flamegraphBody, err := proto.Marshal(&querierv1.SelectMergeStacktracesResponse{Flamegraph: pprofToFlamegraph(&profile, profileTypeID)})
+	require.NoError(t, err)
+
+	getProfile := func(t *testing.T, contentType string, body []byte) *ProfileResponse {
+		t.Helper()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			_, _ = w.Write(body)
+		}))
+		t.Cleanup(server.Close)
+		resp, err := NewPyroscopeClient(server.Client(), server.URL).GetProfile(context.Background(), profileTypeID, "{}", 0, 100, nil, symbolizationSymbolized)
+		require.NoError(t, err)
+		return resp
+	}
+
+	fromPprof := getProfile(t, pprofContentType, pprofBody)
+	fromFlamegraph := getProfile(t, "application/proto", flamegraphBody)
+	require.Equal(t, fromFlamegraph, fromPprof)
+
+	tree := levelsToTree(fromPprof.Flamebearer.Levels, fromPprof.Flamebearer.Names)
+	require.Equal(t, "total", tree.Name)
+	require.Equal(t, int64(660000000), tree.Value)
+	require.Equal(t, levelsToTree(fromFlamegraph.Flamebearer.Levels, fromFlamegraph.Flamebearer.Names), tree)
+
+	t.Run("content type parameters are ignored", func(t *testing.T) {
+		require.Equal(t, fromPprof, getProfile(t, pprofContentType+"; charset=binary", pprofBody))
+	})
+
+	t.Run("corrupt pprof profile", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", pprofContentType)
+			_, _ = w.Write(pprofBody[:len(pprofBody)/2])
+		}))
+		t.Cleanup(server.Close)
+		_, err := NewPyroscopeClient(server.Client(), server.URL).GetProfile(context.Background(), profileTypeID, "{}", 0, 100, nil, symbolizationSymbolized)
+		require.ErrorContains(t, err, "pprof profile")
+	})
+}
+
+func Test_pprofToFlamegraph(t *testing.T) {
+	profile := &googlev1.Profile{
+		StringTable: []string{"", "samples", "count", "cpu", "nanoseconds", "main", "foo", "bar", "baz"},
+		SampleType:  []*googlev1.ValueType{{Type: 1, Unit: 2}, {Type: 3, Unit: 4}},
+		Function:    []*googlev1.Function{{Id: 1, Name: 5}, {Id: 2, Name: 6}, {Id: 3, Name: 7}, {Id: 4, Name: 8}},
+		Location: []*googlev1.Location{
+			{Id: 1, Line: []*googlev1.Line{{FunctionId: 1}}},
+			{Id: 2, Line: []*googlev1.Line{{FunctionId: 2}}},
+			{Id: 3, Line: []*googlev1.Line{{FunctionId: 3}}},
+			// baz inlined in bar
+			{Id: 4, Line: []*googlev1.Line{{FunctionId: 4}, {FunctionId: 3}}},
+			// unsymbolized
+			{Id: 5, Address: 0x1234},
+		},
+		Sample: []*googlev1.Sample{
+			{LocationId: []uint64{2, 1}, Value: []int64{1, 10}},
+			{LocationId: []uint64{3, 1}, Value: []int64{2, 20}},
+			{LocationId: []uint64{4, 2, 1}, Value: []int64{3, 30}},
+			{LocationId: []uint64{2, 1}, Value: []int64{1, 10}},
+			{LocationId: []uint64{5, 1}, Value: []int64{1, 0}},
+		},
+	}
+
+	t.Run("values of the sample type of the profile type", func(t *testing.T) {
+		flamegraph := pprofToFlamegraph(profile, "process_cpu:cpu:nanoseconds:cpu:nanoseconds")
+		require.Equal(t, &querierv1.FlameGraph{
+			Names: []string{"total", "main", "bar", "foo", "baz"},
+			Levels: []*querierv1.Level{
+				{Values: []int64{0, 70, 0, 0}},
+				{Values: []int64{0, 70, 0, 1}},
+				{Values: []int64{0, 20, 20, 2, 0, 50, 20, 3}},
+				{Values: []int64{20, 30, 0, 2}},
+				{Values: []int64{20, 30, 30, 4}},
+			},
+			Total:   70,
+			MaxSelf: 30,
+		}, flamegraph)
+	})
+
+	t.Run("first sample type without the one of the profile type", func(t *testing.T) {
+		flamegraph := pprofToFlamegraph(profile, "memory:alloc_objects:count:space:bytes")
+		require.Equal(t, int64(8), flamegraph.Total)
+		require.Equal(t, []string{"total", "main", "0x1234", "bar", "foo", "baz"}, flamegraph.Names)
+		require.Equal(t, []int64{0, 1, 1, 2, 0, 2, 2, 3, 0, 5, 2, 4}, flamegraph.Levels[2].Values)
+	})
+
+	t.Run("no values", func(t *testing.T) {
+		require.Nil(t, pprofToFlamegraph(&googlev1.Profile{}, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"))
+	})
+}
@@ -2,8 +2,13 @@ package pyroscope
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
@@ -12,14 +17,23 @@ import (
 	"github.com/bufbuild/connect-go"
 	querierv1 "github.com/grafana/pyroscope/api/gen/proto/go/querier/v1"
 	"github.com/grafana/pyroscope/api/gen/proto/go/querier/v1/querierv1connect"
+	statusv1 "github.com/grafana/pyroscope/api/gen/proto/go/status/v1"
+	"github.com/grafana/pyroscope/api/gen/proto/go/status/v1/statusv1connect"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 type ProfileType struct {
 	ID    string `json:"id"`
 	Label string `json:"label"`
+	// PeriodType and PeriodUnit describe the sampling period of the profile, for example cpu and nanoseconds. Empty
+	// when the backend does not provide them.
+	PeriodType string `json:"periodType,omitempty"`
+	PeriodUnit string `json:"periodUnit,omitempty"`
 }
 
 type Flamebearer struct {
@@ -54,32 +68,178 @@ type ProfileResponse struct {
 	Units       string
 }
 
+// ProfileDiffResponse is the difference between two profiles. The levels of the flamebearer have the values of both
+// profiles for every node, see diffLevelsToTree.
+type ProfileDiffResponse struct {
+	Flamebearer *FlamebearerDiff
+	Units       string
+}
+
+type FlamebearerDiff struct {
+	Names      []string
+	Levels     []*Level
+	Total      int64
+	MaxSelf    int64
+	LeftTicks  int64
+	RightTicks int64
+}
+
+// ProfileStats describes how much data a query of a profile type would read, so heavy queries can be spotted before
+// they are run.
+type ProfileStats struct {
+	// NonEmptyPoints is the number of points with samples of the matching series at the step of profileStatsStep, a
+	// coarse measure of how much profiling data the time range has.
+	NonEmptyPoints int64 `json:"nonEmptyPoints"`
+	SeriesCount    int64 `json:"seriesCount"`
+	// MinTimestamp and MaxTimestamp are the milliseconds unix timestamps of the oldest and newest samples, 0 when
+	// there are none.
+	MinTimestamp int64 `json:"minTimestamp"`
+	MaxTimestamp int64 `json:"maxTimestamp"`
+}
+
 type SeriesResponse struct {
 	Series []*Series
 	Units  string
 	Label  string
 }
 
+const compressionGzip = "gzip"
+
+// labelValuesStartField and labelValuesEndField are the field numbers of the start and end of the LabelValuesRequest
+// in the Pyroscope API versions that support them, the vendored API types predate them.
+const (
+	labelValuesStartField protowire.Number = 3
+	labelValuesEndField   protowire.Number = 4
+)
+
+// seriesStartField and seriesEndField are the field numbers of the start and end of the SeriesRequest in the
+// Pyroscope API versions that support them.
+const (
+	seriesStartField protowire.Number = 3
+	seriesEndField   protowire.Number = 4
+)
+
+const (
+	// profileStatsPoints is the maximum number of points GetProfileStats fetches, the stats are only an estimate of
+	// the data of the time range so they don't need a fine step.
+	profileStatsPoints = 100
+	// minProfileStatsStep is the smallest step in seconds of GetProfileStats, the default scrape interval of the
+	// Pyroscope agents, as there are no more points to count below it.
+	minProfileStatsStep = 15
+)
+
+// profileStatsStep returns the step in seconds GetProfileStats counts the points of the time range at, start and end
+// are in milliseconds. The step splits the range in at most profileStatsPoints points.
+func profileStatsStep(start, end int64) float64 {
+	return math.Max(float64(end-start)/1000/profileStatsPoints, minProfileStatsStep)
+}
+
+// ClientError is the error of a call to the Pyroscope API, with the HTTP status Pyroscope answered with.
+type ClientError struct {
+	// Status is the HTTP status of the error, 0 when the error has no status, like connection errors.
+	Status int
+	Err    error
+}
+
+func (e *ClientError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ClientError) Unwrap() error {
+	return e.Err
+}
+
+// newClientError wraps the error of a call in a ClientError with the status of its code. The requests that failed
+// before Pyroscope answered, like connection errors, have no status even though connect reports them as unavailable.
+func newClientError(err error) error {
+	if isConnectionError(err) {
+		return &ClientError{Err: err}
+	}
+	return &ClientError{Status: httpStatus(connect.CodeOf(err)), Err: err}
+}
+
+// spanError marks the span of a failed call as an error, with the HTTP status of the error when it has one, and
+// returns the error.
+func spanError(span trace.Span, err error) error {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	var clientErr *ClientError
+	if errors.As(err, &clientErr) && clientErr.Status != 0 {
+		span.SetAttributes(attribute.Int("http.status_code", clientErr.Status))
+	}
+	return err
+}
+
+// recordResponse sets the HTTP status and the size in bytes of the response of a successful call on its span.
+func recordResponse(span trace.Span, size int) {
+	span.SetAttributes(attribute.Int("http.status_code", http.StatusOK), attribute.Int("http.response_content_length", size))
+}
+
+// isConnectionError returns whether the error is of a request that could not be sent or was not answered.
+func isConnectionError(err error) bool {
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// httpStatus returns the HTTP status of the connect codes the HTTP responses are reported with, 0 for the other codes.
+func httpStatus(code connect.Code) int {
+	switch code {
+	case connect.CodeInvalidArgument:
+		return http.StatusBadRequest
+	case connect.CodeUnauthenticated:
+		return http.StatusUnauthorized
+	case connect.CodePermissionDenied:
+		return http.StatusForbidden
+	case connect.CodeNotFound, connect.CodeUnimplemented:
+		return http.StatusNotFound
+	case connect.CodeResourceExhausted:
+		return http.StatusTooManyRequests
+	case connect.CodeUnavailable:
+		return http.StatusServiceUnavailable
+	case connect.CodeDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return 0
+	}
+}
+
 type PyroscopeClient struct {
 	connectClient querierv1connect.QuerierServiceClient
+	statusClient  statusv1connect.StatusServiceClient
+	// profileClient calls SelectMergeStacktraces keeping the responses undecoded, so the ones with a pprof profile
+	// can be told from their content type. GetProfile uses connectClient when it is nil.
+	profileClient *connect.Client[querierv1.SelectMergeStacktracesRequest, rawResponse]
 }
 
-func NewPyroscopeClient(httpClient *http.Client, url string) *PyroscopeClient {
+// NewPyroscopeClient creates a client for the Pyroscope API at the url. Responses are requested gzip compressed and
+// decompressed transparently unless withoutCompression is passed.
+func NewPyroscopeClient(httpClient *http.Client, url string, opts ...connect.ClientOption) *PyroscopeClient {
 	return &PyroscopeClient{
-		connectClient: querierv1connect.NewQuerierServiceClient(httpClient, url),
+		connectClient: querierv1connect.NewQuerierServiceClient(httpClient, url, opts...),
+		statusClient:  statusv1connect.NewStatusServiceClient(httpClient, url, opts...),
+		profileClient: connect.NewClient[querierv1.SelectMergeStacktracesRequest, rawResponse](
+			httpClient,
+			url+querierv1connect.QuerierServiceSelectMergeStacktracesProcedure,
+			connect.WithClientOptions(opts...),
+			connect.WithCodec(rawCodec{}),
+		),
 	}
 }
 
+// withoutCompression removes the gzip support connect clients have by default.
+func withoutCompression() connect.ClientOption {
+	return connect.WithAcceptCompression(compressionGzip, nil, nil)
+}
+
 func (c *PyroscopeClient) ProfileTypes(ctx context.Context) ([]*ProfileType, error) {
 	ctx, span := tracing.DefaultTracer().Start(ctx, "datasource.pyroscope.ProfileTypes")
 	defer span.End()
 	res, err := c.connectClient.ProfileTypes(ctx, connect.NewRequest(&querierv1.ProfileTypesRequest{}))
 	if err != nil {
 		logger.Error("Received error from client", "error", err, "function", logEntrypoint())
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		return nil, err
+		return nil, spanError(span, newClientError(err))
 	}
+	recordResponse(span, proto.Size(res.Msg))
 	if res.Msg.ProfileTypes == nil {
 		// Let's make sure we send at least empty array if we don't have any types
 		return []*ProfileType{}, nil
@@ -87,8 +247,10 @@ func (c *PyroscopeClient) ProfileTypes(ctx context.Context) ([]*ProfileType, err
 		pTypes := make([]*ProfileType, len(res.Msg.ProfileTypes))
 		for i, pType := range res.Msg.ProfileTypes {
 			pTypes[i] = &ProfileType{
-				ID:    pType.ID,
-				Label: pType.Name + " - " + pType.SampleType,
+				ID:         pType.ID,
+				Label:      pType.Name + " - " + pType.SampleType,
+				PeriodType: pType.PeriodType,
+				PeriodUnit: pType.PeriodUnit,
 			}
 		}
 		return pTypes, nil
@@ -96,7 +258,7 @@ func (c *PyroscopeClient) ProfileTypes(ctx context.Context) ([]*ProfileType, err
 }
 
 func (c *PyroscopeClient) GetSeries(ctx context.Context, profileTypeID string, labelSelector string, start int64, end int64, groupBy []string, step float64) (*SeriesResponse, error) {
-	ctx, span := tracing.DefaultTracer().Start(ctx, "datasource.pyroscope.GetSeries", trace.WithAttributes(attribute.String("profileTypeID", profileTypeID), attribute.String("labelSelector", labelSelector)))
+	ctx, span := tracing.DefaultTracer().Start(ctx, "datasource.pyroscope.GetSeries", trace.WithAttributes(attribute.String("profileTypeID", profileTypeID), attribute.String("labelSelector", labelSelector), attribute.Int64("start", start), attribute.Int64("end", end)))
 	defer span.End()
 	req := connect.NewRequest(&querierv1.SelectSeriesRequest{
 		ProfileTypeID: profileTypeID,
@@ -110,10 +272,9 @@ func (c *PyroscopeClient) GetSeries(ctx context.Context, profileTypeID string, l
 	resp, err := c.connectClient.SelectSeries(ctx, req)
 	if err != nil {
 		logger.Error("Received error from client", "error", err, "function", logEntrypoint())
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		return nil, err
+		return nil, spanError(span, newClientError(err))
 	}
+	recordResponse(span, proto.Size(resp.Msg))
 
 	series := make([]*Series, len(resp.Msg.Series))
 
@@ -149,8 +310,8 @@ func (c *PyroscopeClient) GetSeries(ctx context.Context, profileTypeID string, l
 	}, nil
 }
 
-func (c *PyroscopeClient) GetProfile(ctx context.Context, profileTypeID, labelSelector string, start, end int64, maxNodes *int64) (*ProfileResponse, error) {
-	ctx, span := tracing.DefaultTracer().Start(ctx, "datasource.pyroscope.GetProfile", trace.WithAttributes(attribute.String("profileTypeID", profileTypeID), attribute.String("labelSelector", labelSelector)))
+func (c *PyroscopeClient) GetProfile(ctx context.Context, profileTypeID, labelSelector string, start, end int64, maxNodes *int64, symbolization string) (*ProfileResponse, error) {
+	ctx, span := tracing.DefaultTracer().Start(ctx, "datasource.pyroscope.GetProfile", trace.WithAttributes(attribute.String("profileTypeID", profileTypeID), attribute.String("labelSelector", labelSelector), attribute.Int64("start", start), attribute.Int64("end", end), attribute.String("symbolization", symbolization)))
 	defer span.End()
 	req := &connect.Request[querierv1.SelectMergeStacktracesRequest]{
 		Msg: &querierv1.SelectMergeStacktracesRequest{
@@ -162,21 +323,19 @@ func (c *PyroscopeClient) GetProfile(ctx context.Context, profileTypeID, labelSe
 		},
 	}
 
-	resp, err := c.connectClient.SelectMergeStacktraces(ctx, req)
+	flamegraph, err := c.selectMergeStacktraces(ctx, req)
 	if err != nil {
 		logger.Error("Received error from client", "error", err, "function", logEntrypoint())
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		return nil, err
+		return nil, spanError(span, newClientError(err))
 	}
 
-	if resp.Msg.Flamegraph == nil {
+	if flamegraph == nil {
 		// Not an error, can happen when querying data oout of range.
 		return nil, nil
 	}
 
-	levels := make([]*Level, len(resp.Msg.Flamegraph.Levels))
-	for i, level := range resp.Msg.Flamegraph.Levels {
+	levels := make([]*Level, len(flamegraph.Levels))
+	for i, level := range flamegraph.Levels {
 		levels[i] = &Level{
 			Values: level.Values,
 		}
@@ -184,15 +343,124 @@ func (c *PyroscopeClient) GetProfile(ctx context.Context, profileTypeID, labelSe
 
 	return &ProfileResponse{
 		Flamebearer: &Flamebearer{
-			Names:   resp.Msg.Flamegraph.Names,
+			Names:   frameNames(flamegraph.Names, symbolization),
 			Levels:  levels,
-			Total:   resp.Msg.Flamegraph.Total,
-			MaxSelf: resp.Msg.Flamegraph.MaxSelf,
+			Total:   flamegraph.Total,
+			MaxSelf: flamegraph.MaxSelf,
 		},
 		Units: getUnits(profileTypeID),
 	}, nil
 }
 
+// selectMergeStacktraces returns the flamegraph of the request, which Pyroscope answers either as a flamegraph or,
+// with the pprofContentType content type, as a pprof profile.
+func (c *PyroscopeClient) selectMergeStacktraces(ctx context.Context, req *connect.Request[querierv1.SelectMergeStacktracesRequest]) (*querierv1.FlameGraph, error) {
+	if c.profileClient == nil {
+		resp, err := c.connectClient.SelectMergeStacktraces(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		recordResponse(trace.SpanFromContext(ctx), proto.Size(resp.Msg))
+		return resp.Msg.Flamegraph, nil
+	}
+
+	resp, err := c.profileClient.CallUnary(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	recordResponse(trace.SpanFromContext(ctx), len(resp.Msg.body))
+	flamegraph, err := decodeFlamegraph(resp.Header().Get("Content-Type"), resp.Msg.body, req.Msg.ProfileTypeID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	return flamegraph, nil
+}
+
+// GetProfileDiff returns the difference between the left and the right profiles, selected by their label selectors and
+// time ranges in milliseconds. It returns nil when neither of the profiles has data.
+func (c *PyroscopeClient) GetProfileDiff(ctx context.Context, profileTypeID, leftSelector string, leftStart, leftEnd int64, rightSelector string, rightStart, rightEnd int64, maxNodes *int64) (*ProfileDiffResponse, error) {
+	ctx, span := tracing.DefaultTracer().Start(ctx, "datasource.pyroscope.GetProfileDiff", trace.WithAttributes(attribute.String("profileTypeID", profileTypeID), attribute.String("leftSelector", leftSelector), attribute.Int64("leftStart", leftStart), attribute.Int64("leftEnd", leftEnd), attribute.String("rightSelector", rightSelector), attribute.Int64("rightStart", rightStart), attribute.Int64("rightEnd", rightEnd)))
+	defer span.End()
+	req := connect.NewRequest(&querierv1.DiffRequest{
+		Left: &querierv1.SelectMergeStacktracesRequest{
+			ProfileTypeID: profileTypeID,
+			LabelSelector: leftSelector,
+			Start:         leftStart,
+			End:           leftEnd,
+			MaxNodes:      maxNodes,
+		},
+		Right: &querierv1.SelectMergeStacktracesRequest{
+			ProfileTypeID: profileTypeID,
+			LabelSelector: rightSelector,
+			Start:         rightStart,
+			End:           rightEnd,
+			MaxNodes:      maxNodes,
+		},
+	})
+
+	resp, err := c.connectClient.Diff(ctx, req)
+	if err != nil {
+		logger.Error("Received error from client", "error", err, "function", logEntrypoint())
+		return nil, spanError(span, newClientError(err))
+	}
+	recordResponse(span, proto.Size(resp.Msg))
+
+	flamegraph := resp.Msg.Flamegraph
+	if flamegraph == nil {
+		return nil, nil
+	}
+
+	levels := make([]*Level, len(flamegraph.Levels))
+	for i, level := range flamegraph.Levels {
+		levels[i] = &Level{
+			Values: level.Values,
+		}
+	}
+
+	return &ProfileDiffResponse{
+		Flamebearer: &FlamebearerDiff{
+			Names:      flamegraph.Names,
+			Levels:     levels,
+			Total:      flamegraph.Total,
+			MaxSelf:    flamegraph.MaxSelf,
+			LeftTicks:  flamegraph.LeftTicks,
+			RightTicks: flamegraph.RightTicks,
+		},
+		Units: getUnits(profileTypeID),
+	}, nil
+}
+
+// frameNames returns the names of the flamegraph frames for the requested symbolization. Pyroscope symbolizes the
+// frames server side where it can and returns the bare address of the frames it could not symbolize. In the raw mode
+// those addresses are rendered as hex so they can be matched with the binary, otherwise names are returned as is.
+func frameNames(names []string, symbolization string) []string {
+	if symbolization != symbolizationRaw {
+		return names
+	}
+	rendered := make([]string, len(names))
+	for i, name := range names {
+		rendered[i] = name
+		if address, ok := parseAddress(name); ok {
+			rendered[i] = fmt.Sprintf("0x%x", address)
+		}
+	}
+	return rendered
+}
+
+// parseAddress returns the address of an unsymbolized frame name, which is either a decimal or a 0x prefixed hex
+// number.
+func parseAddress(name string) (uint64, bool) {
+	if name == "" {
+		return 0, false
+	}
+	if strings.HasPrefix(name, "0x") || strings.HasPrefix(name, "0X") {
+		address, err := strconv.ParseUint(name[2:], 16, 64)
+		return address, err == nil
+	}
+	address, err := strconv.ParseUint(name, 10, 64)
+	return address, err == nil
+}
+
 func getUnits(profileTypeID string) string {
 	parts := strings.Split(profileTypeID, ":")
 	unit := parts[2]
@@ -205,16 +473,69 @@ func getUnits(profileTypeID string) string {
 	return unit
 }
 
-func (c *PyroscopeClient) LabelNames(ctx context.Context) ([]string, error) {
+// GetProfileStats returns the number of series and samples of the profile type matching the label selector in the
+// time range, start and end are in milliseconds. The vendored API has no stats endpoint, so the series are counted
+// with a Series call and the points are the non-empty points of the profile type series at profileStatsStep. The
+// series are selected without grouping, so Pyroscope merges them into one series of at most profileStatsPoints
+// points however many series match.
+func (c *PyroscopeClient) GetProfileStats(ctx context.Context, profileTypeID, labelSelector string, start, end int64) (*ProfileStats, error) {
+	ctx, span := tracing.DefaultTracer().Start(ctx, "datasource.pyroscope.GetProfileStats", trace.WithAttributes(attribute.String("profileTypeID", profileTypeID), attribute.String("labelSelector", labelSelector), attribute.Int64("start", start), attribute.Int64("end", end)))
+	defer span.End()
+
+	matcher, err := withProfileTypeMatcher(labelSelector, profileTypeID)
+	if err != nil {
+		return nil, err
+	}
+	seriesReq := &querierv1.SeriesRequest{Matchers: []string{matcher}}
+	withTimeRange(seriesReq, seriesStartField, seriesEndField, start, end)
+	seriesResp, err := c.connectClient.Series(ctx, connect.NewRequest(seriesReq))
+	if err != nil {
+		logger.Error("Received error from client", "error", err, "function", logEntrypoint())
+		return nil, spanError(span, newClientError(err))
+	}
+
+	samplesResp, err := c.connectClient.SelectSeries(ctx, connect.NewRequest(&querierv1.SelectSeriesRequest{
+		ProfileTypeID: profileTypeID,
+		LabelSelector: labelSelector,
+		Start:         start,
+		End:           end,
+		Step:          profileStatsStep(start, end),
+	}))
+	if err != nil {
+		logger.Error("Received error from client", "error", err, "function", logEntrypoint())
+		return nil, spanError(span, newClientError(err))
+	}
+
+	recordResponse(span, proto.Size(seriesResp.Msg)+proto.Size(samplesResp.Msg))
+
+	stats := &ProfileStats{SeriesCount: int64(len(seriesResp.Msg.LabelsSet))}
+	for _, s := range samplesResp.Msg.Series {
+		for _, p := range s.Points {
+			if p.Value == 0 {
+				continue
+			}
+			stats.NonEmptyPoints++
+			if stats.MinTimestamp == 0 || p.Timestamp < stats.MinTimestamp {
+				stats.MinTimestamp = p.Timestamp
+			}
+			if p.Timestamp > stats.MaxTimestamp {
+				stats.MaxTimestamp = p.Timestamp
+			}
+		}
+	}
+	return stats, nil
+}
+
+// LabelNames returns the label names of the series matching the matchers, of all series when there are none.
+func (c *PyroscopeClient) LabelNames(ctx context.Context, matchers []string) ([]string, error) {
 	ctx, span := tracing.DefaultTracer().Start(ctx, "datasource.pyroscope.LabelNames")
 	defer span.End()
-	resp, err := c.connectClient.LabelNames(ctx, connect.NewRequest(&typesv1.LabelNamesRequest{}))
+	resp, err := c.connectClient.LabelNames(ctx, connect.NewRequest(&typesv1.LabelNamesRequest{Matchers: matchers}))
 	if err != nil {
 		logger.Error("Received error from client", "error", err, "function", logEntrypoint())
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		return nil, fmt.Errorf("error sending LabelNames request %v", err)
+		return nil, spanError(span, newClientError(fmt.Errorf("error sending LabelNames request %w", err)))
 	}
+	recordResponse(span, proto.Size(resp.Msg))
 
 	var filtered []string
 	for _, label := range resp.Msg.Names {
@@ -226,19 +547,66 @@ func (c *PyroscopeClient) LabelNames(ctx context.Context) ([]string, error) {
 	return filtered, nil
 }
 
-func (c *PyroscopeClient) LabelValues(ctx context.Context, label string) ([]string, error) {
-	ctx, span := tracing.DefaultTracer().Start(ctx, "datasource.pyroscope.LabelValues")
+// LabelValues returns the values of the label starting with the prefix in the time range, start and end are in
+// milliseconds. All values are returned when the prefix is empty, and the values of the whole retention when start
+// and end are 0.
+func (c *PyroscopeClient) LabelValues(ctx context.Context, label, prefix string, start int64, end int64) ([]string, error) {
+	ctx, span := tracing.DefaultTracer().Start(ctx, "datasource.pyroscope.LabelValues", trace.WithAttributes(attribute.String("label", label), attribute.String("prefix", prefix), attribute.Int64("start", start), attribute.Int64("end", end)))
 	defer span.End()
-	resp, err := c.connectClient.LabelValues(ctx, connect.NewRequest(&typesv1.LabelValuesRequest{Name: label}))
+	req := &typesv1.LabelValuesRequest{Name: label}
+	if prefix != "" {
+		// Pyroscope has no prefix filter, the values are filtered server side by selecting the series with a matching
+		// value of the label.
+		req.Matchers = []string{"{" + label + matchRegexp + strconv.Quote(regexp.QuoteMeta(prefix)+".*") + "}"}
+	}
+	withTimeRange(req, labelValuesStartField, labelValuesEndField, start, end)
+	resp, err := c.connectClient.LabelValues(ctx, connect.NewRequest(req))
 	if err != nil {
 		logger.Error("Received error from client", "error", err, "function", logEntrypoint())
-		span.RecordError(err)
-		span.SetStatus(codes.Error, err.Error())
-		return nil, err
+		return nil, spanError(span, newClientError(err))
 	}
+	recordResponse(span, proto.Size(resp.Msg))
 	return resp.Msg.Names, nil
 }
 
+// Version returns the version of the Pyroscope server, as reported by its build info.
+func (c *PyroscopeClient) Version(ctx context.Context) (string, error) {
+	ctx, span := tracing.DefaultTracer().Start(ctx, "datasource.pyroscope.Version")
+	defer span.End()
+	resp, err := c.statusClient.GetBuildInfo(ctx, connect.NewRequest(&statusv1.GetBuildInfoRequest{}))
+	if err != nil {
+		return "", spanError(span, newClientError(err))
+	}
+	recordResponse(span, proto.Size(resp.Msg))
+	return resp.Msg.GetData().GetVersion(), nil
+}
+
+// withTimeRange sets the non-zero start and end of the message. The start and end fields of the API types are set
+// when they have them, otherwise the values are added as unknown fields of the given numbers, as the vendored API
+// types predate them. Servers that don't support them ignore them.
+func withTimeRange(msg proto.Message, startField, endField protowire.Number, start, end int64) {
+	m := msg.ProtoReflect()
+	var unknown []byte
+	for _, field := range []struct {
+		name   protoreflect.Name
+		number protowire.Number
+		value  int64
+	}{{"start", startField, start}, {"end", endField, end}} {
+		if field.value == 0 {
+			continue
+		}
+		if fd := m.Descriptor().Fields().ByName(field.name); fd != nil && fd.Kind() == protoreflect.Int64Kind {
+			m.Set(fd, protoreflect.ValueOfInt64(field.value))
+			continue
+		}
+		unknown = protowire.AppendTag(unknown, field.number, protowire.VarintType)
+		unknown = protowire.AppendVarint(unknown, uint64(field.value))
+	}
+	if len(unknown) > 0 {
+		m.SetUnknown(append(m.GetUnknown(), unknown...))
+	}
+}
+
 func isPrivateLabel(label string) bool {
 	return strings.HasPrefix(label, "__")
 }
@@ -1,14 +1,31 @@
 package pyroscope
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/bufbuild/connect-go"
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
 	googlev1 "github.com/grafana/pyroscope/api/gen/proto/go/google/v1"
 	querierv1 "github.com/grafana/pyroscope/api/gen/proto/go/querier/v1"
+	"github.com/grafana/pyroscope/api/gen/proto/go/querier/v1/querierv1connect"
 	typesv1 "github.com/grafana/pyroscope/api/gen/proto/go/types/v1"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
 )
 
 func Test_PyroscopeClient(t *testing.T) {
@@ -31,9 +48,22 @@ func Test_PyroscopeClient(t *testing.T) {
 		require.Equal(t, series, resp)
 	})
 
+	t.Run("ProfileTypes", func(t *testing.T) {
+		resp, err := client.ProfileTypes(context.Background())
+		require.Nil(t, err)
+		require.Equal(t, []*ProfileType{
+			{ID: "process_cpu:cpu:nanoseconds:cpu:nanoseconds", Label: "process_cpu - cpu", PeriodType: "cpu", PeriodUnit: "nanoseconds"},
+			{ID: "memory:alloc_space:bytes::", Label: "memory - alloc_space"},
+		}, resp)
+
+		data, err := json.Marshal(resp)
+		require.Nil(t, err)
+		require.Equal(t, `[{"id":"process_cpu:cpu:nanoseconds:cpu:nanoseconds","label":"process_cpu - cpu","periodType":"cpu","periodUnit":"nanoseconds"},{"id":"memory:alloc_space:bytes::","label":"memory - alloc_space"}]`, string(data))
+	})
+
 	t.Run("GetProfile", func(t *testing.T) {
 		maxNodes := int64(-1)
-		resp, err := client.GetProfile(context.Background(), "memory:alloc_objects:count:space:bytes", "{}", 0, 100, &maxNodes)
+		resp, err := client.GetProfile(context.Background(), "memory:alloc_objects:count:space:bytes", "{}", 0, 100, &maxNodes, symbolizationSymbolized)
 		require.Nil(t, err)
 
 		series := &ProfileResponse{
@@ -52,10 +82,48 @@ func Test_PyroscopeClient(t *testing.T) {
 		require.Equal(t, series, resp)
 	})
 
+	t.Run("GetProfileDiff", func(t *testing.T) {
+		maxNodes := int64(100)
+		resp, err := client.GetProfileDiff(context.Background(), "memory:alloc_objects:count:space:bytes", `{app="foo"}`, 0, 100, `{app="bar"}`, 200, 300, &maxNodes)
+		require.Nil(t, err)
+
+		require.Equal(t, &ProfileDiffResponse{
+			Flamebearer: &FlamebearerDiff{
+				Names: []string{"foo", "bar"},
+				Levels: []*Level{
+					{Values: []int64{0, 10, 0, 0, 15, 0, 0}},
+					{Values: []int64{0, 10, 10, 0, 15, 15, 1}},
+				},
+				Total:      25,
+				MaxSelf:    15,
+				LeftTicks:  10,
+				RightTicks: 15,
+			},
+			Units: "short",
+		}, resp)
+
+		req := connectClient.Req.(*connect.Request[querierv1.DiffRequest])
+		require.Equal(t, `{app="foo"}`, req.Msg.Left.LabelSelector)
+		require.Equal(t, int64(0), req.Msg.Left.Start)
+		require.Equal(t, int64(100), req.Msg.Left.End)
+		require.Equal(t, `{app="bar"}`, req.Msg.Right.LabelSelector)
+		require.Equal(t, int64(200), req.Msg.Right.Start)
+		require.Equal(t, int64(300), req.Msg.Right.End)
+		require.Equal(t, &maxNodes, req.Msg.Right.MaxNodes)
+	})
+
+	t.Run("GetProfileDiff with empty response", func(t *testing.T) {
+		connectClient.SendEmptyProfileResponse = true
+		resp, err := client.GetProfileDiff(context.Background(), "memory:alloc_objects:count:space:bytes", "{}", 0, 100, "{}", 0, 100, nil)
+		require.Nil(t, err)
+		require.Nil(t, resp)
+		connectClient.SendEmptyProfileResponse = false
+	})
+
 	t.Run("GetProfile with empty response", func(t *testing.T) {
 		connectClient.SendEmptyProfileResponse = true
 		maxNodes := int64(-1)
-		resp, err := client.GetProfile(context.Background(), "memory:alloc_objects:count:space:bytes", "{}", 0, 100, &maxNodes)
+		resp, err := client.GetProfile(context.Background(), "memory:alloc_objects:count:space:bytes", "{}", 0, 100, &maxNodes, symbolizationSymbolized)
 		require.Nil(t, err)
 		// Mainly ensuring this does not panic like before
 		require.Nil(t, resp)
@@ -63,6 +131,259 @@ func Test_PyroscopeClient(t *testing.T) {
 	})
 }
 
+func Test_PyroscopeClient_compression(t *testing.T) {
+	var acceptEncoding []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = append(acceptEncoding, r.Header.Get("Accept-Encoding"))
+		body, err := proto.Marshal(&querierv1.SelectMergeStacktracesResponse{
+			Flamegraph: &querierv1.FlameGraph{
+				Names:  []string{"total", "foo"},
+				Levels: []*querierv1.Level{{Values: []int64{0, 10, 0, 0}}, {Values: []int64{0, 10, 10, 1}}},
+				Total:  10,
+			},
+		})
+		require.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/proto")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), compressionGzip) {
+			_, _ = w.Write(body)
+			return
+		}
+		w.Header().Set("Content-Encoding", compressionGzip)
+		gz := gzip.NewWriter(w)
+		_, _ = gz.Write(body)
+		require.NoError(t, gz.Close())
+	}))
+	t.Cleanup(server.Close)
+
+	expected := &ProfileResponse{
+		Flamebearer: &Flamebearer{
+			Names:  []string{"total", "foo"},
+			Levels: []*Level{{Values: []int64{0, 10, 0, 0}}, {Values: []int64{0, 10, 10, 1}}},
+			Total:  10,
+		},
+		Units: "short",
+	}
+
+	t.Run("gzipped profile is decompressed", func(t *testing.T) {
+		acceptEncoding = nil
+		client := NewPyroscopeClient(server.Client(), server.URL)
+		resp, err := client.GetProfile(context.Background(), "memory:alloc_objects:count:space:bytes", "{}", 0, 100, nil, symbolizationSymbolized)
+		require.NoError(t, err)
+		require.Equal(t, expected, resp)
+		require.Equal(t, []string{compressionGzip}, acceptEncoding)
+	})
+
+	t.Run("compression can be disabled", func(t *testing.T) {
+		acceptEncoding = nil
+		transport := &http.Transport{}
+		disableCompression(nil)(sdkhttpclient.Options{}, transport)
+		client := NewPyroscopeClient(&http.Client{Transport: transport}, server.URL, withoutCompression())
+		resp, err := client.GetProfile(context.Background(), "memory:alloc_objects:count:space:bytes", "{}", 0, 100, nil, symbolizationSymbolized)
+		require.NoError(t, err)
+		require.Equal(t, expected, resp)
+		require.Equal(t, []string{""}, acceptEncoding)
+	})
+}
+
+func Test_PyroscopeClient_responseEncodings(t *testing.T) {
+	responses := map[string]proto.Message{
+		querierv1connect.QuerierServiceProfileTypesProcedure: &querierv1.ProfileTypesResponse{
+			ProfileTypes: []*typesv1.ProfileType{{ID: "memory:alloc_objects:count:space:bytes", Name: "memory", SampleType: "alloc_objects"}},
+		},
+		querierv1connect.QuerierServiceSelectMergeStacktracesProcedure: &querierv1.SelectMergeStacktracesResponse{
+			Flamegraph: &querierv1.FlameGraph{
+				Names:  []string{"total", "foo"},
+				Levels: []*querierv1.Level{{Values: []int64{0, 10, 0, 0}}, {Values: []int64{0, 10, 10, 1}}},
+				Total:  10,
+			},
+		},
+		querierv1connect.QuerierServiceSelectSeriesProcedure: &querierv1.SelectSeriesResponse{
+			Series: []*typesv1.Series{{Labels: []*typesv1.LabelPair{{Name: "foo", Value: "bar"}}, Points: []*typesv1.Point{{Timestamp: 1000, Value: 30}}}},
+		},
+	}
+
+	gzipped := func(b []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write(b)
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name string
+		// encode returns the body and the content encoding of the response
+		encode func(body []byte) ([]byte, string)
+		err    string
+	}{
+		{
+			name:   "plain body",
+			encode: func(body []byte) ([]byte, string) { return body, "" },
+		},
+		{
+			name:   "gzipped body",
+			encode: func(body []byte) ([]byte, string) { return gzipped(body), compressionGzip },
+		},
+		{
+			name: "truncated gzip body",
+			encode: func(body []byte) ([]byte, string) {
+				compressed := gzipped(body)
+				return compressed[:len(compressed)/2], compressionGzip
+			},
+			err: "decompress",
+		},
+		{
+			name:   "corrupt gzip body",
+			encode: func(body []byte) ([]byte, string) { return []byte("not gzip"), compressionGzip },
+			err:    "decompress",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := proto.Marshal(responses[r.URL.Path])
+				require.NoError(t, err)
+				body, encoding := tt.encode(body)
+				w.Header().Set("Content-Type", "application/proto")
+				if encoding != "" {
+					w.Header().Set("Content-Encoding", encoding)
+				}
+				_, _ = w.Write(body)
+			}))
+			t.Cleanup(server.Close)
+			client := NewPyroscopeClient(server.Client(), server.URL)
+
+			types, err := client.ProfileTypes(context.Background())
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+				require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, []*ProfileType{{ID: "memory:alloc_objects:count:space:bytes", Label: "memory - alloc_objects"}}, types)
+			}
+
+			profile, err := client.GetProfile(context.Background(), "memory:alloc_objects:count:space:bytes", "{}", 0, 100, nil, symbolizationSymbolized)
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, int64(10), profile.Flamebearer.Total)
+			}
+
+			series, err := client.GetSeries(context.Background(), "memory:alloc_objects:count:space:bytes", "{}", 0, 100, nil, 15)
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, []*Series{{Labels: []*LabelPair{{Name: "foo", Value: "bar"}}, Points: []*Point{{Timestamp: 1000, Value: 30}}}}, series.Series)
+			}
+		})
+	}
+}
+
+func Test_PyroscopeClient_errorStatus(t *testing.T) {
+	status := http.StatusNotFound
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	client := NewPyroscopeClient(server.Client(), server.URL)
+
+	for _, tt := range []struct {
+		status   int
+		expected int
+	}{
+		{status: http.StatusUnauthorized, expected: http.StatusUnauthorized},
+		{status: http.StatusForbidden, expected: http.StatusForbidden},
+		{status: http.StatusNotFound, expected: http.StatusNotFound},
+		{status: http.StatusServiceUnavailable, expected: http.StatusServiceUnavailable},
+		{status: http.StatusInternalServerError, expected: 0},
+	} {
+		status = tt.status
+		_, err := client.ProfileTypes(context.Background())
+		var clientErr *ClientError
+		require.ErrorAs(t, err, &clientErr)
+		require.Equal(t, tt.expected, clientErr.Status, "status %d", tt.status)
+
+		_, err = client.LabelNames(context.Background(), nil)
+		require.ErrorAs(t, err, &clientErr)
+		require.Equal(t, tt.expected, clientErr.Status, "status %d", tt.status)
+	}
+}
+
+func Test_PyroscopeClient_connectionErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	client := NewPyroscopeClient(server.Client(), server.URL)
+	server.Close()
+
+	_, err := client.ProfileTypes(context.Background())
+	var clientErr *ClientError
+	require.ErrorAs(t, err, &clientErr)
+	require.Zero(t, clientErr.Status)
+	require.True(t, isConnectionError(err))
+	require.Equal(t, connect.CodeUnavailable, connect.CodeOf(err))
+}
+
+func Test_PyroscopeClient_profileStats(t *testing.T) {
+	var seriesReq, selectSeriesReq map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case querierv1connect.QuerierServiceSeriesProcedure:
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&seriesReq))
+			_, _ = w.Write([]byte(`{"labelsSet": [
+				{"labels": [{"name": "service_name", "value": "foo"}, {"name": "pod", "value": "foo-1"}]},
+				{"labels": [{"name": "service_name", "value": "foo"}, {"name": "pod", "value": "foo-2"}]}
+			]}`))
+		case querierv1connect.QuerierServiceSelectSeriesProcedure:
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&selectSeriesReq))
+			_, _ = w.Write([]byte(`{"series": [{"points": [
+				{"value": 0, "timestamp": "1000"},
+				{"value": 120, "timestamp": "16000"},
+				{"value": 80, "timestamp": "31000"},
+				{"value": 95, "timestamp": "46000"}
+			]}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	client := NewPyroscopeClient(server.Client(), server.URL, connect.WithProtoJSON())
+
+	stats, err := client.GetProfileStats(context.Background(), "process_cpu:cpu:nanoseconds:cpu:nanoseconds", `{service_name="foo"}`, 1000, 60000)
+	require.NoError(t, err)
+	require.Equal(t, &ProfileStats{NonEmptyPoints: 3, SeriesCount: 2, MinTimestamp: 16000, MaxTimestamp: 46000}, stats)
+	require.Equal(t, []any{`{__profile_type__="process_cpu:cpu:nanoseconds:cpu:nanoseconds", service_name="foo"}`}, seriesReq["matchers"])
+	require.Equal(t, float64(minProfileStatsStep), selectSeriesReq["step"])
+	require.Nil(t, selectSeriesReq["groupBy"], "the series are merged into one")
+
+	_, err = client.GetProfileStats(context.Background(), "process_cpu:cpu:nanoseconds:cpu:nanoseconds", `{service_name="foo"}`, 0, 24*60*60*1000)
+	require.NoError(t, err)
+	require.Equal(t, float64(864), selectSeriesReq["step"], "a day is counted in profileStatsPoints points")
+}
+
+func Test_profileStatsStep(t *testing.T) {
+	require.Equal(t, float64(minProfileStatsStep), profileStatsStep(0, 60*1000))
+	require.Equal(t, float64(36), profileStatsStep(0, 60*60*1000))
+	require.Equal(t, float64(7*24*60*60/profileStatsPoints), profileStatsStep(0, 7*24*60*60*1000))
+}
+
+func Test_frameNames(t *testing.T) {
+	names := []string{"total", "main.main", "140735340871680", "0x7FFF5FBFF8C0", ""}
+
+	t.Run("symbolized keeps names as returned", func(t *testing.T) {
+		require.Equal(t, names, frameNames(names, symbolizationSymbolized))
+		require.Equal(t, names, frameNames(names, ""))
+	})
+
+	t.Run("raw renders unsymbolized frames as hex", func(t *testing.T) {
+		require.Equal(t, []string{"total", "main.main", "0x7fff80000000", "0x7fff5fbff8c0", ""}, frameNames(names, symbolizationRaw))
+	})
+}
+
 type FakePyroscopeConnectClient struct {
 	Req                      any
 	SendEmptyProfileResponse bool
@@ -79,12 +400,49 @@ func (f *FakePyroscopeConnectClient) LabelNames(ctx context.Context, c *connect.
 }
 
 func (f *FakePyroscopeConnectClient) Diff(ctx context.Context, c *connect.Request[querierv1.DiffRequest]) (*connect.Response[querierv1.DiffResponse], error) {
-	//TODO implement me
-	panic("implement me")
+	f.Req = c
+	if f.SendEmptyProfileResponse {
+		return &connect.Response[querierv1.DiffResponse]{Msg: &querierv1.DiffResponse{}}, nil
+	}
+	return &connect.Response[querierv1.DiffResponse]{
+		Msg: &querierv1.DiffResponse{
+			Flamegraph: &querierv1.FlameGraphDiff{
+				Names: []string{"foo", "bar"},
+				Levels: []*querierv1.Level{
+					{Values: []int64{0, 10, 0, 0, 15, 0, 0}},
+					{Values: []int64{0, 10, 10, 0, 15, 15, 1}},
+				},
+				Total:      25,
+				MaxSelf:    15,
+				LeftTicks:  10,
+				RightTicks: 15,
+			},
+		},
+	}, nil
 }
 
 func (f *FakePyroscopeConnectClient) ProfileTypes(ctx context.Context, c *connect.Request[querierv1.ProfileTypesRequest]) (*connect.Response[querierv1.ProfileTypesResponse], error) {
-	panic("implement me")
+	f.Req = c
+	return &connect.Response[querierv1.ProfileTypesResponse]{
+		Msg: &querierv1.ProfileTypesResponse{
+			ProfileTypes: []*typesv1.ProfileType{
+				{
+					ID:         "process_cpu:cpu:nanoseconds:cpu:nanoseconds",
+					Name:       "process_cpu",
+					SampleType: "cpu",
+					SampleUnit: "nanoseconds",
+					PeriodType: "cpu",
+					PeriodUnit: "nanoseconds",
+				},
+				{
+					ID:         "memory:alloc_space:bytes::",
+					Name:       "memory",
+					SampleType: "alloc_space",
+					SampleUnit: "bytes",
+				},
+			},
+		},
+	}, nil
 }
 
 func (f *FakePyroscopeConnectClient) Series(ctx context.Context, c *connect.Request[querierv1.SeriesRequest]) (*connect.Response[querierv1.SeriesResponse], error) {
@@ -129,3 +487,178 @@ func (f *FakePyroscopeConnectClient) SelectSeries(ctx context.Context, req *conn
 func (f *FakePyroscopeConnectClient) SelectMergeProfile(ctx context.Context, c *connect.Request[querierv1.SelectMergeProfileRequest]) (*connect.Response[googlev1.Profile], error) {
 	panic("implement me")
 }
+
+func Test_PyroscopeClient_labelValuesTimeRange(t *testing.T) {
+	var path string
+	var fields map[protowire.Number]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		fields = decodeFields(t, body)
+
+		res, err := proto.Marshal(&typesv1.LabelValuesResponse{Names: []string{"app"}})
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/proto")
+		_, _ = w.Write(res)
+	}))
+	t.Cleanup(server.Close)
+	client := NewPyroscopeClient(server.Client(), server.URL)
+
+	t.Run("time range is sent", func(t *testing.T) {
+		values, err := client.LabelValues(context.Background(), "service_name", "", 1000, 2000)
+		require.NoError(t, err)
+		require.Equal(t, []string{"app"}, values)
+		require.Equal(t, querierv1connect.QuerierServiceLabelValuesProcedure, path)
+		require.Equal(t, map[protowire.Number]any{1: "service_name", labelValuesStartField: uint64(1000), labelValuesEndField: uint64(2000)}, fields)
+	})
+
+	t.Run("full range without a time range", func(t *testing.T) {
+		_, err := client.LabelValues(context.Background(), "service_name", "", 0, 0)
+		require.NoError(t, err)
+		require.Equal(t, map[protowire.Number]any{1: "service_name"}, fields)
+	})
+
+	t.Run("values are filtered by the prefix", func(t *testing.T) {
+		_, err := client.LabelValues(context.Background(), "pod", "api.v1-", 0, 0)
+		require.NoError(t, err)
+		require.Equal(t, map[protowire.Number]any{1: "pod", 2: `{pod=~"api\\.v1-.*"}`}, fields)
+	})
+}
+
+func Test_withTimeRange(t *testing.T) {
+	t.Run("start and end fields of the message are set", func(t *testing.T) {
+		req := &querierv1.SelectMergeStacktracesRequest{}
+		withTimeRange(req, 3, 4, 1000, 2000)
+		require.Equal(t, int64(1000), req.GetStart())
+		require.Equal(t, int64(2000), req.GetEnd())
+		require.Empty(t, req.ProtoReflect().GetUnknown())
+	})
+
+	t.Run("unknown fields without start and end fields", func(t *testing.T) {
+		req := &typesv1.LabelValuesRequest{Name: "service_name"}
+		withTimeRange(req, labelValuesStartField, labelValuesEndField, 1000, 0)
+		b, err := proto.Marshal(req)
+		require.NoError(t, err)
+		require.Equal(t, map[protowire.Number]any{1: "service_name", labelValuesStartField: uint64(1000)}, decodeFields(t, b))
+	})
+}
+
+func Test_PyroscopeClient_labelNamesMatchers(t *testing.T) {
+	var fields map[protowire.Number]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, querierv1connect.QuerierServiceLabelNamesProcedure, r.URL.Path)
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		fields = decodeFields(t, body)
+
+		res, err := proto.Marshal(&typesv1.LabelNamesResponse{Names: []string{"__name__", "service_name"}})
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/proto")
+		_, _ = w.Write(res)
+	}))
+	t.Cleanup(server.Close)
+	client := NewPyroscopeClient(server.Client(), server.URL)
+
+	t.Run("matchers narrow the request", func(t *testing.T) {
+		names, err := client.LabelNames(context.Background(), []string{`{service="foo"}`})
+		require.NoError(t, err)
+		require.Equal(t, []string{"service_name"}, names)
+		require.Equal(t, map[protowire.Number]any{1: `{service="foo"}`}, fields)
+	})
+
+	t.Run("all series without matchers", func(t *testing.T) {
+		_, err := client.LabelNames(context.Background(), nil)
+		require.NoError(t, err)
+		require.Empty(t, fields)
+	})
+}
+
+// decodeFields decodes the string and varint fields of a protobuf message by field number.
+func decodeFields(t *testing.T, b []byte) map[protowire.Number]any {
+	t.Helper()
+	fields := map[protowire.Number]any{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		require.GreaterOrEqual(t, n, 0)
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			require.GreaterOrEqual(t, n, 0)
+			fields[num] = v
+			b = b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			require.GreaterOrEqual(t, n, 0)
+			fields[num] = string(v)
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+	}
+	return fields
+}
+
+func Test_PyroscopeClient_spans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracing.InitDefaultTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test"))
+	t.Cleanup(func() { tracing.InitDefaultTracer(trace.NewNoopTracerProvider().Tracer("")) })
+
+	body, err := proto.Marshal(&querierv1.SelectMergeStacktracesResponse{
+		Flamegraph: &querierv1.FlameGraph{
+			Names:  []string{"total", "foo"},
+			Levels: []*querierv1.Level{{Values: []int64{0, 10, 0, 0}}, {Values: []int64{0, 10, 10, 1}}},
+			Total:  10,
+		},
+	})
+	require.NoError(t, err)
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/proto")
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			_, _ = w.Write(body)
+		}
+	}))
+	t.Cleanup(server.Close)
+	client := NewPyroscopeClient(server.Client(), server.URL)
+
+	lastSpan := func(t *testing.T) (sdktrace.ReadOnlySpan, map[attribute.Key]attribute.Value) {
+		t.Helper()
+		spans := recorder.Ended()
+		require.NotEmpty(t, spans)
+		span := spans[len(spans)-1]
+		attributes := map[attribute.Key]attribute.Value{}
+		for _, kv := range span.Attributes() {
+			attributes[kv.Key] = kv.Value
+		}
+		return span, attributes
+	}
+
+	t.Run("successful call", func(t *testing.T) {
+		_, err := client.GetProfile(context.Background(), "memory:alloc_objects:count:space:bytes", `{app="foo"}`, 1000, 2000, nil, symbolizationSymbolized)
+		require.NoError(t, err)
+
+		span, attributes := lastSpan(t)
+		require.Equal(t, "datasource.pyroscope.GetProfile", span.Name())
+		require.Equal(t, otelcodes.Unset, span.Status().Code)
+		require.Equal(t, "memory:alloc_objects:count:space:bytes", attributes["profileTypeID"].AsString())
+		require.Equal(t, `{app="foo"}`, attributes["labelSelector"].AsString())
+		require.Equal(t, int64(1000), attributes["start"].AsInt64())
+		require.Equal(t, int64(2000), attributes["end"].AsInt64())
+		require.Equal(t, int64(http.StatusOK), attributes["http.status_code"].AsInt64())
+		require.Equal(t, int64(len(body)), attributes["http.response_content_length"].AsInt64())
+	})
+
+	t.Run("failed call", func(t *testing.T) {
+		status = http.StatusNotFound
+		_, err := client.GetProfile(context.Background(), "memory:alloc_objects:count:space:bytes", `{app="foo"}`, 1000, 2000, nil, symbolizationSymbolized)
+		require.Error(t, err)
+
+		span, attributes := lastSpan(t)
+		require.Equal(t, "datasource.pyroscope.GetProfile", span.Name())
+		require.Equal(t, otelcodes.Error, span.Status().Code)
+		require.Equal(t, int64(http.StatusNotFound), attributes["http.status_code"].AsInt64())
+	})
+}
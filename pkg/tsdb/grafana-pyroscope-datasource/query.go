@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,13 +25,132 @@ import (
 
 type queryModel struct {
 	WithStreaming bool
+	// BypassCache forces a fetch from the backend even when a cached result exists, the cache is then updated
+	// with the fresh result.
+	BypassCache bool `json:"bypassCache"`
+	// Symbolization selects whether the flamegraph shows symbolized frames or raw addresses, see symbolizationRaw.
+	Symbolization string `json:"symbolization"`
+	// FlamegraphSchemaVersion selects the layout of the flamegraph frame, the latest version when 0.
+	FlamegraphSchemaVersion int `json:"flamegraphSchemaVersion"`
+	// ValueType selects the type of the flamegraph value fields, see valueTypeInt64. When empty it is picked from
+	// the unit of the profile type.
+	ValueType string `json:"valueType"`
+	// ChildSortOrder selects the order of the children of the flamegraph nodes, see childSortOrderValue. The order
+	// reported by Pyroscope is kept when empty.
+	ChildSortOrder string `json:"childSortOrder"`
+	// MinNodeValuePercent prunes the flamegraph nodes whose value is below this percentage of the total, their values
+	// are folded into their parent. 0 keeps all nodes.
+	MinNodeValuePercent float64 `json:"minNodeValuePercent"`
+	// ValueRoundingStep rounds the flamegraph values to multiples of the step, to make the flamegraphs of profiles
+	// with huge values, like memory profiles, smaller. The nodes rounded to 0 are folded into their parent. 0 keeps
+	// the values exact.
+	ValueRoundingStep int64 `json:"valueRoundingStep"`
+	// ComparisonMode makes the query return the Baseline and the Comparison profiles instead of its own profile, see
+	// comparisonModeSideBySide.
+	ComparisonMode string            `json:"comparisonMode"`
+	Baseline       *profileSelection `json:"baseline"`
+	Comparison     *profileSelection `json:"comparison"`
+	// PanelWidth and PanelHeight are the size in pixels of the panel showing the query. When both are set, the
+	// maximum number of flamegraph nodes of a query that doesn't set one is derived from them, see panelMaxNodes.
+	PanelWidth  int `json:"panelWidth"`
+	PanelHeight int `json:"panelHeight"`
+	// ProfileTypeIds are the profile types summarized by the summary queries, see queryTypeSummary.
+	ProfileTypeIds []string `json:"profileTypeIds"`
 	dataquery.GrafanaPyroscopeDataQuery
 }
 
 type dsJsonModel struct {
-	MinStep string `json:"minStep"`
+	MinStep       string `json:"minStep"`
+	QueryCacheTTL string `json:"queryCacheTTL"`
+	// EnableHTTP2 forces HTTP/2 on or off for the client transport, the transport default is used when unset.
+	EnableHTTP2 *bool `json:"enableHttp2,omitempty"`
+	// MaxNodesDefault is the maximum number of flamegraph nodes of the queries that don't set one, 0 means no limit.
+	MaxNodesDefault int64 `json:"maxNodesDefault"`
+	// MaxLabelValues caps the number of values returned by the labelValues resource, defaultMaxLabelValues when 0.
+	MaxLabelValues int `json:"maxLabelValues"`
+	// MaxFlamegraphBytes caps the serialized size of the flamegraph sent to the browser, 0 means no limit.
+	MaxFlamegraphBytes int64 `json:"maxFlamegraphBytes"`
+	// DefaultTimeRange is the window queried when a query arrives without a time range, for example "1h".
+	DefaultTimeRange string `json:"defaultTimeRange"`
+	// DisableCompression stops requesting gzip compressed responses from Pyroscope.
+	DisableCompression bool `json:"disableCompression"`
+	// MaxRetries is the number of times calls failing with a transient error are retried, 0 disables retries.
+	MaxRetries int `json:"maxRetries"`
+	// RetryBackoff is the initial backoff between retries, for example "100ms".
+	RetryBackoff string `json:"retryBackoff"`
+	// ResourceCacheMaxAge is how long the browser may cache the profileTypes and labelNames resources, for example
+	// "1m". Defaults to defaultResourceCacheMaxAge, "0s" disables caching.
+	ResourceCacheMaxAge string `json:"resourceCacheMaxAge"`
+	// NormalizeSelectors sorts the matchers of the label selectors and canonicalizes their formatting before they are
+	// used, so equal selectors share cache entries.
+	NormalizeSelectors bool `json:"normalizeSelectors"`
+	// MaxResourceBodyBytes caps the size of the resource request bodies, defaultMaxResourceBodyBytes when 0.
+	MaxResourceBodyBytes int64 `json:"maxResourceBodyBytes"`
+	// ChildSortOrder is the order of the children of the flamegraph nodes for the queries that don't set one.
+	ChildSortOrder string `json:"childSortOrder"`
+	// ProfileTypesCacheTTL is how long the profile types are cached, for example "1m". Defaults to
+	// defaultProfileTypesCacheTTL, "0s" disables caching.
+	ProfileTypesCacheTTL string `json:"profileTypesCacheTTL"`
+	// OrgDefaultSelectors are the label selectors, keyed by org ID, used for the queries of the org that have none.
+	OrgDefaultSelectors map[string]string `json:"orgDefaultSelectors"`
+	// RequiredMatcherLabel is a label, like service_name, the label selectors of the queries must match on, so a query
+	// can't scan the whole backend by accident.
+	RequiredMatcherLabel string `json:"requiredMatcherLabel"`
+	// ProfileTypeAliases are display names of profile types by profile type ID, like "Heap in use" for
+	// "memory:inuse_space:bytes:space:bytes".
+	ProfileTypeAliases map[string]string `json:"profileTypeAliases"`
+	// MaxConcurrentFetches caps the calls to Pyroscope in flight for the queries of a request, shared by all of them.
+	// Defaults to defaultMaxConcurrentFetches.
+	MaxConcurrentFetches int `json:"maxConcurrentFetches"`
 }
 
+// noProfileDataNotice is shown when the profile query succeeded but there are no samples in the time range.
+const noProfileDataNotice = "No profile data found in the selected time range"
+
+// defaultTimeRangeWindow is the window queried when a query has no time range and none is configured.
+const defaultTimeRangeWindow = time.Hour
+
+const (
+	// flamegraphSchemaV1 has the frame names in a plain string label field.
+	flamegraphSchemaV1 = 1
+	// flamegraphSchemaV2 has the frame names in an enum label field, so every name is sent only once.
+	flamegraphSchemaV2 = 2
+
+	latestFlamegraphSchema = flamegraphSchemaV2
+)
+
+const (
+	// valueTypeInt64 has the flamegraph values as they are reported by Pyroscope.
+	valueTypeInt64 = "int64"
+	// valueTypeFloat64 has the flamegraph values as floats, for panels that compute fractions of them.
+	valueTypeFloat64 = "float64"
+)
+
+const (
+	// childSortOrderValue sorts the children of the flamegraph nodes by value, the biggest first.
+	childSortOrderValue = "value"
+	// childSortOrderName sorts the children of the flamegraph nodes alphabetically.
+	childSortOrderName = "name"
+)
+
+// fractionalUnits are the units of the profile types whose values are not whole numbers.
+var fractionalUnits = map[string]bool{
+	"percent":     true,
+	"percentunit": true,
+}
+
+const (
+	// flamegraphNodeWidth and flamegraphNodeHeight are about the smallest size in pixels a flamegraph node is
+	// readable at.
+	flamegraphNodeWidth  = 10
+	flamegraphNodeHeight = 20
+)
+
+const (
+	symbolizationSymbolized = "symbolized"
+	symbolizationRaw        = "raw"
+)
+
 const (
 	queryTypeProfile = string(dataquery.PyroscopeQueryTypeProfile)
 	queryTypeMetrics = string(dataquery.PyroscopeQueryTypeMetrics)
@@ -37,13 +158,18 @@ const (
 )
 
 // query processes single Pyroscope query transforming the response to data.Frame packaged in DataResponse
-func (d *PyroscopeDatasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) backend.DataResponse {
+func (d *PyroscopeDatasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) (res backend.DataResponse) {
 	ctx, span := tracing.DefaultTracer().Start(ctx, "datasource.pyroscope.query", trace.WithAttributes(attribute.String("query_type", query.QueryType)))
 	defer span.End()
 
 	var qm queryModel
 	response := backend.DataResponse{}
 
+	start := time.Now()
+	defer func() {
+		observeQuery(ctx, query.QueryType, qm.ProfileTypeId, res.Error, time.Since(start))
+	}()
+
 	err := json.Unmarshal(query.JSON, &qm)
 	if err != nil {
 		span.RecordError(err)
@@ -52,6 +178,86 @@ func (d *PyroscopeDatasource) query(ctx context.Context, pCtx backend.PluginCont
 		return response
 	}
 
+	if qm.FlamegraphSchemaVersion < 0 || qm.FlamegraphSchemaVersion > latestFlamegraphSchema {
+		response.Error = fmt.Errorf("unsupported flamegraph schema version %d", qm.FlamegraphSchemaVersion)
+		return response
+	}
+	if qm.ValueType != "" && qm.ValueType != valueTypeInt64 && qm.ValueType != valueTypeFloat64 {
+		response.Error = fmt.Errorf("unsupported flamegraph value type %q", qm.ValueType)
+		return response
+	}
+	if qm.ChildSortOrder == "" {
+		qm.ChildSortOrder = d.childSortOrder
+	}
+	if !isValidChildSortOrder(qm.ChildSortOrder) {
+		response.Error = fmt.Errorf("unsupported child sort order %q", qm.ChildSortOrder)
+		return response
+	}
+	if qm.MinNodeValuePercent < 0 || qm.MinNodeValuePercent > 100 {
+		response.Error = fmt.Errorf("minimum node value percent must be between 0 and 100, got %v", qm.MinNodeValuePercent)
+		return response
+	}
+	if qm.ValueRoundingStep < 0 {
+		response.Error = fmt.Errorf("value rounding step must not be negative, got %d", qm.ValueRoundingStep)
+		return response
+	}
+	if qm.ComparisonMode != "" && qm.ComparisonMode != comparisonModeSideBySide {
+		response.Error = fmt.Errorf("unsupported comparison mode %q", qm.ComparisonMode)
+		return response
+	}
+
+	qm.LabelSelector = d.resolveLabelSelector(pCtx.OrgID, qm.LabelSelector)
+	// The selections of a comparison go through the same selector pipeline, the ones without a selector use the
+	// resolved selector of the query
+	for _, selection := range []**profileSelection{&qm.Baseline, &qm.Comparison} {
+		if *selection != nil && (*selection).LabelSelector != "" {
+			resolved := **selection
+			resolved.LabelSelector = d.resolveLabelSelector(pCtx.OrgID, resolved.LabelSelector)
+			*selection = &resolved
+		}
+	}
+
+	if d.requiredMatcherLabel != "" {
+		if err := d.checkRequiredMatchers(qm); err != nil {
+			response.Error = err
+			return response
+		}
+	}
+
+	if qm.MaxNodes == nil {
+		// The panel size can only lower the default of the datasource, the admins cap the size of the trees with it
+		maxNodes := panelMaxNodes(qm.PanelWidth, qm.PanelHeight)
+		if maxNodes == 0 || (d.maxNodes > 0 && maxNodes > d.maxNodes) {
+			maxNodes = d.maxNodes
+		}
+		if maxNodes > 0 {
+			qm.MaxNodes = &maxNodes
+		}
+	}
+
+	query.TimeRange = d.resolveTimeRange(query.TimeRange, time.Now())
+	d.queryHistory.Add(QueryHistoryEntry{
+		Time:          time.Now(),
+		RefID:         query.RefID,
+		QueryType:     query.QueryType,
+		ProfileTypeID: qm.ProfileTypeId,
+		LabelSelector: qm.LabelSelector,
+		GroupBy:       qm.GroupBy,
+		Start:         query.TimeRange.From.UnixMilli(),
+		End:           query.TimeRange.To.UnixMilli(),
+	})
+
+	var cacheKey string
+	if d.queryCache != nil {
+		cacheKey = queryCacheKey(pCtx, query, qm)
+		if !qm.BypassCache {
+			if cached, ok := d.queryCache.Get(cacheKey); ok {
+				logger.Debug("Returning cached query result", "function", logEntrypoint())
+				return cached
+			}
+		}
+	}
+
 	responseMutex := sync.Mutex{}
 	g, gCtx := errgroup.WithContext(ctx)
 	if query.QueryType == queryTypeMetrics || query.QueryType == queryTypeBoth {
@@ -88,6 +294,7 @@ func (d *PyroscopeDatasource) query(ctx context.Context, pCtx backend.PluginCont
 				logger.Error("Querying SelectSeries()", "err", err, "function", logEntrypoint())
 				return err
 			}
+			seriesResp.Label = d.profileTypeLabel(qm.ProfileTypeId, seriesResp.Label)
 			// add the frames to the response.
 			responseMutex.Lock()
 			response.Frames = append(response.Frames, seriesToDataFrames(seriesResp)...)
@@ -96,10 +303,24 @@ func (d *PyroscopeDatasource) query(ctx context.Context, pCtx backend.PluginCont
 		})
 	}
 
-	if query.QueryType == queryTypeProfile || query.QueryType == queryTypeBoth {
+	if qm.ComparisonMode == comparisonModeSideBySide && (query.QueryType == queryTypeProfile || query.QueryType == queryTypeBoth) {
+		g.Go(func() error {
+			frames, err := d.sideBySideFrames(gCtx, qm, query.TimeRange)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				logger.Error("Error getting the compared profiles", "err", err, "function", logEntrypoint())
+				return err
+			}
+			responseMutex.Lock()
+			response.Frames = append(response.Frames, frames...)
+			responseMutex.Unlock()
+			return nil
+		})
+	} else if query.QueryType == queryTypeProfile || query.QueryType == queryTypeBoth {
 		g.Go(func() error {
 			logger.Debug("Calling GetProfile", "queryModel", qm, "function", logEntrypoint())
-			prof, err := d.client.GetProfile(gCtx, qm.ProfileTypeId, qm.LabelSelector, query.TimeRange.From.UnixMilli(), query.TimeRange.To.UnixMilli(), qm.MaxNodes)
+			prof, err := d.client.GetProfile(gCtx, qm.ProfileTypeId, qm.LabelSelector, query.TimeRange.From.UnixMilli(), query.TimeRange.To.UnixMilli(), qm.MaxNodes, qm.Symbolization)
 			if err != nil {
 				span.RecordError(err)
 				span.SetStatus(codes.Error, err.Error())
@@ -107,24 +328,35 @@ func (d *PyroscopeDatasource) query(ctx context.Context, pCtx backend.PluginCont
 				return err
 			}
 
-			var frame *data.Frame
-			if prof != nil {
-				frame = responseToDataFrames(prof)
-
-				// If query called with streaming on then return a channel
-				// to subscribe on a client-side and consume updates from a plugin.
-				// Feel free to remove this if you don't need streaming for your datasource.
-				if qm.WithStreaming {
-					channel := live.Channel{
-						Scope:     live.ScopeDatasource,
-						Namespace: pCtx.DataSourceInstanceSettings.UID,
-						Path:      "stream",
-					}
-					frame.SetMeta(&data.FrameMeta{Channel: channel.String()})
+			frame, err := d.profileToFrame(prof, qm)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				logger.Error("Error limiting the flamegraph size", "err", err, "function", logEntrypoint())
+				return err
+			}
+
+			// If query called with streaming on then return a channel
+			// to subscribe on a client-side and consume updates from a plugin.
+			// Feel free to remove this if you don't need streaming for your datasource.
+			if prof != nil && qm.WithStreaming {
+				path, err := d.registerStream(seriesStreamPath, streamQuery{
+					ProfileTypeID: qm.ProfileTypeId,
+					LabelSelector: qm.LabelSelector,
+					GroupBy:       qm.GroupBy,
+				})
+				if err != nil {
+					return err
 				}
-			} else {
-				// We still send empty data frame to give feedback that query really run, just didn't return any data.
-				frame = getEmptyDataFrame()
+				channel := live.Channel{
+					Scope:     live.ScopeDatasource,
+					Namespace: pCtx.DataSourceInstanceSettings.UID,
+					Path:      path,
+				}
+				if frame.Meta == nil {
+					frame.Meta = &data.FrameMeta{}
+				}
+				frame.Meta.Channel = channel.String()
 			}
 			responseMutex.Lock()
 			response.Frames = append(response.Frames, frame)
@@ -134,21 +366,352 @@ func (d *PyroscopeDatasource) query(ctx context.Context, pCtx backend.PluginCont
 		})
 	}
 
+	if query.QueryType == queryTypeSummary {
+		g.Go(func() error {
+			frame, err := d.summaryFrame(gCtx, qm, query.TimeRange)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				logger.Error("Error getting the profile summary", "err", err, "function", logEntrypoint())
+				return err
+			}
+			responseMutex.Lock()
+			response.Frames = append(response.Frames, frame)
+			responseMutex.Unlock()
+			return nil
+		})
+	}
+
+	if query.QueryType == queryTypeDiff {
+		g.Go(func() error {
+			frame, err := d.diffFrame(gCtx, qm, query.TimeRange)
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				logger.Error("Error GetProfileDiff()", "err", err, "function", logEntrypoint())
+				return err
+			}
+			responseMutex.Lock()
+			response.Frames = append(response.Frames, frame)
+			responseMutex.Unlock()
+			return nil
+		})
+	}
+
 	if err := g.Wait(); err != nil {
 		span.RecordError(err)
 		span.SetStatus(codes.Error, err.Error())
 		response.Error = g.Wait()
 	}
 
+	// The summary has several profile types, the other frames are all of the profile type of the query.
+	if query.QueryType != queryTypeSummary {
+		for _, frame := range response.Frames {
+			withQueryMeta(frame, qm)
+		}
+	}
+
+	if d.queryCache != nil && response.Error == nil {
+		d.queryCache.Set(cacheKey, response)
+	}
+
 	return response
 }
 
+// profileToFrame turns the profile into a flamegraph frame, limited to the maximum size of the datasource. When
+// there is no profile an empty frame is returned, to give feedback that the query ran but had no data.
+func (d *PyroscopeDatasource) profileToFrame(prof *ProfileResponse, qm queryModel) (*data.Frame, error) {
+	if prof == nil {
+		frame := withValueType(treeToFlamegraphFrame(nil, "", qm.FlamegraphSchemaVersion), flamegraphValueType(qm.ValueType, ""))
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityInfo,
+			Text:     noProfileDataNotice,
+		})
+		return frame, nil
+	}
+
+	var frame *data.Frame
+	if d.maxFlamegraphBytes > 0 {
+		var err error
+		frame, err = responseToLimitedDataFrame(prof, d.maxFlamegraphBytes, qm.FlamegraphSchemaVersion, qm.ChildSortOrder, qm.MinNodeValuePercent, qm.ValueRoundingStep)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		frame = responseToDataFrames(prof, qm.FlamegraphSchemaVersion, qm.ChildSortOrder, qm.MinNodeValuePercent, qm.ValueRoundingStep)
+	}
+	return withValueType(frame, flamegraphValueType(qm.ValueType, prof.Units)), nil
+}
+
+// resolveLabelSelector returns the label selector a query sends for the selector, the default selector of the org
+// when it is empty, normalized when the datasource normalizes the selectors.
+func (d *PyroscopeDatasource) resolveLabelSelector(orgID int64, selector string) string {
+	if isEmptySelector(selector) {
+		if orgSelector, ok := d.orgDefaultSelectors[orgID]; ok {
+			selector = orgSelector
+		}
+	}
+	if d.normalizeSelectors {
+		selector = normalizeSelector(selector)
+	}
+	return selector
+}
+
+// checkRequiredMatchers returns an error unless the label selector of the query, and the ones of its baseline and
+// comparison selections that override it, match on the required matcher label.
+func (d *PyroscopeDatasource) checkRequiredMatchers(qm queryModel) error {
+	selectors := []string{qm.LabelSelector}
+	for _, selection := range []*profileSelection{qm.Baseline, qm.Comparison} {
+		if selection != nil && selection.LabelSelector != "" {
+			selectors = append(selectors, selection.LabelSelector)
+		}
+	}
+	for _, selector := range selectors {
+		if err := checkRequiredMatcher(selector, d.requiredMatcherLabel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isEmptySelector(selector string) bool {
+	selector = strings.TrimSpace(selector)
+	return selector == "" || selector == "{}"
+}
+
+// resolveTimeRange fills in a zero start or end of the time range so ad-hoc queries without one query the default
+// window ending now instead of failing.
+func (d *PyroscopeDatasource) resolveTimeRange(timeRange backend.TimeRange, now time.Time) backend.TimeRange {
+	window := d.defaultTimeRange
+	if window <= 0 {
+		window = defaultTimeRangeWindow
+	}
+	if timeRange.To.IsZero() || timeRange.To.UnixMilli() == 0 {
+		timeRange.To = now
+	}
+	if timeRange.From.IsZero() || timeRange.From.UnixMilli() == 0 {
+		timeRange.From = timeRange.To.Add(-window)
+	}
+	return timeRange
+}
+
+// queryCacheKey builds the result cache key from everything that influences the result of the query.
+func queryCacheKey(pCtx backend.PluginContext, query backend.DataQuery, qm queryModel) string {
+	var uid string
+	if pCtx.DataSourceInstanceSettings != nil {
+		uid = pCtx.DataSourceInstanceSettings.UID
+	}
+	return fmt.Sprintf("%s|%s|%s|%v|%s|%v|%v|%s|%d|%s|%s|%v|%s|%d|%d|%s",
+		uid,
+		query.QueryType,
+		qm.ProfileTypeId,
+		qm.ProfileTypeIds,
+		qm.LabelSelector,
+		qm.GroupBy,
+		formatMaxNodes(qm.MaxNodes),
+		qm.Symbolization,
+		qm.FlamegraphSchemaVersion,
+		qm.ValueType,
+		qm.ChildSortOrder,
+		qm.MinNodeValuePercent,
+		qm.ValueRoundingStep,
+		comparisonCacheKey(query.QueryType, qm, query.TimeRange),
+		query.TimeRange.From.UnixMilli(),
+		query.TimeRange.To.UnixMilli(),
+		query.Interval,
+	)
+}
+
+// panelMaxNodes returns the number of flamegraph nodes that can be told apart in a panel of the size in pixels, so
+// bigger panels show more detail. It returns 0 when the size of the panel is not known.
+func panelMaxNodes(width, height int) int64 {
+	if width <= 0 || height <= 0 {
+		return 0
+	}
+	nodes := int64(width/flamegraphNodeWidth) * int64(height/flamegraphNodeHeight)
+	if nodes < 1 {
+		return 1
+	}
+	return nodes
+}
+
+func formatMaxNodes(maxNodes *int64) string {
+	if maxNodes == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d", *maxNodes)
+}
+
 // responseToDataFrames turns Pyroscope response to data.Frame. We encode the data into a nested set format where we have
 // [level, value, label] columns and by ordering the items in a depth first traversal order we can recreate the whole
-// tree back.
-func responseToDataFrames(resp *ProfileResponse) *data.Frame {
+// tree back. See profileTree for childSortOrder, minValuePercent and roundingStep.
+func responseToDataFrames(resp *ProfileResponse, schemaVersion int, childSortOrder string, minValuePercent float64, roundingStep int64) *data.Frame {
+	tree := profileTree(resp, childSortOrder, minValuePercent, roundingStep)
+	return treeToFlamegraphFrame(tree, resp.Units, schemaVersion)
+}
+
+// profileTree converts the flamebearer of the response into a tree without the nodes below minValuePercent of the
+// total value, with the values rounded to multiples of roundingStep when it is not 0, and with the children of the
+// nodes sorted in the childSortOrder.
+func profileTree(resp *ProfileResponse, childSortOrder string, minValuePercent float64, roundingStep int64) *ProfileTree {
 	tree := levelsToTree(resp.Flamebearer.Levels, resp.Flamebearer.Names)
-	return treeToNestedSetDataFrame(tree, resp.Units)
+	if tree != nil && minValuePercent > 0 {
+		tree = pruneTreeBelow(tree, int64(math.Ceil(float64(tree.Value)*minValuePercent/100)))
+	}
+	if tree != nil && roundingStep > 0 {
+		tree = roundTree(tree, roundingStep)
+	}
+	sortTree(tree, childSortOrder)
+	return tree
+}
+
+// treeToFlamegraphFrame turns the tree into a frame with the layout of the flamegraph schema version.
+func treeToFlamegraphFrame(tree *ProfileTree, unit string, schemaVersion int) *data.Frame {
+	if schemaVersion == flamegraphSchemaV1 {
+		return treeToNestedSetDataFrameV1(tree, unit)
+	}
+	return treeToNestedSetDataFrame(tree, unit)
+}
+
+// responseToLimitedDataFrame is responseToDataFrames, but when the serialized frame is bigger than maxBytes the
+// smallest nodes of the profile are dropped until it fits, and a notice is added to the frame.
+func responseToLimitedDataFrame(resp *ProfileResponse, maxBytes int64, schemaVersion int, childSortOrder string, minValuePercent float64, roundingStep int64) (*data.Frame, error) {
+	tree := profileTree(resp, childSortOrder, minValuePercent, roundingStep)
+	frame := treeToFlamegraphFrame(tree, resp.Units, schemaVersion)
+	size, err := frameSize(frame)
+	if err != nil || size <= maxBytes {
+		return frame, err
+	}
+
+	// Halve the number of nodes until the frame fits, or only the root is left.
+	for maxNodes := countNodes(tree) / 2; maxNodes >= 1; maxNodes /= 2 {
+		frame = treeToFlamegraphFrame(pruneTree(tree, maxNodes), resp.Units, schemaVersion)
+		size, err = frameSize(frame)
+		if err != nil {
+			return nil, err
+		}
+		if size <= maxBytes {
+			break
+		}
+	}
+
+	frame.AppendNotices(data.Notice{
+		Severity: data.NoticeSeverityWarning,
+		Text:     fmt.Sprintf("The flamegraph has been reduced to %d nodes because it exceeded the maximum size of %d bytes", frame.Rows(), maxBytes),
+	})
+	return frame, nil
+}
+
+// flamegraphValueType is the value type requested by the query, or the one fitting the unit of the profile type.
+func flamegraphValueType(valueType string, unit string) string {
+	if valueType != "" {
+		return valueType
+	}
+	if fractionalUnits[unit] {
+		return valueTypeFloat64
+	}
+	return valueTypeInt64
+}
+
+// withValueType converts the value and self fields of the flamegraph frame to float64 for valueTypeFloat64, the
+// fields are built as int64.
+func withValueType(frame *data.Frame, valueType string) *data.Frame {
+	if valueType != valueTypeFloat64 {
+		return frame
+	}
+	for i, field := range frame.Fields {
+		if field.Name != "value" && field.Name != "self" {
+			continue
+		}
+		values := make([]float64, field.Len())
+		for j := range values {
+			values[j] = float64(field.At(j).(int64))
+		}
+		converted := data.NewField(field.Name, field.Labels, values)
+		converted.Config = field.Config
+		frame.Fields[i] = converted
+	}
+	return frame
+}
+
+func frameSize(frame *data.Frame) (int64, error) {
+	b, err := json.Marshal(frame)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(b)), nil
+}
+
+func countNodes(tree *ProfileTree) int {
+	if tree == nil {
+		return 0
+	}
+	count := 0
+	walkTree(tree, func(*ProfileTree) {
+		count++
+	})
+	return count
+}
+
+// pruneTree returns a copy of the tree with about maxNodes of its biggest nodes, see pruneTreeBelow.
+func pruneTree(tree *ProfileTree, maxNodes int) *ProfileTree {
+	if tree == nil {
+		return nil
+	}
+	values := make([]int64, 0, maxNodes)
+	walkTree(tree, func(n *ProfileTree) {
+		values = append(values, n.Value)
+	})
+	sort.Slice(values, func(i, j int) bool { return values[i] > values[j] })
+	threshold := values[len(values)-1]
+	if maxNodes < len(values) {
+		threshold = values[maxNodes-1]
+	}
+	return pruneTreeBelow(tree, threshold)
+}
+
+// pruneTreeBelow returns a copy of the tree without the nodes whose value is below the threshold. The values of the
+// dropped nodes are added to the self value of their parent so the totals still add up.
+func pruneTreeBelow(tree *ProfileTree, threshold int64) *ProfileTree {
+	var prune func(n *ProfileTree) *ProfileTree
+	prune = func(n *ProfileTree) *ProfileTree {
+		pruned := &ProfileTree{Start: n.Start, Value: n.Value, Self: n.Self, Level: n.Level, Name: n.Name}
+		for _, child := range n.Nodes {
+			if child.Value < threshold {
+				pruned.Self += child.Value
+				continue
+			}
+			pruned.Nodes = append(pruned.Nodes, prune(child))
+		}
+		return pruned
+	}
+	return prune(tree)
+}
+
+// roundTree returns a copy of the tree with the values rounded to the nearest multiple of the step. The nodes rounded
+// to 0 are folded into their parent. The self values are what is left of the rounded values once the children are
+// taken, so the values of the children still add up to the value of their parent.
+func roundTree(tree *ProfileTree, step int64) *ProfileTree {
+	var round func(n *ProfileTree) *ProfileTree
+	round = func(n *ProfileTree) *ProfileTree {
+		rounded := &ProfileTree{Start: n.Start, Value: (n.Value + step/2) / step * step, Level: n.Level, Name: n.Name}
+		children := int64(0)
+		for _, child := range n.Nodes {
+			c := round(child)
+			if c.Value == 0 {
+				continue
+			}
+			rounded.Nodes = append(rounded.Nodes, c)
+			children += c.Value
+		}
+		// The children can round up above their parent, which then grows to hold them.
+		if children > rounded.Value {
+			rounded.Value = children
+		}
+		rounded.Self = rounded.Value - children
+		return rounded
+	}
+	return round(tree)
 }
 
 // START_OFFSET is offset of the bar relative to previous sibling
@@ -260,6 +823,28 @@ func levelsToTree(levels []*Level, names []string) *ProfileTree {
 	return tree
 }
 
+func isValidChildSortOrder(order string) bool {
+	return order == "" || order == childSortOrderValue || order == childSortOrderName
+}
+
+// sortTree sorts the children of every node of the tree in the order, so the flamegraph is the same for the same
+// profile regardless of the order Pyroscope reports the frames in. Ties are broken by name. The tree is left as it
+// is when the order is empty.
+func sortTree(tree *ProfileTree, order string) {
+	if tree == nil || order == "" {
+		return
+	}
+	walkTree(tree, func(node *ProfileTree) {
+		sort.SliceStable(node.Nodes, func(i, j int) bool {
+			a, b := node.Nodes[i], node.Nodes[j]
+			if order == childSortOrderValue && a.Value != b.Value {
+				return a.Value > b.Value
+			}
+			return a.Name < b.Name
+		})
+	})
+}
+
 type Function struct {
 	FunctionName string
 	FileName     string // optional
@@ -298,20 +883,41 @@ func (pt *ProfileTree) String() string {
 	return tree.String()
 }
 
-func getEmptyDataFrame() *data.Frame {
-	var emptyProfileDataFrame = data.NewFrame("response")
-	emptyProfileDataFrame.Meta = &data.FrameMeta{PreferredVisualization: "flamegraph"}
-	emptyProfileDataFrame.Fields = data.Fields{
-		data.NewField("level", nil, []int64{}),
-		data.NewField("value", nil, []int64{}),
-		data.NewField("self", nil, []int64{}),
-		data.NewField("label", nil, []string{}),
-	}
-	return emptyProfileDataFrame
-}
-
 type CustomMeta struct {
 	ProfileTypeID string
+	// Sampled is whether the values of the profile are estimates from sampled events rather than exact counts, see
+	// isSampledProfileType.
+	Sampled bool
+	// LabelSelector is the label selector the query ran with, once the default selector of the org and the
+	// normalization are applied, so it can be checked in the query inspector.
+	LabelSelector string
+}
+
+// exactProfileNames are the profiles that record every occurrence instead of sampling them, like the goroutine
+// profile that is a snapshot of all the goroutines.
+var exactProfileNames = map[string]bool{
+	"goroutine":    true,
+	"goroutines":   true,
+	"threadcreate": true,
+}
+
+// isSampledProfileType returns whether the values of the profile type are sampled estimates, which is the case for
+// all profiles but the exact ones.
+func isSampledProfileType(profileTypeID string) bool {
+	name, _, _ := strings.Cut(profileTypeID, ":")
+	return !exactProfileNames[name]
+}
+
+// withQueryMeta sets the CustomMeta of the profile type and the label selector of the query on the frame.
+func withQueryMeta(frame *data.Frame, qm queryModel) {
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+	frame.Meta.Custom = CustomMeta{
+		ProfileTypeID: qm.ProfileTypeId,
+		Sampled:       isSampledProfileType(qm.ProfileTypeId),
+		LabelSelector: qm.LabelSelector,
+	}
 }
 
 // treeToNestedSetDataFrame walks the tree depth first and adds items into the dataframe. This is a nested set format
@@ -347,6 +953,33 @@ func treeToNestedSetDataFrame(tree *ProfileTree, unit string) *data.Frame {
 	return frame
 }
 
+// treeToNestedSetDataFrameV1 is treeToNestedSetDataFrame with the frame names in a plain string label field, as
+// expected by the first version of the flamegraph schema.
+func treeToNestedSetDataFrameV1(tree *ProfileTree, unit string) *data.Frame {
+	frame := data.NewFrame("response")
+	frame.Meta = &data.FrameMeta{PreferredVisualization: "flamegraph"}
+
+	levelField := data.NewField("level", nil, []int64{})
+	valueField := data.NewField("value", nil, []int64{})
+	selfField := data.NewField("self", nil, []int64{})
+	labelField := data.NewField("label", nil, []string{})
+
+	valueField.Config = &data.FieldConfig{Unit: unit}
+	selfField.Config = &data.FieldConfig{Unit: unit}
+	frame.Fields = data.Fields{levelField, valueField, selfField, labelField}
+
+	if tree != nil {
+		walkTree(tree, func(tree *ProfileTree) {
+			levelField.Append(int64(tree.Level))
+			valueField.Append(tree.Value)
+			selfField.Append(tree.Self)
+			labelField.Append(tree.Name)
+		})
+	}
+
+	return frame
+}
+
 type EnumField struct {
 	field     *data.Field
 	valuesMap map[string]data.EnumItemIndex
@@ -405,10 +1038,40 @@ func walkTree(tree *ProfileTree, fn func(tree *ProfileTree)) {
 	}
 }
 
+// emptySeriesDataFrame is the frame of a series response without series, with the fields of the series frames, so
+// no data is reported like in the other query types.
+func emptySeriesDataFrame(resp *SeriesResponse) *data.Frame {
+	valueField := data.NewField(resp.Label, nil, []float64{})
+	valueField.Config = &data.FieldConfig{Unit: resp.Units}
+	frame := data.NewFrame("series", data.NewField("time", nil, []time.Time{}), valueField)
+	frame.Meta = &data.FrameMeta{PreferredVisualization: "graph"}
+	frame.AppendNotices(data.Notice{
+		Severity: data.NoticeSeverityInfo,
+		Text:     noProfileDataNotice,
+	})
+	return frame
+}
+
 func seriesToDataFrames(resp *SeriesResponse) []*data.Frame {
+	if len(resp.Series) == 0 {
+		return []*data.Frame{emptySeriesDataFrame(resp)}
+	}
 	frames := make([]*data.Frame, 0, len(resp.Series))
 
-	for _, series := range resp.Series {
+	// The frames are in the order of their sorted labels, so the legends list the series in the same order whatever
+	// the order Pyroscope reports them in
+	labelPairs := make([][]*LabelPair, len(resp.Series))
+	order := make([]int, len(resp.Series))
+	for i, series := range resp.Series {
+		labelPairs[i] = sortedLabelPairs(series.Labels)
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return compareLabelPairs(labelPairs[order[i]], labelPairs[order[j]]) < 0
+	})
+
+	for _, i := range order {
+		series := resp.Series[i]
 		// We create separate data frames as the series may not have the same length
 		frame := data.NewFrame("series")
 		frame.Meta = &data.FrameMeta{PreferredVisualization: "graph"}
@@ -418,7 +1081,7 @@ func seriesToDataFrames(resp *SeriesResponse) []*data.Frame {
 		fields = append(fields, timeField)
 
 		labels := make(map[string]string)
-		for _, label := range series.Labels {
+		for _, label := range labelPairs[i] {
 			labels[label.Name] = label.Value
 		}
 
@@ -436,3 +1099,31 @@ func seriesToDataFrames(resp *SeriesResponse) []*data.Frame {
 	}
 	return frames
 }
+
+// sortedLabelPairs returns the label pairs sorted by name and then value, so the labels of the series frames are the
+// same regardless of the order Pyroscope reports them in, even when a name is repeated.
+func sortedLabelPairs(pairs []*LabelPair) []*LabelPair {
+	sorted := make([]*LabelPair, len(pairs))
+	copy(sorted, pairs)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+	return sorted
+}
+
+// compareLabelPairs compares the sorted label pairs of two series pair by pair, by name and then value. A series
+// whose pairs are a prefix of the pairs of the other one comes first.
+func compareLabelPairs(a, b []*LabelPair) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := strings.Compare(a[i].Name, b[i].Name); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a[i].Value, b[i].Value); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
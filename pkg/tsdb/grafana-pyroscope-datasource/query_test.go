@@ -2,11 +2,16 @@ package pyroscope
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/live"
 	"github.com/stretchr/testify/require"
 )
 
@@ -47,6 +52,79 @@ func Test_query(t *testing.T) {
 		require.Equal(t, data.NewField("level", nil, []int64{0, 1, 2}), resp.Frames[0].Fields[0])
 	})
 
+	t.Run("query profile with streaming", func(t *testing.T) {
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeProfile
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","labelSelector":"{app=\"baz\"}","groupBy":["service_name"],"WithStreaming":true}`)
+		ds := &PyroscopeDatasource{client: client, streamQueries: newTTLCache[json.RawMessage](time.Minute)}
+		streamCtx := pCtx
+		streamCtx.DataSourceInstanceSettings = &backend.DataSourceInstanceSettings{UID: "pyroscope", JSONData: pCtx.DataSourceInstanceSettings.JSONData}
+		resp := ds.query(context.Background(), streamCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.Len(t, resp.Frames, 1)
+		meta := resp.Frames[0].Meta
+		require.Equal(t, data.VisType("flamegraph"), meta.PreferredVisualization)
+
+		channel, err := live.ParseChannel(meta.Channel)
+		require.NoError(t, err)
+		q, err := ds.parseStreamPath(channel.Path, nil)
+		require.NoError(t, err)
+		require.Equal(t, streamQuery{
+			ProfileTypeID: "memory:alloc_objects:count:space:bytes",
+			LabelSelector: `{app="baz"}`,
+			GroupBy:       []string{"service_name"},
+		}, q)
+	})
+
+	t.Run("query profile without data in range", func(t *testing.T) {
+		ds := &PyroscopeDatasource{
+			client: &FakeClient{EmptyProfile: true},
+		}
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeProfile
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.Equal(t, 1, len(resp.Frames))
+		require.Equal(t, 0, resp.Frames[0].Rows())
+		require.Equal(t, 4, len(resp.Frames[0].Fields))
+		require.Equal(t, []data.Notice{{Severity: data.NoticeSeverityInfo, Text: noProfileDataNotice}}, resp.Frames[0].Meta.Notices)
+	})
+
+	t.Run("frames tell whether the profile is sampled", func(t *testing.T) {
+		dataQuery := makeDataQuery()
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		for _, frame := range resp.Frames {
+			require.Equal(t, CustomMeta{ProfileTypeID: "memory:alloc_objects:count:space:bytes", Sampled: true, LabelSelector: `{app="baz"}`}, frame.Meta.Custom)
+		}
+
+		dataQuery.JSON = []byte(`{"profileTypeId":"goroutines:goroutine:count:goroutine:count"}`)
+		resp = ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.Len(t, resp.Frames, 2)
+		for _, frame := range resp.Frames {
+			require.Equal(t, CustomMeta{ProfileTypeID: "goroutines:goroutine:count:goroutine:count", Sampled: false}, frame.Meta.Custom)
+		}
+	})
+
+	t.Run("frames have the effective label selector", func(t *testing.T) {
+		ds := &PyroscopeDatasource{
+			client:              client,
+			normalizeSelectors:  true,
+			orgDefaultSelectors: map[int64]string{1: `{service_name="checkout", env="prod"}`},
+		}
+		dataQuery := makeDataQuery()
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","labelSelector":"{}"}`)
+		orgCtx := pCtx
+		orgCtx.OrgID = 1
+		resp := ds.query(context.Background(), orgCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.Len(t, resp.Frames, 2)
+		for _, frame := range resp.Frames {
+			require.Equal(t, `{env="prod", service_name="checkout"}`, frame.Meta.Custom.(CustomMeta).LabelSelector)
+		}
+	})
+
 	t.Run("query metrics", func(t *testing.T) {
 		dataQuery := makeDataQuery()
 		dataQuery.QueryType = queryTypeMetrics
@@ -91,6 +169,167 @@ func Test_query(t *testing.T) {
 		require.True(t, ok)
 		require.Equal(t, []string{"app", "instance"}, groupBy)
 	})
+
+	t.Run("query with selector normalization", func(t *testing.T) {
+		client := &FakeClient{}
+		ds := &PyroscopeDatasource{
+			client:             client,
+			normalizeSelectors: true,
+		}
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeMetrics
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","labelSelector":"{ pod='a',app=\"baz\" }"}`)
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.Equal(t, `{app="baz", pod="a"}`, client.Args[1])
+	})
+
+	t.Run("query with an unsupported flamegraph schema version", func(t *testing.T) {
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeProfile
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","flamegraphSchemaVersion":99}`)
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.EqualError(t, resp.Error, "unsupported flamegraph schema version 99")
+	})
+
+	t.Run("query profile with float64 values", func(t *testing.T) {
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeProfile
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","valueType":"float64"}`)
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.Equal(t, data.NewField("level", nil, []int64{0, 1, 2}), resp.Frames[0].Fields[0])
+		require.Equal(t, []float64{10, 9, 8}, fieldValues[float64](resp.Frames[0].Fields[1]))
+		require.Equal(t, []float64{0, 0, 8}, fieldValues[float64](resp.Frames[0].Fields[2]))
+		require.Equal(t, "count", resp.Frames[0].Fields[1].Config.Unit)
+	})
+
+	t.Run("query with an unsupported value type", func(t *testing.T) {
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeProfile
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","valueType":"int32"}`)
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.EqualError(t, resp.Error, `unsupported flamegraph value type "int32"`)
+	})
+
+	t.Run("query with an unsupported child sort order", func(t *testing.T) {
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeProfile
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","childSortOrder":"random"}`)
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.EqualError(t, resp.Error, `unsupported child sort order "random"`)
+	})
+
+	t.Run("query with a minimum node value percent out of range", func(t *testing.T) {
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeProfile
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","minNodeValuePercent":120}`)
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.EqualError(t, resp.Error, "minimum node value percent must be between 0 and 100, got 120")
+	})
+
+	t.Run("query with a negative value rounding step", func(t *testing.T) {
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeProfile
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_space:bytes:space:bytes","valueRoundingStep":-1}`)
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.EqualError(t, resp.Error, "value rounding step must not be negative, got -1")
+	})
+
+	t.Run("query without a time range uses the default window", func(t *testing.T) {
+		client := &FakeClient{}
+		ds := &PyroscopeDatasource{
+			client:           client,
+			defaultTimeRange: 30 * time.Minute,
+		}
+
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeMetrics
+		dataQuery.TimeRange = backend.TimeRange{}
+		before := time.Now()
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+
+		start, end := client.Args[2].(int64), client.Args[3].(int64)
+		require.Equal(t, (30 * time.Minute).Milliseconds(), end-start)
+		require.GreaterOrEqual(t, end, before.UnixMilli())
+	})
+
+	t.Run("query without a selector uses the default selector of the org", func(t *testing.T) {
+		client := &FakeClient{}
+		ds := &PyroscopeDatasource{
+			client: client,
+			orgDefaultSelectors: map[int64]string{
+				1: `{service_name="team-a"}`,
+				2: `{service_name="team-b"}`,
+			},
+		}
+
+		for orgID, expected := range map[int64]string{1: `{service_name="team-a"}`, 2: `{service_name="team-b"}`, 3: "{}"} {
+			dataQuery := makeDataQuery()
+			dataQuery.QueryType = queryTypeMetrics
+			dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","labelSelector":"{}"}`)
+			orgCtx := pCtx
+			orgCtx.OrgID = orgID
+			resp := ds.query(context.Background(), orgCtx, *dataQuery)
+			require.Nil(t, resp.Error)
+			require.Equal(t, expected, client.Args[1])
+		}
+
+		// An explicit selector is kept
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeMetrics
+		orgCtx := pCtx
+		orgCtx.OrgID = 1
+		resp := ds.query(context.Background(), orgCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.NotEqual(t, `{service_name="team-a"}`, client.Args[1])
+	})
+
+	t.Run("query must match the required matcher label", func(t *testing.T) {
+		ds := &PyroscopeDatasource{client: &FakeClient{}, requiredMatcherLabel: "service_name"}
+		query := func(json string) backend.DataResponse {
+			dataQuery := makeDataQuery()
+			dataQuery.QueryType = queryTypeProfile
+			dataQuery.JSON = []byte(json)
+			return ds.query(context.Background(), pCtx, *dataQuery)
+		}
+
+		resp := query(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","labelSelector":"{service_name=\"foo\"}"}`)
+		require.Nil(t, resp.Error)
+
+		resp = query(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","labelSelector":"{app=\"foo\"}"}`)
+		require.ErrorContains(t, resp.Error, "must match the service_name label")
+
+		resp = query(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","labelSelector":"{service_name=\"foo\"}","comparisonMode":"sideBySide","comparison":{"labelSelector":"{}"}}`)
+		require.ErrorContains(t, resp.Error, "must match the service_name label")
+	})
+
+	t.Run("query bypasses a warm cache when asked to", func(t *testing.T) {
+		client := &FakeClient{}
+		ds := &PyroscopeDatasource{
+			client:     client,
+			queryCache: newTTLCache[backend.DataResponse](time.Minute),
+		}
+
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeMetrics
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.Equal(t, 1, client.SeriesCalls)
+
+		// Served from the cache
+		resp = ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.Equal(t, 1, len(resp.Frames))
+		require.Equal(t, 1, client.SeriesCalls)
+
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes","labelSelector":"{app=\\\"baz\\\"}","bypassCache":true}`)
+		resp = ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.Equal(t, 1, len(resp.Frames))
+		require.Equal(t, 2, client.SeriesCalls)
+	})
 }
 
 func makeDataQuery() *backend.DataQuery {
@@ -116,6 +355,95 @@ func fieldValues[T any](field *data.Field) []T {
 }
 
 // This is where the tests for the datasource backend live.
+func Test_emptyFrames(t *testing.T) {
+	ds := &PyroscopeDatasource{client: &FakeClient{EmptyProfile: true, EmptySeries: true}}
+	pCtx := backend.PluginContext{
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			JSONData: []byte(`{}`),
+		},
+	}
+	noDataNotice := []data.Notice{{Severity: data.NoticeSeverityInfo, Text: noProfileDataNotice}}
+
+	query := func(t *testing.T, queryType string, model string) backend.DataResponse {
+		t.Helper()
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryType
+		dataQuery.JSON = []byte(model)
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		return resp
+	}
+	fieldTypes := func(frame *data.Frame) []data.FieldType {
+		types := make([]data.FieldType, len(frame.Fields))
+		for i, field := range frame.Fields {
+			types[i] = field.Type()
+		}
+		return types
+	}
+
+	t.Run("flamegraph", func(t *testing.T) {
+		resp := query(t, queryTypeProfile, `{"profileTypeId":"memory:alloc_objects:count:space:bytes"}`)
+		require.Len(t, resp.Frames, 1)
+		frame := resp.Frames[0]
+		require.Equal(t, 0, frame.Rows())
+		require.Equal(t, noDataNotice, frame.Meta.Notices)
+		require.Equal(t, []data.FieldType{data.FieldTypeInt64, data.FieldTypeInt64, data.FieldTypeInt64, data.FieldTypeEnum}, fieldTypes(frame))
+	})
+
+	t.Run("flamegraph of the first schema version", func(t *testing.T) {
+		resp := query(t, queryTypeProfile, `{"profileTypeId":"memory:alloc_objects:count:space:bytes","flamegraphSchemaVersion":1}`)
+		require.Len(t, resp.Frames, 1)
+		require.Equal(t, 0, resp.Frames[0].Rows())
+		require.Equal(t, []data.FieldType{data.FieldTypeInt64, data.FieldTypeInt64, data.FieldTypeInt64, data.FieldTypeString}, fieldTypes(resp.Frames[0]))
+	})
+
+	t.Run("flamegraph with float64 values", func(t *testing.T) {
+		resp := query(t, queryTypeProfile, `{"profileTypeId":"memory:alloc_objects:count:space:bytes","valueType":"float64"}`)
+		require.Len(t, resp.Frames, 1)
+		require.Equal(t, []data.FieldType{data.FieldTypeInt64, data.FieldTypeFloat64, data.FieldTypeFloat64, data.FieldTypeEnum}, fieldTypes(resp.Frames[0]))
+	})
+
+	t.Run("series", func(t *testing.T) {
+		resp := query(t, queryTypeMetrics, `{"profileTypeId":"memory:alloc_objects:count:space:bytes"}`)
+		require.Len(t, resp.Frames, 1)
+		frame := resp.Frames[0]
+		require.Equal(t, 0, frame.Rows())
+		require.Equal(t, noDataNotice, frame.Meta.Notices)
+		require.Equal(t, data.VisType(data.VisTypeGraph), frame.Meta.PreferredVisualization)
+		require.Equal(t, []data.FieldType{data.FieldTypeTime, data.FieldTypeFloat64}, fieldTypes(frame))
+		require.Equal(t, "test", frame.Fields[1].Name)
+		require.Equal(t, "count", frame.Fields[1].Config.Unit)
+	})
+
+	t.Run("diff", func(t *testing.T) {
+		resp := query(t, queryTypeDiff, `{"profileTypeId":"memory:alloc_objects:count:space:bytes"}`)
+		require.Len(t, resp.Frames, 1)
+		frame := resp.Frames[0]
+		require.Equal(t, 0, frame.Rows())
+		require.Equal(t, noDataNotice, frame.Meta.Notices)
+		require.Len(t, frame.Fields, 8)
+	})
+
+	t.Run("side by side comparison", func(t *testing.T) {
+		resp := query(t, queryTypeProfile, `{"profileTypeId":"memory:alloc_objects:count:space:bytes","comparisonMode":"sideBySide"}`)
+		require.Len(t, resp.Frames, 2)
+		for _, frame := range resp.Frames {
+			require.Equal(t, 0, frame.Rows())
+			require.Equal(t, noDataNotice, frame.Meta.Notices)
+			require.Equal(t, []data.FieldType{data.FieldTypeInt64, data.FieldTypeInt64, data.FieldTypeInt64, data.FieldTypeEnum}, fieldTypes(frame))
+		}
+	})
+
+	t.Run("table", func(t *testing.T) {
+		resp := query(t, queryTypeSummary, `{"profileTypeId":"memory:alloc_objects:count:space:bytes"}`)
+		require.Len(t, resp.Frames, 1)
+		frame := resp.Frames[0]
+		require.Equal(t, 1, frame.Rows())
+		require.Equal(t, []data.FieldType{data.FieldTypeString, data.FieldTypeString, data.FieldTypeInt64, data.FieldTypeInt64}, fieldTypes(frame))
+		require.Equal(t, []int64{0}, fieldValues[int64](frame.Fields[2]))
+	})
+}
+
 func Test_profileToDataFrame(t *testing.T) {
 	profile := &ProfileResponse{
 		Flamebearer: &Flamebearer{
@@ -129,7 +457,7 @@ func Test_profileToDataFrame(t *testing.T) {
 		},
 		Units: "short",
 	}
-	frame := responseToDataFrames(profile)
+	frame := responseToDataFrames(profile, latestFlamegraphSchema, "", 0, 0)
 	require.Equal(t, 4, len(frame.Fields))
 	require.Equal(t, data.NewField("level", nil, []int64{0, 1, 1}), frame.Fields[0])
 	require.Equal(t, data.NewField("value", nil, []int64{20, 10, 5}).SetConfig(&data.FieldConfig{Unit: "short"}), frame.Fields[1])
@@ -187,6 +515,149 @@ func Test_levelsToTree(t *testing.T) {
 	})
 }
 
+func Test_sortTree(t *testing.T) {
+	newTree := func() *ProfileTree {
+		return &ProfileTree{
+			Value: 100, Level: 0, Name: "root", Nodes: []*ProfileTree{
+				{Value: 20, Level: 1, Name: "func2"},
+				{Value: 50, Level: 1, Name: "func3", Nodes: []*ProfileTree{
+					{Value: 10, Level: 2, Name: "func5"},
+					{Value: 30, Level: 2, Name: "func4"},
+				}},
+				{Value: 20, Level: 1, Name: "func1"},
+			},
+		}
+	}
+	labels := func(tree *ProfileTree) []string {
+		var names []string
+		walkTree(tree, func(node *ProfileTree) {
+			names = append(names, node.Name)
+		})
+		return names
+	}
+
+	t.Run("by value with ties broken by name", func(t *testing.T) {
+		tree := newTree()
+		sortTree(tree, childSortOrderValue)
+		require.Equal(t, []string{"root", "func3", "func4", "func5", "func1", "func2"}, labels(tree))
+	})
+
+	t.Run("by name", func(t *testing.T) {
+		tree := newTree()
+		sortTree(tree, childSortOrderName)
+		require.Equal(t, []string{"root", "func1", "func2", "func3", "func4", "func5"}, labels(tree))
+	})
+
+	t.Run("empty order keeps the reported order", func(t *testing.T) {
+		tree := newTree()
+		sortTree(tree, "")
+		require.Equal(t, []string{"root", "func2", "func3", "func5", "func4", "func1"}, labels(tree))
+	})
+
+	t.Run("frame follows the order", func(t *testing.T) {
+		profile := &ProfileResponse{
+			Flamebearer: &Flamebearer{
+				Names:  []string{"root", "b", "a"},
+				Levels: []*Level{{Values: []int64{0, 30, 0, 0}}, {Values: []int64{0, 10, 10, 1, 0, 20, 20, 2}}},
+			},
+			Units: "short",
+		}
+		frame := responseToDataFrames(profile, flamegraphSchemaV1, childSortOrderValue, 0, 0)
+		require.Equal(t, []int64{30, 20, 10}, fieldValues[int64](frame.Fields[1]))
+		require.Equal(t, []string{"root", "a", "b"}, fieldValues[string](frame.Fields[3]))
+	})
+}
+
+func Test_profileTree(t *testing.T) {
+	// root(100) -> func1(60) -> func3(2), func2(38) -> func4(1)
+	resp := &ProfileResponse{
+		Flamebearer: &Flamebearer{
+			Names: []string{"root", "func1", "func2", "func3", "func4"},
+			Levels: []*Level{
+				{Values: []int64{0, 100, 2, 0}},
+				{Values: []int64{0, 60, 58, 1, 0, 38, 37, 2}},
+				{Values: []int64{0, 2, 2, 3, 58, 1, 1, 4}},
+			},
+		},
+	}
+
+	t.Run("keeps all nodes without a threshold", func(t *testing.T) {
+		require.Equal(t, 5, countNodes(profileTree(resp, "", 0, 0)))
+	})
+
+	t.Run("folds the nodes below the threshold into their parent", func(t *testing.T) {
+		tree := profileTree(resp, "", 5, 0)
+		require.Equal(t, &ProfileTree{
+			Value: 100, Self: 2, Name: "root", Nodes: []*ProfileTree{
+				{Value: 60, Self: 60, Level: 1, Name: "func1"},
+				{Start: 60, Value: 38, Self: 38, Level: 1, Name: "func2"},
+			},
+		}, tree)
+	})
+
+	t.Run("nodes at the threshold are kept", func(t *testing.T) {
+		tree := profileTree(resp, "", 38, 0)
+		require.Len(t, tree.Nodes, 2)
+		require.Equal(t, int64(2), tree.Self)
+
+		tree = profileTree(resp, "", 39, 0)
+		require.Len(t, tree.Nodes, 1)
+		require.Equal(t, int64(40), tree.Self)
+		require.Equal(t, int64(100), tree.Value)
+	})
+}
+
+func Test_roundTree(t *testing.T) {
+	const step = 1_000_000
+	// total(1000000000) -> malloc(600400000), alloc(399000000) -> small(400000)
+	tree := &ProfileTree{
+		Value: 1_000_000_000, Self: 600_000, Name: "total", Nodes: []*ProfileTree{
+			{Value: 600_400_000, Self: 600_400_000, Level: 1, Name: "malloc"},
+			{Start: 600_400_000, Value: 399_000_000, Self: 398_600_000, Level: 1, Name: "alloc", Nodes: []*ProfileTree{
+				{Start: 600_400_000, Value: 400_000, Self: 400_000, Level: 2, Name: "small"},
+			}},
+		},
+	}
+
+	t.Run("rounds the values and folds the nodes rounded to 0 into their parent", func(t *testing.T) {
+		require.Equal(t, &ProfileTree{
+			Value: 1_000_000_000, Self: 1_000_000, Name: "total", Nodes: []*ProfileTree{
+				{Value: 600_000_000, Self: 600_000_000, Level: 1, Name: "malloc"},
+				{Start: 600_400_000, Value: 399_000_000, Self: 399_000_000, Level: 1, Name: "alloc"},
+			},
+		}, roundTree(tree, step))
+		require.Equal(t, int64(400_000), tree.Nodes[1].Nodes[0].Value, "the tree is not modified")
+	})
+
+	t.Run("parents hold the children rounded up", func(t *testing.T) {
+		rounded := roundTree(&ProfileTree{
+			Value: 12_000_000, Name: "total", Nodes: []*ProfileTree{
+				{Value: 6_500_000, Self: 6_500_000, Level: 1, Name: "foo"},
+				{Start: 6_500_000, Value: 5_500_000, Self: 5_500_000, Level: 1, Name: "bar"},
+			},
+		}, step)
+		require.Equal(t, int64(13_000_000), rounded.Value)
+		require.Equal(t, int64(0), rounded.Self)
+		require.InDelta(t, 12_000_000, rounded.Value, float64(len(rounded.Nodes)*step))
+	})
+
+	t.Run("keeps the root total of a profile within the step", func(t *testing.T) {
+		profile := &ProfileResponse{Flamebearer: &Flamebearer{
+			Names: []string{"total", "malloc", "alloc", "small"},
+			Levels: []*Level{
+				{Values: []int64{0, 1_000_300_000, 300_000, 0}},
+				{Values: []int64{0, 600_400_000, 600_400_000, 1, 0, 399_600_000, 399_200_000, 2}},
+				{Values: []int64{600_400_000, 400_000, 400_000, 3}},
+			},
+		}}
+		exact := profileTree(profile, "", 0, 0)
+		rounded := profileTree(profile, "", 0, step)
+		require.InDelta(t, exact.Value, rounded.Value, step/2)
+		require.Equal(t, 3, countNodes(rounded))
+		require.Equal(t, rounded.Value, rounded.Self+rounded.Nodes[0].Value+rounded.Nodes[1].Value)
+	})
+}
+
 func Test_treeToNestedDataFrame(t *testing.T) {
 	t.Run("sample profile tree", func(t *testing.T) {
 		tree := &ProfileTree{
@@ -226,6 +697,206 @@ func Test_treeToNestedDataFrame(t *testing.T) {
 	})
 }
 
+func Test_treeToFlamegraphFrame(t *testing.T) {
+	tree := &ProfileTree{
+		Value: 100, Level: 0, Self: 60, Name: "root", Nodes: []*ProfileTree{
+			{Value: 40, Level: 1, Self: 40, Name: "func1"},
+		},
+	}
+	fieldTypes := func(frame *data.Frame) []data.FieldType {
+		types := make([]data.FieldType, len(frame.Fields))
+		for i, f := range frame.Fields {
+			types[i] = f.Type()
+		}
+		return types
+	}
+
+	t.Run("schema v1 has a string label field", func(t *testing.T) {
+		frame := treeToFlamegraphFrame(tree, "short", flamegraphSchemaV1)
+		require.Equal(t, []data.FieldType{data.FieldTypeInt64, data.FieldTypeInt64, data.FieldTypeInt64, data.FieldTypeString}, fieldTypes(frame))
+		require.Equal(t, data.NewField("label", nil, []string{"root", "func1"}), frame.Fields[3])
+	})
+
+	t.Run("schema v2 has an enum label field", func(t *testing.T) {
+		frame := treeToFlamegraphFrame(tree, "short", flamegraphSchemaV2)
+		require.Equal(t, []data.FieldType{data.FieldTypeInt64, data.FieldTypeInt64, data.FieldTypeInt64, data.FieldTypeEnum}, fieldTypes(frame))
+		require.Equal(t, []string{"root", "func1"}, frame.Fields[3].Config.TypeConfig.Enum.Text)
+	})
+
+	t.Run("latest schema is the default", func(t *testing.T) {
+		require.Equal(t, treeToFlamegraphFrame(tree, "short", latestFlamegraphSchema), treeToFlamegraphFrame(tree, "short", 0))
+	})
+}
+
+func Test_withValueType(t *testing.T) {
+	tree := &ProfileTree{
+		Value: 100, Level: 0, Self: 60, Name: "root", Nodes: []*ProfileTree{
+			{Value: 40, Level: 1, Self: 40, Name: "func1"},
+		},
+	}
+
+	t.Run("int64 keeps the values", func(t *testing.T) {
+		frame := withValueType(treeToFlamegraphFrame(tree, "short", latestFlamegraphSchema), valueTypeInt64)
+		require.Equal(t, data.FieldTypeInt64, frame.Fields[1].Type())
+		require.Equal(t, []int64{100, 40}, fieldValues[int64](frame.Fields[1]))
+		require.Equal(t, []int64{60, 40}, fieldValues[int64](frame.Fields[2]))
+	})
+
+	t.Run("float64 converts the value and self fields", func(t *testing.T) {
+		frame := withValueType(treeToFlamegraphFrame(tree, "short", latestFlamegraphSchema), valueTypeFloat64)
+		require.Equal(t, data.FieldTypeInt64, frame.Fields[0].Type())
+		require.Equal(t, []float64{100, 40}, fieldValues[float64](frame.Fields[1]))
+		require.Equal(t, []float64{60, 40}, fieldValues[float64](frame.Fields[2]))
+		require.Equal(t, "short", frame.Fields[1].Config.Unit)
+		require.Equal(t, "short", frame.Fields[2].Config.Unit)
+	})
+
+	t.Run("value type defaults from the unit", func(t *testing.T) {
+		require.Equal(t, valueTypeInt64, flamegraphValueType("", "bytes"))
+		require.Equal(t, valueTypeFloat64, flamegraphValueType("", "percent"))
+		require.Equal(t, valueTypeInt64, flamegraphValueType(valueTypeInt64, "percent"))
+	})
+}
+
+func Test_responseToLimitedDataFrame(t *testing.T) {
+	// A root with many children of increasing value
+	names := []string{"root"}
+	var total int64
+	var children []int64
+	for i := int64(1); i <= 200; i++ {
+		names = append(names, fmt.Sprintf("function_with_a_long_name_%d", i))
+		children = append(children, 0, i, i, i)
+		total += i
+	}
+	resp := &ProfileResponse{
+		Flamebearer: &Flamebearer{
+			Names: names,
+			Levels: []*Level{
+				{Values: []int64{0, total, 0, 0}},
+				{Values: children},
+			},
+			Total: total,
+		},
+		Units: "short",
+	}
+
+	full, err := frameSize(responseToDataFrames(resp, latestFlamegraphSchema, "", 0, 0))
+	require.NoError(t, err)
+
+	t.Run("profile under the cap is not changed", func(t *testing.T) {
+		frame, err := responseToLimitedDataFrame(resp, full, latestFlamegraphSchema, "", 0, 0)
+		require.NoError(t, err)
+		require.Equal(t, 201, frame.Rows())
+		require.Nil(t, frame.Meta.Notices)
+	})
+
+	t.Run("large profile is reduced below the cap", func(t *testing.T) {
+		maxBytes := full / 3
+		frame, err := responseToLimitedDataFrame(resp, maxBytes, latestFlamegraphSchema, "", 0, 0)
+		require.NoError(t, err)
+
+		size, err := frameSize(frame)
+		require.NoError(t, err)
+		require.LessOrEqual(t, size, maxBytes)
+		require.Less(t, frame.Rows(), 201)
+		require.Len(t, frame.Meta.Notices, 1)
+		require.Equal(t, data.NoticeSeverityWarning, frame.Meta.Notices[0].Severity)
+
+		// Root keeps its value and the dropped children are accounted in its self value
+		require.Equal(t, total, frame.Fields[1].At(0))
+		var childrenTotal int64
+		for i := 1; i < frame.Rows(); i++ {
+			childrenTotal += frame.Fields[1].At(i).(int64)
+		}
+		require.Equal(t, total, frame.Fields[2].At(0).(int64)+childrenTotal)
+	})
+}
+
+func Test_resolveTimeRange(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+
+	t.Run("zero time range uses the default window", func(t *testing.T) {
+		ds := &PyroscopeDatasource{}
+		tr := ds.resolveTimeRange(backend.TimeRange{}, now)
+		require.Equal(t, backend.TimeRange{From: now.Add(-time.Hour), To: now}, tr)
+	})
+
+	t.Run("zero start uses the configured window before the end", func(t *testing.T) {
+		ds := &PyroscopeDatasource{defaultTimeRange: 5 * time.Minute}
+		to := time.UnixMilli(1600000000000)
+		tr := ds.resolveTimeRange(backend.TimeRange{From: time.UnixMilli(0), To: to}, now)
+		require.Equal(t, backend.TimeRange{From: to.Add(-5 * time.Minute), To: to}, tr)
+	})
+
+	t.Run("time range is kept when set", func(t *testing.T) {
+		ds := &PyroscopeDatasource{}
+		tr := backend.TimeRange{From: time.UnixMilli(10000), To: time.UnixMilli(20000)}
+		require.Equal(t, tr, ds.resolveTimeRange(tr, now))
+	})
+}
+
+func Test_panelMaxNodes(t *testing.T) {
+	require.Equal(t, int64(2000), panelMaxNodes(1000, 400))
+	require.Equal(t, int64(500), panelMaxNodes(500, 200))
+	require.Equal(t, int64(1), panelMaxNodes(5, 5))
+	require.Equal(t, int64(0), panelMaxNodes(0, 400))
+	require.Equal(t, int64(0), panelMaxNodes(1000, 0))
+}
+
+func Test_queryMaxNodes(t *testing.T) {
+	pCtx := backend.PluginContext{
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			JSONData: []byte(`{}`),
+		},
+	}
+	maxNodes := func(ds *PyroscopeDatasource, query string) *int64 {
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeProfile
+		dataQuery.JSON = []byte(query)
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.NoError(t, resp.Error)
+		return ds.client.(*FakeClient).MaxNodes
+	}
+
+	t.Run("derived from the panel size", func(t *testing.T) {
+		ds := &PyroscopeDatasource{client: &FakeClient{}}
+		require.Equal(t, int64(2000), *maxNodes(ds, `{"profileTypeId":"memory:alloc_objects:count:space:bytes","panelWidth":1000,"panelHeight":400}`))
+
+		ds = &PyroscopeDatasource{client: &FakeClient{}, maxNodes: 1024}
+		require.Equal(t, int64(500), *maxNodes(ds, `{"profileTypeId":"memory:alloc_objects:count:space:bytes","panelWidth":500,"panelHeight":200}`))
+	})
+
+	t.Run("panel size capped by the datasource default", func(t *testing.T) {
+		ds := &PyroscopeDatasource{client: &FakeClient{}, maxNodes: 1024}
+		require.Equal(t, int64(1024), *maxNodes(ds, `{"profileTypeId":"memory:alloc_objects:count:space:bytes","panelWidth":1000,"panelHeight":400}`))
+	})
+
+	t.Run("datasource default without panel size", func(t *testing.T) {
+		ds := &PyroscopeDatasource{client: &FakeClient{}, maxNodes: 1024}
+		require.Equal(t, int64(1024), *maxNodes(ds, `{"profileTypeId":"memory:alloc_objects:count:space:bytes","panelWidth":1000}`))
+
+		ds = &PyroscopeDatasource{client: &FakeClient{}}
+		require.Nil(t, maxNodes(ds, `{"profileTypeId":"memory:alloc_objects:count:space:bytes"}`))
+	})
+
+	t.Run("query max nodes wins", func(t *testing.T) {
+		ds := &PyroscopeDatasource{client: &FakeClient{}, maxNodes: 1024}
+		require.Equal(t, int64(100), *maxNodes(ds, `{"profileTypeId":"memory:alloc_objects:count:space:bytes","maxNodes":100,"panelWidth":1000,"panelHeight":400}`))
+	})
+
+	t.Run("maxNodesDefault of the datasource settings", func(t *testing.T) {
+		instance, err := NewPyroscopeDatasource(context.Background(), httpclient.NewProvider(), backend.DataSourceInstanceSettings{
+			URL:      "http://localhost:4040",
+			JSONData: []byte(`{"maxNodesDefault":512}`),
+		}, nil)
+		require.NoError(t, err)
+		ds := instance.(*PyroscopeDatasource)
+		ds.client = &FakeClient{}
+		require.Equal(t, int64(512), *maxNodes(ds, `{"profileTypeId":"memory:alloc_objects:count:space:bytes"}`))
+		require.Equal(t, int64(100), *maxNodes(ds, `{"profileTypeId":"memory:alloc_objects:count:space:bytes","maxNodes":100}`))
+	})
+}
+
 func Test_seriesToDataFrame(t *testing.T) {
 	t.Run("single series", func(t *testing.T) {
 		series := &SeriesResponse{
@@ -269,13 +940,98 @@ func Test_seriesToDataFrame(t *testing.T) {
 		require.Equal(t, data.NewField("samples", map[string]string{"foo": "bar"}, []float64{30, 10}).SetConfig(&data.FieldConfig{Unit: "short"}), frames[0].Fields[1])
 		require.Equal(t, data.NewField("samples", map[string]string{"foo": "baz"}, []float64{30, 10}).SetConfig(&data.FieldConfig{Unit: "short"}), frames[1].Fields[1])
 	})
+
+	t.Run("no series", func(t *testing.T) {
+		frames := seriesToDataFrames(&SeriesResponse{Units: "short", Label: "samples"})
+		require.Len(t, frames, 1)
+		require.Equal(t, 0, frames[0].Rows())
+		require.Equal(t, data.NewField("samples", nil, []float64{}).SetConfig(&data.FieldConfig{Unit: "short"}), frames[0].Fields[1])
+	})
+
+	t.Run("labels are in sorted key order", func(t *testing.T) {
+		labels := []*LabelPair{{Name: "service_name", Value: "app"}, {Name: "env", Value: "prod"}, {Name: "az", Value: "b"}, {Name: "az", Value: "a"}}
+		resp := &SeriesResponse{
+			Series: []*Series{{Labels: labels, Points: []*Point{{Timestamp: int64(1000), Value: 30}}}},
+			Units:  "short",
+			Label:  "samples",
+		}
+		frames := seriesToDataFrames(resp)
+		require.Equal(t, `az=b, env=prod, service_name=app`, frames[0].Fields[1].Labels.String())
+
+		b, err := json.Marshal(frames[0].Fields[1].Labels)
+		require.NoError(t, err)
+		require.Equal(t, `{"az":"b","env":"prod","service_name":"app"}`, string(b))
+
+		require.Equal(t, []*LabelPair{{Name: "az", Value: "a"}, {Name: "az", Value: "b"}, {Name: "env", Value: "prod"}, {Name: "service_name", Value: "app"}}, sortedLabelPairs(labels))
+		require.Equal(t, "service_name", labels[0].Name, "the label pairs of the response are left as they are")
+	})
+
+	t.Run("frames are in the order of their sorted labels", func(t *testing.T) {
+		series := func(labels ...string) *Series {
+			s := &Series{Points: []*Point{{Timestamp: int64(1000), Value: 30}}}
+			for i := 0; i < len(labels); i += 2 {
+				s.Labels = append(s.Labels, &LabelPair{Name: labels[i], Value: labels[i+1]})
+			}
+			return s
+		}
+		resp := &SeriesResponse{
+			Series: []*Series{
+				series("service_name", "b", "env", "prod"),
+				series("service_name", "a", "env", "prod"),
+				series("service_name", "a", "env", "dev"),
+				series("env", "dev"),
+			},
+			Units: "short",
+			Label: "samples",
+		}
+		var legends []string
+		for _, frame := range seriesToDataFrames(resp) {
+			legends = append(legends, frame.Fields[1].Labels.String())
+		}
+		require.Equal(t, []string{
+			"env=dev",
+			"env=dev, service_name=a",
+			"env=prod, service_name=a",
+			"env=prod, service_name=b",
+		}, legends)
+	})
 }
 
 type FakeClient struct {
-	Args []any
+	Args        []any
+	SeriesCalls int
+	Types       []*ProfileType
+	// EmptyProfile makes GetProfile return no profile, like when there is no data in the time range
+	EmptyProfile bool
+	Values       []string
+	// PagedValues returns the values of LabelValues by time range instead of Values, when set
+	PagedValues func(start, end int64) []string
+	Names       []string
+	// ProfileArgs are the label selector, start and end of every GetProfile call
+	ProfileArgs [][]any
+	// BuildVersion is the version returned by Version
+	BuildVersion string
+	// SeriesErr makes GetSeries fail with the error
+	SeriesErr error
+	// EmptySeries makes GetSeries return no series, like when there is no data in the time range
+	EmptySeries bool
+	// DiffArgs are the left and right label selectors, starts and ends of the last GetProfileDiff call
+	DiffArgs []any
+	// MaxNodes is the maxNodes of the last GetProfile call
+	MaxNodes *int64
+	// Profiles are the profiles returned by GetProfile by profile type, when set
+	Profiles map[string]*ProfileResponse
+	mu       sync.Mutex
+}
+
+func (f *FakeClient) Version(ctx context.Context) (string, error) {
+	return f.BuildVersion, nil
 }
 
 func (f *FakeClient) ProfileTypes(ctx context.Context) ([]*ProfileType, error) {
+	if f.Types != nil {
+		return f.Types, nil
+	}
 	return []*ProfileType{
 		{
 			ID:    "type:1",
@@ -288,15 +1044,30 @@ func (f *FakeClient) ProfileTypes(ctx context.Context) ([]*ProfileType, error) {
 	}, nil
 }
 
-func (f *FakeClient) LabelValues(ctx context.Context, label string) ([]string, error) {
-	panic("implement me")
+func (f *FakeClient) LabelValues(ctx context.Context, label, prefix string, start int64, end int64) ([]string, error) {
+	f.Args = []any{label, prefix, start, end}
+	if f.PagedValues != nil {
+		return f.PagedValues(start, end), nil
+	}
+	return f.Values, nil
 }
 
-func (f *FakeClient) LabelNames(ctx context.Context) ([]string, error) {
-	panic("implement me")
+func (f *FakeClient) LabelNames(ctx context.Context, matchers []string) ([]string, error) {
+	f.Args = []any{matchers}
+	return f.Names, nil
 }
 
-func (f *FakeClient) GetProfile(ctx context.Context, profileTypeID, labelSelector string, start, end int64, maxNodes *int64) (*ProfileResponse, error) {
+func (f *FakeClient) GetProfile(ctx context.Context, profileTypeID, labelSelector string, start, end int64, maxNodes *int64, symbolization string) (*ProfileResponse, error) {
+	f.mu.Lock()
+	f.ProfileArgs = append(f.ProfileArgs, []any{labelSelector, start, end})
+	f.MaxNodes = maxNodes
+	f.mu.Unlock()
+	if f.EmptyProfile {
+		return nil, nil
+	}
+	if f.Profiles != nil {
+		return f.Profiles[profileTypeID], nil
+	}
 	return &ProfileResponse{
 		Flamebearer: &Flamebearer{
 			Names: []string{"foo", "bar", "baz"},
@@ -312,8 +1083,42 @@ func (f *FakeClient) GetProfile(ctx context.Context, profileTypeID, labelSelecto
 	}, nil
 }
 
+func (f *FakeClient) GetProfileDiff(ctx context.Context, profileTypeID, leftSelector string, leftStart, leftEnd int64, rightSelector string, rightStart, rightEnd int64, maxNodes *int64) (*ProfileDiffResponse, error) {
+	f.DiffArgs = []any{leftSelector, leftStart, leftEnd, rightSelector, rightStart, rightEnd}
+	if f.EmptyProfile {
+		return nil, nil
+	}
+	return &ProfileDiffResponse{
+		Flamebearer: &FlamebearerDiff{
+			Names: []string{"total", "foo", "bar", "baz"},
+			Levels: []*Level{
+				{Values: []int64{0, 10, 0, 0, 15, 0, 0}},
+				{Values: []int64{0, 10, 10, 0, 5, 5, 1, 0, 0, 0, 0, 10, 10, 2}},
+				{Values: []int64{10, 0, 0, 5, 4, 4, 3}},
+			},
+			Total:      25,
+			MaxSelf:    10,
+			LeftTicks:  10,
+			RightTicks: 15,
+		},
+		Units: "short",
+	}, nil
+}
+
+func (f *FakeClient) GetProfileStats(ctx context.Context, profileTypeID, labelSelector string, start, end int64) (*ProfileStats, error) {
+	f.Args = []any{profileTypeID, labelSelector, start, end}
+	return &ProfileStats{NonEmptyPoints: 120, SeriesCount: 3, MinTimestamp: 10000, MaxTimestamp: 20000}, nil
+}
+
 func (f *FakeClient) GetSeries(ctx context.Context, profileTypeID, labelSelector string, start, end int64, groupBy []string, step float64) (*SeriesResponse, error) {
 	f.Args = []any{profileTypeID, labelSelector, start, end, groupBy, step}
+	f.SeriesCalls++
+	if f.SeriesErr != nil {
+		return nil, f.SeriesErr
+	}
+	if f.EmptySeries {
+		return &SeriesResponse{Units: "count", Label: "test"}, nil
+	}
 	return &SeriesResponse{
 		Series: []*Series{
 			{
@@ -0,0 +1,76 @@
+package pyroscope
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+)
+
+const (
+	defaultRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff     = 2 * time.Second
+	// maxRetryAttempts caps the configured number of retries, so a failing backend can't hold a query for long.
+	maxRetryAttempts = 5
+)
+
+// withRetry retries the calls failing with a transient error up to maxRetries times, at most maxRetryAttempts. The
+// backoff between the attempts starts at backoff and doubles with every attempt, up to maxRetryBackoff, and is
+// jittered so the clients failing at the same time don't retry at the same time.
+func withRetry(maxRetries int, backoff time.Duration) connect.ClientOption {
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	if maxRetries > maxRetryAttempts {
+		maxRetries = maxRetryAttempts
+	}
+	return connect.WithInterceptors(connect.UnaryInterceptorFunc(func(next connect.UnaryFunc) connect.UnaryFunc {
+		return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+			delay := backoff
+			for attempt := 0; ; attempt++ {
+				res, err := next(ctx, req)
+				if err == nil || attempt >= maxRetries || !isRetryable(err) {
+					return res, err
+				}
+
+				logger.Debug("Retrying request", "procedure", req.Spec().Procedure, "attempt", attempt+1, "error", err, "function", logEntrypoint())
+				timer := time.NewTimer(jitter(delay))
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return nil, ctx.Err()
+				case <-timer.C:
+				}
+
+				delay *= 2
+				if delay > maxRetryBackoff {
+					delay = maxRetryBackoff
+				}
+			}
+		}
+	}))
+}
+
+// jitter returns a random duration between half of the delay and the delay.
+func jitter(delay time.Duration) time.Duration {
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(int64(delay)-half+1))
+}
+
+// isRetryable reports whether the error is transient. Connect reports the connection errors and the 502, 503 and 504
+// responses as unavailable, as well as the 429 responses asking to retry later. Pyroscope reports its rate limits as
+// resource exhausted, which are retried too, unlike the 413 and 431 responses connect also reports as resource
+// exhausted. The other 4xx responses have other codes and are not retried.
+func isRetryable(err error) bool {
+	switch connect.CodeOf(err) {
+	case connect.CodeUnavailable:
+		return true
+	case connect.CodeResourceExhausted:
+		// Only the errors sent by the server, the 413 and 431 responses without a connect error are too large
+		// requests that fail the same way every time.
+		return connect.IsWireError(err)
+	default:
+		return false
+	}
+}
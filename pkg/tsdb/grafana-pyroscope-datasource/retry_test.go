@@ -0,0 +1,120 @@
+package pyroscope
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	querierv1 "github.com/grafana/pyroscope/api/gen/proto/go/querier/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func Test_withRetry(t *testing.T) {
+	var calls int
+	failures := 0
+	failureStatus := http.StatusServiceUnavailable
+	failureBody := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= failures {
+			w.WriteHeader(failureStatus)
+			_, _ = w.Write([]byte(failureBody))
+			return
+		}
+		body, err := proto.Marshal(&querierv1.ProfileTypesResponse{})
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/proto")
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	t.Run("call eventually succeeds", func(t *testing.T) {
+		for _, status := range []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+			calls, failures, failureStatus = 0, 2, status
+			client := NewPyroscopeClient(server.Client(), server.URL, withRetry(3, time.Millisecond))
+			types, err := client.ProfileTypes(context.Background())
+			require.NoError(t, err)
+			require.Empty(t, types)
+			require.Equal(t, 3, calls)
+		}
+		failureStatus = http.StatusServiceUnavailable
+	})
+
+	t.Run("rate limited calls are retried", func(t *testing.T) {
+		calls, failures, failureStatus = 0, 2, http.StatusTooManyRequests
+		client := NewPyroscopeClient(server.Client(), server.URL, withRetry(3, time.Millisecond))
+		_, err := client.ProfileTypes(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 3, calls)
+
+		calls, failureBody = 0, `{"code":"resource_exhausted","message":"rate limit exceeded"}`
+		_, err = client.ProfileTypes(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 3, calls)
+		failureStatus, failureBody = http.StatusServiceUnavailable, ""
+	})
+
+	t.Run("client errors are not retried", func(t *testing.T) {
+		for _, status := range []int{http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge, http.StatusRequestHeaderFieldsTooLarge} {
+			calls, failures, failureStatus = 0, 2, status
+			client := NewPyroscopeClient(server.Client(), server.URL, withRetry(3, time.Millisecond))
+			_, err := client.ProfileTypes(context.Background())
+			require.Error(t, err)
+			require.Equal(t, 1, calls)
+		}
+		failureStatus = http.StatusServiceUnavailable
+	})
+
+	t.Run("retries are capped", func(t *testing.T) {
+		calls, failures = 0, 100
+		client := NewPyroscopeClient(server.Client(), server.URL, withRetry(100, time.Millisecond))
+		_, err := client.ProfileTypes(context.Background())
+		require.Equal(t, connect.CodeUnavailable, connect.CodeOf(err))
+		require.Equal(t, maxRetryAttempts+1, calls)
+	})
+
+	t.Run("gives up after max retries", func(t *testing.T) {
+		calls, failures = 0, 5
+		client := NewPyroscopeClient(server.Client(), server.URL, withRetry(2, time.Millisecond))
+		_, err := client.ProfileTypes(context.Background())
+		require.Equal(t, connect.CodeUnavailable, connect.CodeOf(err))
+		require.Equal(t, 3, calls)
+	})
+
+	t.Run("stops when the context is done", func(t *testing.T) {
+		calls, failures = 0, 5
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		client := NewPyroscopeClient(server.Client(), server.URL, withRetry(3, time.Hour))
+		_, err := client.ProfileTypes(ctx)
+		require.Error(t, err)
+		require.LessOrEqual(t, calls, 1)
+	})
+}
+
+func Test_jitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		delay := jitter(100 * time.Millisecond)
+		require.GreaterOrEqual(t, delay, 50*time.Millisecond)
+		require.LessOrEqual(t, delay, 100*time.Millisecond)
+	}
+	require.Equal(t, time.Duration(0), jitter(0))
+}
+
+func Test_isRetryable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	_, err := NewPyroscopeClient(http.DefaultClient, url).ProfileTypes(context.Background())
+	require.True(t, isRetryable(err), "connection errors are retried")
+	require.True(t, isRetryable(connect.NewWireError(connect.CodeResourceExhausted, nil)), "rate limits are retried")
+	require.False(t, isRetryable(connect.NewError(connect.CodeResourceExhausted, nil)), "too large requests are not retried")
+	require.False(t, isRetryable(connect.NewWireError(connect.CodeInvalidArgument, nil)))
+	require.False(t, isRetryable(connect.NewWireError(connect.CodePermissionDenied, nil)))
+	require.False(t, isRetryable(connect.NewWireError(connect.CodeNotFound, nil)))
+}
@@ -0,0 +1,290 @@
+package pyroscope
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Matcher is a single label matcher of a label selector, for example app="foo".
+type Matcher struct {
+	Name  string
+	Type  string
+	Value string
+}
+
+// profileTypeLabel is the label of the series with the ID of their profile type.
+const profileTypeLabel = "__profile_type__"
+
+const (
+	matchEqual     = "="
+	matchNotEqual  = "!="
+	matchRegexp    = "=~"
+	matchNotRegexp = "!~"
+)
+
+// SelectorParseError describes why a label selector is malformed and where, so the query editor can point at the
+// offending part of the selector.
+type SelectorParseError struct {
+	Message string `json:"message"`
+	// Token is the part of the selector the error was found at, empty at the end of the selector.
+	Token string `json:"token"`
+	// Offset is the character offset of Token in the selector.
+	Offset int `json:"offset"`
+}
+
+func (e *SelectorParseError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("invalid label selector: %s at the end of the selector (offset %d)", e.Message, e.Offset)
+	}
+	return fmt.Sprintf("invalid label selector: %s at %q (offset %d)", e.Message, e.Token, e.Offset)
+}
+
+// parseSelector parses a label selector in the {name="value", name=~"regex"} form. Empty selector is valid and has no
+// matchers. The returned error is a *SelectorParseError.
+func parseSelector(selector string) ([]*Matcher, error) {
+	p := &selectorParser{input: selector}
+
+	p.skipSpaces()
+	if p.done() {
+		return nil, nil
+	}
+	if p.peek() != '{' {
+		return nil, p.errorAt(p.pos, "expected '{'")
+	}
+	p.pos++
+
+	var matchers []*Matcher
+	for {
+		p.skipSpaces()
+		if p.done() {
+			return nil, p.errorAt(p.pos, "expected label matcher or '}'")
+		}
+		if p.peek() == '}' {
+			p.pos++
+			break
+		}
+
+		m, err := p.parseMatcher()
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+
+		p.skipSpaces()
+		if p.done() {
+			return nil, p.errorAt(p.pos, "expected ',' or '}'")
+		}
+		if p.peek() == ',' {
+			p.pos++
+			continue
+		}
+		if p.peek() == '}' {
+			p.pos++
+			break
+		}
+		return nil, p.errorAt(p.pos, "expected ',' or '}'")
+	}
+
+	p.skipSpaces()
+	if !p.done() {
+		return nil, p.errorAt(p.pos, "unexpected characters after '}'")
+	}
+	return matchers, nil
+}
+
+// normalizeSelector returns the canonical form of the selector, with the matchers sorted and the whitespace and
+// quoting made uniform, so selectors that only differ in these produce the same string. Selectors that cannot be
+// parsed are returned as they are, so the backend reports the error.
+func normalizeSelector(selector string) string {
+	matchers, err := parseSelector(selector)
+	if err != nil {
+		return selector
+	}
+
+	sort.Slice(matchers, func(i, j int) bool {
+		a, b := matchers[i], matchers[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Value < b.Value
+	})
+
+	parts := make([]string, 0, len(matchers))
+	for i, m := range matchers {
+		if i > 0 && *m == *matchers[i-1] {
+			continue
+		}
+		parts = append(parts, m.Name+m.Type+strconv.Quote(m.Value))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// withProfileTypeMatcher returns the selector with a matcher of the profile type added, for the calls that select
+// series by label matchers only.
+func withProfileTypeMatcher(selector, profileTypeID string) (string, error) {
+	matchers, err := parseSelector(selector)
+	if err != nil {
+		return "", err
+	}
+
+	parts := []string{profileTypeLabel + matchEqual + strconv.Quote(profileTypeID)}
+	for _, m := range matchers {
+		parts = append(parts, m.Name+m.Type+strconv.Quote(m.Value))
+	}
+	return "{" + strings.Join(parts, ", ") + "}", nil
+}
+
+// checkRequiredMatcher returns an error unless the selector has a matcher restricting the label to some of its
+// values, an = matcher or a =~ matcher with a regex other than .* and .+.
+func checkRequiredMatcher(selector, label string) error {
+	matchers, err := parseSelector(selector)
+	if err != nil {
+		return err
+	}
+	for _, m := range matchers {
+		if m.Name != label || m.Value == "" {
+			continue
+		}
+		if m.Type == matchEqual || (m.Type == matchRegexp && m.Value != ".*" && m.Value != ".+") {
+			return nil
+		}
+	}
+	return fmt.Errorf("label selector %q must match the %s label, for example {%s=\"value\"}", selector, label, label)
+}
+
+type selectorParser struct {
+	input string
+	pos   int
+}
+
+func (p *selectorParser) done() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *selectorParser) peek() byte {
+	return p.input[p.pos]
+}
+
+func (p *selectorParser) skipSpaces() {
+	for !p.done() && (p.peek() == ' ' || p.peek() == '\t' || p.peek() == '\n' || p.peek() == '\r') {
+		p.pos++
+	}
+}
+
+func (p *selectorParser) parseMatcher() (*Matcher, error) {
+	start := p.pos
+	if !isLabelNameStart(p.peek()) {
+		return nil, p.errorAt(start, "expected label name")
+	}
+	for !p.done() && isLabelNameChar(p.peek()) {
+		p.pos++
+	}
+	name := p.input[start:p.pos]
+
+	p.skipSpaces()
+	opStart := p.pos
+	var op string
+	rest := p.input[p.pos:]
+	switch {
+	case strings.HasPrefix(rest, matchNotEqual):
+		op = matchNotEqual
+	case strings.HasPrefix(rest, matchRegexp):
+		op = matchRegexp
+	case strings.HasPrefix(rest, matchNotRegexp):
+		op = matchNotRegexp
+	case strings.HasPrefix(rest, matchEqual):
+		op = matchEqual
+	default:
+		return nil, p.errorAt(opStart, "expected matcher operator")
+	}
+	p.pos += len(op)
+
+	p.skipSpaces()
+	valueStart := p.pos
+	value, err := p.parseString()
+	if err != nil {
+		return nil, err
+	}
+
+	if op == matchRegexp || op == matchNotRegexp {
+		if _, err := regexp.Compile("^(?:" + value + ")$"); err != nil {
+			return nil, &SelectorParseError{Message: "invalid regular expression", Token: p.input[valueStart:p.pos], Offset: valueStart}
+		}
+	}
+
+	return &Matcher{Name: name, Type: op, Value: value}, nil
+}
+
+func (p *selectorParser) parseString() (string, error) {
+	start := p.pos
+	if p.done() {
+		return "", p.errorAt(start, "expected quoted label value")
+	}
+	quote := p.peek()
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", p.errorAt(start, "expected quoted label value")
+	}
+
+	p.pos++
+	for {
+		if p.done() {
+			return "", &SelectorParseError{Message: "unterminated quoted string", Token: p.input[start:], Offset: start}
+		}
+		c := p.peek()
+		if c == '\\' && quote != '`' {
+			p.pos += 2
+			continue
+		}
+		p.pos++
+		if c == quote {
+			break
+		}
+	}
+
+	raw := p.input[start:p.pos]
+	if quote == '\'' {
+		// strconv only unquotes single characters in single quotes, so turn it into a double-quoted string
+		inner := raw[1 : len(raw)-1]
+		inner = strings.ReplaceAll(inner, `\'`, `'`)
+		inner = strings.ReplaceAll(inner, `"`, `\"`)
+		raw = `"` + inner + `"`
+	}
+	value, err := strconv.Unquote(raw)
+	if err != nil {
+		return "", &SelectorParseError{Message: "invalid quoted string", Token: p.input[start:p.pos], Offset: start}
+	}
+	return value, nil
+}
+
+// errorAt returns a parse error for the token that starts at the offset.
+func (p *selectorParser) errorAt(offset int, message string) *SelectorParseError {
+	return &SelectorParseError{Message: message, Token: p.tokenAt(offset), Offset: offset}
+}
+
+func (p *selectorParser) tokenAt(offset int) string {
+	if offset >= len(p.input) {
+		return ""
+	}
+	end := offset
+	for end < len(p.input) && isLabelNameChar(p.input[end]) {
+		end++
+	}
+	if end == offset {
+		end++
+	}
+	return p.input[offset:end]
+}
+
+func isLabelNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isLabelNameChar(c byte) bool {
+	return isLabelNameStart(c) || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,124 @@
+package pyroscope
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseSelector(t *testing.T) {
+	t.Run("valid selectors", func(t *testing.T) {
+		matchers, err := parseSelector(`{app="foo", env!='prod', pod=~"pod-.*",region!~` + "`eu-.*`" + `,}`)
+		require.NoError(t, err)
+		require.Equal(t, []*Matcher{
+			{Name: "app", Type: matchEqual, Value: "foo"},
+			{Name: "env", Type: matchNotEqual, Value: "prod"},
+			{Name: "pod", Type: matchRegexp, Value: "pod-.*"},
+			{Name: "region", Type: matchNotRegexp, Value: "eu-.*"},
+		}, matchers)
+
+		matchers, err = parseSelector(`{}`)
+		require.NoError(t, err)
+		require.Empty(t, matchers)
+
+		matchers, err = parseSelector(``)
+		require.NoError(t, err)
+		require.Empty(t, matchers)
+	})
+
+	t.Run("malformed selectors report the position", func(t *testing.T) {
+		tests := []struct {
+			selector string
+			expected *SelectorParseError
+		}{
+			{`app="foo"}`, &SelectorParseError{Message: "expected '{'", Token: "app", Offset: 0}},
+			{`{app="foo"`, &SelectorParseError{Message: "expected ',' or '}'", Token: "", Offset: 10}},
+			{`{app=foo}`, &SelectorParseError{Message: "expected quoted label value", Token: "foo", Offset: 5}},
+			{`{app="foo" env="bar"}`, &SelectorParseError{Message: "expected ',' or '}'", Token: "env", Offset: 11}},
+			{`{1app="foo"}`, &SelectorParseError{Message: "expected label name", Token: "1app", Offset: 1}},
+			{`{app>"foo"}`, &SelectorParseError{Message: "expected matcher operator", Token: ">", Offset: 4}},
+			{`{app="foo}`, &SelectorParseError{Message: "unterminated quoted string", Token: `"foo}`, Offset: 5}},
+			{`{app=~"(foo"}`, &SelectorParseError{Message: "invalid regular expression", Token: `"(foo"`, Offset: 6}},
+			{`{app="foo"} bar`, &SelectorParseError{Message: "unexpected characters after '}'", Token: "bar", Offset: 12}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.selector, func(t *testing.T) {
+				_, err := parseSelector(tt.selector)
+				require.Equal(t, tt.expected, err)
+			})
+		}
+	})
+}
+
+func Test_normalizeSelector(t *testing.T) {
+	t.Run("semantically equal selectors have the same normal form", func(t *testing.T) {
+		expected := `{app="foo", env!="prod", pod=~"pod-.*"}`
+		for _, selector := range []string{
+			`{app="foo", env!="prod", pod=~"pod-.*"}`,
+			`{pod=~"pod-.*",app="foo",env!="prod"}`,
+			` {  env != 'prod' , pod=~` + "`pod-.*`" + `, app="foo", }`,
+			`{app="foo", app="foo", pod=~"pod-.*", env!="prod"}`,
+		} {
+			require.Equal(t, expected, normalizeSelector(selector), selector)
+		}
+	})
+
+	t.Run("empty selectors", func(t *testing.T) {
+		require.Equal(t, `{}`, normalizeSelector(``))
+		require.Equal(t, `{}`, normalizeSelector(` { } `))
+	})
+
+	t.Run("malformed selectors are kept", func(t *testing.T) {
+		require.Equal(t, `{app="foo"`, normalizeSelector(`{app="foo"`))
+	})
+}
+
+func Test_withProfileTypeMatcher(t *testing.T) {
+	selector, err := withProfileTypeMatcher(`{app="foo", pod=~'pod-.*'}`, "memory:alloc_space:bytes:space:bytes")
+	require.NoError(t, err)
+	require.Equal(t, `{__profile_type__="memory:alloc_space:bytes:space:bytes", app="foo", pod=~"pod-.*"}`, selector)
+
+	selector, err = withProfileTypeMatcher(``, "memory:alloc_space:bytes:space:bytes")
+	require.NoError(t, err)
+	require.Equal(t, `{__profile_type__="memory:alloc_space:bytes:space:bytes"}`, selector)
+
+	_, err = withProfileTypeMatcher(`{app=}`, "memory:alloc_space:bytes:space:bytes")
+	require.Error(t, err)
+}
+
+func Test_checkRequiredMatcher(t *testing.T) {
+	for _, selector := range []string{`{service_name="foo"}`, `{app="bar", service_name=~"foo|bar"}`} {
+		require.NoError(t, checkRequiredMatcher(selector, "service_name"), selector)
+	}
+	for _, selector := range []string{``, `{}`, `{app="foo"}`, `{service_name!="foo"}`, `{service_name=""}`, `{service_name=~".*"}`, `{service_name=~".+"}`} {
+		require.Error(t, checkRequiredMatcher(selector, "service_name"), selector)
+	}
+	require.EqualError(t, checkRequiredMatcher(`{app="foo"}`, "service_name"), `label selector "{app=\"foo\"}" must match the service_name label, for example {service_name="value"}`)
+}
+
+func Test_validateSelector(t *testing.T) {
+	ds := &PyroscopeDatasource{}
+
+	validate := func(t *testing.T, selector string) string {
+		t.Helper()
+		sender := &FakeSender{}
+		err := ds.CallResource(
+			context.Background(),
+			&backend.CallResourceRequest{
+				Path:   "validateSelector",
+				Method: "GET",
+				URL:    "validateSelector?selector=" + url.QueryEscape(selector),
+			},
+			sender,
+		)
+		require.NoError(t, err)
+		require.Equal(t, 200, sender.Resp.Status)
+		return string(sender.Resp.Body)
+	}
+
+	require.Equal(t, `{"valid":true}`, validate(t, `{app="foo"}`))
+	require.Equal(t, `{"valid":false,"error":{"message":"expected quoted label value","token":"foo","offset":5}}`, validate(t, `{app=foo}`))
+}
@@ -0,0 +1,85 @@
+package pyroscope
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"golang.org/x/sync/errgroup"
+)
+
+// queryTypeSummary returns a table with the summary of the profiles of several profile types, see summaryFrame.
+const queryTypeSummary = "summary"
+
+const summaryFrameName = "summary"
+
+// profileSummary is the summary of the profile of a profile type.
+type profileSummary struct {
+	profileTypeID string
+	unit          string
+	total         int64
+	nodes         int64
+}
+
+// summaryProfileTypes are the profile types summarized by the query, its profile type when it has no list of them.
+func summaryProfileTypes(qm queryModel) []string {
+	if len(qm.ProfileTypeIds) > 0 {
+		return qm.ProfileTypeIds
+	}
+	return []string{qm.ProfileTypeId}
+}
+
+// summaryFrame fetches the profiles of the profile types of the query concurrently and returns a table with a row
+// per profile type, in the order of the query, with the total value and the number of nodes of its profile. The
+// profile types without data have a row with zero values.
+func (d *PyroscopeDatasource) summaryFrame(ctx context.Context, qm queryModel, timeRange backend.TimeRange) (*data.Frame, error) {
+	profileTypes := summaryProfileTypes(qm)
+	summaries := make([]profileSummary, len(profileTypes))
+
+	g, gCtx := errgroup.WithContext(ctx)
+	for i, profileTypeID := range profileTypes {
+		i, profileTypeID := i, profileTypeID
+		g.Go(func() error {
+			logger.Debug("Calling GetProfile", "profileTypeID", profileTypeID, "function", logEntrypoint())
+			prof, err := d.client.GetProfile(gCtx, profileTypeID, qm.LabelSelector, timeRange.From.UnixMilli(), timeRange.To.UnixMilli(), qm.MaxNodes, qm.Symbolization)
+			if err != nil {
+				return fmt.Errorf("error getting the %s profile: %w", profileTypeID, err)
+			}
+			summaries[i] = summarizeProfile(profileTypeID, prof)
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return summaryToDataFrame(summaries), nil
+}
+
+func summarizeProfile(profileTypeID string, prof *ProfileResponse) profileSummary {
+	summary := profileSummary{profileTypeID: profileTypeID}
+	if prof == nil {
+		return summary
+	}
+	summary.unit = prof.Units
+	summary.total = prof.Flamebearer.Total
+	summary.nodes = int64(countNodes(levelsToTree(prof.Flamebearer.Levels, prof.Flamebearer.Names)))
+	return summary
+}
+
+func summaryToDataFrame(summaries []profileSummary) *data.Frame {
+	profileTypeField := data.NewField("Profile type", nil, []string{})
+	unitField := data.NewField("Unit", nil, []string{})
+	totalField := data.NewField("Total", nil, []int64{})
+	nodesField := data.NewField("Nodes", nil, []int64{})
+	for _, summary := range summaries {
+		profileTypeField.Append(summary.profileTypeID)
+		unitField.Append(summary.unit)
+		totalField.Append(summary.total)
+		nodesField.Append(summary.nodes)
+	}
+
+	frame := data.NewFrame(summaryFrameName, profileTypeField, unitField, totalField, nodesField)
+	frame.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeTable}
+	return frame
+}
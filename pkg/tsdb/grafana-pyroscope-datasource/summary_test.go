@@ -0,0 +1,74 @@
+package pyroscope
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_summaryQuery(t *testing.T) {
+	pCtx := backend.PluginContext{
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			JSONData: []byte(`{}`),
+		},
+	}
+
+	t.Run("returns a row per profile type", func(t *testing.T) {
+		client := &FakeClient{Profiles: map[string]*ProfileResponse{
+			"process_cpu:cpu:nanoseconds:cpu:nanoseconds": {
+				Flamebearer: &Flamebearer{
+					Names: []string{"total", "foo", "bar"},
+					Levels: []*Level{
+						{Values: []int64{0, 300, 0, 0}},
+						{Values: []int64{0, 200, 200, 1, 0, 100, 100, 2}},
+					},
+					Total: 300,
+				},
+				Units: "ns",
+			},
+			"memory:alloc_space:bytes:space:bytes": {
+				Flamebearer: &Flamebearer{
+					Names:  []string{"total"},
+					Levels: []*Level{{Values: []int64{0, 1024, 1024, 0}}},
+					Total:  1024,
+				},
+				Units: "bytes",
+			},
+		}}
+		ds := &PyroscopeDatasource{client: client}
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeSummary
+		dataQuery.JSON = []byte(`{"labelSelector":"{app=\"baz\"}","profileTypeIds":["process_cpu:cpu:nanoseconds:cpu:nanoseconds","memory:alloc_space:bytes:space:bytes","goroutine:goroutine:count:goroutine:count"]}`)
+
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.Len(t, resp.Frames, 1)
+
+		frame := resp.Frames[0]
+		require.Equal(t, summaryFrameName, frame.Name)
+		require.Equal(t, data.VisType(data.VisTypeTable), frame.Meta.PreferredVisualization)
+		require.Equal(t, []string{"process_cpu:cpu:nanoseconds:cpu:nanoseconds", "memory:alloc_space:bytes:space:bytes", "goroutine:goroutine:count:goroutine:count"}, fieldValues[string](frame.Fields[0]))
+		require.Equal(t, []string{"ns", "bytes", ""}, fieldValues[string](frame.Fields[1]))
+		require.Equal(t, []int64{300, 1024, 0}, fieldValues[int64](frame.Fields[2]))
+		require.Equal(t, []int64{3, 1, 0}, fieldValues[int64](frame.Fields[3]))
+		for _, args := range client.ProfileArgs {
+			require.Equal(t, `{app="baz"}`, args[0])
+		}
+	})
+
+	t.Run("summarizes the profile type of the query without a list", func(t *testing.T) {
+		ds := &PyroscopeDatasource{client: &FakeClient{}}
+		dataQuery := makeDataQuery()
+		dataQuery.QueryType = queryTypeSummary
+		dataQuery.JSON = []byte(`{"profileTypeId":"memory:alloc_objects:count:space:bytes"}`)
+
+		resp := ds.query(context.Background(), pCtx, *dataQuery)
+		require.Nil(t, resp.Error)
+		require.Equal(t, []string{"memory:alloc_objects:count:space:bytes"}, fieldValues[string](resp.Frames[0].Fields[0]))
+		require.Equal(t, []int64{100}, fieldValues[int64](resp.Frames[0].Fields[2]))
+		require.Equal(t, []int64{3}, fieldValues[int64](resp.Frames[0].Fields[3]))
+	})
+}
@@ -0,0 +1,52 @@
+package pyroscope
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// minSupportedVersion is the oldest Pyroscope version the datasource is known to work with.
+var minSupportedVersion = serverVersion{major: 1}
+
+// serverVersion is the major.minor.patch part of a Pyroscope version.
+type serverVersion struct {
+	major, minor, patch int
+}
+
+func (v serverVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+}
+
+func (v serverVersion) less(other serverVersion) bool {
+	if v.major != other.major {
+		return v.major < other.major
+	}
+	if v.minor != other.minor {
+		return v.minor < other.minor
+	}
+	return v.patch < other.patch
+}
+
+// parseVersion parses versions like "v1.2.3" or "1.2.3-rc.1", missing minor and patch numbers are 0. Development
+// builds, like "main-ab12cd3", are not parsed.
+func parseVersion(version string) (serverVersion, bool) {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+
+	parts := strings.Split(version, ".")
+	if len(parts) > 3 {
+		return serverVersion{}, false
+	}
+	numbers := make([]int, 3)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return serverVersion{}, false
+		}
+		numbers[i] = n
+	}
+	return serverVersion{major: numbers[0], minor: numbers[1], patch: numbers[2]}, true
+}
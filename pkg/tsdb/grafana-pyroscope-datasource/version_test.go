@@ -0,0 +1,36 @@
+package pyroscope
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseVersion(t *testing.T) {
+	for _, tt := range []struct {
+		version  string
+		expected serverVersion
+		ok       bool
+	}{
+		{version: "1.2.3", expected: serverVersion{1, 2, 3}, ok: true},
+		{version: "v1.2.3", expected: serverVersion{1, 2, 3}, ok: true},
+		{version: "1.2.0-rc.1", expected: serverVersion{1, 2, 0}, ok: true},
+		{version: "0.37", expected: serverVersion{0, 37, 0}, ok: true},
+		{version: "main-ab12cd3"},
+		{version: ""},
+		{version: "1.2.3.4"},
+	} {
+		t.Run(tt.version, func(t *testing.T) {
+			version, ok := parseVersion(tt.version)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.expected, version)
+		})
+	}
+}
+
+func Test_serverVersionLess(t *testing.T) {
+	require.True(t, serverVersion{0, 37, 2}.less(minSupportedVersion))
+	require.True(t, serverVersion{1, 2, 3}.less(serverVersion{1, 3, 0}))
+	require.False(t, serverVersion{1, 0, 0}.less(minSupportedVersion))
+	require.False(t, serverVersion{1, 2, 4}.less(serverVersion{1, 2, 3}))
+}
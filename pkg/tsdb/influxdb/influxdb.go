@@ -2,11 +2,15 @@ package influxdb
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
+	sdkhttpclient "github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
 
 	"github.com/grafana/grafana/pkg/tsdb/influxdb/flux"
@@ -36,11 +40,6 @@ func newInstanceSettings(httpClientProvider httpclient.Provider) datasource.Inst
 		if err != nil {
 			return nil, err
 		}
-
-		client, err := httpClientProvider.New(opts)
-		if err != nil {
-			return nil, err
-		}
 		//fmt.Println("Received JSONData:", string(settings.JSONData))
 
 		jsonData := models.DatasourceInfo{}
@@ -49,6 +48,15 @@ func newInstanceSettings(httpClientProvider httpclient.Provider) datasource.Inst
 			return nil, fmt.Errorf("error reading settings: %w", err)
 		}
 
+		applyTimeouts(&opts, jsonData)
+		if jsonData.ForceHTTP1 {
+			opts.ConfigureTransport = forceHTTP1(opts.ConfigureTransport)
+		}
+		client, err := httpClientProvider.New(opts)
+		if err != nil {
+			return nil, err
+		}
+
 		httpMode := jsonData.HTTPMode
 		if httpMode == "" {
 			httpMode = "GET"
@@ -64,6 +72,40 @@ func newInstanceSettings(httpClientProvider httpclient.Provider) datasource.Inst
 			version = influxVersionInfluxQL
 		}
 
+		emptyResultsMode := jsonData.EmptyResultsMode
+		if emptyResultsMode == "" {
+			emptyResultsMode = models.EmptyResultsModeEmpty
+		}
+
+		emptyTagValues := jsonData.EmptyTagValues
+		if emptyTagValues == "" {
+			emptyTagValues = models.EmptyTagValuesKeep
+		}
+
+		zeroTimestamps := jsonData.ZeroTimestamps
+		if zeroTimestamps == "" {
+			zeroTimestamps = models.ZeroTimestampsKeep
+		}
+
+		frameFormat := jsonData.FrameFormat
+		if frameFormat == "" {
+			frameFormat = models.FrameFormatSplit
+		}
+
+		precision := jsonData.Precision
+		if precision == "" {
+			precision = models.DefaultPrecision
+		}
+
+		exemplarMeasurementSuffix := jsonData.ExemplarMeasurementSuffix
+		if exemplarMeasurementSuffix == "" {
+			exemplarMeasurementSuffix = models.DefaultExemplarMeasurementSuffix
+		}
+
+		if version == influxVersionInfluxQL {
+			client.CheckRedirect = influxql.RedirectPolicy(settings.URL, jsonData.ClusterHosts)
+		}
+
 		database := jsonData.DbName
 		if database == "" {
 			database = settings.Database
@@ -72,6 +114,7 @@ func newInstanceSettings(httpClientProvider httpclient.Provider) datasource.Inst
 		model := &models.DatasourceInfo{
 			HTTPClient:                  client,
 			URL:                         settings.URL,
+			UID:                         settings.UID,
 			DbName:                      database,
 			Version:                     version,
 			HTTPMode:                    httpMode,
@@ -80,14 +123,75 @@ func newInstanceSettings(httpClientProvider httpclient.Provider) datasource.Inst
 			Organization:                jsonData.Organization,
 			Metadata:                    jsonData.Metadata,
 			MaxSeries:                   maxSeries,
+			MaxStatements:               jsonData.MaxStatements,
+			EmptyResultsMode:            emptyResultsMode,
+			EmptyTagValues:              emptyTagValues,
+			ZeroTimestamps:              zeroTimestamps,
+			FrameFormat:                 frameFormat,
+			Precision:                   precision,
+			ChunkSize:                   jsonData.ChunkSize,
+			AutoAggregation:             jsonData.AutoAggregation,
+			FieldAggregations:           jsonData.FieldAggregations,
+			ResponseContentTypes:        jsonData.ResponseContentTypes,
+			V2Compatibility:             jsonData.V2Compatibility,
+			ClusterHosts:                jsonData.ClusterHosts,
+			UserAgent:                   jsonData.UserAgent,
+			ForceHTTP1:                  jsonData.ForceHTTP1,
+			ConnectTimeout:              jsonData.ConnectTimeout,
+			QueryTimeout:                jsonData.QueryTimeout,
 			SecureGrpc:                  true,
 			Token:                       settings.DecryptedSecureJSONData["token"],
 			ExemplarTraceIdDestinations: jsonData.ExemplarTraceIdDestinations,
+			ExemplarMeasurementSuffix:   exemplarMeasurementSuffix,
+			DatabasesCache:              models.NewDatabasesCache(models.DefaultDatabasesCacheTTL),
 		}
 		return model, nil
 	}
 }
 
+// applyTimeouts sets the dial timeout of the client to the connect timeout, so an unreachable server fails fast,
+// and the overall client timeout to the query timeout, so it doesn't cut long running queries short.
+func applyTimeouts(opts *sdkhttpclient.Options, jsonData models.DatasourceInfo) {
+	if jsonData.ConnectTimeout <= 0 && jsonData.QueryTimeout <= 0 {
+		return
+	}
+
+	timeouts := sdkhttpclient.DefaultTimeoutOptions
+	if opts.Timeouts != nil {
+		timeouts = *opts.Timeouts
+	}
+	if jsonData.ConnectTimeout > 0 {
+		timeouts.DialTimeout = time.Duration(jsonData.ConnectTimeout)
+	}
+	if jsonData.QueryTimeout > 0 {
+		timeouts.Timeout = time.Duration(jsonData.QueryTimeout)
+	}
+	opts.Timeouts = &timeouts
+}
+
+// forceHTTP1 returns a transport configuration that disables HTTP/2, chained after the given one.
+func forceHTTP1(next sdkhttpclient.ConfigureTransportFunc) sdkhttpclient.ConfigureTransportFunc {
+	return func(opts sdkhttpclient.Options, transport *http.Transport) {
+		if next != nil {
+			next(opts, transport)
+		}
+		transport.ForceAttemptHTTP2 = false
+		// A non-nil, empty TLSNextProto map disables HTTP/2 on the transport.
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		// h2 must not be offered during the TLS handshake either, or the server picks it and rejects the request.
+		if transport.TLSClientConfig != nil {
+			transport.TLSClientConfig = transport.TLSClientConfig.Clone()
+			protos := transport.TLSClientConfig.NextProtos[:0:0]
+			for _, proto := range transport.TLSClientConfig.NextProtos {
+				if proto != "h2" {
+					protos = append(protos, proto)
+				}
+			}
+			transport.TLSClientConfig.NextProtos = protos
+		}
+	}
+}
+
 func (s *Service) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
 	logger := logger.FromContext(ctx)
 
@@ -102,12 +206,20 @@ func (s *Service) QueryData(ctx context.Context, req *backend.QueryDataRequest)
 	case influxVersionFlux:
 		return flux.Query(ctx, dsInfo, *req)
 	case influxVersionInfluxQL:
-		// Check if ExemplarTraceIdDestinations is not empty
-		if len(dsInfo.ExemplarTraceIdDestinations) > 0 {
-			// Call the function to query exemplar data
-			influxql.QueryExemplarData(ctx, dsInfo, req)
+		resp, err := influxql.Query(ctx, dsInfo, req)
+		if err != nil || len(dsInfo.ExemplarTraceIdDestinations) == 0 {
+			return resp, err
+		}
+		// The exemplars are optional, the series are returned without them when they can't be read
+		exemplars, err := influxql.QueryExemplarData(ctx, dsInfo, req)
+		if err != nil {
+			logger.Warn("Failed to query the exemplars", "err", err)
+			return resp, nil
+		}
+		if err := influxql.AttachExemplars(resp, exemplars, dsInfo.ExemplarTraceIdDestinations); err != nil {
+			logger.Warn("Failed to attach the exemplars", "err", err)
 		}
-		return influxql.Query(ctx, dsInfo, req)
+		return resp, nil
 	case influxVersionSQL:
 		return fsql.Query(ctx, dsInfo, *req)
 	default:
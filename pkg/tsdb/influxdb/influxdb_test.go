@@ -0,0 +1,253 @@
+package influxdb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/tsdb/influxdb/models"
+)
+
+func TestNewInstanceSettings_Timeouts(t *testing.T) {
+	newInstance := func(t *testing.T, jsonData string) (*fakeHttpClientProvider, *models.DatasourceInfo) {
+		t.Helper()
+		provider := &fakeHttpClientProvider{}
+		instance, err := newInstanceSettings(provider)(context.Background(), backend.DataSourceInstanceSettings{
+			URL:      "http://localhost:8086",
+			JSONData: []byte(jsonData),
+		})
+		require.NoError(t, err)
+		return provider, instance.(*models.DatasourceInfo)
+	}
+
+	t.Run("connect timeout only limits dialing", func(t *testing.T) {
+		provider, dsInfo := newInstance(t, `{"connectTimeout":2}`)
+		require.Equal(t, 2*time.Second, provider.opts.Timeouts.DialTimeout)
+		require.Equal(t, models.Duration(2*time.Second), dsInfo.ConnectTimeout)
+		require.Equal(t, models.Duration(0), dsInfo.QueryTimeout)
+		require.NotEqual(t, 2*time.Second, provider.opts.Timeouts.Timeout)
+	})
+
+	t.Run("query timeout limits the whole request", func(t *testing.T) {
+		provider, dsInfo := newInstance(t, `{"connectTimeout":2,"queryTimeout":300}`)
+		require.Equal(t, 2*time.Second, provider.opts.Timeouts.DialTimeout)
+		require.Equal(t, 300*time.Second, provider.opts.Timeouts.Timeout)
+		require.Equal(t, 300*time.Second, dsInfo.HTTPClient.Timeout)
+		require.Equal(t, models.Duration(300*time.Second), dsInfo.QueryTimeout)
+	})
+
+	t.Run("query timeout as a duration string", func(t *testing.T) {
+		provider, dsInfo := newInstance(t, `{"queryTimeout":"60s"}`)
+		require.Equal(t, 60*time.Second, provider.opts.Timeouts.Timeout)
+		require.Equal(t, models.Duration(60*time.Second), dsInfo.QueryTimeout)
+	})
+
+	t.Run("connect timeout as a duration string", func(t *testing.T) {
+		provider, dsInfo := newInstance(t, `{"connectTimeout":"500ms"}`)
+		require.Equal(t, 500*time.Millisecond, provider.opts.Timeouts.DialTimeout)
+		require.Equal(t, models.Duration(500*time.Millisecond), dsInfo.ConnectTimeout)
+	})
+
+	t.Run("invalid query timeout", func(t *testing.T) {
+		_, err := newInstanceSettings(&fakeHttpClientProvider{})(context.Background(), backend.DataSourceInstanceSettings{
+			URL:      "http://localhost:8086",
+			JSONData: []byte(`{"queryTimeout":"soon"}`),
+		})
+		require.ErrorContains(t, err, `invalid duration "soon"`)
+	})
+
+	t.Run("defaults are kept without timeouts", func(t *testing.T) {
+		provider, _ := newInstance(t, `{}`)
+		defaults := backend.DataSourceInstanceSettings{}
+		opts, err := defaults.HTTPClientOptions(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, opts.Timeouts.DialTimeout, provider.opts.Timeouts.DialTimeout)
+		require.Equal(t, opts.Timeouts.Timeout, provider.opts.Timeouts.Timeout)
+	})
+}
+
+func TestNewInstanceSettings_ForceHTTP1(t *testing.T) {
+	newInstance := func(t *testing.T, jsonData string) *fakeHttpClientProvider {
+		t.Helper()
+		provider := &fakeHttpClientProvider{}
+		_, err := newInstanceSettings(provider)(context.Background(), backend.DataSourceInstanceSettings{
+			URL:      "https://localhost:8086",
+			JSONData: []byte(jsonData),
+		})
+		require.NoError(t, err)
+		return provider
+	}
+
+	t.Run("transport is not changed by default", func(t *testing.T) {
+		provider := newInstance(t, `{}`)
+		require.Nil(t, provider.opts.ConfigureTransport)
+	})
+
+	t.Run("forced HTTP/1.1 is negotiated with an HTTP/2 server", func(t *testing.T) {
+		provider := newInstance(t, `{"forceHttp1":true}`)
+		require.NotNil(t, provider.opts.ConfigureTransport)
+
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.EnableHTTP2 = true
+		server.StartTLS()
+		t.Cleanup(server.Close)
+
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		transport.ForceAttemptHTTP2 = true
+		provider.opts.ConfigureTransport(provider.opts, transport)
+		require.False(t, transport.ForceAttemptHTTP2)
+
+		res, err := (&http.Client{Transport: transport}).Get(server.URL)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, "HTTP/1.1", res.Proto)
+	})
+}
+
+func TestNewInstanceSettings_MaxStatements(t *testing.T) {
+	newInstance := func(t *testing.T, jsonData string) *models.DatasourceInfo {
+		t.Helper()
+		instance, err := newInstanceSettings(&fakeHttpClientProvider{})(context.Background(), backend.DataSourceInstanceSettings{
+			URL:      "http://localhost:8086",
+			JSONData: []byte(jsonData),
+		})
+		require.NoError(t, err)
+		return instance.(*models.DatasourceInfo)
+	}
+
+	require.Equal(t, 0, newInstance(t, `{}`).MaxStatements, "the statements are not limited by default")
+	require.Equal(t, 3, newInstance(t, `{"maxStatements":3}`).MaxStatements)
+}
+
+func TestNewInstanceSettings_ExemplarMeasurementSuffix(t *testing.T) {
+	newInstance := func(t *testing.T, jsonData string) *models.DatasourceInfo {
+		t.Helper()
+		instance, err := newInstanceSettings(&fakeHttpClientProvider{})(context.Background(), backend.DataSourceInstanceSettings{
+			URL:      "http://localhost:8086",
+			JSONData: []byte(jsonData),
+		})
+		require.NoError(t, err)
+		return instance.(*models.DatasourceInfo)
+	}
+
+	require.Equal(t, "_exemplar", newInstance(t, `{}`).ExemplarMeasurementSuffix)
+	require.Equal(t, ":exemplars", newInstance(t, `{"exemplarMeasurementSuffix":":exemplars"}`).ExemplarMeasurementSuffix)
+}
+
+func TestNewInstanceSettings_Precision(t *testing.T) {
+	newInstance := func(t *testing.T, jsonData string) *models.DatasourceInfo {
+		t.Helper()
+		instance, err := newInstanceSettings(&fakeHttpClientProvider{})(context.Background(), backend.DataSourceInstanceSettings{
+			URL:      "http://localhost:8086",
+			JSONData: []byte(jsonData),
+		})
+		require.NoError(t, err)
+		return instance.(*models.DatasourceInfo)
+	}
+
+	require.Equal(t, "ms", newInstance(t, `{}`).Precision)
+	require.Equal(t, "ns", newInstance(t, `{"precision":"ns"}`).Precision)
+}
+
+func TestNewInstanceSettings_FrameFormat(t *testing.T) {
+	newInstance := func(t *testing.T, jsonData string) *models.DatasourceInfo {
+		t.Helper()
+		instance, err := newInstanceSettings(&fakeHttpClientProvider{})(context.Background(), backend.DataSourceInstanceSettings{
+			URL:      "http://localhost:8086",
+			JSONData: []byte(jsonData),
+		})
+		require.NoError(t, err)
+		return instance.(*models.DatasourceInfo)
+	}
+
+	require.Equal(t, models.FrameFormatSplit, newInstance(t, `{}`).FrameFormat)
+	require.Equal(t, models.FrameFormatWide, newInstance(t, `{"frameFormat":"wide"}`).FrameFormat)
+}
+
+func TestService_QueryData_Exemplars(t *testing.T) {
+	exemplarsFail := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Query().Get("q"), "_exemplar") {
+			_, _ = w.Write([]byte(`{"results":[{"series":[{"name":"cpu","columns":["time","value"],"values":[[1609459200000,1],[1609459260000,2]]}]}]}`))
+			return
+		}
+		if exemplarsFail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(`{"results":[{"series":[` +
+			`{"name":"cpu_exemplar","tags":{"trace_id":"abc"},"columns":["time","value"],"values":[[1609459230000,1.5]]},` +
+			`{"name":"cpu_exemplar","tags":{"trace_id":"def"},"columns":["time","value"],"values":[[1609459200000,0.5]]}` +
+			`]}]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	dsInfo, err := newInstanceSettings(&fakeHttpClientProvider{})(context.Background(), backend.DataSourceInstanceSettings{
+		URL:      server.URL,
+		JSONData: []byte(`{"dbName":"telegraf","exemplarTraceIdDestinations":[{"name":"trace_id","datasourceUid":"tempo"}]}`),
+	})
+	require.NoError(t, err)
+	dsInfo.(*models.DatasourceInfo).HTTPClient = server.Client()
+	s := &Service{im: datasource.NewInstanceManager(func(context.Context, backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+		return dsInfo, nil
+	})}
+
+	query := func(t *testing.T) backend.DataResponse {
+		t.Helper()
+		resp, err := s.QueryData(context.Background(), &backend.QueryDataRequest{
+			PluginContext: backend.PluginContext{DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{UID: "influx"}},
+			Queries: []backend.DataQuery{{
+				RefID: "A",
+				JSON:  []byte(`{"rawQuery":true,"query":"SELECT \"value\" FROM \"cpu\" WHERE $timeFilter"}`),
+				TimeRange: backend.TimeRange{
+					From: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+					To:   time.Date(2021, 1, 1, 1, 0, 0, 0, time.UTC),
+				},
+			}},
+		})
+		require.NoError(t, err)
+		require.Len(t, resp.Responses, 1)
+		return resp.Responses["A"]
+	}
+
+	t.Run("exemplars are attached to the response of their query", func(t *testing.T) {
+		resp := query(t)
+		require.NoError(t, resp.Error)
+		require.Len(t, resp.Frames, 2)
+		require.Equal(t, 2, resp.Frames[0].Rows())
+
+		exemplars := resp.Frames[1]
+		require.Equal(t, "exemplar", exemplars.Name)
+		require.Equal(t, "A", exemplars.RefID)
+		require.Equal(t, 2, exemplars.Rows())
+		require.Equal(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), exemplars.Fields[0].At(0))
+		require.Equal(t, 0.5, exemplars.Fields[1].At(0))
+		require.Equal(t, "trace_id", exemplars.Fields[2].Name)
+		require.Equal(t, "def", exemplars.Fields[2].At(0))
+		require.Equal(t, "abc", exemplars.Fields[2].At(1))
+		require.Equal(t, []data.DataLink{{
+			Title: "trace_id",
+			Internal: &data.InternalDataLink{
+				DatasourceUID: "tempo",
+				Query:         map[string]any{"query": "${__value.raw}"},
+			},
+		}}, exemplars.Fields[2].Config.Links)
+	})
+
+	t.Run("the series are returned when the exemplars fail", func(t *testing.T) {
+		exemplarsFail = true
+		t.Cleanup(func() { exemplarsFail = false })
+		resp := query(t)
+		require.NoError(t, resp.Error)
+		require.Len(t, resp.Frames, 1)
+	})
+}
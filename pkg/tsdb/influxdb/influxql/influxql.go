@@ -1,24 +1,45 @@
 package influxql
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/tsdb/influxdb/exemplar"
 	"github.com/grafana/grafana/pkg/tsdb/influxdb/models"
 )
 
-const defaultRetentionPolicy = "default"
+const (
+	defaultRetentionPolicy = "default"
+	// maxBodySnippetBytes is how much of an unexpected response body is reported in the error.
+	maxBodySnippetBytes = 256
+)
 
 var (
 	ErrInvalidHttpMode = errors.New("'httpMode' should be either 'GET' or 'POST'")
+	ErrPostNotAllowed  = errors.New("InfluxDB does not allow POST requests")
 	glog               = log.New("tsdb.influx_influxql")
 )
 
@@ -29,59 +50,181 @@ func Query(ctx context.Context, dsInfo *models.DatasourceInfo, req *backend.Quer
 	response := backend.NewQueryDataResponse()
 
 	for _, reqQuery := range req.Queries {
-		query, err := models.QueryParse(reqQuery)
+		resp, err := runQuery(ctx, logger, dsInfo, req, reqQuery)
 		if err != nil {
 			return &backend.QueryDataResponse{}, err
 		}
+		response.Responses[reqQuery.RefID] = resp
+	}
 
-		rawQuery, err := query.Build(req)
-		if err != nil {
-			return &backend.QueryDataResponse{}, err
-		}
+	return response, nil
+}
 
-		query.RefID = reqQuery.RefID
-		query.RawQuery = rawQuery
+// runQuery runs one query of the request in its own span. The error is returned for the queries that can't be
+// built or sent, the errors of InfluxDB are in the response.
+func runQuery(ctx context.Context, logger log.Logger, dsInfo *models.DatasourceInfo, req *backend.QueryDataRequest, reqQuery backend.DataQuery) (backend.DataResponse, error) {
+	ctx, span := tracing.DefaultTracer().Start(ctx, "datasource.influxdb.influxql.query", trace.WithAttributes(
+		attribute.String("refID", reqQuery.RefID),
+		attribute.String("httpMode", dsInfo.HTTPMode),
+	))
+	defer span.End()
 
-		if setting.Env == setting.Dev {
-			logger.Info("Influxdb query", "raw query", rawQuery)
-		}
+	query, err := models.QueryParse(reqQuery)
+	if err != nil {
+		return backend.DataResponse{}, spanError(span, err)
+	}
+	span.SetAttributes(attribute.String("retentionPolicy", effectiveRetentionPolicy(query)))
 
-		request, err := createRequest(ctx, logger, dsInfo, rawQuery, query.Policy)
-		if err != nil {
-			return &backend.QueryDataResponse{}, err
+	query.MaxStatements = dsInfo.MaxStatements
+	query.AutoAggregation = dsInfo.AutoAggregation
+	query.FieldAggregations = dsInfo.FieldAggregations
+	rawQuery, err := query.Build(req)
+	if err != nil {
+		return backend.DataResponse{}, spanError(span, err)
+	}
+
+	query.RefID = reqQuery.RefID
+	query.RawQuery = rawQuery
+	query.EmptyResultsMode = dsInfo.EmptyResultsMode
+	query.EmptyTagValues = dsInfo.EmptyTagValues
+	query.ZeroTimestamps = dsInfo.ZeroTimestamps
+	if query.FrameFormat == "" {
+		query.FrameFormat = dsInfo.FrameFormat
+	}
+	if query.Epoch == "" {
+		query.Epoch = dsInfo.Precision
+	}
+	if query.MaxSeries <= 0 {
+		query.MaxSeries = dsInfo.MaxSeries
+	}
+
+	if setting.Env == setting.Dev {
+		logger.Info("Influxdb query", "raw query", rawQuery)
+	}
+
+	cache := databasesCache(dsInfo, query)
+	cacheKey := databasesCacheKey(req, query)
+	if cache != nil {
+		if resp, ok := cache.Get(cacheKey); ok {
+			span.SetAttributes(attribute.Bool("cached", true))
+			return resp, nil
 		}
+	}
 
-		resp, err := execute(dsInfo, logger, query, request)
+	queryCtx, cancel := queryContext(ctx, dsInfo)
+	request, err := createRequest(queryCtx, logger, dsInfo, query)
+	if err != nil {
+		cancel()
+		return backend.DataResponse{}, spanError(span, err)
+	}
 
-		if err != nil {
-			response.Responses[query.RefID] = backend.DataResponse{Error: err}
+	resp, err := execute(dsInfo, logger, query, request)
+	cancel()
+
+	if err != nil {
+		// The request could not be sent or was not answered, InfluxDB or the network failed
+		resp = backend.DataResponse{Error: err, ErrorSource: backend.ErrorSourceDownstream}
+	}
+	if cache != nil {
+		if resp.Error != nil {
+			cache.Invalidate()
 		} else {
-			response.Responses[query.RefID] = resp
+			cache.Set(cacheKey, resp)
 		}
 	}
+	if resp.Error != nil {
+		spanError(span, resp.Error)
+	}
+	return resp, nil
+}
 
-	return response, nil
+// spanError marks the span as failed with the error and returns the error.
+func spanError(span trace.Span, err error) error {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	return err
 }
 
-func createNewExemplarQuery(rawQuery string) (string, error) {
+func createNewExemplarQuery(rawQuery, measurementSuffix string) (string, error) {
 	fromIndex := strings.Index(rawQuery, "FROM")
 	if fromIndex == -1 {
 		return "", errors.New("keyword 'FROM' not found in query")
 	}
 
 	prefix := "SELECT * FROM "
-	suffix := rawQuery[fromIndex+len("FROM")+1:]
+	target := strings.TrimLeft(rawQuery[fromIndex+len("FROM"):], " ")
 
-	endOfTableName := strings.Index(suffix, " ")
-	if endOfTableName == -1 {
-		return "", errors.New("space not found after table name in query")
+	policy, measurement, end, err := splitMeasurement(target)
+	if err != nil {
+		return "", err
 	}
+	if measurementSuffix == "" {
+		measurementSuffix = models.DefaultExemplarMeasurementSuffix
+	}
+
+	return prefix + policy + exemplarMeasurement(measurement, measurementSuffix) + target[end:], nil
+}
+
+// splitMeasurement splits the FROM target at the start of s into the retention policy, with its trailing dot, and the
+// measurement. Every part is a bare name, a double-quoted name that may have spaces and dots, or a /regex/. end is
+// the index of s the target ends at.
+func splitMeasurement(s string) (policy, measurement string, end int, err error) {
+	i := 0
+	for {
+		start := i
+		if i < len(s) && (s[i] == '"' || s[i] == '/') {
+			closing := closingDelimiter(s, i)
+			if closing == -1 {
+				return "", "", 0, fmt.Errorf("unterminated %c in the FROM clause of the query", s[i])
+			}
+			i = closing + 1
+		} else {
+			for i < len(s) && s[i] != '.' && !isFromTargetEnd(s[i]) {
+				i++
+			}
+		}
+		// The parts may be empty, as the retention policy of database..measurement
+		if i < len(s) && s[i] == '.' {
+			i++
+			continue
+		}
+		if i == start {
+			return "", "", 0, errors.New("measurement not found after keyword 'FROM' in query")
+		}
+		return s[:start], s[start:i], i, nil
+	}
+}
 
-	tableName := suffix[:endOfTableName]
-	modifiedTableName := strings.TrimSuffix(tableName, "\"") + "_exemplar\""
-	remainder := suffix[endOfTableName:]
+// closingDelimiter returns the index of the delimiter closing the one at open in s, skipping the escaped ones, or -1.
+func closingDelimiter(s string, open int) int {
+	for i := open + 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case s[open]:
+			return i
+		}
+	}
+	return -1
+}
 
-	return prefix + modifiedTableName + remainder, nil
+func isFromTargetEnd(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' || c == ';' || c == ')'
+}
+
+// exemplarMeasurement returns the measurement with the suffix appended to its name. The name is quoted, as the suffix
+// may have characters that are not valid in identifiers. For a regex, the suffix is appended to the measurements it
+// matches, anchored to their end.
+func exemplarMeasurement(measurement, suffix string) string {
+	if strings.HasPrefix(measurement, "/") {
+		pattern := strings.TrimSuffix(strings.TrimSuffix(measurement, "/")[1:], "$")
+		return "/" + pattern + strings.ReplaceAll(regexp.QuoteMeta(suffix), "/", `\/`) + "$/"
+	}
+	suffix = strings.ReplaceAll(suffix, `"`, `\"`)
+	if strings.HasPrefix(measurement, `"`) {
+		return strings.TrimSuffix(measurement, `"`) + suffix + `"`
+	}
+	return `"` + measurement + suffix + `"`
 }
 
 // QueryExemplarData function returns a slice of models.Exemplar
@@ -95,12 +238,13 @@ func QueryExemplarData(ctx context.Context, dsInfo *models.DatasourceInfo, req *
 			return nil, err
 		}
 
+		query.MaxStatements = dsInfo.MaxStatements
 		rawQuery, err := query.Build(req)
 		if err != nil {
 			return nil, err
 		}
 
-		modifiedQuery, err := createNewExemplarQuery(rawQuery)
+		modifiedQuery, err := createNewExemplarQuery(rawQuery, dsInfo.ExemplarMeasurementSuffix)
 		if err != nil {
 			return nil, err
 		}
@@ -109,30 +253,161 @@ func QueryExemplarData(ctx context.Context, dsInfo *models.DatasourceInfo, req *
 
 		query.RefID = reqQuery.RefID
 		query.RawQuery = modifiedQuery
+		query.EmptyResultsMode = dsInfo.EmptyResultsMode
+		query.EmptyTagValues = dsInfo.EmptyTagValues
+		query.ZeroTimestamps = dsInfo.ZeroTimestamps
+		if query.FrameFormat == "" {
+			query.FrameFormat = dsInfo.FrameFormat
+		}
+		if query.Epoch == "" {
+			query.Epoch = dsInfo.Precision
+		}
+		if query.MaxSeries <= 0 {
+			query.MaxSeries = dsInfo.MaxSeries
+		}
 
 		if setting.Env == setting.Dev {
 			logger.Debug("Influxdb query", "raw query", rawQuery)
 		}
 
-		request, err := createRequest(ctx, logger, dsInfo, rawQuery, query.Policy)
+		// The exemplar query is sent with the same epoch as the main query, so the exemplar
+		// timestamps line up with the series they belong to.
+		queryCtx, cancel := queryContext(ctx, dsInfo)
+		request, err := createRequest(queryCtx, logger, dsInfo, query)
 		if err != nil {
+			cancel()
 			return nil, err
 		}
 
 		resp, err := execute(dsInfo, logger, query, request)
+		cancel()
 		if err != nil {
 			return nil, err
 		}
 
 		// Transform the frames to exemplars and append them to the exemplars slice
-		exemplars = append(exemplars, transformToExemplars(resp.Frames)...)
+		for _, exemplar := range transformToExemplars(resp.Frames, traceIDLabels(dsInfo)) {
+			exemplar.RefID = query.RefID
+			exemplars = append(exemplars, exemplar)
+		}
 
 	}
 	logger.Info("exemplars", "exemplars", exemplars)
 	return exemplars, nil
 }
 
-func createRequest(ctx context.Context, logger log.Logger, dsInfo *models.DatasourceInfo, queryStr string, retentionPolicy string) (*http.Request, error) {
+var showDatabasesPattern = regexp.MustCompile(`(?i)^\s*SHOW\s+DATABASES\s*;?\s*$`)
+
+// databasesCache returns the cache of the database list of the datasource when the query is a SHOW DATABASES query,
+// as the variable queries listing the databases send, nil otherwise.
+func databasesCache(dsInfo *models.DatasourceInfo, query *models.Query) *models.DatabasesCache {
+	if dsInfo.DatabasesCache == nil || !showDatabasesPattern.MatchString(query.RawQuery) {
+		return nil
+	}
+	return dsInfo.DatabasesCache
+}
+
+// databasesCacheKey returns the key of the database list of the query in the cache. The response depends on the
+// result format and whether it is a variable query, and InfluxDB may list different databases to different users, so
+// the user and the credentials forwarded for them are part of the key, hashed to keep them out of memory.
+func databasesCacheKey(req *backend.QueryDataRequest, query *models.Query) string {
+	identity := sha256.New()
+	if user := req.PluginContext.User; user != nil {
+		_, _ = identity.Write([]byte(user.Login + "\n" + user.Email + "\n"))
+	}
+	for _, header := range []string{backend.OAuthIdentityTokenHeaderName, backend.OAuthIdentityIDTokenHeaderName} {
+		_, _ = identity.Write([]byte(req.GetHTTPHeader(header) + "\n"))
+	}
+	return fmt.Sprintf("%s/%t/%s", query.ResultFormat, query.VariableQuery, hex.EncodeToString(identity.Sum(nil)))
+}
+
+// AttachExemplars adds a frame with the exemplars of every query to its response. The fields of the trace ID labels
+// link to the traces in the datasources of their ExemplarTraceIdDestinations.
+func AttachExemplars(response *backend.QueryDataResponse, exemplars []models.Exemplar, destinations []models.ExemplarSetting) error {
+	byRefID := map[string][]models.Exemplar{}
+	for _, e := range exemplars {
+		byRefID[e.RefID] = append(byRefID[e.RefID], e)
+	}
+	for refID, refExemplars := range byRefID {
+		resp, ok := response.Responses[refID]
+		if !ok || resp.Error != nil {
+			continue
+		}
+		frame, err := exemplarFrame(refID, refExemplars, destinations)
+		if err != nil {
+			return err
+		}
+		resp.Frames = append(resp.Frames, frame)
+		response.Responses[refID] = resp
+	}
+	return nil
+}
+
+// exemplarFrame builds the exemplar frame of a query, with a field for every series label of the exemplars and
+// for every trace ID label of the destinations.
+func exemplarFrame(refID string, exemplars []models.Exemplar, destinations []models.ExemplarSetting) (*data.Frame, error) {
+	sampler := exemplar.NewNoOpSampler()
+	labels := exemplar.NewLabelTracker()
+	for _, destination := range destinations {
+		if destination.Name != "" {
+			labels.Add(map[string]string{destination.Name: ""})
+		}
+	}
+	for _, e := range exemplars {
+		labels.Add(e.SeriesLabels)
+		// The labels are the tags of the series, the fields of the frame are its time and value.
+		e.Fields = nil
+		sampler.Add(e)
+	}
+
+	framer := exemplar.NewFramer(sampler, labels)
+	framer.SetRefID(refID)
+	frames, err := framer.Frames()
+	if err != nil {
+		return nil, err
+	}
+	frame := frames[len(frames)-1]
+	for _, field := range frame.Fields {
+		for _, destination := range destinations {
+			if destination.Name != field.Name || destination.DatasourceUid == "" {
+				continue
+			}
+			if field.Config == nil {
+				field.Config = &data.FieldConfig{}
+			}
+			field.Config.Links = append(field.Config.Links, data.DataLink{
+				Title: destination.Name,
+				Internal: &data.InternalDataLink{
+					DatasourceUID: destination.DatasourceUid,
+					Query:         map[string]any{"query": "${__value.raw}"},
+				},
+			})
+		}
+	}
+	return frame, nil
+}
+
+// traceIDLabels are the names of the labels holding the trace ID of exemplars.
+func traceIDLabels(dsInfo *models.DatasourceInfo) []string {
+	labels := make([]string, 0, len(dsInfo.ExemplarTraceIdDestinations))
+	for _, destination := range dsInfo.ExemplarTraceIdDestinations {
+		if destination.Name != "" {
+			labels = append(labels, destination.Name)
+		}
+	}
+	return labels
+}
+
+// queryContext limits the time a single query may take to the query timeout of the datasource, if set.
+func queryContext(ctx context.Context, dsInfo *models.DatasourceInfo) (context.Context, context.CancelFunc) {
+	if dsInfo.QueryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, time.Duration(dsInfo.QueryTimeout))
+}
+
+func createRequest(ctx context.Context, logger log.Logger, dsInfo *models.DatasourceInfo, query *models.Query) (*http.Request, error) {
+	queryStr := query.RawQuery
 	u, err := url.Parse(dsInfo.URL)
 	if err != nil {
 		return nil, err
@@ -161,11 +436,23 @@ func createRequest(ctx context.Context, logger log.Logger, dsInfo *models.Dataso
 	}
 
 	params := req.URL.Query()
-	params.Set("db", dsInfo.DbName)
-	params.Set("epoch", "ms")
+	params.Set("db", database(dsInfo))
+	epoch := query.Epoch
+	if epoch == "" {
+		epoch = models.DefaultPrecision
+	}
+	// Without an epoch InfluxDB returns RFC3339 timestamps, see parseTimestamp
+	if epoch != models.PrecisionRFC3339 {
+		params.Set("epoch", epoch)
+	}
+	if dsInfo.ChunkSize > 0 {
+		params.Set("chunked", "true")
+		params.Set("chunk_size", strconv.Itoa(dsInfo.ChunkSize))
+	}
+	retentionPolicy := effectiveRetentionPolicy(query)
 	// default is hardcoded default retention policy
 	// InfluxDB will use the default policy when it is not added to the request
-	if retentionPolicy != "" && retentionPolicy != "default" {
+	if retentionPolicy != "" && retentionPolicy != defaultRetentionPolicy {
 		params.Set("rp", retentionPolicy)
 	}
 
@@ -176,21 +463,197 @@ func createRequest(ctx context.Context, logger log.Logger, dsInfo *models.Dataso
 	}
 
 	req.URL.RawQuery = params.Encode()
+	req.Header.Set("User-Agent", userAgent(dsInfo))
+	// InfluxDB 2.x authenticates the InfluxQL compatibility API with a token. InfluxDB 1.x doesn't know the token
+	// scheme, so it is only sent to the compatibility API. The authentication configured in the HTTP settings of the
+	// datasource is applied after, so it still takes precedence.
+	if dsInfo.V2Compatibility && dsInfo.Token != "" {
+		req.Header.Set("Authorization", "Token "+dsInfo.Token)
+	}
+	// Large result sets compress well, the response is decompressed by responseBody
+	req.Header.Set("Accept-Encoding", "gzip")
 
 	logger.Debug("Influxdb request", "url", req.URL.String())
 	return req, nil
 }
 
+// database returns the db parameter of the requests, the default bucket of the datasource when it queries the
+// compatibility API of InfluxDB 2.x without a database.
+func database(dsInfo *models.DatasourceInfo) string {
+	if dsInfo.DbName == "" && dsInfo.V2Compatibility {
+		return dsInfo.DefaultBucket
+	}
+	return dsInfo.DbName
+}
+
+// effectiveRetentionPolicy returns the retention policy the query reads from, the retention policy override of the
+// query takes precedence over the policy of the query model.
+func effectiveRetentionPolicy(query *models.Query) string {
+	if query.RetentionPolicyOverride != "" {
+		return query.RetentionPolicyOverride
+	}
+	return query.Policy
+}
+
+// userAgent identifies the Grafana version and the datasource sending the request, so the requests can be
+// correlated in the InfluxDB logs, for example "Grafana/10.2.0 (datasource P951FEA4DE68E13C5) team-a".
+func userAgent(dsInfo *models.DatasourceInfo) string {
+	version := setting.BuildVersion
+	if version == "" {
+		version = "dev"
+	}
+	ua := "Grafana/" + version
+	if dsInfo.UID != "" {
+		ua += " (datasource " + dsInfo.UID + ")"
+	}
+	if dsInfo.UserAgent != "" {
+		ua += " " + dsInfo.UserAgent
+	}
+	return ua
+}
+
 func execute(dsInfo *models.DatasourceInfo, logger log.Logger, query *models.Query, request *http.Request) (backend.DataResponse, error) {
+	ctx, span := tracing.DefaultTracer().Start(request.Context(), "datasource.influxdb.influxql.execute", trace.WithAttributes(
+		attribute.String("http.method", request.Method),
+	))
+	defer span.End()
+
+	start := time.Now()
 	res, err := dsInfo.HTTPClient.Do(request)
 	if err != nil {
-		return backend.DataResponse{}, err
+		observeRequest(dsInfo.UID, 0, 0, time.Since(start))
+		if dsInfo.QueryTimeout > 0 && errors.Is(request.Context().Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("InfluxDB query timed out after %s: %w", time.Duration(dsInfo.QueryTimeout), err)
+		}
+		return backend.DataResponse{}, spanError(span, err)
 	}
+	span.SetAttributes(attribute.Int("http.status_code", res.StatusCode))
 	defer func() {
 		if err := res.Body.Close(); err != nil {
 			logger.Warn("Failed to close response body", "err", err)
 		}
 	}()
-	resp := ResponseParse(res.Body, res.StatusCode, query)
+	body := &countingReader{ReadCloser: res.Body}
+	reader, empty, err := responseBody(res, body)
+	if err != nil {
+		observeRequest(dsInfo.UID, res.StatusCode, body.n, time.Since(start))
+		return backend.DataResponse{}, spanError(span, err)
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			logger.Warn("Failed to close the decompressed response body", "err", err)
+		}
+	}()
+	// The status is checked before the content type, the error responses of proxies in front of InfluxDB often
+	// have a content type of their own and are reported with their status.
+	contentTypeAllowed := allowedContentType(dsInfo.ResponseContentTypes, res.Header.Get("Content-Type"))
+	var resp *backend.DataResponse
+	switch {
+	case res.StatusCode == http.StatusMethodNotAllowed && request.Method == http.MethodPost:
+		// Read-only proxies in front of InfluxDB often only allow GET on /query
+		resp = &backend.DataResponse{
+			Error: fmt.Errorf("%w: the server answered 405 Method Not Allowed. "+
+				"Switch the HTTP Method of the data source settings to GET", ErrPostNotAllowed),
+			ErrorSource: backend.ErrorSourceDownstream,
+		}
+	case res.StatusCode/100 != 2 && !contentTypeAllowed:
+		resp = &backend.DataResponse{
+			Error:       fmt.Errorf("InfluxDB returned status %d: %s", res.StatusCode, bodySnippet(reader)),
+			ErrorSource: backend.ErrorSourceFromHTTPStatus(res.StatusCode),
+		}
+	case res.StatusCode/100 != 2:
+		resp = parseResponse(ctx, reader, res.StatusCode, query)
+	case !contentTypeAllowed:
+		resp = &backend.DataResponse{
+			Error: fmt.Errorf("unexpected content type %q of the InfluxDB response with status %d, expected one of %s: %s",
+				res.Header.Get("Content-Type"), res.StatusCode, strings.Join(dsInfo.ResponseContentTypes, ", "), bodySnippet(reader)),
+			ErrorSource: backend.ErrorSourceDownstream,
+		}
+	case empty:
+		resp = emptyResults(query)
+	default:
+		resp = parseResponse(ctx, reader, res.StatusCode, query)
+	}
+	observeRequest(dsInfo.UID, res.StatusCode, body.n, time.Since(start))
+	span.SetAttributes(attribute.Int64("http.response_content_length", body.n))
+	if resp.Error != nil {
+		spanError(span, resp.Error)
+	}
 	return *resp, nil
 }
+
+// parseResponse parses the response body in its own span, as reading and parsing a large response can take longer
+// than InfluxDB took to answer.
+func parseResponse(ctx context.Context, reader io.Reader, statusCode int, query *models.Query) *backend.DataResponse {
+	_, span := tracing.DefaultTracer().Start(ctx, "datasource.influxdb.influxql.parse")
+	defer span.End()
+
+	resp := parse(reader, statusCode, query)
+	span.SetAttributes(attribute.Int("frames", len(resp.Frames)))
+	if resp.Error != nil {
+		spanError(span, resp.Error)
+	}
+	return resp
+}
+
+// allowedContentType reports whether the media type of the content type is one of the allowed ones, any content
+// type is allowed when there are none.
+func allowedContentType(allowed []string, contentType string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		if strings.EqualFold(mediaType, strings.TrimSpace(a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// bodySnippet returns the start of the body, for the errors about responses that can't be parsed.
+func bodySnippet(body io.Reader) string {
+	snippet, _ := io.ReadAll(io.LimitReader(body, maxBodySnippetBytes))
+	return strings.TrimSpace(string(snippet))
+}
+
+// responseBody returns the body of the response, decompressed when it is gzip encoded and the transport didn't
+// decompress it, and whether it is a gzip encoded body that is empty once decompressed. Some proxies answer with
+// such bodies, either zero-length or an empty gzip stream, which are not valid gzip or JSON documents. Closing the
+// returned body doesn't close the body of the response.
+func responseBody(res *http.Response, body io.Reader) (io.ReadCloser, bool, error) {
+	compressed := strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip")
+	if !res.Uncompressed && !compressed {
+		return io.NopCloser(body), false, nil
+	}
+
+	buffered := bufio.NewReader(body)
+	if !compressed {
+		_, err := buffered.Peek(1)
+		return io.NopCloser(buffered), err == io.EOF, nil
+	}
+
+	if _, err := buffered.Peek(1); err == io.EOF {
+		return io.NopCloser(buffered), true, nil
+	}
+	gz, err := gzip.NewReader(buffered)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decompress the InfluxDB response: %w", err)
+	}
+	decompressed := bufio.NewReader(gz)
+	_, err = decompressed.Peek(1)
+	return gzipBody{Reader: decompressed, gz: gz}, err == io.EOF, nil
+}
+
+// gzipBody is a decompressed response body, closing it releases the gzip reader.
+type gzipBody struct {
+	io.Reader
+	gz *gzip.Reader
+}
+
+func (b gzipBody) Close() error {
+	return b.gz.Close()
+}
@@ -1,15 +1,31 @@
 package influxql
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/setting"
 	"github.com/grafana/grafana/pkg/tsdb/influxdb/models"
 )
 
@@ -20,24 +36,40 @@ func TestExecutor_createRequest(t *testing.T) {
 		DbName:   "awesome-db",
 		HTTPMode: "GET",
 	}
-	query := "SELECT awesomeness FROM somewhere"
+	queryString := "SELECT awesomeness FROM somewhere"
+	query := &models.Query{RawQuery: queryString, Policy: defaultRetentionPolicy}
 
 	t.Run("createRequest with GET httpMode", func(t *testing.T) {
-		req, err := createRequest(context.Background(), logger, datasource, query, defaultRetentionPolicy)
+		req, err := createRequest(context.Background(), logger, datasource, query)
 
 		require.NoError(t, err)
 
 		assert.Equal(t, "GET", req.Method)
 
 		q := req.URL.Query().Get("q")
-		assert.Equal(t, query, q)
+		assert.Equal(t, queryString, q)
 
 		assert.Nil(t, req.Body)
+		assert.Equal(t, "gzip", req.Header.Get("Accept-Encoding"))
+		assert.Empty(t, req.URL.Query().Get("chunked"))
+	})
+
+	t.Run("createRequest with a chunk size", func(t *testing.T) {
+		datasource := &models.DatasourceInfo{
+			URL:       "http://awesome-influxdb:1337",
+			DbName:    "awesome-db",
+			HTTPMode:  "GET",
+			ChunkSize: 10000,
+		}
+		req, err := createRequest(context.Background(), logger, datasource, query)
+		require.NoError(t, err)
+		assert.Equal(t, "true", req.URL.Query().Get("chunked"))
+		assert.Equal(t, "10000", req.URL.Query().Get("chunk_size"))
 	})
 
 	t.Run("createRequest with POST httpMode", func(t *testing.T) {
 		datasource.HTTPMode = "POST"
-		req, err := createRequest(context.Background(), logger, datasource, query, defaultRetentionPolicy)
+		req, err := createRequest(context.Background(), logger, datasource, query)
 		require.NoError(t, err)
 
 		assert.Equal(t, "POST", req.Method)
@@ -49,14 +81,905 @@ func TestExecutor_createRequest(t *testing.T) {
 		require.NoError(t, err)
 
 		testBodyValues := url.Values{}
-		testBodyValues.Add("q", query)
+		testBodyValues.Add("q", queryString)
 		testBody := testBodyValues.Encode()
 		assert.Equal(t, testBody, string(body))
 	})
 
 	t.Run("createRequest with PUT httpMode", func(t *testing.T) {
 		datasource.HTTPMode = "PUT"
-		_, err := createRequest(context.Background(), logger, datasource, query, defaultRetentionPolicy)
+		_, err := createRequest(context.Background(), logger, datasource, query)
 		require.EqualError(t, err, ErrInvalidHttpMode.Error())
 	})
+
+	t.Run("createRequest sets the User-Agent", func(t *testing.T) {
+		version := setting.BuildVersion
+		setting.BuildVersion = "10.2.0"
+		t.Cleanup(func() { setting.BuildVersion = version })
+
+		datasource := &models.DatasourceInfo{URL: "http://awesome-influxdb:1337", DbName: "awesome-db", HTTPMode: "GET", UID: "P951FEA4DE68E13C5"}
+		req, err := createRequest(context.Background(), logger, datasource, query)
+		require.NoError(t, err)
+		assert.Equal(t, "Grafana/10.2.0 (datasource P951FEA4DE68E13C5)", req.Header.Get("User-Agent"))
+
+		datasource.UserAgent = "team-a"
+		req, err = createRequest(context.Background(), logger, datasource, query)
+		require.NoError(t, err)
+		assert.Equal(t, "Grafana/10.2.0 (datasource P951FEA4DE68E13C5) team-a", req.Header.Get("User-Agent"))
+	})
+
+	t.Run("createRequest sets the token", func(t *testing.T) {
+		datasource := &models.DatasourceInfo{URL: "http://awesome-influxdb:1337", DbName: "awesome-db", HTTPMode: "GET"}
+		req, err := createRequest(context.Background(), logger, datasource, query)
+		require.NoError(t, err)
+		assert.Empty(t, req.Header.Get("Authorization"))
+
+		datasource.Token = "secret-token"
+		req, err = createRequest(context.Background(), logger, datasource, query)
+		require.NoError(t, err)
+		assert.Empty(t, req.Header.Get("Authorization"), "the token is only sent to the v2 compatibility API")
+
+		datasource.V2Compatibility = true
+		req, err = createRequest(context.Background(), logger, datasource, query)
+		require.NoError(t, err)
+		assert.Equal(t, "Token secret-token", req.Header.Get("Authorization"))
+	})
+
+	t.Run("createRequest with the v2 compatibility API", func(t *testing.T) {
+		datasource := &models.DatasourceInfo{URL: "http://awesome-influxdb:1337", DefaultBucket: "awesome-bucket", HTTPMode: "GET", V2Compatibility: true}
+		req, err := createRequest(context.Background(), logger, datasource, query)
+		require.NoError(t, err)
+		assert.Equal(t, "awesome-bucket", req.URL.Query().Get("db"))
+
+		datasource.DbName = "awesome-db"
+		req, err = createRequest(context.Background(), logger, datasource, query)
+		require.NoError(t, err)
+		assert.Equal(t, "awesome-db", req.URL.Query().Get("db"))
+
+		datasource.DbName, datasource.V2Compatibility = "", false
+		req, err = createRequest(context.Background(), logger, datasource, query)
+		require.NoError(t, err)
+		assert.Empty(t, req.URL.Query().Get("db"))
+	})
+
+	t.Run("createRequest retention policy precedence", func(t *testing.T) {
+		datasource.HTTPMode = "GET"
+		tests := []struct {
+			name     string
+			policy   string
+			override string
+			expected string
+		}{
+			{name: "default policy is not sent", policy: defaultRetentionPolicy, expected: ""},
+			{name: "policy of the query model", policy: "one_week", expected: "one_week"},
+			{name: "override wins over the policy of the query model", policy: "one_week", override: "one_year", expected: "one_year"},
+			{name: "override wins over the default policy", policy: defaultRetentionPolicy, override: "one_year", expected: "one_year"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				req, err := createRequest(context.Background(), logger, datasource, &models.Query{
+					RawQuery:                queryString,
+					Policy:                  tt.policy,
+					RetentionPolicyOverride: tt.override,
+				})
+				require.NoError(t, err)
+				assert.Equal(t, tt.expected, req.URL.Query().Get("rp"))
+			})
+		}
+	})
+}
+
+func TestExecutor_QueryExemplarData(t *testing.T) {
+	var epochs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		epochs = append(epochs, r.URL.Query().Get("epoch"))
+		name := "cpu"
+		if strings.Contains(r.URL.Query().Get("q"), "_exemplar") {
+			name = "cpu_exemplar"
+		}
+		_, _ = w.Write([]byte(`{"results":[{"series":[{"name":"` + name + `","columns":["time","value"],"values":[[1609459200,12.5]]}]}]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	datasource := &models.DatasourceInfo{
+		HTTPClient: server.Client(),
+		URL:        server.URL,
+		DbName:     "awesome-db",
+		HTTPMode:   "GET",
+	}
+	req := &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				RefID: "A",
+				JSON:  []byte(`{"rawQuery":true,"query":"SELECT \"value\" FROM \"cpu\" WHERE $timeFilter","epoch":"s"}`),
+				TimeRange: backend.TimeRange{
+					From: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+					To:   time.Date(2021, 1, 1, 1, 0, 0, 0, time.UTC),
+				},
+			},
+		},
+	}
+
+	t.Run("exemplar query inherits the epoch of the main query", func(t *testing.T) {
+		epochs = nil
+		resp, err := Query(context.Background(), datasource, req)
+		require.NoError(t, err)
+		frames := resp.Responses["A"].Frames
+		require.Len(t, frames, 1)
+
+		exemplars, err := QueryExemplarData(context.Background(), datasource, req)
+		require.NoError(t, err)
+		require.Len(t, exemplars, 1)
+
+		require.Equal(t, []string{"s", "s"}, epochs)
+		expected := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+		require.Equal(t, expected, frames[0].Fields[0].At(0))
+		require.Equal(t, expected, exemplars[0].Timestamp)
+	})
+}
+
+func TestExecutor_Query_MethodNotAllowed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		_, _ = w.Write([]byte(`{"results":[{"series":[{"name":"cpu","columns":["time","value"],"values":[[1609459200000,1]]}]}]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	query := func(t *testing.T, httpMode string) backend.DataResponse {
+		t.Helper()
+		datasource := &models.DatasourceInfo{
+			HTTPClient: server.Client(),
+			URL:        server.URL,
+			DbName:     "awesome-db",
+			HTTPMode:   httpMode,
+		}
+		resp, err := Query(context.Background(), datasource, &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{
+				RefID: "A",
+				JSON:  []byte(`{"rawQuery":true,"query":"SELECT \"value\" FROM \"cpu\" WHERE $timeFilter"}`),
+				TimeRange: backend.TimeRange{
+					From: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+					To:   time.Date(2021, 1, 1, 1, 0, 0, 0, time.UTC),
+				},
+			}},
+		})
+		require.NoError(t, err)
+		return resp.Responses["A"]
+	}
+
+	t.Run("POST requests rejected by the server suggest the GET mode", func(t *testing.T) {
+		resp := query(t, "POST")
+		require.ErrorIs(t, resp.Error, ErrPostNotAllowed)
+		require.ErrorContains(t, resp.Error, "Switch the HTTP Method of the data source settings to GET")
+		require.Equal(t, backend.ErrorSourceDownstream, resp.ErrorSource)
+	})
+
+	t.Run("GET requests are answered", func(t *testing.T) {
+		resp := query(t, "GET")
+		require.NoError(t, resp.Error)
+		require.Len(t, resp.Frames, 1)
+	})
+}
+
+func TestExecutor_Query_Precision(t *testing.T) {
+	var epochs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		epochs = append(epochs, r.URL.Query().Get("epoch"))
+		timestamp := "1609459200123456789"
+		switch {
+		case r.URL.Query().Get("epoch") == "s":
+			timestamp = "1609459200"
+		case !r.URL.Query().Has("epoch") && strings.Contains(r.URL.Query().Get("q"), "zoneless"):
+			timestamp = `"2021-01-01T01:00:00.5"`
+		case !r.URL.Query().Has("epoch"):
+			timestamp = `"2021-01-01T01:00:00.5+01:00"`
+		}
+		_, _ = w.Write([]byte(`{"results":[{"series":[{"name":"cpu","columns":["time","value"],"values":[[` + timestamp + `,1]]}]}]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	datasource := &models.DatasourceInfo{
+		HTTPClient: server.Client(),
+		URL:        server.URL,
+		DbName:     "awesome-db",
+		HTTPMode:   "GET",
+		Precision:  "ns",
+	}
+	query := func(t *testing.T, json string) time.Time {
+		t.Helper()
+		resp, err := Query(context.Background(), datasource, &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{
+				RefID: "A",
+				JSON:  []byte(json),
+				TimeRange: backend.TimeRange{
+					From: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+					To:   time.Date(2021, 1, 1, 1, 0, 0, 0, time.UTC),
+				},
+			}},
+		})
+		require.NoError(t, err)
+		frames := resp.Responses["A"].Frames
+		require.Len(t, frames, 1)
+		return frames[0].Fields[0].At(0).(time.Time)
+	}
+
+	t.Run("timestamps are requested and parsed in the precision of the datasource", func(t *testing.T) {
+		epochs = nil
+		timestamp := query(t, `{"rawQuery":true,"query":"SELECT \"value\" FROM \"cpu\" WHERE $timeFilter"}`)
+		require.Equal(t, []string{"ns"}, epochs)
+		require.Equal(t, time.Date(2021, 1, 1, 0, 0, 0, 123456789, time.UTC), timestamp)
+	})
+
+	t.Run("the epoch of the query takes precedence", func(t *testing.T) {
+		epochs = nil
+		timestamp := query(t, `{"rawQuery":true,"query":"SELECT \"value\" FROM \"cpu\" WHERE $timeFilter","epoch":"s"}`)
+		require.Equal(t, []string{"s"}, epochs)
+		require.Equal(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), timestamp)
+	})
+
+	t.Run("RFC3339 timestamps are requested without an epoch", func(t *testing.T) {
+		epochs = nil
+		timestamp := query(t, `{"rawQuery":true,"query":"SELECT \"value\" FROM \"cpu\" WHERE $timeFilter","epoch":"rfc3339"}`)
+		require.Equal(t, []string{""}, epochs)
+		require.Equal(t, time.Date(2021, 1, 1, 0, 0, 0, 500000000, time.UTC), timestamp, "the offset is applied")
+
+		timestamp = query(t, `{"rawQuery":true,"query":"SELECT \"value\" FROM \"zoneless\" WHERE $timeFilter","epoch":"rfc3339","tz":"Europe/Paris"}`)
+		require.Equal(t, time.Date(2021, 1, 1, 0, 0, 0, 500000000, time.UTC), timestamp, "zone-less timestamps are in the timezone of the query")
+	})
+}
+
+func TestCreateNewExemplarQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		suffix   string
+		expected string
+	}{
+		{
+			name:     "quoted measurement",
+			query:    `SELECT "value" FROM "cpu" WHERE time > now() - 1h`,
+			suffix:   ":exemplars",
+			expected: `SELECT * FROM "cpu:exemplars" WHERE time > now() - 1h`,
+		},
+		{
+			name:     "unquoted measurement",
+			query:    `SELECT value FROM cpu WHERE time > now() - 1h`,
+			suffix:   ":exemplars",
+			expected: `SELECT * FROM "cpu:exemplars" WHERE time > now() - 1h`,
+		},
+		{
+			name:     "quoted measurement with a retention policy",
+			query:    `SELECT "value" FROM "autogen"."cpu" WHERE time > now() - 1h`,
+			suffix:   ":exemplars",
+			expected: `SELECT * FROM "autogen"."cpu:exemplars" WHERE time > now() - 1h`,
+		},
+		{
+			name:     "unquoted measurement with a retention policy",
+			query:    `SELECT value FROM autogen.cpu WHERE time > now() - 1h`,
+			suffix:   ":exemplars",
+			expected: `SELECT * FROM autogen."cpu:exemplars" WHERE time > now() - 1h`,
+		},
+		{
+			name:     "quoted measurement with spaces",
+			query:    `SELECT "value" FROM "my measurement" WHERE time > now() - 1h`,
+			suffix:   ":exemplars",
+			expected: `SELECT * FROM "my measurement:exemplars" WHERE time > now() - 1h`,
+		},
+		{
+			name:     "quoted measurement with escaped quotes and dots",
+			query:    `SELECT "value" FROM "my \"cpu\".total" WHERE time > now() - 1h`,
+			suffix:   ":exemplars",
+			expected: `SELECT * FROM "my \"cpu\".total:exemplars" WHERE time > now() - 1h`,
+		},
+		{
+			name:     "fully qualified measurement with spaces",
+			query:    `SELECT "value" FROM "one day"."my measurement" WHERE time > now() - 1h`,
+			suffix:   ":exemplars",
+			expected: `SELECT * FROM "one day"."my measurement:exemplars" WHERE time > now() - 1h`,
+		},
+		{
+			name:     "fully qualified measurement with a database",
+			query:    `SELECT "value" FROM "telegraf"."autogen"."cpu" WHERE time > now() - 1h`,
+			suffix:   ":exemplars",
+			expected: `SELECT * FROM "telegraf"."autogen"."cpu:exemplars" WHERE time > now() - 1h`,
+		},
+		{
+			name:     "measurement with the default retention policy of a database",
+			query:    `SELECT value FROM telegraf..cpu WHERE time > now() - 1h`,
+			suffix:   ":exemplars",
+			expected: `SELECT * FROM telegraf.."cpu:exemplars" WHERE time > now() - 1h`,
+		},
+		{
+			name:     "regex measurement",
+			query:    `SELECT "value" FROM /cpu.*/ WHERE time > now() - 1h`,
+			suffix:   ":exemplars",
+			expected: `SELECT * FROM /cpu.*:exemplars$/ WHERE time > now() - 1h`,
+		},
+		{
+			name:     "anchored regex measurement with a retention policy",
+			query:    `SELECT "value" FROM "autogen"./^cpu\/[0-9]$/ WHERE time > now() - 1h`,
+			suffix:   "/exemplars.",
+			expected: `SELECT * FROM "autogen"./^cpu\/[0-9]\/exemplars\.$/ WHERE time > now() - 1h`,
+		},
+		{
+			name:     "measurement at the end of the query",
+			query:    `SELECT "value" FROM "my measurement"`,
+			expected: `SELECT * FROM "my measurement_exemplar"`,
+		},
+		{
+			name:     "default suffix",
+			query:    `SELECT "value" FROM "cpu" WHERE time > now() - 1h`,
+			expected: `SELECT * FROM "cpu_exemplar" WHERE time > now() - 1h`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := createNewExemplarQuery(tt.query, tt.suffix)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, query)
+		})
+	}
+}
+
+func TestCreateNewExemplarQuery_Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		err   string
+	}{
+		{name: "no FROM clause", query: `SHOW DATABASES`, err: "keyword 'FROM' not found in query"},
+		{name: "no measurement", query: `SELECT "value" FROM `, err: "measurement not found after keyword 'FROM' in query"},
+		{name: "unterminated quote", query: `SELECT "value" FROM "my measurement WHERE time > now() - 1h`, err: `unterminated " in the FROM clause of the query`},
+		{name: "unterminated regex", query: `SELECT "value" FROM /cpu.* WHERE time > now() - 1h`, err: "unterminated / in the FROM clause of the query"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := createNewExemplarQuery(tt.query, "")
+			require.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestExecutor_Query_MaxSeries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"results":[{"series":[` +
+			`{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[1609459200000,1]]},` +
+			`{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[[1609459200000,2]]},` +
+			`{"name":"cpu","tags":{"host":"c"},"columns":["time","value"],"values":[[1609459200000,3]]}` +
+			`]}]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	datasource := &models.DatasourceInfo{
+		HTTPClient: server.Client(),
+		URL:        server.URL,
+		DbName:     "awesome-db",
+		HTTPMode:   "GET",
+		MaxSeries:  2,
+	}
+	query := func(json string) backend.DataResponse {
+		req := &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{
+				{
+					RefID: "A",
+					JSON:  []byte(json),
+					TimeRange: backend.TimeRange{
+						From: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+						To:   time.Date(2021, 1, 1, 1, 0, 0, 0, time.UTC),
+					},
+				},
+			},
+		}
+		resp, err := Query(context.Background(), datasource, req)
+		require.NoError(t, err)
+		return resp.Responses["A"]
+	}
+
+	t.Run("datasource limit is applied without an override", func(t *testing.T) {
+		resp := query(`{"rawQuery":true,"query":"SELECT \"value\" FROM \"cpu\" WHERE $timeFilter GROUP BY \"host\""}`)
+		require.NoError(t, resp.Error)
+		require.Len(t, resp.Frames, 2)
+		require.Len(t, resp.Frames[0].Meta.Notices, 1)
+	})
+
+	t.Run("override raises the limit", func(t *testing.T) {
+		resp := query(`{"rawQuery":true,"query":"SELECT \"value\" FROM \"cpu\" WHERE $timeFilter GROUP BY \"host\"","maxSeries":10}`)
+		require.NoError(t, resp.Error)
+		require.Len(t, resp.Frames, 3)
+		require.Empty(t, resp.Frames[0].Meta.Notices)
+	})
+
+	t.Run("override lowers the limit", func(t *testing.T) {
+		resp := query(`{"rawQuery":true,"query":"SELECT \"value\" FROM \"cpu\" WHERE $timeFilter GROUP BY \"host\"","maxSeries":1}`)
+		require.NoError(t, resp.Error)
+		require.Len(t, resp.Frames, 1)
+		require.Equal(t, data.NoticeSeverityWarning, resp.Frames[0].Meta.Notices[0].Severity)
+		require.Equal(t, "Results have been limited to 1 series because the max series limit was reached", resp.Frames[0].Meta.Notices[0].Text)
+	})
+}
+
+func TestRedirectPolicy(t *testing.T) {
+	var dataNodeAuth string
+	dataNode := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dataNodeAuth = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte(`{"results":[{}]}`))
+	}))
+	t.Cleanup(dataNode.Close)
+
+	// Served on localhost so the http.Client sees the redirect as going to another host and drops the credentials
+	dataNodeURL, err := url.Parse(dataNode.URL)
+	require.NoError(t, err)
+	dataNodeHost := "localhost:" + dataNodeURL.Port()
+
+	metaNode := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://"+dataNodeHost+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}))
+	t.Cleanup(metaNode.Close)
+
+	do := func(clusterHosts []string) *http.Response {
+		client := &http.Client{CheckRedirect: RedirectPolicy(metaNode.URL, clusterHosts)}
+		req, err := http.NewRequest(http.MethodGet, metaNode.URL+"/query", nil)
+		require.NoError(t, err)
+		req.SetBasicAuth("user", "secret")
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = res.Body.Close() })
+		return res
+	}
+
+	t.Run("redirect to a cluster host is followed with the credentials", func(t *testing.T) {
+		dataNodeAuth = ""
+		res := do([]string{dataNodeHost})
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		user, password, ok := (&http.Request{Header: http.Header{"Authorization": {dataNodeAuth}}}).BasicAuth()
+		require.True(t, ok)
+		require.Equal(t, "user", user)
+		require.Equal(t, "secret", password)
+	})
+
+	t.Run("redirect to another host is not followed", func(t *testing.T) {
+		dataNodeAuth = ""
+		res := do(nil)
+		require.Equal(t, http.StatusTemporaryRedirect, res.StatusCode)
+		require.Empty(t, dataNodeAuth)
+	})
+}
+
+func TestExecutor_Query_QueryTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		_, _ = w.Write([]byte(`{"results":[{"series":[]}]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	datasource := &models.DatasourceInfo{
+		HTTPClient:   server.Client(),
+		URL:          server.URL,
+		DbName:       "awesome-db",
+		HTTPMode:     "GET",
+		QueryTimeout: models.Duration(time.Second),
+	}
+	req := &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				RefID: "A",
+				JSON:  []byte(`{"rawQuery":true,"query":"SELECT \"value\" FROM \"cpu\" WHERE $timeFilter"}`),
+				TimeRange: backend.TimeRange{
+					From: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+					To:   time.Date(2021, 1, 1, 1, 0, 0, 0, time.UTC),
+				},
+			},
+		},
+	}
+
+	start := time.Now()
+	resp, err := Query(context.Background(), datasource, req)
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.ErrorIs(t, resp.Responses["A"].Error, context.DeadlineExceeded)
+	require.ErrorContains(t, resp.Responses["A"].Error, "InfluxDB query timed out after 1s")
+	require.Equal(t, backend.ErrorSourceDownstream, resp.Responses["A"].ErrorSource)
+}
+
+func TestExecutor_Query_ResponseContentTypes(t *testing.T) {
+	contentType := "text/html"
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		if contentType == "text/html" {
+			_, _ = w.Write([]byte(`<html><body>Bad Gateway</body></html>`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"results":[{"series":[{"name":"cpu","columns":["time","mean"],"values":[[1609459200000,1]]}]}]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	datasource := &models.DatasourceInfo{
+		HTTPClient:           server.Client(),
+		URL:                  server.URL,
+		DbName:               "awesome-db",
+		HTTPMode:             "GET",
+		ResponseContentTypes: []string{"application/json", "application/csv"},
+	}
+	req := &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				RefID: "A",
+				JSON:  []byte(`{"rawQuery":true,"query":"SELECT mean(\"value\") FROM \"cpu\""}`),
+			},
+		},
+	}
+
+	t.Run("unexpected content type", func(t *testing.T) {
+		contentType, status = "text/html", http.StatusOK
+		resp, err := Query(context.Background(), datasource, req)
+		require.NoError(t, err)
+		require.EqualError(t, resp.Responses["A"].Error, `unexpected content type "text/html" of the InfluxDB response with status 200, `+
+			`expected one of application/json, application/csv: <html><body>Bad Gateway</body></html>`)
+		require.Equal(t, backend.ErrorSourceDownstream, resp.Responses["A"].ErrorSource)
+	})
+
+	t.Run("error statuses are reported before the content type", func(t *testing.T) {
+		contentType, status = "text/html", http.StatusBadGateway
+		resp, err := Query(context.Background(), datasource, req)
+		require.NoError(t, err)
+		require.EqualError(t, resp.Responses["A"].Error, `InfluxDB returned status 502: <html><body>Bad Gateway</body></html>`)
+		require.Equal(t, backend.ErrorSourceDownstream, resp.Responses["A"].ErrorSource)
+
+		contentType = "application/json"
+		resp, err = Query(context.Background(), datasource, req)
+		require.NoError(t, err)
+		require.NotContains(t, resp.Responses["A"].Error.Error(), "unexpected content type")
+	})
+
+	t.Run("method not allowed is reported before the content type", func(t *testing.T) {
+		contentType, status = "text/html", http.StatusMethodNotAllowed
+		datasource := *datasource
+		datasource.HTTPMode = "POST"
+		resp, err := Query(context.Background(), &datasource, req)
+		require.NoError(t, err)
+		require.ErrorIs(t, resp.Responses["A"].Error, ErrPostNotAllowed)
+	})
+
+	t.Run("allowed content type", func(t *testing.T) {
+		contentType, status = "application/json; charset=utf-8", http.StatusOK
+		resp, err := Query(context.Background(), datasource, req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Responses["A"].Error)
+		require.Len(t, resp.Responses["A"].Frames, 1)
+	})
+
+	t.Run("no allowlist", func(t *testing.T) {
+		contentType, status = "text/html", http.StatusBadGateway
+		datasource := *datasource
+		datasource.ResponseContentTypes = nil
+		resp, err := Query(context.Background(), &datasource, req)
+		require.NoError(t, err)
+		require.Error(t, resp.Responses["A"].Error)
+		require.NotContains(t, resp.Responses["A"].Error.Error(), "unexpected content type")
+	})
+}
+
+func TestExecutor_Query_Spans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracing.InitDefaultTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test"))
+	t.Cleanup(func() { tracing.InitDefaultTracer(trace.NewNoopTracerProvider().Tracer("")) })
+
+	body := `{"results":[{"series":[{"name":"cpu","columns":["time","mean"],"values":[[1609459200000,1]]}]}]}`
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			_, _ = w.Write([]byte(body))
+			return
+		}
+		_, _ = w.Write([]byte(`{"error":"internal error"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	datasource := &models.DatasourceInfo{
+		HTTPClient: server.Client(),
+		URL:        server.URL,
+		DbName:     "awesome-db",
+		HTTPMode:   "GET",
+	}
+	req := &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				RefID: "A",
+				JSON:  []byte(`{"policy":"autogen","measurement":"cpu","select":[[{"type":"field","params":["value"]}]]}`),
+				TimeRange: backend.TimeRange{
+					From: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+					To:   time.Date(2021, 1, 1, 1, 0, 0, 0, time.UTC),
+				},
+			},
+		},
+	}
+
+	querySpans := func(t *testing.T) (sdktrace.ReadOnlySpan, sdktrace.ReadOnlySpan, sdktrace.ReadOnlySpan) {
+		t.Helper()
+		spans := recorder.Ended()
+		require.GreaterOrEqual(t, len(spans), 3)
+		parse, execute, query := spans[len(spans)-3], spans[len(spans)-2], spans[len(spans)-1]
+		require.Equal(t, "datasource.influxdb.influxql.parse", parse.Name())
+		require.Equal(t, "datasource.influxdb.influxql.execute", execute.Name())
+		require.Equal(t, "datasource.influxdb.influxql.query", query.Name())
+		require.Equal(t, query.SpanContext().SpanID(), execute.Parent().SpanID())
+		require.Equal(t, execute.SpanContext().SpanID(), parse.Parent().SpanID())
+		return query, execute, parse
+	}
+	attributes := func(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+		attributes := map[attribute.Key]attribute.Value{}
+		for _, kv := range span.Attributes() {
+			attributes[kv.Key] = kv.Value
+		}
+		return attributes
+	}
+
+	t.Run("successful query", func(t *testing.T) {
+		status = http.StatusOK
+		resp, err := Query(context.Background(), datasource, req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Responses["A"].Error)
+
+		query, execute, parse := querySpans(t)
+		require.Equal(t, codes.Unset, query.Status().Code)
+		require.Equal(t, "A", attributes(query)["refID"].AsString())
+		require.Equal(t, "autogen", attributes(query)["retentionPolicy"].AsString())
+		require.Equal(t, "GET", attributes(query)["httpMode"].AsString())
+		require.Equal(t, codes.Unset, execute.Status().Code)
+		require.Equal(t, int64(http.StatusOK), attributes(execute)["http.status_code"].AsInt64())
+		require.Equal(t, int64(len(body)), attributes(execute)["http.response_content_length"].AsInt64())
+		require.Equal(t, codes.Unset, parse.Status().Code)
+		require.Equal(t, int64(1), attributes(parse)["frames"].AsInt64())
+	})
+
+	t.Run("retention policy override", func(t *testing.T) {
+		status = http.StatusOK
+		resp, err := Query(context.Background(), datasource, &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{
+				RefID:     "A",
+				JSON:      []byte(`{"policy":"autogen","retentionPolicyOverride":"one_year","measurement":"cpu","select":[[{"type":"field","params":["value"]}]]}`),
+				TimeRange: req.Queries[0].TimeRange,
+			}},
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Responses["A"].Error)
+
+		query, _, _ := querySpans(t)
+		require.Equal(t, "one_year", attributes(query)["retentionPolicy"].AsString())
+	})
+
+	t.Run("failed query", func(t *testing.T) {
+		status = http.StatusInternalServerError
+		resp, err := Query(context.Background(), datasource, req)
+		require.NoError(t, err)
+		require.Error(t, resp.Responses["A"].Error)
+
+		query, execute, parse := querySpans(t)
+		require.Equal(t, codes.Error, query.Status().Code)
+		require.Equal(t, codes.Error, execute.Status().Code)
+		require.Equal(t, codes.Error, parse.Status().Code)
+		require.Equal(t, int64(http.StatusInternalServerError), attributes(execute)["http.status_code"].AsInt64())
+	})
+}
+
+func TestExecutor_Query_EffectiveInterval(t *testing.T) {
+	var rawQuery string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawQuery = r.URL.Query().Get("q")
+		_, _ = w.Write([]byte(`{"results":[{"series":[{"name":"cpu","columns":["time","mean"],"values":[[1609459200000,1]]}]}]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	datasource := &models.DatasourceInfo{
+		HTTPClient: server.Client(),
+		URL:        server.URL,
+		DbName:     "awesome-db",
+		HTTPMode:   "GET",
+	}
+	req := &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				RefID:    "A",
+				JSON:     []byte(`{"rawQuery":true,"query":"SELECT mean(\"value\") FROM \"cpu\" WHERE $timeFilter GROUP BY time($__interval)"}`),
+				Interval: 5 * time.Minute,
+				TimeRange: backend.TimeRange{
+					From: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+					To:   time.Date(2021, 1, 1, 1, 0, 0, 0, time.UTC),
+				},
+			},
+		},
+	}
+
+	resp, err := Query(context.Background(), datasource, req)
+	require.NoError(t, err)
+	require.Contains(t, rawQuery, "GROUP BY time(5m)")
+	frames := resp.Responses["A"].Frames
+	require.Len(t, frames, 1)
+	require.Equal(t, FrameMetaCustom{Interval: "5m", IntervalMs: 300000}, frames[0].Meta.Custom)
+}
+
+func TestExecutor_Query_GzipResponses(t *testing.T) {
+	gzipped := func(t *testing.T, body string) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write([]byte(body))
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+		return buf.Bytes()
+	}
+
+	query := func(t *testing.T, body []byte, contentEncoding string, transport *http.Transport) backend.DataResponse {
+		t.Helper()
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+			if contentEncoding != "" {
+				w.Header().Set("Content-Encoding", contentEncoding)
+			}
+			_, _ = w.Write(body)
+		}))
+		t.Cleanup(server.Close)
+
+		datasource := &models.DatasourceInfo{
+			HTTPClient: &http.Client{Transport: transport},
+			URL:        server.URL,
+			DbName:     "awesome-db",
+			HTTPMode:   "GET",
+		}
+		resp, err := Query(context.Background(), datasource, &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{
+				RefID: "A",
+				JSON:  []byte(`{"rawQuery":true,"query":"SELECT \"value\" FROM \"cpu\" WHERE $timeFilter"}`),
+				TimeRange: backend.TimeRange{
+					From: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+					To:   time.Date(2021, 1, 1, 1, 0, 0, 0, time.UTC),
+				},
+			}},
+		})
+		require.NoError(t, err)
+		return resp.Responses["A"]
+	}
+
+	for name, newTransport := range map[string]func() *http.Transport{
+		"decompressed by the transport":    func() *http.Transport { return &http.Transport{} },
+		"left compressed by the transport": func() *http.Transport { return &http.Transport{DisableCompression: true} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Run("empty gzip stream", func(t *testing.T) {
+				resp := query(t, gzipped(t, ""), "gzip", newTransport())
+				require.NoError(t, resp.Error)
+				require.Empty(t, resp.Frames)
+			})
+
+			t.Run("zero-length body", func(t *testing.T) {
+				resp := query(t, nil, "gzip", newTransport())
+				require.NoError(t, resp.Error)
+				require.Empty(t, resp.Frames)
+			})
+
+			t.Run("gzipped results", func(t *testing.T) {
+				resp := query(t, gzipped(t, `{"results":[{"series":[{"name":"cpu","columns":["time","value"],"values":[[1609459200000,1]]}]}]}`), "gzip", newTransport())
+				require.NoError(t, resp.Error)
+				require.Len(t, resp.Frames, 1)
+				require.Equal(t, 1, resp.Frames[0].Rows())
+			})
+
+			t.Run("plain results", func(t *testing.T) {
+				resp := query(t, []byte(`{"results":[{"series":[{"name":"cpu","columns":["time","value"],"values":[[1609459200000,1]]}]}]}`), "", newTransport())
+				require.NoError(t, resp.Error)
+				require.Len(t, resp.Frames, 1)
+				require.Equal(t, 1, resp.Frames[0].Rows())
+			})
+		})
+	}
+}
+
+func TestExecutor_Query_DatabasesCache(t *testing.T) {
+	var requests int
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error":"internal error"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"results":[{"series":[{"name":"databases","columns":["name"],"values":[["_internal"],["telegraf"]]}]}]}`))
+	}))
+	t.Cleanup(server.Close)
+
+	datasource := &models.DatasourceInfo{
+		HTTPClient:     server.Client(),
+		URL:            server.URL,
+		DbName:         "awesome-db",
+		HTTPMode:       "GET",
+		DatabasesCache: models.NewDatabasesCache(time.Minute),
+	}
+	query := func(t *testing.T, rawQuery string) backend.DataResponse {
+		t.Helper()
+		resp, err := Query(context.Background(), datasource, &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{
+				RefID: "A",
+				JSON:  []byte(`{"rawQuery":true,"resultFormat":"table","query":"` + rawQuery + `"}`),
+			}},
+		})
+		require.NoError(t, err)
+		return resp.Responses["A"]
+	}
+
+	t.Run("the database list is read once within the TTL", func(t *testing.T) {
+		first := query(t, "SHOW DATABASES")
+		require.NoError(t, first.Error)
+		require.Len(t, first.Frames, 1)
+		require.Equal(t, first, query(t, "show databases"))
+		require.Equal(t, 1, requests)
+	})
+
+	t.Run("other queries are not cached", func(t *testing.T) {
+		requests = 0
+		query(t, "SHOW MEASUREMENTS")
+		query(t, "SHOW MEASUREMENTS")
+		require.Equal(t, 2, requests)
+	})
+
+	t.Run("errors invalidate the cache", func(t *testing.T) {
+		datasource.DatabasesCache.Invalidate()
+		failing = true
+		requests = 0
+		require.Error(t, query(t, "SHOW DATABASES").Error)
+		failing = false
+		require.NoError(t, query(t, "SHOW DATABASES").Error)
+		require.Equal(t, 2, requests)
+	})
+
+	t.Run("the database list is cached per user and variable query", func(t *testing.T) {
+		datasource.DatabasesCache.Invalidate()
+		requests = 0
+		queryAs := func(t *testing.T, user *backend.User, headers map[string]string, variableQuery bool) {
+			t.Helper()
+			req := &backend.QueryDataRequest{
+				PluginContext: backend.PluginContext{User: user},
+				Queries: []backend.DataQuery{{
+					RefID: "A",
+					JSON:  []byte(fmt.Sprintf(`{"rawQuery":true,"resultFormat":"table","variableQuery":%t,"query":"SHOW DATABASES"}`, variableQuery)),
+				}},
+			}
+			for name, value := range headers {
+				req.SetHTTPHeader(name, value)
+			}
+			resp, err := Query(context.Background(), datasource, req)
+			require.NoError(t, err)
+			require.NoError(t, resp.Responses["A"].Error)
+		}
+
+		alice := &backend.User{Login: "alice"}
+		queryAs(t, alice, nil, false)
+		queryAs(t, alice, nil, false)
+		require.Equal(t, 1, requests)
+		queryAs(t, alice, nil, true)
+		require.Equal(t, 2, requests, "variable queries are cached apart")
+		queryAs(t, &backend.User{Login: "bob"}, nil, false)
+		require.Equal(t, 3, requests, "users are cached apart")
+		queryAs(t, alice, map[string]string{"Authorization": "Bearer alice-token"}, false)
+		queryAs(t, alice, map[string]string{"Authorization": "Bearer alice-token"}, false)
+		require.Equal(t, 4, requests, "forwarded credentials are cached apart")
+		queryAs(t, alice, map[string]string{"X-Id-Token": "alice-id-token"}, false)
+		require.Equal(t, 5, requests)
+	})
+
+	t.Run("frames added to a cached response are not cached", func(t *testing.T) {
+		datasource.DatabasesCache.Invalidate()
+		resp := query(t, "SHOW DATABASES")
+		resp.Frames = append(resp.Frames, data.NewFrame("exemplars"))
+		require.Len(t, query(t, "SHOW DATABASES").Frames, 1)
+	})
 }
@@ -0,0 +1,69 @@
+package influxql
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// requestStatusError is the status of the requests that could not be sent or were not answered.
+const requestStatusError = "error"
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana",
+		Name:      "influxdb_influxql_requests_total",
+		Help:      "Number of InfluxQL requests sent to InfluxDB by datasource and status",
+	}, []string{"datasource", "status"})
+
+	requestErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana",
+		Name:      "influxdb_influxql_request_errors_total",
+		Help:      "Number of InfluxQL requests that failed or were answered with an error status, by datasource and status",
+	}, []string{"datasource", "status"})
+
+	responseBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grafana",
+		Name:      "influxdb_influxql_response_bytes_total",
+		Help:      "Number of bytes of the InfluxQL responses read from InfluxDB by datasource and status",
+	}, []string{"datasource", "status"})
+
+	requestDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "grafana",
+		Name:      "influxdb_influxql_request_duration_seconds",
+		Help:      "Duration of InfluxQL requests in seconds, including reading the response",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"datasource", "status"})
+)
+
+// observeRequest records a request to InfluxDB in the metrics Grafana exposes for scraping. The status code is the
+// HTTP status of the response, 0 when the request could not be sent or was not answered.
+func observeRequest(datasource string, statusCode int, bytes int64, duration time.Duration) {
+	status := requestStatusError
+	if statusCode != 0 {
+		status = strconv.Itoa(statusCode)
+	}
+
+	requestsTotal.WithLabelValues(datasource, status).Inc()
+	if statusCode == 0 || statusCode >= http.StatusBadRequest {
+		requestErrorsTotal.WithLabelValues(datasource, status).Inc()
+	}
+	responseBytesTotal.WithLabelValues(datasource, status).Add(float64(bytes))
+	requestDurationSeconds.WithLabelValues(datasource, status).Observe(duration.Seconds())
+}
+
+// countingReader counts the bytes read from the response body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
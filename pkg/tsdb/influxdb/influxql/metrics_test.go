@@ -0,0 +1,76 @@
+package influxql
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/tsdb/influxdb/models"
+)
+
+func TestExecutor_Query_Metrics(t *testing.T) {
+	const body = `{"results":[{"series":[{"name":"cpu","columns":["time","value"],"values":[[1609459200000,1]]}]}]}`
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	query := func(t *testing.T, dsInfo *models.DatasourceInfo) {
+		t.Helper()
+		_, err := Query(context.Background(), dsInfo, &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{
+				RefID: "A",
+				JSON:  []byte(`{"rawQuery":true,"query":"SELECT \"value\" FROM \"cpu\" WHERE $timeFilter"}`),
+				TimeRange: backend.TimeRange{
+					From: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+					To:   time.Date(2021, 1, 1, 1, 0, 0, 0, time.UTC),
+				},
+			}},
+		})
+		require.NoError(t, err)
+	}
+	durationCount := func(t *testing.T, datasource, status string) uint64 {
+		t.Helper()
+		m := &dto.Metric{}
+		observer := requestDurationSeconds.WithLabelValues(datasource, status)
+		require.NoError(t, observer.(prometheus.Metric).Write(m))
+		return m.GetHistogram().GetSampleCount()
+	}
+
+	t.Run("successful requests", func(t *testing.T) {
+		status = http.StatusOK
+		query(t, &models.DatasourceInfo{UID: "metrics-ok", HTTPClient: server.Client(), URL: server.URL, HTTPMode: "GET"})
+
+		require.Equal(t, float64(1), testutil.ToFloat64(requestsTotal.WithLabelValues("metrics-ok", "200")))
+		require.Equal(t, float64(0), testutil.ToFloat64(requestErrorsTotal.WithLabelValues("metrics-ok", "200")))
+		require.Equal(t, float64(len(body)), testutil.ToFloat64(responseBytesTotal.WithLabelValues("metrics-ok", "200")))
+		require.Equal(t, uint64(1), durationCount(t, "metrics-ok", "200"))
+	})
+
+	t.Run("error responses", func(t *testing.T) {
+		status = http.StatusBadRequest
+		query(t, &models.DatasourceInfo{UID: "metrics-bad-request", HTTPClient: server.Client(), URL: server.URL, HTTPMode: "GET"})
+
+		require.Equal(t, float64(1), testutil.ToFloat64(requestsTotal.WithLabelValues("metrics-bad-request", "400")))
+		require.Equal(t, float64(1), testutil.ToFloat64(requestErrorsTotal.WithLabelValues("metrics-bad-request", "400")))
+		require.Equal(t, uint64(1), durationCount(t, "metrics-bad-request", "400"))
+	})
+
+	t.Run("requests without a response", func(t *testing.T) {
+		query(t, &models.DatasourceInfo{UID: "metrics-unreachable", HTTPClient: server.Client(), URL: "http://127.0.0.1:0", HTTPMode: "GET"})
+
+		require.Equal(t, float64(1), testutil.ToFloat64(requestsTotal.WithLabelValues("metrics-unreachable", requestStatusError)))
+		require.Equal(t, float64(1), testutil.ToFloat64(requestErrorsTotal.WithLabelValues("metrics-unreachable", requestStatusError)))
+		require.Equal(t, float64(0), testutil.ToFloat64(responseBytesTotal.WithLabelValues("metrics-unreachable", requestStatusError)))
+	})
+}
@@ -0,0 +1,126 @@
+package influxql
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"github.com/grafana/grafana/pkg/tsdb/influxdb/models"
+)
+
+// explainAnalyzeColumn is the column of the series InfluxDB returns for EXPLAIN ANALYZE queries, every value is a
+// line of the query plan, like "├── execution_time: 2.25ms".
+const explainAnalyzeColumn = "EXPLAIN ANALYZE"
+
+var planLinePattern = regexp.MustCompile(`([a-z_]+): (\S+)$`)
+
+// queryCost is the cost of a query, as reported by InfluxDB in the plan of an EXPLAIN ANALYZE query.
+type queryCost struct {
+	planningTime  *time.Duration
+	executionTime *time.Duration
+	totalTime     *time.Duration
+	shards        int
+	blocksDecoded int64
+	blocksBytes   int64
+}
+
+// appendQueryStats adds the cost reported in the plan of EXPLAIN ANALYZE queries to the stats of the first frame,
+// so expensive queries can be found and optimized.
+func appendQueryStats(frames data.Frames, rows []models.Row) data.Frames {
+	cost, ok := parseQueryCost(rows)
+	if !ok {
+		return frames
+	}
+
+	stats := make([]data.QueryStat, 0, 6)
+	for _, duration := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"Planning time", cost.planningTime},
+		{"Execution time", cost.executionTime},
+		{"Total time", cost.totalTime},
+	} {
+		if duration.value != nil {
+			stats = append(stats, newQueryStat(duration.name, "ms", float64(*duration.value)/float64(time.Millisecond)))
+		}
+	}
+	stats = append(stats,
+		newQueryStat("Shards", "", float64(cost.shards)),
+		newQueryStat("Blocks decoded", "", float64(cost.blocksDecoded)),
+		newQueryStat("Blocks size", "decbytes", float64(cost.blocksBytes)),
+	)
+
+	if len(frames) == 0 {
+		frames = append(frames, data.NewFrame(""))
+	}
+	if frames[0].Meta == nil {
+		frames[0].Meta = &data.FrameMeta{}
+	}
+	frames[0].Meta.Stats = append(frames[0].Meta.Stats, stats...)
+	return frames
+}
+
+func newQueryStat(name string, unit string, value float64) data.QueryStat {
+	return data.QueryStat{FieldConfig: data.FieldConfig{DisplayName: name, Unit: unit}, Value: value}
+}
+
+// parseQueryCost sums up the cost in the plans of the EXPLAIN ANALYZE series, it returns false when there are none.
+func parseQueryCost(rows []models.Row) (queryCost, bool) {
+	var cost queryCost
+	found := false
+	for _, row := range rows {
+		if len(row.Columns) != 1 || row.Columns[0] != explainAnalyzeColumn {
+			continue
+		}
+		found = true
+
+		for _, values := range row.Values {
+			if len(values) == 0 {
+				continue
+			}
+			line, ok := values[0].(string)
+			if !ok {
+				continue
+			}
+			match := planLinePattern.FindStringSubmatch(strings.TrimSpace(line))
+			if match == nil {
+				continue
+			}
+			cost.add(match[1], match[2])
+		}
+	}
+	return cost, found
+}
+
+func (c *queryCost) add(name string, value string) {
+	switch {
+	case name == "planning_time":
+		c.planningTime = parseDurationStat(value)
+	case name == "execution_time":
+		c.executionTime = parseDurationStat(value)
+	case name == "total_time":
+		c.totalTime = parseDurationStat(value)
+	case name == "shard":
+		c.shards++
+	case strings.HasSuffix(name, "_blocks_decoded"):
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			c.blocksDecoded += n
+		}
+	case strings.HasSuffix(name, "_blocks_size_bytes"):
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			c.blocksBytes += n
+		}
+	}
+}
+
+func parseDurationStat(value string) *time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return nil
+	}
+	return &d
+}
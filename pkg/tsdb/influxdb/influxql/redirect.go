@@ -0,0 +1,44 @@
+package influxql
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const maxRedirects = 10
+
+var redirectHeaders = []string{"Authorization", "Cookie"}
+
+// RedirectPolicy returns a http.Client CheckRedirect function that only follows redirects to the host of the
+// datasource URL and to the cluster hosts, like the data nodes of an InfluxDB Enterprise cluster. Redirects to
+// other hosts are not followed and the redirect response is returned instead. The credentials of the original
+// request are re-applied, as they are dropped by the http.Client when the redirect goes to another host.
+func RedirectPolicy(datasourceURL string, clusterHosts []string) func(req *http.Request, via []*http.Request) error {
+	allowed := make(map[string]bool, len(clusterHosts)+1)
+	if u, err := url.Parse(datasourceURL); err == nil && u.Host != "" {
+		allowed[strings.ToLower(u.Host)] = true
+	}
+	for _, host := range clusterHosts {
+		allowed[strings.ToLower(host)] = true
+	}
+
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return errors.New("stopped after 10 redirects")
+		}
+		if !allowed[strings.ToLower(req.URL.Host)] {
+			glog.Warn("Not following redirect to a host outside of the InfluxDB cluster", "host", req.URL.Host)
+			return http.ErrUseLastResponse
+		}
+
+		initial := via[0]
+		for _, header := range redirectHeaders {
+			if req.Header.Get(header) == "" && initial.Header.Get(header) != "" {
+				req.Header[header] = initial.Header.Values(header)
+			}
+		}
+		return nil
+	}
+}
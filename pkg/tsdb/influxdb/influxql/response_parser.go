@@ -2,9 +2,13 @@ package influxql
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -13,6 +17,7 @@ import (
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 
 	"github.com/grafana/grafana/pkg/tsdb/influxdb/models"
+	"github.com/grafana/grafana/pkg/tsdb/intervalv2"
 )
 
 var (
@@ -28,6 +33,26 @@ var (
 	boolArray   []*bool
 )
 
+const (
+	databaseNotFoundMessage = "database not found"
+
+	timestampWithoutOffsetLayout = "2006-01-02T15:04:05.999999999"
+)
+
+var (
+	ErrDatabaseNotFound = errors.New("InfluxDB database not found")
+	ErrEmptyResults     = errors.New("InfluxDB returned no results")
+	ErrQueryTooComplex  = errors.New("InfluxDB query too complex or too long")
+)
+
+// queryTimeoutMessages are parts of the errors InfluxDB returns for queries stopped by the server-side timeout.
+var queryTimeoutMessages = []string{
+	"query-timeout limit exceeded",
+	"query timeout",
+	"query interrupted",
+	"context deadline exceeded",
+}
+
 const (
 	graphVisType data.VisType = "graph"
 	tableVisType data.VisType = "table"
@@ -39,42 +64,351 @@ func ResponseParse(buf io.ReadCloser, statusCode int, query *models.Query) *back
 }
 
 // parse is the same as Parse, but without the io.ReadCloser (we don't need to
-// close the buffer)
+// close the buffer). The errors returned by InfluxDB have the downstream error source, unless the status code
+// points at a request the plugin should not have sent, while the responses the plugin fails to parse have the
+// plugin error source.
 func parse(buf io.Reader, statusCode int, query *models.Query) *backend.DataResponse {
-	response, jsonErr := parseJSON(buf)
+	response, jsonErr := parseJSON(buf, query.MaxSeries)
 
 	if statusCode/100 != 2 {
-		return &backend.DataResponse{Error: fmt.Errorf("InfluxDB returned error: %s", response.Error)}
+		source := backend.ErrorSourceFromHTTPStatus(statusCode)
+		if isDatabaseNotFound(response.Error) || isQueryTimeout(response.Error) {
+			return &backend.DataResponse{Error: newInfluxDBError(response.Error), ErrorSource: source}
+		}
+		return &backend.DataResponse{Error: fmt.Errorf("InfluxDB returned error: %s", response.Error), ErrorSource: source}
 	}
 
 	if jsonErr != nil {
-		return &backend.DataResponse{Error: jsonErr}
+		return &backend.DataResponse{Error: jsonErr, ErrorSource: backend.ErrorSourcePlugin}
 	}
 
 	if response.Error != "" {
-		return &backend.DataResponse{Error: fmt.Errorf(response.Error)}
+		return &backend.DataResponse{Error: newInfluxDBError(response.Error), ErrorSource: backend.ErrorSourceDownstream}
+	}
+
+	if len(response.Results) == 0 {
+		return emptyResults(query)
+	}
+
+	// A query can have several statements, or be answered with the rows split across several results, so the
+	// rows and messages of all results are parsed together.
+	var series []models.Row
+	var messages []*models.Message
+	for _, result := range response.Results {
+		if result.Error != "" {
+			return &backend.DataResponse{Error: newInfluxDBError(result.Error), ErrorSource: backend.ErrorSourceDownstream}
+		}
+		series = append(series, result.Series...)
+		messages = append(messages, result.Messages...)
+	}
+
+	if query.VariableQuery {
+		return &backend.DataResponse{Frames: appendMessageNotices(transformRowsToVariableValues(series), messages)}
+	}
+
+	truncated := query.MaxSeries > 0 && len(series) > query.MaxSeries
+	if truncated {
+		series = series[:query.MaxSeries]
+	}
+
+	frames, ok := transformShowSeriesRows(series, *query)
+	if !ok {
+		frames = setEffectiveInterval(transformRows(series, *query), *query)
+	}
+	setPreferredVisualization(frames, *query)
+	frames = appendMessageNotices(frames, messages)
+	frames = appendQueryStats(frames, series)
+	if truncated {
+		if len(frames) == 0 {
+			frames = append(frames, data.NewFrame(""))
+		}
+		frames[0].AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("Results have been limited to %d series because the max series limit was reached", query.MaxSeries),
+		})
+	}
+	return &backend.DataResponse{Frames: nullNonFiniteValues(frames)}
+}
+
+// FrameMetaCustom is the custom metadata of the time series frames.
+type FrameMetaCustom struct {
+	// Interval is the value the $__interval and $interval macros of the query were replaced with.
+	Interval string `json:"interval"`
+	// IntervalMs is the value the $__interval_ms macro of the query was replaced with.
+	IntervalMs int64 `json:"intervalMs"`
+}
+
+// setEffectiveInterval adds the interval used for the macros of the query to the metadata of the time series frames,
+// so the grouping granularity of the results can be verified. The custom metadata the frames already have is kept,
+// the interval is merged into it.
+func setEffectiveInterval(frames data.Frames, query models.Query) data.Frames {
+	if query.Interval <= 0 {
+		return frames
+	}
+
+	custom := FrameMetaCustom{
+		Interval:   intervalv2.FormatDuration(query.Interval),
+		IntervalMs: query.Interval.Milliseconds(),
+	}
+	for _, frame := range frames {
+		if frame.Meta != nil {
+			frame.Meta.Custom = mergeFrameMetaCustom(frame.Meta.Custom, custom)
+		}
 	}
+	return frames
+}
 
-	result := response.Results[0]
-	if result.Error != "" {
-		return &backend.DataResponse{Error: fmt.Errorf(result.Error)}
-	} else {
-		return &backend.DataResponse{Frames: transformRows(result.Series, *query)}
+// mergeFrameMetaCustom adds the fields of custom to the existing custom metadata of a frame. Metadata other than a
+// map is turned into one through its JSON encoding, metadata that isn't a JSON object is kept as it is.
+func mergeFrameMetaCustom(existing any, custom FrameMetaCustom) any {
+	switch existing.(type) {
+	case nil, FrameMetaCustom:
+		return custom
 	}
+
+	merged, ok := existing.(map[string]any)
+	if !ok {
+		b, err := json.Marshal(existing)
+		if err != nil || json.Unmarshal(b, &merged) != nil || merged == nil {
+			return existing
+		}
+	}
+	merged["interval"] = custom.Interval
+	merged["intervalMs"] = custom.IntervalMs
+	return merged
 }
 
-func parseJSON(buf io.Reader) (models.Response, error) {
+// nullNonFiniteValues replaces the NaN and infinite values of the float fields with nulls, as JSON can't represent
+// them. The float fields that are not nullable are made nullable when they have such values. It is the last step of
+// the parsing, so the frames are safe to encode whatever the earlier steps did.
+func nullNonFiniteValues(frames data.Frames) data.Frames {
+	for _, frame := range frames {
+		for i, field := range frame.Fields {
+			switch field.Type() {
+			case data.FieldTypeNullableFloat64:
+				for row := 0; row < field.Len(); row++ {
+					if value := field.At(row).(*float64); value != nil && !isFinite(*value) {
+						field.Set(row, (*float64)(nil))
+					}
+				}
+			case data.FieldTypeFloat64:
+				if hasNonFiniteValues(field) {
+					frame.Fields[i] = nullableFloatField(field)
+				}
+			}
+		}
+	}
+	return frames
+}
+
+func isFinite(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+func hasNonFiniteValues(field *data.Field) bool {
+	for row := 0; row < field.Len(); row++ {
+		if !isFinite(field.At(row).(float64)) {
+			return true
+		}
+	}
+	return false
+}
+
+// nullableFloatField copies the float field into a nullable one, with nulls in place of the non-finite values.
+func nullableFloatField(field *data.Field) *data.Field {
+	values := make([]*float64, field.Len())
+	for row := range values {
+		if value := field.At(row).(float64); isFinite(value) {
+			values[row] = &value
+		}
+	}
+	nullable := data.NewField(field.Name, field.Labels, values)
+	nullable.Config = field.Config
+	return nullable
+}
+
+// appendMessageNotices surfaces the messages InfluxDB returned with the result, like deprecation warnings,
+// as notices on the first frame.
+func appendMessageNotices(frames data.Frames, messages []*models.Message) data.Frames {
+	notices := make([]data.Notice, 0, len(messages))
+	for _, message := range messages {
+		if message == nil || message.Text == "" {
+			continue
+		}
+		notices = append(notices, data.Notice{
+			Severity: messageSeverity(message.Level),
+			Text:     message.Text,
+		})
+	}
+	if len(notices) == 0 {
+		return frames
+	}
+
+	if len(frames) == 0 {
+		frames = append(frames, data.NewFrame(""))
+	}
+	frames[0].AppendNotices(notices...)
+	return frames
+}
+
+func messageSeverity(level string) data.NoticeSeverity {
+	switch strings.ToLower(level) {
+	case "warning", "warn":
+		return data.NoticeSeverityWarning
+	case "error":
+		return data.NoticeSeverityError
+	default:
+		return data.NoticeSeverityInfo
+	}
+}
+
+// newInfluxDBError turns an error message returned by InfluxDB into an error, replacing the messages
+// we know about with a more actionable one.
+func newInfluxDBError(message string) error {
+	if isDatabaseNotFound(message) {
+		return fmt.Errorf("%w: %s. Check that the database name in the data source settings is correct, "+
+			"or create the database on the InfluxDB server with `CREATE DATABASE`", ErrDatabaseNotFound, databaseNameFromError(message))
+	}
+	if isQueryTimeout(message) {
+		return fmt.Errorf("%w: %s. Try narrowing the time range, grouping by a larger time interval "+
+			"or querying fewer series", ErrQueryTooComplex, message)
+	}
+	return errors.New(message)
+}
+
+// isQueryTimeout reports whether the message is one of the errors InfluxDB returns when it stops a query
+// because it ran longer than its query-timeout.
+func isQueryTimeout(message string) bool {
+	message = strings.ToLower(message)
+	for _, timeoutMessage := range queryTimeoutMessages {
+		if strings.Contains(message, timeoutMessage) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDatabaseNotFound(message string) bool {
+	return strings.HasPrefix(message, databaseNotFoundMessage)
+}
+
+func databaseNameFromError(message string) string {
+	name := strings.TrimSpace(strings.TrimPrefix(message, databaseNotFoundMessage))
+	name = strings.TrimPrefix(name, ":")
+	return strings.Trim(strings.TrimSpace(name), `"`)
+}
+
+// emptyResults is the response to a query answered without results. Some proxies answer with an empty results array
+// on errors, this is only an error if configured so.
+func emptyResults(query *models.Query) *backend.DataResponse {
+	if query.EmptyResultsMode == models.EmptyResultsModeError {
+		return &backend.DataResponse{Error: ErrEmptyResults, ErrorSource: backend.ErrorSourceDownstream}
+	}
+	return &backend.DataResponse{Frames: data.Frames{}}
+}
+
+// parseJSON decodes the response, a stream of JSON documents when the results are chunked. The chunks are merged
+// into a single response. The chunks are no longer read once the response has more than maxSeries series, when
+// maxSeries is set, as InfluxDB streams the series one after the other so the first maxSeries are complete.
+func parseJSON(buf io.Reader, maxSeries int) (models.Response, error) {
 	var response models.Response
 
 	dec := json.NewDecoder(buf)
 	dec.UseNumber()
 
-	err := dec.Decode(&response)
+	if err := dec.Decode(&response); err != nil {
+		return response, err
+	}
+	for maxSeries <= 0 || seriesCount(response) <= maxSeries {
+		var chunk models.Response
+		err := dec.Decode(&chunk)
+		if errors.Is(err, io.EOF) {
+			return response, nil
+		}
+		if err != nil {
+			return response, err
+		}
+		mergeChunk(&response, chunk)
+	}
+	return response, nil
+}
+
+func seriesCount(response models.Response) int {
+	count := 0
+	for _, result := range response.Results {
+		count += len(result.Series)
+	}
+	return count
+}
+
+// mergeChunk merges a chunk of a chunked response into the response. The results of a statement are merged into a
+// single result, and the rows of a series, by measurement and tags, into a single row.
+func mergeChunk(response *models.Response, chunk models.Response) {
+	if response.Error == "" {
+		response.Error = chunk.Error
+	}
+	for _, result := range chunk.Results {
+		i := resultIndex(response.Results, result.StatementID)
+		if i == -1 {
+			response.Results = append(response.Results, result)
+			continue
+		}
+		merged := &response.Results[i]
+		if merged.Error == "" {
+			merged.Error = result.Error
+		}
+		merged.Messages = append(merged.Messages, result.Messages...)
+		for _, row := range result.Series {
+			if j := seriesIndex(merged.Series, row); j != -1 {
+				merged.Series[j].Values = append(merged.Series[j].Values, row.Values...)
+			} else {
+				merged.Series = append(merged.Series, row)
+			}
+		}
+	}
+}
 
-	return response, err
+func resultIndex(results []models.Result, statementID int) int {
+	for i, result := range results {
+		if result.StatementID == statementID {
+			return i
+		}
+	}
+	return -1
 }
 
+func seriesIndex(series []models.Row, row models.Row) int {
+	for i, s := range series {
+		if s.Name == row.Name && equalTags(s.Tags, row.Tags) {
+			return i
+		}
+	}
+	return -1
+}
+
+func equalTags(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// transformRows turns the series into narrow frames, every field of a series gets its own frame with
+// a time and a value field so series with many fields don't need to be split up in the panels. With
+// FrameFormatWide the fields of a series share a single frame instead.
 func transformRows(rows []models.Row, query models.Query) data.Frames {
+	for i := range rows {
+		rows[i].Columns = uniqueColumnNames(rows[i].Columns)
+		if query.EmptyTagValues == models.EmptyTagValuesDrop {
+			rows[i].Tags = withoutEmptyTags(rows[i].Tags)
+		}
+	}
+
 	// Create a map for faster column name lookups
 	columnToLowerCase := make(map[string]string)
 	for _, row := range rows {
@@ -94,6 +428,8 @@ func transformRows(rows []models.Row, query models.Query) data.Frames {
 	// It's sized for a reasonably-large name, but will grow if needed.
 	frameName := make([]byte, 0, 128)
 
+	location := timestampLocation(query)
+
 	for _, row := range rows {
 		var hasTimeCol = false
 
@@ -105,12 +441,27 @@ func transformRows(rows []models.Row, query models.Query) data.Frames {
 			newFrame := newFrameWithoutTimeField(row, query)
 			frames = append(frames, newFrame)
 		} else {
+			var wideFrame *data.Frame
 			for colIndex, column := range row.Columns {
 				if columnToLowerCase[column] == timeColumn {
 					continue
 				}
-				newFrame := newFrameWithTimeField(row, column, colIndex, query, frameName)
-				frames = append(frames, newFrame)
+				newFrame := newFrameWithTimeField(row, column, colIndex, query, frameName, location)
+				if query.FrameFormat != models.FrameFormatWide {
+					frames = append(frames, newFrame)
+					continue
+				}
+				// The fields of a series are parsed from the same rows, so they all have the same timestamps
+				newFrame.Fields[1].Name = column
+				if wideFrame == nil {
+					wideFrame = newFrame
+					wideFrame.Name = row.Name
+				} else {
+					wideFrame.Fields = append(wideFrame.Fields, newFrame.Fields[1])
+				}
+			}
+			if wideFrame != nil {
+				frames = append(frames, wideFrame)
 			}
 		}
 	}
@@ -118,7 +469,93 @@ func transformRows(rows []models.Row, query models.Query) data.Frames {
 	return frames
 }
 
-func newFrameWithTimeField(row models.Row, column string, colIndex int, query models.Query, frameName []byte) *data.Frame {
+// transformRowsToVariableValues flattens the series into a single frame with the distinct values of all of them,
+// whatever meta query returned them. The time column is skipped and of the key and value columns returned by
+// SHOW TAG VALUES only the values are kept.
+func transformRowsToVariableValues(rows []models.Row) data.Frames {
+	values := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		for _, colIndex := range variableValueColumns(row.Columns) {
+			for _, valuePair := range row.Values {
+				if colIndex >= len(valuePair) || valuePair[colIndex] == nil {
+					continue
+				}
+				value := fmt.Sprint(valuePair[colIndex])
+				if !seen[value] {
+					seen[value] = true
+					values = append(values, value)
+				}
+			}
+		}
+	}
+	return data.Frames{data.NewFrame("", data.NewField(valueColumnName, nil, values))}
+}
+
+// variableValueColumns returns the indexes of the columns holding the values of a variable query.
+func variableValueColumns(columns []string) []int {
+	keyIndex, valueIndex := -1, -1
+	for i, column := range columns {
+		switch strings.ToLower(column) {
+		case "key":
+			keyIndex = i
+		case "value":
+			valueIndex = i
+		}
+	}
+	if keyIndex >= 0 && valueIndex >= 0 {
+		return []int{valueIndex}
+	}
+
+	indexes := make([]int, 0, len(columns))
+	for i, column := range columns {
+		if strings.ToLower(column) != timeColumn {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// withoutEmptyTags returns the tags without the ones with an empty value, which would show up as blank labels
+// in the legends.
+func withoutEmptyTags(tags map[string]string) map[string]string {
+	if tags == nil {
+		return nil
+	}
+	res := make(map[string]string, len(tags))
+	for k, v := range tags {
+		if v != "" {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// uniqueColumnNames suffixes repeated column names with _1, _2, ... so every column of a series gets its own,
+// distinguishable field. Suffixes that are already used by another column are skipped.
+func uniqueColumnNames(columns []string) []string {
+	taken := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		taken[column] = true
+	}
+
+	used := make(map[string]bool, len(columns))
+	unique := make([]string, 0, len(columns))
+	for _, column := range columns {
+		name := column
+		for n := 1; used[name]; n++ {
+			name = fmt.Sprintf("%s_%d", column, n)
+			if taken[name] {
+				name = column
+			}
+		}
+		used[name] = true
+		unique = append(unique, name)
+	}
+	return unique
+}
+
+func newFrameWithTimeField(row models.Row, column string, colIndex int, query models.Query, frameName []byte, location *time.Location) *data.Frame {
 	timeArray = timeArray[:0]
 	floatArray = floatArray[:0]
 	stringArray = stringArray[:0]
@@ -127,10 +564,13 @@ func newFrameWithTimeField(row models.Row, column string, colIndex int, query mo
 	valType := typeof(row.Values, colIndex)
 
 	for _, valuePair := range row.Values {
-		timestamp, timestampErr := parseTimestamp(valuePair[0])
+		timestamp, timestampErr := parseTimestamp(valuePair[0], query.Epoch, location)
 		if timestampErr != nil {
 			continue
 		}
+		if query.ZeroTimestamps == models.ZeroTimestampsDrop && timestamp.UnixNano() == 0 {
+			continue
+		}
 
 		timeArray = append(timeArray, timestamp)
 
@@ -176,10 +616,27 @@ func newFrameWithTimeField(row models.Row, column string, colIndex int, query mo
 	valueField.Labels = row.Tags // Assign tags here
 
 	name := string(formatFrameName(row, column, query, frameName[:]))
-	valueField.SetConfig(&data.FieldConfig{DisplayNameFromDS: name})
+	config := &data.FieldConfig{DisplayNameFromDS: name}
+	if function := columnFunction(query, colIndex); function != "" {
+		config.Custom = map[string]any{"aggregation": function}
+	}
+	valueField.SetConfig(config)
 	return newDataFrame(name, query.RawQuery, timeField, valueField, getVisType(query.ResultFormat))
 }
 
+// columnFunction returns the function of the select the column was returned for, the columns after the time
+// column follow the order of the selects of the query builder. Raw queries have no function metadata.
+func columnFunction(query models.Query, colIndex int) string {
+	if query.UseRawQuery {
+		return ""
+	}
+	selectIndex := colIndex - 1
+	if selectIndex < 0 || selectIndex >= len(query.Selects) || query.Selects[selectIndex] == nil {
+		return ""
+	}
+	return query.Selects[selectIndex].Function()
+}
+
 func newFrameWithoutTimeField(row models.Row, query models.Query) *data.Frame {
 	var values []string
 
@@ -250,25 +707,29 @@ func formatFrameName(row models.Row, column string, query models.Query, frameNam
 }
 
 func buildFrameNameFromQuery(row models.Row, column string, frameName []byte, resultFormat string) []byte {
-	if resultFormat != "table" {
+	if resultFormat != "table" && row.Name != "" {
 		frameName = append(frameName, row.Name...)
 		frameName = append(frameName, '.')
 	}
 	frameName = append(frameName, column...)
 
 	if len(row.Tags) > 0 {
+		// sort the tag keys so the same series always gets the same name
+		tagKeys := make([]string, 0, len(row.Tags))
+		for k := range row.Tags {
+			tagKeys = append(tagKeys, k)
+		}
+		sort.Strings(tagKeys)
+
 		frameName = append(frameName, ' ', '{', ' ')
-		first := true
-		for k, v := range row.Tags {
-			if !first {
+		for i, k := range tagKeys {
+			if i > 0 {
 				frameName = append(frameName, ',')
 				frameName = append(frameName, ' ')
-			} else {
-				first = false
 			}
 			frameName = append(frameName, k...)
 			frameName = append(frameName, ':', ' ')
-			frameName = append(frameName, v...)
+			frameName = append(frameName, row.Tags[k]...)
 		}
 
 		frameName = append(frameName, ' ', '}')
@@ -277,21 +738,87 @@ func buildFrameNameFromQuery(row models.Row, column string, frameName []byte, re
 	return frameName
 }
 
-func parseTimestamp(value any) (time.Time, error) {
+// parseTimestamp parses a timestamp returned by InfluxDB into a UTC time.
+// Numeric timestamps are in the epoch of the query. When no epoch is applied InfluxDB returns
+// RFC3339 strings, which are normalized to UTC using their offset. Strings without an offset
+// are interpreted in the given location.
+func parseTimestamp(value any, epoch string, location *time.Location) (time.Time, error) {
+	if timestampString, ok := value.(string); ok {
+		return parseTimestampString(timestampString, location)
+	}
+
 	timestampNumber, ok := value.(json.Number)
 	if !ok {
 		return time.Time{}, fmt.Errorf("timestamp-value has invalid type: %#v", value)
 	}
-	timestampInMilliseconds, err := timestampNumber.Int64()
+	timestamp, err := parseInteger(timestampNumber)
 	if err != nil {
 		return time.Time{}, err
 	}
 
-	// currently in the code the influxdb-timestamps are requested with
-	// milliseconds-precision, meaning these values are milliseconds
-	t := time.UnixMilli(timestampInMilliseconds).UTC()
+	// the influxdb-timestamps are requested with the epoch of the query,
+	// milliseconds-precision when the query doesn't set one
+	var t time.Time
+	switch epoch {
+	case "h":
+		t = time.Unix(timestamp*int64(time.Hour/time.Second), 0)
+	case "m":
+		t = time.Unix(timestamp*int64(time.Minute/time.Second), 0)
+	case "s":
+		t = time.Unix(timestamp, 0)
+	case "u":
+		t = time.UnixMicro(timestamp)
+	case "ns":
+		t = time.Unix(0, timestamp)
+	default:
+		t = time.UnixMilli(timestamp)
+	}
 
-	return t, nil
+	return t.UTC(), nil
+}
+
+// parseInteger parses an integer that may be in scientific notation, like 1.6094592e+12, as some InfluxDB builds
+// return them. The number is parsed with enough precision to keep every digit of an int64.
+func parseInteger(number json.Number) (int64, error) {
+	if i, err := number.Int64(); err == nil {
+		return i, nil
+	}
+
+	f, _, err := big.ParseFloat(number.String(), 10, 64, big.ToNearestEven)
+	if err != nil {
+		return 0, err
+	}
+	i, accuracy := f.Int64()
+	if accuracy != big.Exact {
+		return 0, fmt.Errorf("timestamp-value is not an integer: %s", number)
+	}
+	return i, nil
+}
+
+func parseTimestampString(value string, location *time.Location) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err == nil {
+		return t.UTC(), nil
+	}
+
+	t, locErr := time.ParseInLocation(timestampWithoutOffsetLayout, value, location)
+	if locErr != nil {
+		return time.Time{}, fmt.Errorf("timestamp-value has invalid format: %w", err)
+	}
+	return t.UTC(), nil
+}
+
+// timestampLocation is the location timestamps without an offset are interpreted in,
+// the timezone of the query or UTC if it doesn't have a valid one.
+func timestampLocation(query models.Query) *time.Location {
+	if query.Tz == "" {
+		return time.UTC
+	}
+	location, err := time.LoadLocation(query.Tz)
+	if err != nil {
+		return time.UTC
+	}
+	return location
 }
 
 func typeof(values [][]any, colIndex int) string {
@@ -339,10 +866,37 @@ func getVisType(resFormat string) data.VisType {
 	}
 }
 
-func transformToExemplars(frames data.Frames) []models.Exemplar {
+// metaQueryPattern matches the queries listing the schema of the database rather than reading its points.
+var metaQueryPattern = regexp.MustCompile(`(?i)^\s*SHOW\b`)
+
+// setPreferredVisualization sets the visualization Explore shows the frames in by default.
+func setPreferredVisualization(frames data.Frames, query models.Query) {
+	for _, frame := range frames {
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{ExecutedQueryString: query.RawQuery}
+		}
+		frame.Meta.PreferredVisualization = preferredVisualization(frame, query)
+	}
+}
+
+// preferredVisualization is a table for the results of meta queries and the other frames without a time field, as
+// they are lists of names rather than series, and the visualization of the result format of the query otherwise.
+func preferredVisualization(frame *data.Frame, query models.Query) data.VisType {
+	if metaQueryPattern.MatchString(query.RawQuery) || len(frame.TypeIndices(data.FieldTypeTime, data.FieldTypeNullableTime)) == 0 {
+		return tableVisType
+	}
+	return getVisType(query.ResultFormat)
+}
+
+// transformToExemplars turns the frames of an exemplar query into exemplars. Exemplars of the same trace, by
+// the value of one of the traceIDLabels, are deduplicated keeping the one with the highest value.
+func transformToExemplars(frames data.Frames, traceIDLabels []string) []models.Exemplar {
 	var exemplars []models.Exemplar
 
 	for _, frame := range frames {
+		if len(frame.Fields) < 2 {
+			continue
+		}
 		// Assuming that the frame's first field is time and the second field is value
 		timeField := frame.Fields[0]
 		valueField := frame.Fields[1]
@@ -356,16 +910,17 @@ func transformToExemplars(frames data.Frames) []models.Exemplar {
 				continue // or handle the error
 			}
 
-			value, ok := valueField.At(i).(float64) // Cast to float64, ensure this is correct
-			if !ok {
-				continue // or handle the error
+			// Numbers are parsed as nullable floats
+			value, ok := valueField.At(i).(*float64)
+			if !ok || value == nil {
+				continue
 			}
 
 			exemplar := models.Exemplar{
 				SeriesLabels: seriesLabels, // Use the labels we got from the frame field
 				Fields:       frame.Fields, // You can include all fields from the frame or filter as needed
 				RowIdx:       i,
-				Value:        value,
+				Value:        *value,
 				Timestamp:    timestamp,
 			}
 
@@ -373,5 +928,42 @@ func transformToExemplars(frames data.Frames) []models.Exemplar {
 		}
 	}
 
-	return exemplars
+	return dedupeExemplarsByTraceID(exemplars, traceIDLabels)
+}
+
+// dedupeExemplarsByTraceID keeps a single exemplar per trace, the one with the highest value, at the position
+// the trace was first seen. Exemplars without a trace ID are all kept.
+func dedupeExemplarsByTraceID(exemplars []models.Exemplar, traceIDLabels []string) []models.Exemplar {
+	if len(traceIDLabels) == 0 {
+		return exemplars
+	}
+
+	deduped := make([]models.Exemplar, 0, len(exemplars))
+	traceIndex := make(map[string]int)
+	for _, exemplar := range exemplars {
+		traceID := exemplarTraceID(exemplar, traceIDLabels)
+		if traceID == "" {
+			deduped = append(deduped, exemplar)
+			continue
+		}
+		i, seen := traceIndex[traceID]
+		if !seen {
+			traceIndex[traceID] = len(deduped)
+			deduped = append(deduped, exemplar)
+			continue
+		}
+		if exemplar.Value > deduped[i].Value {
+			deduped[i] = exemplar
+		}
+	}
+	return deduped
+}
+
+func exemplarTraceID(exemplar models.Exemplar, traceIDLabels []string) string {
+	for _, label := range traceIDLabels {
+		if traceID := exemplar.SeriesLabels[label]; traceID != "" {
+			return traceID
+		}
+	}
+	return ""
 }
@@ -3,6 +3,7 @@ package influxql
 import (
 	"encoding/json"
 	"io"
+	"math"
 	"strings"
 	"testing"
 	"time"
@@ -162,6 +163,7 @@ func TestInfluxdbResponseParser(t *testing.T) {
 		testFrame := data.NewFrame("cpu",
 			newField,
 		)
+		testFrame.Meta = &data.FrameMeta{PreferredVisualization: tableVisType, ExecutedQueryString: "Test raw query"}
 
 		result := ResponseParse(prepare(response), 200, generateQuery(query))
 
@@ -197,6 +199,7 @@ func TestInfluxdbResponseParser(t *testing.T) {
 		testFrame := data.NewFrame("cpu",
 			newField,
 		)
+		testFrame.Meta = &data.FrameMeta{PreferredVisualization: tableVisType, ExecutedQueryString: query.RawQuery}
 
 		result := ResponseParse(prepare(response), 200, generateQuery(query))
 
@@ -405,6 +408,392 @@ func TestInfluxdbResponseParser(t *testing.T) {
 		assert.True(t, strings.Contains(result.Frames[1].Name, ","))
 	})
 
+	t.Run("Influxdb response parser parses the series of all results", func(t *testing.T) {
+		response := `
+		{
+			"results": [
+				{
+					"statement_id": 0,
+					"series": [
+						{
+							"name": "cpu",
+							"columns": ["time","mean"],
+							"values": [[111,222]]
+						}
+					],
+					"messages": [{"level": "warning", "text": "deprecated"}]
+				},
+				{
+					"statement_id": 1,
+					"series": [
+						{
+							"name": "mem",
+							"columns": ["time","mean"],
+							"values": [[111,333]]
+						},
+						{
+							"name": "disk",
+							"columns": ["time","mean"],
+							"values": [[111,444]]
+						}
+					]
+				}
+			]
+		}
+		`
+
+		query := models.Query{}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.NoError(t, result.Error)
+		require.Len(t, result.Frames, 3)
+		assert.Equal(t, "cpu.mean", result.Frames[0].Name)
+		assert.Equal(t, "mem.mean", result.Frames[1].Name)
+		assert.Equal(t, "disk.mean", result.Frames[2].Name)
+		assert.Equal(t, []data.Notice{{Severity: data.NoticeSeverityWarning, Text: "deprecated"}}, result.Frames[0].Meta.Notices)
+	})
+
+	t.Run("Influxdb response parser returns the error of any result", func(t *testing.T) {
+		response := `
+		{
+			"results": [
+				{
+					"statement_id": 0,
+					"series": [{"name": "cpu", "columns": ["time","mean"], "values": [[111,222]]}]
+				},
+				{
+					"statement_id": 1,
+					"error": "measurement not found"
+				}
+			]
+		}
+		`
+
+		query := models.Query{}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.EqualError(t, result.Error, "measurement not found")
+	})
+
+	t.Run("Influxdb response parser names frames after the measurement and sorted tags", func(t *testing.T) {
+		response := `
+		{
+			"results": [
+				{
+					"series": [
+						{
+							"name": "cpu.upc",
+							"columns": ["time","mean"],
+							"tags": {
+								"datacenter": "America",
+								"cluster-name":   "Cluster"
+							},
+							"values": [
+								[111,222]
+							]
+						},
+						{
+							"name": "logins.count",
+							"columns": ["time","mean"],
+							"tags": {
+								"datacenter": "America",
+								"cluster-name":   "Cluster"
+							},
+							"values": [
+								[111,222]
+							]
+						},
+						{
+							"columns": ["time","mean"],
+							"values": [
+								[111,222]
+							]
+						}
+					]
+				}
+			]
+		}
+		`
+
+		query := models.Query{}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.Len(t, result.Frames, 3)
+		assert.Equal(t, "cpu.upc.mean { cluster-name: Cluster, datacenter: America }", result.Frames[0].Name)
+		assert.Equal(t, "logins.count.mean { cluster-name: Cluster, datacenter: America }", result.Frames[1].Name)
+		assert.Equal(t, "mean", result.Frames[2].Name)
+		assert.Equal(t, result.Frames[0].Name, result.Frames[0].Fields[1].Config.DisplayNameFromDS)
+	})
+
+	t.Run("Influxdb response parser handles empty tag values", func(t *testing.T) {
+		response := `
+		{
+			"results": [
+				{
+					"series": [
+						{
+							"name": "cpu",
+							"columns": ["time","mean"],
+							"tags": {
+								"datacenter": "America",
+								"host": ""
+							},
+							"values": [
+								[111,222]
+							]
+						}
+					]
+				}
+			]
+		}
+		`
+
+		t.Run("keeps them by default", func(t *testing.T) {
+			result := ResponseParse(prepare(response), 200, generateQuery(models.Query{}))
+			require.Len(t, result.Frames, 1)
+			assert.Equal(t, data.Labels{"datacenter": "America", "host": ""}, result.Frames[0].Fields[1].Labels)
+			assert.Equal(t, "cpu.mean { datacenter: America, host:  }", result.Frames[0].Name)
+		})
+
+		t.Run("keeps them when configured so", func(t *testing.T) {
+			query := models.Query{EmptyTagValues: models.EmptyTagValuesKeep}
+			result := ResponseParse(prepare(response), 200, generateQuery(query))
+			require.Len(t, result.Frames, 1)
+			assert.Equal(t, data.Labels{"datacenter": "America", "host": ""}, result.Frames[0].Fields[1].Labels)
+		})
+
+		t.Run("drops them when configured so", func(t *testing.T) {
+			query := models.Query{EmptyTagValues: models.EmptyTagValuesDrop}
+			result := ResponseParse(prepare(response), 200, generateQuery(query))
+			require.Len(t, result.Frames, 1)
+			assert.Equal(t, data.Labels{"datacenter": "America"}, result.Frames[0].Fields[1].Labels)
+			assert.Equal(t, "cpu.mean { datacenter: America }", result.Frames[0].Name)
+		})
+	})
+
+	t.Run("Influxdb response parser handles epoch 0 timestamps", func(t *testing.T) {
+		response := `
+		{
+			"results": [
+				{
+					"series": [
+						{
+							"name": "cpu",
+							"columns": ["time","mean"],
+							"values": [
+								[0,111],
+								[1000,222]
+							]
+						}
+					]
+				}
+			]
+		}
+		`
+
+		t.Run("keeps them by default", func(t *testing.T) {
+			result := ResponseParse(prepare(response), 200, generateQuery(models.Query{}))
+			require.Len(t, result.Frames, 1)
+			require.Equal(t, 2, result.Frames[0].Rows())
+			assert.Equal(t, time.Unix(0, 0).UTC(), result.Frames[0].Fields[0].At(0))
+			assert.Equal(t, time.Unix(1, 0).UTC(), result.Frames[0].Fields[0].At(1))
+		})
+
+		t.Run("keeps them when configured so", func(t *testing.T) {
+			query := models.Query{ZeroTimestamps: models.ZeroTimestampsKeep}
+			result := ResponseParse(prepare(response), 200, generateQuery(query))
+			require.Len(t, result.Frames, 1)
+			assert.Equal(t, 2, result.Frames[0].Rows())
+		})
+
+		t.Run("drops them when configured so", func(t *testing.T) {
+			query := models.Query{ZeroTimestamps: models.ZeroTimestampsDrop}
+			result := ResponseParse(prepare(response), 200, generateQuery(query))
+			require.Len(t, result.Frames, 1)
+			require.Equal(t, 1, result.Frames[0].Rows())
+			assert.Equal(t, time.Unix(1, 0).UTC(), result.Frames[0].Fields[0].At(0))
+			assert.Equal(t, util.Pointer(222.0), result.Frames[0].Fields[1].At(0))
+		})
+	})
+
+	t.Run("Influxdb response parser returns a frame per field of a multi-field series, or a frame per series in the wide format", func(t *testing.T) {
+		response := `
+		{
+			"results": [
+				{
+					"series": [
+						{
+							"name": "cpu",
+							"columns": ["time","mean","max","min"],
+							"values": [
+								[111,1,3,0],
+								[112,2,4,1]
+							]
+						}
+					]
+				}
+			]
+		}
+		`
+
+		query := models.Query{FrameFormat: models.FrameFormatSplit}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.Len(t, result.Frames, 3)
+		for i, name := range []string{"cpu.mean", "cpu.max", "cpu.min"} {
+			assert.Equal(t, name, result.Frames[i].Name)
+			require.Len(t, result.Frames[i].Fields, 2)
+			assert.Equal(t, 2, result.Frames[i].Rows())
+		}
+
+		query = models.Query{FrameFormat: models.FrameFormatWide}
+		result = ResponseParse(prepare(response), 200, generateQuery(query))
+		require.Len(t, result.Frames, 1)
+		assert.Equal(t, "cpu", result.Frames[0].Name)
+		require.Len(t, result.Frames[0].Fields, 4)
+		assert.Equal(t, 2, result.Frames[0].Rows())
+		for i, name := range []string{"mean", "max", "min"} {
+			assert.Equal(t, name, result.Frames[0].Fields[i+1].Name)
+			assert.Equal(t, "cpu."+name, result.Frames[0].Fields[i+1].Config.DisplayNameFromDS)
+		}
+		assert.Equal(t, 4.0, *result.Frames[0].Fields[2].At(1).(*float64))
+	})
+
+	t.Run("Influxdb response parser attaches the aggregation function of the select to the field config", func(t *testing.T) {
+		response := `
+		{
+			"results": [
+				{
+					"series": [
+						{
+							"name": "cpu",
+							"columns": ["time","mean","value"],
+							"values": [
+								[111,222,333]
+							]
+						}
+					]
+				}
+			]
+		}
+		`
+
+		field, err := models.NewQueryPart("field", []string{"value"})
+		require.NoError(t, err)
+		mean, err := models.NewQueryPart("mean", []string{})
+		require.NoError(t, err)
+		query := models.Query{Selects: []*models.Select{{*field, *mean}, {*field}}}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.Len(t, result.Frames, 2)
+		assert.Equal(t, map[string]any{"aggregation": "mean"}, result.Frames[0].Fields[1].Config.Custom)
+		assert.Nil(t, result.Frames[1].Fields[1].Config.Custom)
+	})
+
+	t.Run("Influxdb response parser adds the effective interval to the frame metadata", func(t *testing.T) {
+		response := `{"results":[{"series":[{"name":"cpu","columns":["time","mean"],"values":[[111,1],[112,2]]}]}]}`
+
+		query := models.Query{Interval: 30 * time.Second}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.NoError(t, result.Error)
+		require.Len(t, result.Frames, 1)
+		require.Equal(t, FrameMetaCustom{Interval: "30s", IntervalMs: 30000}, result.Frames[0].Meta.Custom)
+	})
+
+	t.Run("Influxdb response parser merges the effective interval into the existing custom metadata", func(t *testing.T) {
+		query := models.Query{Interval: 30 * time.Second}
+		frames := data.Frames{
+			{Meta: &data.FrameMeta{Custom: map[string]any{"source": "influxql"}}},
+			{Meta: &data.FrameMeta{Custom: struct {
+				Source string `json:"source"`
+			}{Source: "influxql"}}},
+			{Meta: &data.FrameMeta{Custom: "influxql"}},
+		}
+
+		frames = setEffectiveInterval(frames, query)
+		require.Equal(t, map[string]any{"source": "influxql", "interval": "30s", "intervalMs": int64(30000)}, frames[0].Meta.Custom)
+		require.Equal(t, map[string]any{"source": "influxql", "interval": "30s", "intervalMs": int64(30000)}, frames[1].Meta.Custom)
+		require.Equal(t, "influxql", frames[2].Meta.Custom, "custom metadata that isn't an object is kept")
+	})
+
+	t.Run("Influxdb response parser exposes the query cost of EXPLAIN ANALYZE as stats", func(t *testing.T) {
+		response := `
+		{
+			"results": [
+				{
+					"series": [
+						{
+							"columns": ["EXPLAIN ANALYZE"],
+							"values": [
+								["."],
+								["└── select"],
+								["    ├── execution_time: 2.5ms"],
+								["    ├── planning_time: 18ms"],
+								["    ├── total_time: 20.5ms"],
+								["    └── field_iterators"],
+								["        └── create_iterator"],
+								["            ├── labels"],
+								["            │   ├── measurement: h2o_feet"],
+								["            │   └── shard: 1"],
+								["            ├── float_blocks_decoded: 3"],
+								["            ├── float_blocks_size_bytes: 1024"],
+								["            ├── integer_blocks_decoded: 2"],
+								["            └── integer_blocks_size_bytes: 512"]
+							]
+						}
+					]
+				}
+			]
+		}
+		`
+
+		query := models.Query{RawQuery: "EXPLAIN ANALYZE SELECT mean(water_level) FROM h2o_feet"}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.NoError(t, result.Error)
+		require.Len(t, result.Frames, 1)
+		require.Equal(t, []data.QueryStat{
+			{FieldConfig: data.FieldConfig{DisplayName: "Planning time", Unit: "ms"}, Value: 18},
+			{FieldConfig: data.FieldConfig{DisplayName: "Execution time", Unit: "ms"}, Value: 2.5},
+			{FieldConfig: data.FieldConfig{DisplayName: "Total time", Unit: "ms"}, Value: 20.5},
+			{FieldConfig: data.FieldConfig{DisplayName: "Shards"}, Value: 1},
+			{FieldConfig: data.FieldConfig{DisplayName: "Blocks decoded"}, Value: 5},
+			{FieldConfig: data.FieldConfig{DisplayName: "Blocks size", Unit: "decbytes"}, Value: 1536},
+		}, result.Frames[0].Meta.Stats)
+	})
+
+	t.Run("Influxdb response parser adds no stats without a query plan", func(t *testing.T) {
+		response := `{"results":[{"series":[{"name":"cpu","columns":["time","mean"],"values":[[111,1]]}]}]}`
+
+		result := ResponseParse(prepare(response), 200, generateQuery(models.Query{}))
+		require.NoError(t, result.Error)
+		require.Empty(t, result.Frames[0].Meta.Stats)
+	})
+
+	t.Run("Influxdb response parser keeps all columns with duplicate names", func(t *testing.T) {
+		response := `
+		{
+			"results": [
+				{
+					"series": [
+						{
+							"name": "cpu",
+							"columns": ["time","value","value","value_1"],
+							"values": [
+								[111,1,2,3]
+							]
+						}
+					]
+				}
+			]
+		}
+		`
+
+		query := models.Query{}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.Len(t, result.Frames, 3)
+		for i, name := range []string{"cpu.value", "cpu.value_2", "cpu.value_1"} {
+			assert.Equal(t, name, result.Frames[i].Name)
+		}
+		for i, value := range []float64{1, 2, 3} {
+			assert.Equal(t, &value, result.Frames[i].Fields[1].At(0))
+		}
+	})
+
 	t.Run("Influxdb response parser with alias", func(t *testing.T) {
 		response := `
 		{
@@ -696,6 +1085,149 @@ func TestInfluxdbResponseParser(t *testing.T) {
 		require.EqualError(t, result.Error, "error parsing query: found THING")
 	})
 
+	t.Run("Influxdb response parser with database not found error", func(t *testing.T) {
+		response := `
+		{
+			"results": [
+				{
+					"statement_id": 0,
+					"error": "database not found: mydb"
+				}
+			]
+		}
+		`
+
+		query := models.Query{}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+
+		require.Nil(t, result.Frames)
+		require.ErrorIs(t, result.Error, ErrDatabaseNotFound)
+		require.EqualError(t, result.Error, "InfluxDB database not found: mydb. Check that the database name in the data source settings is correct, "+
+			"or create the database on the InfluxDB server with `CREATE DATABASE`")
+	})
+
+	t.Run("Influxdb response parser with database not found error and non 2xx status code", func(t *testing.T) {
+		response := `{ "error": "database not found: \"mydb\"" }`
+
+		query := models.Query{}
+		result := ResponseParse(prepare(response), 404, generateQuery(query))
+
+		require.Nil(t, result.Frames)
+		require.ErrorIs(t, result.Error, ErrDatabaseNotFound)
+		require.ErrorContains(t, result.Error, "InfluxDB database not found: mydb.")
+	})
+
+	t.Run("Influxdb response parser with server-side query timeout error", func(t *testing.T) {
+		response := `{"results":[{"statement_id":0,"error":"query-timeout limit exceeded"}]}`
+
+		query := models.Query{}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.ErrorIs(t, result.Error, ErrQueryTooComplex)
+		require.Equal(t, "InfluxDB query too complex or too long: query-timeout limit exceeded. Try narrowing the time range, "+
+			"grouping by a larger time interval or querying fewer series", result.Error.Error())
+
+		response = `{"error":"timeout: query interrupted"}`
+		result = ResponseParse(prepare(response), 500, generateQuery(query))
+		require.ErrorIs(t, result.Error, ErrQueryTooComplex)
+	})
+
+	t.Run("Influxdb response parser sets the error source", func(t *testing.T) {
+		query := generateQuery(models.Query{})
+
+		t.Run("server error is downstream", func(t *testing.T) {
+			result := ResponseParse(prepare(`{"error":"internal error"}`), 500, query)
+			require.EqualError(t, result.Error, "InfluxDB returned error: internal error")
+			require.Equal(t, backend.ErrorSourceDownstream, result.ErrorSource)
+		})
+
+		t.Run("bad request is plugin", func(t *testing.T) {
+			result := ResponseParse(prepare(`{"error":"error parsing query: found EOF"}`), 400, query)
+			require.Error(t, result.Error)
+			require.Equal(t, backend.ErrorSourcePlugin, result.ErrorSource)
+		})
+
+		t.Run("parse failure is plugin", func(t *testing.T) {
+			result := ResponseParse(prepare(`{ invalid }`), 200, query)
+			require.Error(t, result.Error)
+			require.Equal(t, backend.ErrorSourcePlugin, result.ErrorSource)
+		})
+
+		t.Run("result error is downstream", func(t *testing.T) {
+			result := ResponseParse(prepare(`{"results":[{"statement_id":0,"error":"database not found: mydb"}]}`), 200, query)
+			require.ErrorIs(t, result.Error, ErrDatabaseNotFound)
+			require.Equal(t, backend.ErrorSourceDownstream, result.ErrorSource)
+		})
+
+		t.Run("successful response has no error source", func(t *testing.T) {
+			result := ResponseParse(prepare(`{"results":[{"series":[]}]}`), 200, query)
+			require.NoError(t, result.Error)
+			require.Empty(t, result.ErrorSource)
+		})
+	})
+
+	t.Run("Influxdb response parser normalizes RFC3339 timestamps with an offset to UTC", func(t *testing.T) {
+		response := `
+		{
+			"results": [
+				{
+					"series": [
+						{
+							"name": "cpu",
+							"columns": ["time","mean"],
+							"values": [
+								["2021-01-01T01:00:00+01:00",222],
+								["2021-01-01T00:00:01Z",223]
+							]
+						}
+					]
+				}
+			]
+		}
+		`
+
+		query := models.Query{Tz: "Europe/Paris"}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.NoError(t, result.Error)
+		require.Len(t, result.Frames, 1)
+		require.Equal(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), result.Frames[0].Fields[0].At(0))
+		require.Equal(t, time.Date(2021, 1, 1, 0, 0, 1, 0, time.UTC), result.Frames[0].Fields[0].At(1))
+	})
+
+	t.Run("Influxdb response parser surfaces messages as notices", func(t *testing.T) {
+		response := `
+		{
+			"results": [
+				{
+					"series": [
+						{
+							"name": "cpu",
+							"columns": ["time","mean"],
+							"values": [
+								[111,222]
+							]
+						}
+					],
+					"messages": [
+						{
+							"level": "warning",
+							"text": "deprecated use of 'EXPLAIN ANALYZE', use the Flux profiler instead"
+						}
+					]
+				}
+			]
+		}
+		`
+
+		query := models.Query{}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.NoError(t, result.Error)
+		require.Len(t, result.Frames, 1)
+		require.Equal(t, []data.Notice{{
+			Severity: data.NoticeSeverityWarning,
+			Text:     "deprecated use of 'EXPLAIN ANALYZE', use the Flux profiler instead",
+		}}, result.Frames[0].Meta.Notices)
+	})
+
 	t.Run("Influxdb response parser parseNumber nil", func(t *testing.T) {
 		value := parseNumber(nil)
 		require.Nil(t, value)
@@ -711,19 +1243,85 @@ func TestInfluxdbResponseParser(t *testing.T) {
 		require.Nil(t, value)
 	})
 
+	t.Run("Influxdb response parser parseNumber scientific notation", func(t *testing.T) {
+		require.Equal(t, 1.23e+10, *parseNumber(json.Number("1.23e+10")))
+		require.Equal(t, -4.5e-3, *parseNumber(json.Number("-4.5E-3")))
+	})
+
+	t.Run("Influxdb response parser parseTimestamp scientific notation", func(t *testing.T) {
+		timestamp, err := parseTimestamp(json.Number("1.609556645e+12"), "ms", time.UTC)
+		require.NoError(t, err)
+		require.Equal(t, time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC), timestamp)
+
+		timestamp, err = parseTimestamp(json.Number("1.609556645123456789e+18"), "ns", time.UTC)
+		require.NoError(t, err)
+		require.Equal(t, time.Date(2021, 1, 2, 3, 4, 5, 123456789, time.UTC), timestamp)
+
+		_, err = parseTimestamp(json.Number("1.5e+0"), "ms", time.UTC)
+		require.Error(t, err)
+	})
+
+	t.Run("Influxdb response parser parses values in scientific notation", func(t *testing.T) {
+		response := `
+		{
+			"results": [
+				{
+					"series": [
+						{
+							"name": "cpu",
+							"columns": ["time","value"],
+							"values": [
+								[1.609556645e+12,1.23e+10],
+								[1609556646000,-2.5E-4],
+								[1609556647000,12345678901234]
+							]
+						}
+					]
+				}
+			]
+		}
+		`
+
+		query := models.Query{}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.NoError(t, result.Error)
+		require.Len(t, result.Frames, 1)
+		assert.Equal(t, time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC), result.Frames[0].Fields[0].At(0))
+		assert.Equal(t, 1.23e+10, *result.Frames[0].Fields[1].At(0).(*float64))
+		assert.Equal(t, -2.5e-4, *result.Frames[0].Fields[1].At(1).(*float64))
+		assert.Equal(t, float64(12345678901234), *result.Frames[0].Fields[1].At(2).(*float64))
+	})
+
 	t.Run("Influxdb response parser parseTimestamp valid JSON.number", func(t *testing.T) {
 		// currently we use milliseconds-precision with influxdb, so the test works with that.
 		// if we change this to for example nanoseconds-precision, the tests will have to change.
-		timestamp, err := parseTimestamp(json.Number("1609556645000"))
+		timestamp, err := parseTimestamp(json.Number("1609556645000"), "ms", time.UTC)
 		require.NoError(t, err)
 		require.Equal(t, timestamp.Format(time.RFC3339), "2021-01-02T03:04:05Z")
 	})
 
 	t.Run("Influxdb response parser parseNumber invalid type", func(t *testing.T) {
-		_, err := parseTimestamp("hello")
+		_, err := parseTimestamp("hello", "ms", time.UTC)
 		require.Error(t, err)
 	})
 
+	t.Run("Influxdb response parser with an empty results array", func(t *testing.T) {
+		response := `{ "results": [] }`
+
+		for _, mode := range []string{"", models.EmptyResultsModeEmpty} {
+			query := models.Query{EmptyResultsMode: mode}
+			result := ResponseParse(prepare(response), 200, generateQuery(query))
+			require.NoError(t, result.Error)
+			require.NotNil(t, result.Frames)
+			require.Len(t, result.Frames, 0)
+		}
+
+		query := models.Query{EmptyResultsMode: models.EmptyResultsModeError}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.ErrorIs(t, result.Error, ErrEmptyResults)
+		require.Nil(t, result.Frames)
+	})
+
 	t.Run("InfluxDB returns empty DataResponse when there is empty response", func(t *testing.T) {
 		response := `
 		{
@@ -801,6 +1399,7 @@ func TestResponseParser_Parse_RetentionPolicy(t *testing.T) {
 				"autogen", "bar", "5m_avg", "1m_avg",
 			}),
 		)
+		policyFrame.Meta = &data.FrameMeta{PreferredVisualization: tableVisType, ExecutedQueryString: query.RawQuery}
 
 		result := ResponseParse(prepare(response), 200, generateQuery(query))
 
@@ -931,12 +1530,195 @@ func TestResponseParser_Parse(t *testing.T) {
 	}
 }
 
+func TestResponseParser_ChunkedResponse(t *testing.T) {
+	response := `{"results":[{"statement_id":0,"series":[` +
+		`{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[1000,1],[2000,2]],"partial":true}` +
+		`],"partial":true}]}
+{"results":[{"statement_id":0,"series":[` +
+		`{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[3000,3]]},` +
+		`{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[[1000,4]],"partial":true}` +
+		`],"partial":true}]}
+{"results":[{"statement_id":0,"series":[` +
+		`{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[[2000,5]]}` +
+		`]},{"statement_id":1,"series":[` +
+		`{"name":"mem","columns":["time","value"],"values":[[1000,6]]}` +
+		`]}]}
+`
+
+	result := ResponseParse(prepare(response), 200, generateQuery(models.Query{}))
+	require.NoError(t, result.Error)
+	require.Len(t, result.Frames, 3)
+	require.Equal(t, 3, result.Frames[0].Rows())
+	require.Equal(t, data.Labels{"host": "a"}, result.Frames[0].Fields[1].Labels)
+	require.Equal(t, 2, result.Frames[1].Rows())
+	require.Equal(t, data.Labels{"host": "b"}, result.Frames[1].Fields[1].Labels)
+	require.Equal(t, 1, result.Frames[2].Rows())
+
+	t.Run("chunks are not read past the max series", func(t *testing.T) {
+		response := `{"results":[{"statement_id":0,"series":[` +
+			`{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[1000,1]],"partial":true}` +
+			`],"partial":true}]}
+{"results":[{"statement_id":0,"series":[` +
+			`{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[2000,2]]},` +
+			`{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[[1000,3]],"partial":true}` +
+			`],"partial":true}]}
+{"results":[{"statement_id":0,"series":[` +
+			`{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[[2000,4]]},` +
+			`{"name":"cpu","tags":{"host":"c"},"columns":["time","value"],"values":[[1000,5]]}` +
+			`],"partial":true}]}
+not read`
+
+		result := ResponseParse(prepare(response), 200, generateQuery(models.Query{MaxSeries: 1}))
+		require.NoError(t, result.Error)
+		require.Len(t, result.Frames, 1)
+		require.Equal(t, 2, result.Frames[0].Rows())
+		require.Equal(t, "Results have been limited to 1 series because the max series limit was reached", result.Frames[0].Meta.Notices[0].Text)
+
+		result = ResponseParse(prepare(response), 200, generateQuery(models.Query{MaxSeries: 2}))
+		require.NoError(t, result.Error)
+		require.Len(t, result.Frames, 2)
+		require.Equal(t, 2, result.Frames[1].Rows())
+		require.Len(t, result.Frames[0].Meta.Notices, 1)
+	})
+
+	t.Run("errors of later chunks are returned", func(t *testing.T) {
+		response := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1000,1]]}],"partial":true}]}
+{"results":[{"statement_id":0,"error":"max-select-point limit exceeded"}]}
+`
+		result := ResponseParse(prepare(response), 200, generateQuery(models.Query{}))
+		require.EqualError(t, result.Error, "max-select-point limit exceeded")
+	})
+}
+
+func TestResponseParser_PreferredVisualization(t *testing.T) {
+	const timeSeries = `{"results":[{"series":[{"name":"cpu","columns":["time","mean"],"values":[[100,1],[101,2]]}]}]}`
+	tests := []struct {
+		name         string
+		rawQuery     string
+		resultFormat string
+		response     string
+		expected     data.VisType
+	}{
+		{
+			name:     "meta query",
+			rawQuery: "SHOW MEASUREMENTS",
+			response: `{"results":[{"series":[{"name":"measurements","columns":["name"],"values":[["cpu"],["mem"]]}]}]}`,
+			expected: tableVisType,
+		},
+		{
+			name:     "meta query with several columns",
+			rawQuery: "show field keys from cpu",
+			response: `{"results":[{"series":[{"name":"cpu","columns":["fieldKey","fieldType"],"values":[["usage","float"]]}]}]}`,
+			expected: tableVisType,
+		},
+		{
+			name:     "time series query",
+			rawQuery: `SELECT mean("value") FROM "cpu" WHERE $timeFilter GROUP BY time($__interval)`,
+			response: timeSeries,
+			expected: graphVisType,
+		},
+		{
+			name:         "time series query in the table format",
+			rawQuery:     `SELECT mean("value") FROM "cpu" WHERE $timeFilter GROUP BY time($__interval)`,
+			resultFormat: "table",
+			response:     timeSeries,
+			expected:     tableVisType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ResponseParse(prepare(tt.response), 200, generateQuery(models.Query{RawQuery: tt.rawQuery, ResultFormat: tt.resultFormat}))
+			require.NoError(t, result.Error)
+			require.NotEmpty(t, result.Frames)
+			for _, frame := range result.Frames {
+				require.Equal(t, tt.expected, frame.Meta.PreferredVisualization)
+				require.Equal(t, tt.rawQuery, frame.Meta.ExecutedQueryString)
+			}
+		})
+	}
+}
+
+func TestResponseParser_Parse_VariableQuery(t *testing.T) {
+	parseValues := func(t *testing.T, rawQuery string, response string) []string {
+		t.Helper()
+		query := models.Query{RawQuery: rawQuery, VariableQuery: true}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.NoError(t, result.Error)
+		require.Len(t, result.Frames, 1)
+		require.Len(t, result.Frames[0].Fields, 1)
+		require.Equal(t, "Value", result.Frames[0].Fields[0].Name)
+
+		values := make([]string, result.Frames[0].Rows())
+		for i := range values {
+			values[i] = result.Frames[0].Fields[0].At(i).(string)
+		}
+		return values
+	}
+
+	t.Run("SHOW TAG VALUES of several measurements", func(t *testing.T) {
+		response := `{"results":[{"series":[
+			{"name":"cpu","columns":["key","value"],"values":[["host","server-1"],["host","server-2"]]},
+			{"name":"mem","columns":["key","value"],"values":[["host","server-2"],["host","server-3"]]}
+		]}]}`
+		values := parseValues(t, `SHOW TAG VALUES WITH KEY = "host"`, response)
+		require.Equal(t, []string{"server-1", "server-2", "server-3"}, values)
+	})
+
+	t.Run("SELECT DISTINCT", func(t *testing.T) {
+		response := `{"results":[{"series":[
+			{"name":"cpu","columns":["time","distinct"],"values":[[0,"idle"],[0,"user"],[0,"idle"],[0,12.5]]}
+		]}]}`
+		values := parseValues(t, `SELECT DISTINCT("state") FROM "cpu"`, response)
+		require.Equal(t, []string{"idle", "user", "12.5"}, values)
+	})
+
+	t.Run("SHOW MEASUREMENTS", func(t *testing.T) {
+		response := `{"results":[{"series":[{"name":"measurements","columns":["name"],"values":[["cpu"],["mem"]]}]}]}`
+		values := parseValues(t, `SHOW MEASUREMENTS`, response)
+		require.Equal(t, []string{"cpu", "mem"}, values)
+	})
+
+	t.Run("no series", func(t *testing.T) {
+		values := parseValues(t, `SHOW TAG VALUES WITH KEY = "host"`, `{"results":[{}]}`)
+		require.Empty(t, values)
+	})
+}
+
+func TestNullNonFiniteValues(t *testing.T) {
+	value := 1.5
+	inf, negInf, nan := math.Inf(1), math.Inf(-1), math.NaN()
+	frames := data.Frames{
+		data.NewFrame("nullable",
+			data.NewField("Time", nil, []time.Time{time.Unix(1, 0), time.Unix(2, 0), time.Unix(3, 0)}),
+			data.NewField("Value", data.Labels{"host": "a"}, []*float64{&inf, &value, &nan}),
+		),
+		data.NewFrame("not nullable",
+			data.NewField("Value", data.Labels{"host": "b"}, []float64{negInf, 2}).SetConfig(&data.FieldConfig{Unit: "s"}),
+			data.NewField("Finite", nil, []float64{1, 2}),
+		),
+	}
+
+	frames = nullNonFiniteValues(frames)
+
+	require.Equal(t, data.NewField("Value", data.Labels{"host": "a"}, []*float64{nil, &value, nil}), frames[0].Fields[1])
+	two := 2.0
+	require.Equal(t, data.NewField("Value", data.Labels{"host": "b"}, []*float64{nil, &two}).SetConfig(&data.FieldConfig{Unit: "s"}), frames[1].Fields[0])
+	require.Equal(t, data.FieldTypeFloat64, frames[1].Fields[1].Type(), "fields without non-finite values are kept as they are")
+
+	for _, frame := range frames {
+		b, err := data.FrameToJSON(frame, data.IncludeAll)
+		require.NoError(t, err)
+		require.True(t, json.Valid(b))
+		require.NotContains(t, string(b), "entities")
+	}
+}
+
 func TestParseTimestamp(t *testing.T) {
 	validValue := json.Number("1609459200000") // Milliseconds since epoch (January 1, 2021)
 	invalidValue := "invalid"
 
 	t.Run("ValidTimestamp", func(t *testing.T) {
-		parsedTime, err := parseTimestamp(validValue)
+		parsedTime, err := parseTimestamp(validValue, "ms", time.UTC)
 		if err != nil {
 			t.Errorf("Expected no error, got: %v", err)
 		}
@@ -947,10 +1729,75 @@ func TestParseTimestamp(t *testing.T) {
 		}
 	})
 
+	t.Run("RFC3339TimestampWithOffset", func(t *testing.T) {
+		parsedTime, err := parseTimestamp("2021-01-01T02:00:00.5+02:00", "", time.UTC)
+		require.NoError(t, err)
+		require.Equal(t, time.Date(2021, 1, 1, 0, 0, 0, 500000000, time.UTC), parsedTime)
+		require.Equal(t, time.UTC, parsedTime.Location())
+	})
+
+	t.Run("TimestampWithoutOffsetUsesLocation", func(t *testing.T) {
+		location, err := time.LoadLocation("Europe/Paris")
+		require.NoError(t, err)
+		parsedTime, err := parseTimestamp("2021-01-01T01:00:00", "", location)
+		require.NoError(t, err)
+		require.Equal(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), parsedTime)
+	})
+
 	t.Run("InvalidTimestamp", func(t *testing.T) {
-		_, err := parseTimestamp(invalidValue)
+		_, err := parseTimestamp(invalidValue, "ms", time.UTC)
 		if err == nil {
 			t.Errorf("Expected an error, got nil")
 		}
 	})
 }
+
+func TestTransformToExemplars(t *testing.T) {
+	response := `
+	{
+		"results": [
+			{
+				"series": [
+					{
+						"name": "cpu_exemplar",
+						"columns": ["time","value"],
+						"tags": {"trace_id": "abc"},
+						"values": [[111,1],[112,5],[113,3]]
+					},
+					{
+						"name": "cpu_exemplar",
+						"columns": ["time","value"],
+						"tags": {"trace_id": "def"},
+						"values": [[114,2]]
+					},
+					{
+						"name": "cpu_exemplar",
+						"columns": ["time","value"],
+						"values": [[115,4],[116,4]]
+					}
+				]
+			}
+		]
+	}
+	`
+	result := ResponseParse(prepare(response), 200, generateQuery(models.Query{}))
+	require.NoError(t, result.Error)
+
+	t.Run("keeps the exemplar with the highest value per trace", func(t *testing.T) {
+		exemplars := transformToExemplars(result.Frames, []string{"trace_id"})
+		require.Len(t, exemplars, 4)
+		require.Equal(t, "abc", exemplars[0].SeriesLabels["trace_id"])
+		require.Equal(t, 5.0, exemplars[0].Value)
+		require.Equal(t, time.UnixMilli(112).UTC(), exemplars[0].Timestamp)
+		require.Equal(t, "def", exemplars[1].SeriesLabels["trace_id"])
+		require.Equal(t, 2.0, exemplars[1].Value)
+		// Exemplars without a trace ID are not deduplicated
+		require.Equal(t, 4.0, exemplars[2].Value)
+		require.Equal(t, 4.0, exemplars[3].Value)
+	})
+
+	t.Run("keeps all exemplars without trace ID labels", func(t *testing.T) {
+		exemplars := transformToExemplars(result.Frames, nil)
+		require.Len(t, exemplars, 6)
+	})
+}
@@ -0,0 +1,105 @@
+package influxql
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"github.com/grafana/grafana/pkg/tsdb/influxdb/models"
+)
+
+var (
+	showSeriesCardinalityPattern = regexp.MustCompile(`(?i)^\s*SHOW\s+SERIES\s+(?:EXACT\s+)?CARDINALITY\b`)
+	showSeriesPattern            = regexp.MustCompile(`(?i)^\s*SHOW\s+SERIES\b`)
+)
+
+// seriesKeyColumn is the column of the series keys InfluxDB returns for SHOW SERIES queries, like "cpu,host=a".
+const seriesKeyColumn = "key"
+
+// transformShowSeriesRows turns the rows of SHOW SERIES and SHOW SERIES CARDINALITY queries into a single table
+// frame for cardinality dashboards. ok is false for other queries.
+func transformShowSeriesRows(rows []models.Row, query models.Query) (frames data.Frames, ok bool) {
+	var frame *data.Frame
+	switch {
+	case showSeriesCardinalityPattern.MatchString(query.RawQuery):
+		frame = seriesCardinalityFrame(rows)
+	case showSeriesPattern.MatchString(query.RawQuery):
+		frame = seriesKeysFrame(rows)
+	default:
+		return nil, false
+	}
+	frame.Meta = &data.FrameMeta{PreferredVisualization: tableVisType, ExecutedQueryString: query.RawQuery}
+	return data.Frames{frame}, true
+}
+
+// seriesKeysFrame has a row with the measurement and the key of every series.
+func seriesKeysFrame(rows []models.Row) *data.Frame {
+	measurements := make([]string, 0)
+	keys := make([]string, 0)
+	for _, row := range rows {
+		colIndex := 0
+		for i, column := range row.Columns {
+			if column == seriesKeyColumn {
+				colIndex = i
+			}
+		}
+		for _, valuePair := range row.Values {
+			if colIndex >= len(valuePair) {
+				continue
+			}
+			key, ok := valuePair[colIndex].(string)
+			if !ok {
+				continue
+			}
+			measurements = append(measurements, seriesKeyMeasurement(key))
+			keys = append(keys, key)
+		}
+	}
+	return data.NewFrame("series",
+		data.NewField("Measurement", nil, measurements),
+		data.NewField("Series", nil, keys),
+	)
+}
+
+// seriesKeyMeasurement is the measurement of the series key, the part before the first comma that isn't escaped.
+func seriesKeyMeasurement(key string) string {
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '\\':
+			i++
+		case ',':
+			return strings.ReplaceAll(key[:i], `\,`, ",")
+		}
+	}
+	return strings.ReplaceAll(key, `\,`, ",")
+}
+
+// seriesCardinalityFrame has a row with the number of series of every measurement. The measurement is empty for the
+// total cardinality of the database.
+func seriesCardinalityFrame(rows []models.Row) *data.Frame {
+	measurements := make([]string, 0)
+	counts := make([]int64, 0)
+	for _, row := range rows {
+		for _, valuePair := range row.Values {
+			if len(valuePair) == 0 {
+				continue
+			}
+			number, ok := valuePair[0].(json.Number)
+			if !ok {
+				continue
+			}
+			count, err := parseInteger(number)
+			if err != nil {
+				continue
+			}
+			measurements = append(measurements, row.Name)
+			counts = append(counts, count)
+		}
+	}
+	return data.NewFrame("cardinality",
+		data.NewField("Measurement", nil, measurements),
+		data.NewField("Cardinality", nil, counts),
+	)
+}
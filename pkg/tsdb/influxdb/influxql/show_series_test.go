@@ -0,0 +1,110 @@
+package influxql
+
+import (
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/tsdb/influxdb/models"
+)
+
+func TestResponseParser_ShowSeries(t *testing.T) {
+	t.Run("SHOW SERIES returns the measurement and key of every series", func(t *testing.T) {
+		response := `
+		{
+			"results": [
+				{
+					"statement_id": 0,
+					"series": [
+						{
+							"columns": ["key"],
+							"values": [
+								["cpu,host=server01,region=uswest"],
+								["cpu,host=server02,region=useast"],
+								["disk\\,io,host=server01"]
+							]
+						}
+					]
+				}
+			]
+		}
+		`
+
+		query := models.Query{RawQuery: "SHOW SERIES ON telegraf"}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.NoError(t, result.Error)
+		require.Len(t, result.Frames, 1)
+
+		expected := data.NewFrame("series",
+			data.NewField("Measurement", nil, []string{"cpu", "cpu", "disk,io"}),
+			data.NewField("Series", nil, []string{"cpu,host=server01,region=uswest", "cpu,host=server02,region=useast", `disk\,io,host=server01`}),
+		)
+		expected.Meta = &data.FrameMeta{PreferredVisualization: tableVisType, ExecutedQueryString: "SHOW SERIES ON telegraf"}
+		require.Equal(t, expected, result.Frames[0])
+	})
+
+	t.Run("SHOW SERIES CARDINALITY returns the total cardinality", func(t *testing.T) {
+		response := `
+		{
+			"results": [
+				{
+					"statement_id": 0,
+					"series": [
+						{
+							"columns": ["cardinality estimation"],
+							"values": [[1290]]
+						}
+					]
+				}
+			]
+		}
+		`
+
+		query := models.Query{RawQuery: "show series cardinality on telegraf"}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.NoError(t, result.Error)
+		require.Len(t, result.Frames, 1)
+
+		expected := data.NewFrame("cardinality",
+			data.NewField("Measurement", nil, []string{""}),
+			data.NewField("Cardinality", nil, []int64{1290}),
+		)
+		expected.Meta = &data.FrameMeta{PreferredVisualization: tableVisType, ExecutedQueryString: "show series cardinality on telegraf"}
+		require.Equal(t, expected, result.Frames[0])
+	})
+
+	t.Run("SHOW SERIES EXACT CARDINALITY returns the cardinality of every measurement", func(t *testing.T) {
+		response := `
+		{
+			"results": [
+				{
+					"statement_id": 0,
+					"series": [
+						{"name": "cpu", "columns": ["count"], "values": [[24]]},
+						{"name": "disk", "columns": ["count"], "values": [[8]]},
+						{"name": "mem", "columns": ["count"], "values": [[1]]}
+					]
+				}
+			]
+		}
+		`
+
+		query := models.Query{RawQuery: "SHOW SERIES EXACT CARDINALITY ON telegraf"}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.NoError(t, result.Error)
+		require.Len(t, result.Frames, 1)
+		require.Equal(t, data.NewField("Measurement", nil, []string{"cpu", "disk", "mem"}), result.Frames[0].Fields[0])
+		require.Equal(t, data.NewField("Cardinality", nil, []int64{24, 8, 1}), result.Frames[0].Fields[1])
+	})
+
+	t.Run("SHOW SERIES without series returns an empty frame", func(t *testing.T) {
+		response := `{"results": [{"statement_id": 0}]}`
+
+		query := models.Query{RawQuery: "SHOW SERIES FROM cpu"}
+		result := ResponseParse(prepare(response), 200, generateQuery(query))
+		require.NoError(t, result.Error)
+		require.Len(t, result.Frames, 1)
+		require.Equal(t, 0, result.Frames[0].Rows())
+	})
+}
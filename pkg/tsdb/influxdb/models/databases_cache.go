@@ -0,0 +1,96 @@
+package models
+
+import (
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// DefaultDatabasesCacheTTL is how long the database list of a datasource is cached.
+const DefaultDatabasesCacheTTL = 30 * time.Second
+
+// DatabasesCache holds the responses of the SHOW DATABASES queries of a datasource for a short time, so the variable
+// queries needing the database list don't query InfluxDB on every refresh. The responses are keyed by everything that
+// changes them, like the result format of the query and the user sending it.
+type DatabasesCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]databasesCacheEntry
+}
+
+type databasesCacheEntry struct {
+	response backend.DataResponse
+	expires  time.Time
+}
+
+func NewDatabasesCache(ttl time.Duration) *DatabasesCache {
+	return &DatabasesCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]databasesCacheEntry{},
+	}
+}
+
+// Get returns the cached response for the key, ok is false when there is none or it expired.
+func (c *DatabasesCache) Get(key string) (backend.DataResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return backend.DataResponse{}, false
+	}
+	return copyFrames(entry.response), true
+}
+
+// Set caches the response for the key for the TTL of the cache.
+func (c *DatabasesCache) Set(key string, response backend.DataResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = databasesCacheEntry{response: copyFrames(response), expires: c.now().Add(c.ttl)}
+}
+
+// copyFrames returns the response with a deep copy of its frames, so neither the frames the callers add to their
+// response, like the exemplar frames, nor the changes they make to the frames, like their notices, end up in the
+// cached one.
+func copyFrames(response backend.DataResponse) backend.DataResponse {
+	if response.Frames != nil {
+		frames := make(data.Frames, 0, len(response.Frames))
+		for _, frame := range response.Frames {
+			frames = append(frames, copyFrame(frame))
+		}
+		response.Frames = frames
+	}
+	return response
+}
+
+func copyFrame(frame *data.Frame) *data.Frame {
+	frameCopy := frame.EmptyCopy()
+	for i, field := range frame.Fields {
+		if field.Config != nil {
+			config := *field.Config
+			frameCopy.Fields[i].Config = &config
+		}
+		for row := 0; row < field.Len(); row++ {
+			frameCopy.Fields[i].Append(field.CopyAt(row))
+		}
+	}
+	if frame.Meta != nil {
+		meta := *frame.Meta
+		meta.Notices = append([]data.Notice(nil), frame.Meta.Notices...)
+		meta.Stats = append([]data.QueryStat(nil), frame.Meta.Stats...)
+		frameCopy.Meta = &meta
+	}
+	return frameCopy
+}
+
+// Invalidate drops all the cached responses, so the next query reads the database list from InfluxDB again.
+func (c *DatabasesCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]databasesCacheEntry{}
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatabasesCache(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := NewDatabasesCache(30 * time.Second)
+	cache.now = func() time.Time { return now }
+	response := backend.DataResponse{Status: backend.StatusOK}
+
+	_, ok := cache.Get("table")
+	require.False(t, ok)
+
+	cache.Set("table", response)
+	cached, ok := cache.Get("table")
+	require.True(t, ok)
+	require.Equal(t, response, cached)
+	_, ok = cache.Get("time_series")
+	require.False(t, ok, "the responses are cached per result format")
+
+	now = now.Add(30 * time.Second)
+	_, ok = cache.Get("table")
+	require.False(t, ok, "the response expires after the TTL")
+
+	cache.Set("table", response)
+	cache.Invalidate()
+	_, ok = cache.Get("table")
+	require.False(t, ok)
+}
+
+func TestDatabasesCache_Frames(t *testing.T) {
+	cache := NewDatabasesCache(30 * time.Second)
+	response := backend.DataResponse{Frames: data.Frames{data.NewFrame("databases")}}
+	cache.Set("table", response)
+
+	response.Frames = append(response.Frames, data.NewFrame("set"))
+	response.Frames[0] = data.NewFrame("replaced")
+	cached, ok := cache.Get("table")
+	require.True(t, ok)
+	require.Len(t, cached.Frames, 1)
+	require.Equal(t, "databases", cached.Frames[0].Name)
+
+	cached.Frames = append(cached.Frames[:1], data.NewFrame("exemplars"))
+	cached, ok = cache.Get("table")
+	require.True(t, ok)
+	require.Len(t, cached.Frames, 1, "the frames added to a cached response are not cached")
+}
+
+func TestDatabasesCache_FrameChanges(t *testing.T) {
+	cache := NewDatabasesCache(30 * time.Second)
+	frame := data.NewFrame("databases", data.NewField("Value", data.Labels{"db": "a"}, []string{"telegraf", "metrics"}))
+	frame.Meta = &data.FrameMeta{ExecutedQueryString: "SHOW DATABASES"}
+	cache.Set("table", backend.DataResponse{Frames: data.Frames{frame}})
+
+	frame.Fields[0].Set(0, "changed")
+	frame.Meta.ExecutedQueryString = "changed"
+	cached, ok := cache.Get("table")
+	require.True(t, ok)
+	require.Equal(t, "telegraf", cached.Frames[0].Fields[0].At(0))
+	require.Equal(t, "SHOW DATABASES", cached.Frames[0].Meta.ExecutedQueryString)
+
+	cached.Frames[0].Fields[0].Append("added")
+	cached.Frames[0].Fields[0].Labels["db"] = "changed"
+	cached.Frames[0].AppendNotices(data.Notice{Text: "added"})
+	cached, ok = cache.Get("table")
+	require.True(t, ok)
+	require.Equal(t, 2, cached.Frames[0].Rows(), "the changes to a cached response are not cached")
+	require.Equal(t, data.Labels{"db": "a"}, cached.Frames[0].Fields[0].Labels)
+	require.Empty(t, cached.Frames[0].Meta.Notices)
+}
@@ -1,7 +1,13 @@
 package models
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
 )
 
 type ExemplarSetting struct {
@@ -9,11 +15,87 @@ type ExemplarSetting struct {
 	Name          string `json:"name"`
 }
 
+const (
+	// EmptyResultsModeEmpty returns no frames for a response with an empty results array, the default.
+	EmptyResultsModeEmpty = "empty"
+	// EmptyResultsModeError returns an error for a response with an empty results array.
+	EmptyResultsModeError = "error"
+)
+
+const (
+	// EmptyTagValuesKeep keeps the tags with an empty value as labels of the series, the default.
+	EmptyTagValuesKeep = "keep"
+	// EmptyTagValuesDrop removes the tags with an empty value from the labels and names of the series.
+	EmptyTagValuesDrop = "drop"
+)
+
+const (
+	// ZeroTimestampsKeep keeps the rows with an epoch 0 timestamp, the default.
+	ZeroTimestampsKeep = "keep"
+	// ZeroTimestampsDrop removes the rows with an epoch 0 timestamp, which are often sentinel values.
+	ZeroTimestampsDrop = "drop"
+)
+
+const (
+	// FrameFormatSplit returns a frame per field of a series, each with a time and a value field, the default.
+	FrameFormatSplit = "split"
+	// FrameFormatWide returns a frame per series, with a time field and a value field per field of the series.
+	FrameFormatWide = "wide"
+)
+
+// DefaultPrecision is the epoch InfluxQL timestamps are requested in when none is configured, milliseconds.
+const DefaultPrecision = "ms"
+
+// PrecisionRFC3339 requests the InfluxQL timestamps without an epoch, InfluxDB then returns them as RFC3339 strings.
+const PrecisionRFC3339 = "rfc3339"
+
+const (
+	// DefaultGaugeAggregation is the aggregation AutoAggregation applies to the fields without a configured one.
+	DefaultGaugeAggregation = "mean"
+	// DefaultCounterAggregation is the aggregation AutoAggregation applies to the fields without a configured one
+	// whose name looks like the name of a counter, like requests_total.
+	DefaultCounterAggregation = "sum"
+)
+
+// DefaultExemplarMeasurementSuffix is the suffix of the measurements of the exemplars when none is configured.
+const DefaultExemplarMeasurementSuffix = "_exemplar"
+
+// Duration is a duration of the datasource settings, set as a duration string like "60s", or as a number of
+// seconds like the settings that predate duration strings.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case nil:
+		*d = 0
+	case float64:
+		*d = Duration(value * float64(time.Second))
+	case string:
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+			*d = Duration(seconds * float64(time.Second))
+			return nil
+		}
+		duration, err := gtime.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", value, err)
+		}
+		*d = Duration(duration)
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	return nil
+}
+
 type DatasourceInfo struct {
 	HTTPClient *http.Client
 
 	Token string
 	URL   string
+	UID   string
 
 	DbName        string `json:"dbName"`
 	Version       string `json:"version"`
@@ -22,6 +104,46 @@ type DatasourceInfo struct {
 	DefaultBucket string `json:"defaultBucket"`
 	Organization  string `json:"organization"`
 	MaxSeries     int    `json:"maxSeries"`
+	// MaxStatements is the maximum number of ;-separated statements of an InfluxQL query, 0, the default, means no
+	// limit so the existing queries keep working
+	MaxStatements int `json:"maxStatements"`
+	// EmptyResultsMode is how InfluxQL responses with an empty results array are handled, see EmptyResultsModeEmpty
+	EmptyResultsMode string `json:"emptyResultsMode"`
+	// EmptyTagValues is how tags with an empty value returned by InfluxQL queries are handled, see EmptyTagValuesKeep
+	EmptyTagValues string `json:"emptyTagValues"`
+	// Precision is the epoch InfluxQL timestamps are requested and parsed in, one of ns, u, ms and s, or
+	// PrecisionRFC3339 for RFC3339 timestamps, for the queries that don't set their own
+	Precision string `json:"precision"`
+	// ChunkSize is the number of points per chunk InfluxDB streams the InfluxQL results in, 0 disables chunking
+	ChunkSize int `json:"chunkSize"`
+	// ZeroTimestamps is how rows with an epoch 0 timestamp returned by InfluxQL queries are handled, see ZeroTimestampsKeep
+	ZeroTimestamps string `json:"zeroTimestamps"`
+	// FrameFormat is how the series of InfluxQL queries are turned into frames, for the queries that don't set their
+	// own, see FrameFormatSplit
+	FrameFormat string `json:"frameFormat"`
+	// AutoAggregation applies an aggregation to the fields InfluxQL builder queries grouped by time select without
+	// one, instead of letting InfluxDB reject the query
+	AutoAggregation bool `json:"autoAggregation"`
+	// FieldAggregations are the aggregations AutoAggregation applies by field name, like sum for requests. The other
+	// fields get DefaultCounterAggregation or DefaultGaugeAggregation
+	FieldAggregations map[string]string `json:"fieldAggregations"`
+	// ResponseContentTypes are the media types, like application/json and application/csv, the InfluxQL responses
+	// must have. A response with another content type, often the HTML page of a misconfigured proxy, is an error.
+	// Responses are not checked when empty
+	ResponseContentTypes []string `json:"responseContentTypes"`
+	// V2Compatibility queries the InfluxQL compatibility API of InfluxDB 2.x, which maps the db parameter to a
+	// bucket, so the DefaultBucket is queried when no DbName is set
+	V2Compatibility bool `json:"v2Compatibility"`
+	// ClusterHosts are the hosts, besides the one of the URL, InfluxQL requests may be redirected to
+	ClusterHosts []string `json:"clusterHosts"`
+	// UserAgent is appended to the User-Agent of the InfluxQL requests, after the Grafana version and datasource UID
+	UserAgent string `json:"userAgent"`
+	// ForceHTTP1 disables HTTP/2 on the client transport, for setups that misbehave over HTTP/2
+	ForceHTTP1 bool `json:"forceHttp1"`
+	// ConnectTimeout is the timeout for establishing a connection to InfluxDB
+	ConnectTimeout Duration `json:"connectTimeout"`
+	// QueryTimeout is the timeout for running a single InfluxQL query, including reading its response
+	QueryTimeout Duration `json:"queryTimeout"`
 
 	// Flight SQL metadata
 	Metadata []map[string]string `json:"metadata"`
@@ -30,4 +152,10 @@ type DatasourceInfo struct {
 
 	// Exemplar settings
 	ExemplarTraceIdDestinations []ExemplarSetting `json:"exemplarTraceIdDestinations"`
+	// ExemplarMeasurementSuffix is appended to the measurement of a query to get the measurement of its exemplars,
+	// DefaultExemplarMeasurementSuffix when empty
+	ExemplarMeasurementSuffix string `json:"exemplarMeasurementSuffix"`
+
+	// DatabasesCache caches the responses of the SHOW DATABASES queries of the datasource, nothing is cached when nil
+	DatabasesCache *DatabasesCache `json:"-"`
 }
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuration_UnmarshalJSON(t *testing.T) {
+	for _, tt := range []struct {
+		json     string
+		expected Duration
+	}{
+		{json: `60`, expected: Duration(60 * time.Second)},
+		{json: `1.5`, expected: Duration(1500 * time.Millisecond)},
+		{json: `"60"`, expected: Duration(60 * time.Second)},
+		{json: `"60s"`, expected: Duration(60 * time.Second)},
+		{json: `"2m"`, expected: Duration(2 * time.Minute)},
+		{json: `"500ms"`, expected: Duration(500 * time.Millisecond)},
+		{json: `null`, expected: 0},
+	} {
+		t.Run(tt.json, func(t *testing.T) {
+			var info DatasourceInfo
+			require.NoError(t, json.Unmarshal([]byte(`{"queryTimeout":`+tt.json+`}`), &info))
+			require.Equal(t, tt.expected, info.QueryTimeout)
+		})
+	}
+
+	t.Run("invalid durations", func(t *testing.T) {
+		var d Duration
+		require.EqualError(t, json.Unmarshal([]byte(`"soon"`), &d), `invalid duration "soon": time: invalid duration "soon"`)
+		require.EqualError(t, json.Unmarshal([]byte(`true`), &d), `invalid duration true`)
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
 
 	"github.com/grafana/grafana/pkg/components/simplejson"
 )
@@ -28,6 +29,22 @@ func QueryParse(query backend.DataQuery) (*Query, error) {
 	orderByTime := model.Get("orderByTime").MustString("")
 	measurement := model.Get("measurement").MustString("")
 	resultFormat := model.Get("resultFormat").MustString("")
+	epoch := model.Get("epoch").MustString("")
+	frameFormat := model.Get("frameFormat").MustString("")
+	retentionPolicyOverride := model.Get("retentionPolicyOverride").MustString("")
+	maxSeries := model.Get("maxSeries").MustInt(0)
+	measurementRegexEscaping := model.Get("measurementRegexEscaping").MustString(MeasurementRegexRaw)
+	variableQuery := model.Get("variableQuery").MustBool(false)
+	verbatim := model.Get("verbatim").MustBool(false)
+	alignGroupByTime := model.Get("alignGroupByTime").MustBool(false)
+
+	var groupByTimeOffset time.Duration
+	if offset := model.Get("groupByTimeOffset").MustString(""); offset != "" {
+		groupByTimeOffset, err = gtime.ParseDuration(offset)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group by time offset %q: %w", offset, err)
+		}
+	}
 
 	tags, err := parseTags(model)
 	if err != nil {
@@ -54,20 +71,29 @@ func QueryParse(query backend.DataQuery) (*Query, error) {
 	}
 
 	return &Query{
-		Measurement:  measurement,
-		Policy:       policy,
-		GroupBy:      groupBys,
-		Tags:         tags,
-		Selects:      selects,
-		RawQuery:     rawQuery,
-		Interval:     interval,
-		Alias:        alias,
-		UseRawQuery:  useRawQuery,
-		Tz:           tz,
-		Limit:        limit,
-		Slimit:       slimit,
-		OrderByTime:  orderByTime,
-		ResultFormat: resultFormat,
+		Measurement:              measurement,
+		Policy:                   policy,
+		GroupBy:                  groupBys,
+		Tags:                     tags,
+		Selects:                  selects,
+		RawQuery:                 rawQuery,
+		Interval:                 interval,
+		Alias:                    alias,
+		UseRawQuery:              useRawQuery,
+		Tz:                       tz,
+		Limit:                    limit,
+		Slimit:                   slimit,
+		OrderByTime:              orderByTime,
+		ResultFormat:             resultFormat,
+		Epoch:                    epoch,
+		FrameFormat:              frameFormat,
+		RetentionPolicyOverride:  retentionPolicyOverride,
+		MaxSeries:                maxSeries,
+		MeasurementRegexEscaping: measurementRegexEscaping,
+		VariableQuery:            variableQuery,
+		Verbatim:                 verbatim,
+		AlignGroupByTime:         alignGroupByTime,
+		GroupByTimeOffset:        groupByTimeOffset,
 	}, nil
 }
 
@@ -198,4 +198,19 @@ func TestInfluxdbQueryParser_Parse(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, time.Millisecond*1, res.Interval)
 	})
+
+	t.Run("can parse group by time alignment", func(t *testing.T) {
+		query := backend.DataQuery{
+			JSON: []byte(`{"query": "RawDummyQuery", "rawQuery": true, "alignGroupByTime": true, "groupByTimeOffset": "-15m"}`),
+		}
+
+		res, err := QueryParse(query)
+		require.NoError(t, err)
+		require.True(t, res.AlignGroupByTime)
+		require.Equal(t, -15*time.Minute, res.GroupByTimeOffset)
+
+		query.JSON = []byte(`{"query": "RawDummyQuery", "rawQuery": true, "groupByTimeOffset": "soon"}`)
+		_, err = QueryParse(query)
+		require.Error(t, err)
+	})
 }
@@ -22,8 +22,50 @@ type Query struct {
 	OrderByTime  string
 	RefID        string
 	ResultFormat string
+	// Epoch is the precision InfluxDB returns timestamps in, the precision of the datasource when the query doesn't
+	// set one, milliseconds when neither does
+	Epoch string
+	// RetentionPolicyOverride is sent as the retention policy of the request instead of Policy when set
+	RetentionPolicyOverride string
+	// EmptyResultsMode is how a response with an empty results array is handled, from the datasource settings
+	EmptyResultsMode string
+	// EmptyTagValues is how tags with an empty value are handled, from the datasource settings
+	EmptyTagValues string
+	// ZeroTimestamps is how rows with an epoch 0 timestamp are handled, from the datasource settings
+	ZeroTimestamps string
+	// FrameFormat is how the series are turned into frames, the format of the datasource when the query doesn't set
+	// one, see FrameFormatSplit
+	FrameFormat string
+	// MaxSeries is the maximum number of series returned, the query JSON overrides the datasource setting when set
+	MaxSeries int
+	// MaxStatements is the maximum number of ;-separated statements of the raw query, from the datasource settings,
+	// no limit when 0
+	MaxStatements int
+	// MeasurementRegexEscaping is how /.../ measurement patterns are rendered, MeasurementRegexRaw when empty
+	MeasurementRegexEscaping string
+	// Verbatim sends the raw query as it is, without replacing the $timeFilter and interval macros
+	Verbatim bool
+	// AlignGroupByTime starts the time filter at the beginning of the GROUP BY time bucket it falls in and renders
+	// GroupByTimeOffset as the offset argument of time(), so refreshes always return the same complete buckets
+	AlignGroupByTime bool
+	// GroupByTimeOffset shifts the GROUP BY time buckets from the epoch boundaries when AlignGroupByTime is set
+	GroupByTimeOffset time.Duration
+	// VariableQuery flattens the response into a single list of values, as used by template variables
+	VariableQuery bool
+	// AutoAggregation applies an aggregation to the fields the builder selects without one when the query is grouped
+	// by time, from the datasource settings
+	AutoAggregation bool
+	// FieldAggregations are the aggregations AutoAggregation applies by field name, from the datasource settings
+	FieldAggregations map[string]string
 }
 
+const (
+	// MeasurementRegexRaw renders /.../ measurement patterns as they are, as regular expressions.
+	MeasurementRegexRaw = "raw"
+	// MeasurementRegexEscaped renders /.../ measurement patterns so their content is matched literally.
+	MeasurementRegexEscaped = "escaped"
+)
+
 type Tag struct {
 	Key       string
 	Operator  string
@@ -39,12 +81,16 @@ type Response struct {
 }
 
 type Result struct {
-	Series   []Row
-	Messages []*Message
-	Error    string
+	// StatementID is the index of the statement of the query the result is for
+	StatementID int `json:"statement_id"`
+	Series      []Row
+	Messages    []*Message
+	Error       string
 }
 
 type Exemplar struct {
+	// RefID is the one of the query the exemplar is for
+	RefID        string
 	SeriesLabels map[string]string
 	Fields       []*data.Field
 	RowIdx       int
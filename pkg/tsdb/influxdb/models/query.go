@@ -6,8 +6,10 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/gtime"
 
 	"github.com/grafana/grafana/pkg/tsdb/intervalv2"
 )
@@ -20,8 +22,17 @@ var (
 func (query *Query) Build(queryContext *backend.QueryDataRequest) (string, error) {
 	var res string
 	if query.UseRawQuery && query.RawQuery != "" {
+		if statements := countStatements(query.RawQuery); query.MaxStatements > 0 && statements > query.MaxStatements {
+			return "", fmt.Errorf("query has %d statements, more than the maximum of %d statements per query", statements, query.MaxStatements)
+		}
+		if query.Verbatim {
+			return query.RawQuery, nil
+		}
 		res = query.RawQuery
 	} else {
+		if err := query.applyAutoAggregation(); err != nil {
+			return "", err
+		}
 		res = query.renderSelectors(queryContext)
 		res += query.renderMeasurement()
 		res += query.renderWhereClause()
@@ -44,6 +55,41 @@ func (query *Query) Build(queryContext *backend.QueryDataRequest) (string, error
 	return res, nil
 }
 
+// countStatements returns the number of non-empty ;-separated statements of the query, semicolons in quoted strings
+// and identifiers don't separate statements.
+func countStatements(query string) int {
+	count := 0
+	var quote rune
+	escaped := false
+	statement := false
+	for _, c := range query {
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			statement = true
+		case c == ';':
+			if statement {
+				count++
+			}
+			statement = false
+		case !unicode.IsSpace(c):
+			statement = true
+		}
+	}
+	if statement {
+		count++
+	}
+	return count
+}
+
 func (query *Query) renderTags() []string {
 	res := make([]string, 0, len(query.Tags))
 	for i, tag := range query.Tags {
@@ -95,10 +141,102 @@ func (query *Query) renderTags() []string {
 }
 
 func (query *Query) renderTimeFilter(queryContext *backend.QueryDataRequest) string {
-	from, to := epochMStoInfluxTime(&queryContext.Queries[0].TimeRange)
+	timeRange := queryContext.Queries[0].TimeRange
+	if query.AlignGroupByTime {
+		timeRange.From = query.alignToGroupByTime(timeRange.From)
+	}
+	from, to := epochMStoInfluxTime(&timeRange)
 	return fmt.Sprintf("time >= %s and time <= %s", from, to)
 }
 
+// alignToGroupByTime returns the start of the GROUP BY time bucket t falls in. InfluxDB starts the buckets at the
+// epoch boundaries of the interval shifted by the offset, so the first bucket is not cut by the time filter.
+func (query *Query) alignToGroupByTime(t time.Time) time.Time {
+	interval := query.groupByTimeInterval()
+	if interval <= 0 {
+		return t
+	}
+	shift := (t.UnixNano() - int64(query.GroupByTimeOffset)) % int64(interval)
+	if shift < 0 {
+		shift += int64(interval)
+	}
+	return t.Add(-time.Duration(shift))
+}
+
+// groupByTimeInterval returns the interval of the GROUP BY time part, or the interval of the query for raw queries
+// and when the query has no such part. It returns 0 when the interval cannot be parsed.
+func (query *Query) groupByTimeInterval() time.Duration {
+	for _, group := range query.GroupBy {
+		if group.Type != "time" || len(group.Params) == 0 {
+			continue
+		}
+		switch param := group.Params[0]; param {
+		case "auto", "$__interval", "$interval":
+			return query.Interval
+		default:
+			interval, err := gtime.ParseDuration(param)
+			if err != nil {
+				return 0
+			}
+			return interval
+		}
+	}
+	return query.Interval
+}
+
+// counterSuffixes are the suffixes of the names of the fields AutoAggregation treats as counters.
+var counterSuffixes = []string{"_total", "_count", "_sum"}
+
+// applyAutoAggregation adds an aggregation after the field of the selects without one when AutoAggregation is set
+// and the query is grouped by time, as InfluxDB rejects such queries otherwise. The selects are changed in place so
+// the response reports the applied aggregation like the ones picked in the builder.
+func (query *Query) applyAutoAggregation() error {
+	if !query.AutoAggregation || !query.hasGroupByTime() {
+		return nil
+	}
+	for _, sel := range query.Selects {
+		if sel.Function() != "" {
+			continue
+		}
+		for i, part := range *sel {
+			if part.Type != "field" || len(part.Params) == 0 {
+				continue
+			}
+			field := strings.TrimSuffix(part.Params[0], "::field")
+			aggregation, err := NewQueryPart(query.fieldAggregation(field), nil)
+			if err != nil {
+				return fmt.Errorf("unsupported aggregation for field %q: %w", field, err)
+			}
+			*sel = append((*sel)[:i+1], append(Select{*aggregation}, (*sel)[i+1:]...)...)
+			break
+		}
+	}
+	return nil
+}
+
+// fieldAggregation returns the aggregation AutoAggregation applies to the field: the configured one, or the default
+// one of counters or gauges depending on the name of the field.
+func (query *Query) fieldAggregation(field string) string {
+	if aggregation, ok := query.FieldAggregations[field]; ok {
+		return aggregation
+	}
+	for _, suffix := range counterSuffixes {
+		if strings.HasSuffix(field, suffix) {
+			return DefaultCounterAggregation
+		}
+	}
+	return DefaultGaugeAggregation
+}
+
+func (query *Query) hasGroupByTime() bool {
+	for _, group := range query.GroupBy {
+		if group.Type == "time" {
+			return true
+		}
+	}
+	return false
+}
+
 func (query *Query) renderSelectors(queryContext *backend.QueryDataRequest) string {
 	res := "SELECT "
 
@@ -126,11 +264,21 @@ func (query *Query) renderMeasurement() string {
 
 	if !regexpMeasurementPattern.MatchString(measurement) {
 		measurement = fmt.Sprintf(`"%s"`, measurement)
+	} else if query.MeasurementRegexEscaping == MeasurementRegexEscaped {
+		measurement = escapeMeasurementRegex(measurement)
 	}
 
 	return fmt.Sprintf(` FROM %s%s`, policy, measurement)
 }
 
+// escapeMeasurementRegex turns a /.../ measurement pattern into one that matches its content literally, so names
+// with regex characters interpolated from template variables, like cpu.total, only match themselves.
+func escapeMeasurementRegex(measurement string) string {
+	name := measurement[1 : len(measurement)-1]
+	escaped := strings.ReplaceAll(regexp.QuoteMeta(name), "/", `\/`)
+	return "/^" + escaped + "$/"
+}
+
 func (query *Query) renderWhereClause() string {
 	res := " WHERE "
 	conditions := query.renderTags()
@@ -159,6 +307,12 @@ func (query *Query) renderGroupBy(queryContext *backend.QueryDataRequest) string
 			groupBy += " "
 		}
 
+		if group.Type == "time" && len(group.Params) == 1 && query.AlignGroupByTime && query.GroupByTimeOffset != 0 {
+			aligned := *group
+			aligned.Params = []string{group.Params[0], fmt.Sprintf("%dms", query.GroupByTimeOffset.Milliseconds())}
+			group = &aligned
+		}
+
 		groupBy += group.Render(query, queryContext, "")
 	}
 
@@ -197,6 +351,19 @@ func (query *Query) renderSlimit() string {
 	return fmt.Sprintf(" slimit %s", slimit)
 }
 
+// Function returns the first function applied to the field of the select, for example "mean" for
+// mean("value"), or an empty string when the field is selected as is.
+func (sel Select) Function() string {
+	for _, part := range sel {
+		switch part.Type {
+		case "field", "tag", "math", "alias":
+			continue
+		}
+		return part.Type
+	}
+	return ""
+}
+
 func epochMStoInfluxTime(tr *backend.TimeRange) (string, string) {
 	from := tr.From.UnixNano() / int64(time.Millisecond)
 	to := tr.To.UnixNano() / int64(time.Millisecond)
@@ -140,6 +140,91 @@ func TestInfluxdbQueryBuilder(t *testing.T) {
 				`SELECT mean("value") FROM "cpu" WHERE time >= 1596240000000ms and time <= 1596240300000ms GROUP BY time(200ms)`)
 		})
 
+		t.Run("can build query with group by time aligned to epoch boundaries", func(t *testing.T) {
+			unalignedContext := &backend.QueryDataRequest{
+				Queries: []backend.DataQuery{
+					{
+						TimeRange: backend.TimeRange{
+							From: time.Date(2020, 8, 1, 0, 2, 30, 0, time.UTC),
+							To:   time.Date(2020, 8, 1, 0, 10, 0, 0, time.UTC),
+						},
+					},
+				},
+			}
+
+			t.Run("aligned buckets", func(t *testing.T) {
+				query := &Query{
+					Selects:          []*Select{{*qp1, *qp2}},
+					Measurement:      "cpu",
+					GroupBy:          []*QueryPart{groupBy1, groupBy3},
+					Interval:         time.Minute,
+					AlignGroupByTime: true,
+				}
+
+				rawQuery, err := query.Build(unalignedContext)
+				require.NoError(t, err)
+				require.Equal(t, `SELECT mean("value") FROM "cpu" WHERE time >= 1596240120000ms and time <= 1596240600000ms GROUP BY time(1m) fill(null)`, rawQuery)
+			})
+
+			t.Run("offset buckets", func(t *testing.T) {
+				query := &Query{
+					Selects:           []*Select{{*qp1, *qp2}},
+					Measurement:       "cpu",
+					GroupBy:           []*QueryPart{groupBy1, groupBy3},
+					Interval:          time.Minute,
+					AlignGroupByTime:  true,
+					GroupByTimeOffset: 45 * time.Second,
+				}
+
+				rawQuery, err := query.Build(unalignedContext)
+				require.NoError(t, err)
+				require.Equal(t, `SELECT mean("value") FROM "cpu" WHERE time >= 1596240105000ms and time <= 1596240600000ms GROUP BY time(1m, 45000ms) fill(null)`, rawQuery)
+			})
+
+			t.Run("negative offset buckets with a fixed interval", func(t *testing.T) {
+				groupByHour, _ := NewQueryPart("time", []string{"1h"})
+				query := &Query{
+					Selects:           []*Select{{*qp1, *qp2}},
+					Measurement:       "cpu",
+					GroupBy:           []*QueryPart{groupByHour},
+					Interval:          time.Minute,
+					AlignGroupByTime:  true,
+					GroupByTimeOffset: -15 * time.Minute,
+				}
+
+				rawQuery, err := query.Build(unalignedContext)
+				require.NoError(t, err)
+				require.Equal(t, `SELECT mean("value") FROM "cpu" WHERE time >= 1596239100000ms and time <= 1596240600000ms GROUP BY time(1h, -900000ms)`, rawQuery)
+			})
+
+			t.Run("time filter of raw queries", func(t *testing.T) {
+				query := &Query{
+					RawQuery:         `SELECT mean("value") FROM "cpu" WHERE $timeFilter GROUP BY time($__interval)`,
+					UseRawQuery:      true,
+					Interval:         time.Minute,
+					AlignGroupByTime: true,
+				}
+
+				rawQuery, err := query.Build(unalignedContext)
+				require.NoError(t, err)
+				require.Equal(t, `SELECT mean("value") FROM "cpu" WHERE time >= 1596240120000ms and time <= 1596240600000ms GROUP BY time(1m)`, rawQuery)
+			})
+
+			t.Run("not aligned by default", func(t *testing.T) {
+				query := &Query{
+					Selects:           []*Select{{*qp1, *qp2}},
+					Measurement:       "cpu",
+					GroupBy:           []*QueryPart{groupBy1},
+					Interval:          time.Minute,
+					GroupByTimeOffset: 45 * time.Second,
+				}
+
+				rawQuery, err := query.Build(unalignedContext)
+				require.NoError(t, err)
+				require.Equal(t, `SELECT mean("value") FROM "cpu" WHERE time >= 1596240150000ms and time <= 1596240600000ms GROUP BY time(1m)`, rawQuery)
+			})
+		})
+
 		t.Run("can render time range", func(t *testing.T) {
 			query := Query{}
 			t.Run("render from: 2h to now-1h", func(t *testing.T) {
@@ -192,6 +277,49 @@ func TestInfluxdbQueryBuilder(t *testing.T) {
 			require.Equal(t, rawQuery, `Raw query`)
 		})
 
+		t.Run("limits the statements of a raw query", func(t *testing.T) {
+			query := &Query{
+				Interval:      time.Second * 10,
+				RawQuery:      `SELECT "value" FROM "cpu"; SELECT "value" FROM "mem" WHERE "host" = 'a;b';`,
+				UseRawQuery:   true,
+				MaxStatements: 2,
+			}
+
+			_, err := query.Build(queryContext)
+			require.NoError(t, err)
+
+			query.RawQuery += ` SELECT "value" FROM "disk"`
+			_, err = query.Build(queryContext)
+			require.EqualError(t, err, "query has 3 statements, more than the maximum of 2 statements per query")
+
+			query.Verbatim = true
+			_, err = query.Build(queryContext)
+			require.Error(t, err)
+
+			query.MaxStatements = 0
+			_, err = query.Build(queryContext)
+			require.NoError(t, err)
+		})
+
+		t.Run("leaves the macros of a verbatim raw query untouched", func(t *testing.T) {
+			raw := `SELECT mean("value") FROM "cpu" WHERE $timeFilter GROUP BY time($__interval), time($interval) LIMIT $__interval_ms`
+			query := &Query{
+				Interval:    time.Second * 10,
+				RawQuery:    raw,
+				UseRawQuery: true,
+				Verbatim:    true,
+			}
+
+			rawQuery, err := query.Build(queryContext)
+			require.NoError(t, err)
+			require.Equal(t, raw, rawQuery)
+
+			query.Verbatim = false
+			rawQuery, err = query.Build(queryContext)
+			require.NoError(t, err)
+			require.Equal(t, `SELECT mean("value") FROM "cpu" WHERE time >= 1596240000000ms and time <= 1596240300000ms GROUP BY time(10s), time(10s) LIMIT 10000`, rawQuery)
+		})
+
 		t.Run("can render normal tags without operator", func(t *testing.T) {
 			query := &Query{Tags: []*Tag{{Operator: "", Value: `value`, Key: "key"}}}
 
@@ -251,5 +379,123 @@ func TestInfluxdbQueryBuilder(t *testing.T) {
 
 			require.Equal(t, query.renderMeasurement(), ` FROM "policy"./apa/`)
 		})
+
+		t.Run("can render regexp measurement with raw escaping", func(t *testing.T) {
+			query := &Query{Measurement: `/^cpu.(total|idle)$/`, MeasurementRegexEscaping: MeasurementRegexRaw}
+
+			require.Equal(t, query.renderMeasurement(), ` FROM /^cpu.(total|idle)$/`)
+		})
+
+		t.Run("can render regexp measurement with escaped escaping", func(t *testing.T) {
+			query := &Query{Measurement: `/cpu.total/1m/`, MeasurementRegexEscaping: MeasurementRegexEscaped}
+
+			require.Equal(t, query.renderMeasurement(), ` FROM /^cpu\.total\/1m$/`)
+		})
+	})
+}
+
+func TestSelectFunction(t *testing.T) {
+	field, _ := NewQueryPart("field", []string{"value"})
+	mean, _ := NewQueryPart("mean", []string{})
+	derivative, _ := NewQueryPart("derivative", []string{"10s"})
+	math, _ := NewQueryPart("math", []string{"/ 100"})
+	alias, _ := NewQueryPart("alias", []string{"test"})
+
+	require.Equal(t, "mean", Select{*field, *mean}.Function())
+	require.Equal(t, "mean", Select{*field, *mean, *derivative, *math, *alias}.Function())
+	require.Equal(t, "", Select{*field, *alias}.Function())
+}
+
+func TestAutoAggregation(t *testing.T) {
+	groupByTime, _ := NewQueryPart("time", []string{"$__interval"})
+	groupByTag, _ := NewQueryPart("tag", []string{"datacenter"})
+	queryContext := &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{
+			{
+				TimeRange: backend.TimeRange{
+					From: time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC),
+					To:   time.Date(2020, 8, 1, 0, 5, 0, 0, time.UTC),
+				},
+			},
+		},
+	}
+	selectField := func(field string, parts ...string) *Select {
+		fieldPart, _ := NewQueryPart("field", []string{field})
+		sel := Select{*fieldPart}
+		for _, typ := range parts {
+			var params []string
+			if typ == "math" {
+				params = []string{"* 8"}
+			}
+			part, _ := NewQueryPart(typ, params)
+			sel = append(sel, *part)
+		}
+		return &sel
+	}
+	build := func(t *testing.T, query *Query) string {
+		t.Helper()
+		query.Measurement = "cpu"
+		query.Interval = 10 * time.Second
+		rawQuery, err := query.Build(queryContext)
+		require.NoError(t, err)
+		return strings.TrimPrefix(strings.Split(rawQuery, " FROM ")[0], "SELECT ")
+	}
+
+	t.Run("aggregation by field type", func(t *testing.T) {
+		query := &Query{
+			Selects:         []*Select{selectField("usage"), selectField("requests_total"), selectField("bytes", "math")},
+			GroupBy:         []*QueryPart{groupByTime},
+			AutoAggregation: true,
+		}
+		require.Equal(t, `mean("usage"), sum("requests_total"), mean("bytes") * 8`, build(t, query))
+		require.Equal(t, "sum", query.Selects[1].Function())
+	})
+
+	t.Run("configured aggregation by field", func(t *testing.T) {
+		query := &Query{
+			Selects:           []*Select{selectField("usage"), selectField("requests_total"), selectField("errors::field")},
+			GroupBy:           []*QueryPart{groupByTime},
+			AutoAggregation:   true,
+			FieldAggregations: map[string]string{"usage": "max", "requests_total": "last", "errors": "sum"},
+		}
+		require.Equal(t, `max("usage"), last("requests_total"), sum("errors"::field)`, build(t, query))
+	})
+
+	t.Run("selects with an aggregation are kept", func(t *testing.T) {
+		query := &Query{
+			Selects:         []*Select{selectField("usage", "max"), selectField("requests_total", "count")},
+			GroupBy:         []*QueryPart{groupByTime},
+			AutoAggregation: true,
+		}
+		require.Equal(t, `max("usage"), count("requests_total")`, build(t, query))
+	})
+
+	t.Run("queries not grouped by time are kept", func(t *testing.T) {
+		query := &Query{
+			Selects:         []*Select{selectField("usage")},
+			GroupBy:         []*QueryPart{groupByTag},
+			AutoAggregation: true,
+		}
+		require.Equal(t, `"usage"`, build(t, query))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		query := &Query{
+			Selects: []*Select{selectField("usage")},
+			GroupBy: []*QueryPart{groupByTime},
+		}
+		require.Equal(t, `"usage"`, build(t, query))
+	})
+
+	t.Run("unsupported aggregation", func(t *testing.T) {
+		query := &Query{
+			Measurement:       "cpu",
+			Selects:           []*Select{selectField("usage")},
+			GroupBy:           []*QueryPart{groupByTime},
+			AutoAggregation:   true,
+			FieldAggregations: map[string]string{"usage": "average"},
+		}
+		_, err := query.Build(queryContext)
+		require.EqualError(t, err, `unsupported aggregation for field "usage": missing query definition for "average"`)
 	})
 }